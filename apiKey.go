@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key so secret scanners can recognize one that has leaked. Keys look like
+// nak_{16 hex character key ID}_{43 character base64url secret}
+const apiKeyPrefix string = "nak_"
+const apiKeyIDBytes int = 8
+const apiKeySecretBytes int = 32
+const apiKeyDefaultExpireDays int = 90
+const apiKeyMaxExpireDays int = 365
+const apiKeyMaxNameLength int = 100
+const apiKeyMaxPerUser int = 50
+
+// apiKeyLastUsedResolution limits how often LastUsedTimeUTC is written, since keys may be used on every request
+const apiKeyLastUsedResolution time.Duration = time.Minute
+
+var apiKeyScopeRegex = regexp.MustCompile(`^[A-Za-z0-9:._/-]{1,64}$`)
+
+// APIKey describes a personal access token. The secret is never included after the key is created
+type APIKey struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	Prefix          string     `json:"prefix"`
+	Scopes          []string   `json:"scopes"`
+	CreatedTimeUTC  time.Time  `json:"createdTimeUTC"`
+	ExpireTimeUTC   time.Time  `json:"expireTimeUTC"`
+	LastUsedTimeUTC *time.Time `json:"lastUsedTimeUTC,omitempty"`
+}
+
+// NewAPIKey is returned when a key is created. Key can't be retrieved again, so it must be shown to the user now
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type apiKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+func (k *apiKey) public() *APIKey {
+	key := &APIKey{ID: k.KeyID, Name: k.Name, Prefix: apiKeyPrefix + k.KeyID, Scopes: k.Scopes, CreatedTimeUTC: k.CreatedTimeUTC, ExpireTimeUTC: k.ExpireTimeUTC}
+	if !k.LastUsedTimeUTC.IsZero() {
+		lastUsed := k.LastUsedTimeUTC
+		key.LastUsedTimeUTC = &lastUsed
+	}
+	return key
+}
+
+func (s *authStore) CreateAPIKey(w http.ResponseWriter, r *http.Request) (*NewAPIKey, error) {
+	request := &apiKeyRequest{}
+	if err := getJSON(r, request); err != nil {
+		return nil, newAuthError("Unable to get API key details", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.createAPIKey(w, r, b, request)
+}
+
+func (s *authStore) createAPIKey(w http.ResponseWriter, r *http.Request, b Backender, request *apiKeyRequest) (*NewAPIKey, error) {
+	session, err := s.getSession(w, r, b) // API keys can't be used to create more keys
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" || len(name) > apiKeyMaxNameLength {
+		return nil, newAuthError("API key name is required and must be at most 100 characters", nil)
+	}
+	for _, scope := range request.Scopes {
+		if !apiKeyScopeRegex.MatchString(scope) {
+			return nil, newAuthError("Invalid API key scope: "+scope, nil)
+		}
+	}
+	expiresInDays := request.ExpiresInDays
+	if expiresInDays == 0 {
+		expiresInDays = apiKeyDefaultExpireDays
+	}
+	if expiresInDays < 0 || expiresInDays > apiKeyMaxExpireDays {
+		return nil, newAuthError("API keys must expire within 365 days", nil)
+	}
+
+	keys, err := b.GetAPIKeys(session.UserID)
+	if err != nil {
+		return nil, newLoggedError("Unable to get API keys", err)
+	}
+	if len(keys) >= apiKeyMaxPerUser {
+		return nil, newAuthError("Too many API keys. Please delete one first", nil)
+	}
+
+	id, err := generateRandomBytes(apiKeyIDBytes)
+	if err != nil {
+		return nil, newLoggedError("Problem generating API key", err)
+	}
+	secret, err := generateRandomBytes(apiKeySecretBytes)
+	if err != nil {
+		return nil, newLoggedError("Problem generating API key", err)
+	}
+	now := time.Now().UTC()
+	key := &apiKey{
+		KeyID:          hex.EncodeToString(id),
+		UserID:         session.UserID,
+		Name:           name,
+		Scopes:         append([]string{}, request.Scopes...),
+		SecretHash:     encodeToString(hash(secret)),
+		CreatedTimeUTC: now,
+		ExpireTimeUTC:  now.Add(time.Duration(expiresInDays) * 24 * time.Hour),
+	}
+	if err := b.CreateAPIKey(key); err != nil {
+		return nil, newLoggedError("Unable to save API key", err)
+	}
+	return &NewAPIKey{APIKey: *key.public(), Key: apiKeyPrefix + key.KeyID + "_" + base64.RawURLEncoding.EncodeToString(secret)}, nil
+}
+
+func (s *authStore) GetAPIKeys(w http.ResponseWriter, r *http.Request) ([]*APIKey, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.getAPIKeys(w, r, b)
+}
+
+func (s *authStore) getAPIKeys(w http.ResponseWriter, r *http.Request, b Backender) ([]*APIKey, error) {
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := b.GetAPIKeys(session.UserID)
+	if err != nil {
+		return nil, newLoggedError("Unable to get API keys", err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedTimeUTC.Before(keys[j].CreatedTimeUTC) })
+	result := make([]*APIKey, len(keys))
+	for i, key := range keys {
+		result[i] = key.public()
+	}
+	return result, nil
+}
+
+func (s *authStore) DeleteAPIKey(w http.ResponseWriter, r *http.Request, keyID string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.deleteAPIKey(w, r, b, keyID)
+}
+
+func (s *authStore) deleteAPIKey(w http.ResponseWriter, r *http.Request, b Backender, keyID string) error {
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return err
+	}
+	if err := b.DeleteAPIKey(session.UserID, strings.TrimPrefix(keyID, apiKeyPrefix)); err != nil {
+		return newLoggedError("Unable to delete API key", err)
+	}
+	return nil
+}
+
+// getAPIKey returns an API key sent as a bearer token or as the basic auth password
+func getAPIKey(r *http.Request) string {
+	if token := getBearerToken(r); strings.HasPrefix(token, apiKeyPrefix) {
+		return token
+	}
+	if _, password, ok := r.BasicAuth(); ok && strings.HasPrefix(password, apiKeyPrefix) {
+		return password
+	}
+	return ""
+}
+
+// parseAPIKey splits a key into its ID and secret
+func parseAPIKey(key string) (string, []byte, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || len(parts[0]) != 2*apiKeyIDBytes {
+		return "", nil, false
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(secret) != apiKeySecretBytes {
+		return "", nil, false
+	}
+	return parts[0], secret, true
+}
+
+// getAPIKeySession checks an API key and returns a session for its user. The secret is random so a single
+// SHA-256 is enough to protect it, unlike a password which needs the slow crypt hash used by basic auth
+func (s *authStore) getAPIKeySession(b Backender, key string) (*LoginSession, error) {
+	keyID, secret, ok := parseAPIKey(key)
+	if !ok {
+		return nil, newAuthError("Invalid API key", nil).withCode(ErrCodeUnauthenticated)
+	}
+	stored, err := b.GetAPIKey(keyID)
+	if err != nil {
+		return nil, newLoggedError("Invalid API key", err).withCode(ErrCodeUnauthenticated)
+	}
+	secretHash, err := base64.URLEncoding.DecodeString(stored.SecretHash)
+	if err != nil || !hashEquals(secret, secretHash) {
+		return nil, newLoggedError("Invalid API key", err).withCode(ErrCodeUnauthenticated)
+	}
+	now := time.Now().UTC()
+	if stored.ExpireTimeUTC.Before(now) {
+		return nil, newAuthError("API key has expired", nil).withCode(ErrCodeUnauthenticated)
+	}
+
+	user, err := b.GetUserByID(stored.UserID)
+	if err != nil {
+		return nil, newLoggedError("Invalid API key", err).withCode(ErrCodeUnauthenticated)
+	}
+	if user.IsLockedOut() {
+		return nil, newAuthError("Your account is locked. Please reset your password.", nil).withCode(ErrCodeAccountLocked)
+	}
+
+	if stored.LastUsedTimeUTC.Add(apiKeyLastUsedResolution).Before(now) {
+		b.UpdateAPIKeyLastUsed(keyID, now) // best effort. A failed write shouldn't fail the request
+	}
+	return &LoginSession{UserID: user.UserID, Email: user.Email, Info: user.Info, ExpireTimeUTC: stored.ExpireTimeUTC, Scopes: stored.Scopes}, nil
+}
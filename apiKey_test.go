@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTestAPIKey(t *testing.T, s *authStore, b *backendMemory, accessToken string, scopes ...string) *NewAPIKey {
+	key, err := s.createAPIKey(nil, bearerRequest(accessToken), b, &apiKeyRequest{Name: " CI ", Scopes: scopes})
+	if err != nil {
+		t.Fatal("expected key to be created", err)
+	}
+	return key
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	s, b := getTokenStore()
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	key := createTestAPIKey(t, s, b, tokens.AccessToken, "deploy:write")
+	if !strings.HasPrefix(key.Key, "nak_"+key.ID+"_") || len(key.Key) != 64 || key.Name != "CI" || key.Prefix != "nak_"+key.ID || key.Scopes[0] != "deploy:write" {
+		t.Fatal("expected identifiable key", key)
+	}
+	if len(b.APIKeys) != 1 || strings.Contains(key.Key, b.APIKeys[0].SecretHash) || b.APIKeys[0].UserID != "1" {
+		t.Fatal("expected key to be stored hashed", b.APIKeys)
+	}
+	if expires := time.Until(key.ExpireTimeUTC); expires < 89*24*time.Hour || expires > 90*24*time.Hour {
+		t.Fatal("expected default expiry", key.ExpireTimeUTC)
+	}
+
+	r := bearerRequest(tokens.AccessToken)
+	for _, request := range []*apiKeyRequest{{}, {Name: strings.Repeat("a", 101)}, {Name: "CI", Scopes: []string{"bad scope"}}, {Name: "CI", ExpiresInDays: 366}, {Name: "CI", ExpiresInDays: -1}} {
+		if _, err := s.createAPIKey(nil, r, b, request); err == nil {
+			t.Error("expected invalid request to fail", request)
+		}
+	}
+
+	// a key can't be used to create more keys
+	if _, err := s.createAPIKey(nil, bearerRequest(key.Key), b, &apiKeyRequest{Name: "CI"}); err == nil {
+		t.Error("expected API key to be rejected for key management")
+	}
+}
+
+func TestAPIKeySession(t *testing.T) {
+	s, b := getTokenStore()
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	key := createTestAPIKey(t, s, b, tokens.AccessToken, "read")
+
+	session, err := s.GetSession(nil, bearerRequest(key.Key))
+	if err != nil || session.UserID != "1" || session.Email != "test@test.com" || session.Info["key"] != "value" || session.Scopes[0] != "read" {
+		t.Fatal("expected bearer API key to be accepted", err, session)
+	}
+	if b.APIKeys[0].LastUsedTimeUTC.IsZero() {
+		t.Fatal("expected last used time to be saved")
+	}
+
+	r := &http.Request{Header: http.Header{}}
+	r.SetBasicAuth("ci", key.Key)
+	if session, err := s.GetBasicAuth(nil, r); err != nil || session.UserID != "1" {
+		t.Fatal("expected API key as basic auth password to be accepted", err, session)
+	}
+
+	for _, bogus := range []string{"nak_bogus", key.Key[:len(key.Key)-2] + "AA", "nak_0000000000000000" + key.Key[20:]} {
+		if _, err := s.GetSession(nil, bearerRequest(bogus)); err == nil || err.Error() != "Invalid API key" {
+			t.Error("expected invalid key", bogus, err)
+		}
+	}
+
+	b.Users[0].LockoutEndTimeUTC = &futureTime
+	if _, err := s.GetSession(nil, bearerRequest(key.Key)); err == nil {
+		t.Error("expected locked out user's key to be rejected")
+	}
+	b.Users[0].LockoutEndTimeUTC = nil
+
+	b.APIKeys[0].ExpireTimeUTC = pastTime
+	if _, err := s.GetSession(nil, bearerRequest(key.Key)); err == nil || err.Error() != "API key has expired" {
+		t.Error("expected expired key", err)
+	}
+}
+
+func TestGetAndDeleteAPIKeys(t *testing.T) {
+	s, b := getTokenStore()
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	first := createTestAPIKey(t, s, b, tokens.AccessToken)
+	second := createTestAPIKey(t, s, b, tokens.AccessToken)
+	b.APIKeys = append(b.APIKeys, &apiKey{KeyID: "other", UserID: "2"})
+
+	keys, err := s.getAPIKeys(nil, bearerRequest(tokens.AccessToken), b)
+	if err != nil || len(keys) != 2 || keys[0].ID != first.ID || keys[1].ID != second.ID || keys[0].Scopes == nil {
+		t.Fatal("expected only the user's keys", err, keys)
+	}
+
+	if err := s.deleteAPIKey(nil, bearerRequest(tokens.AccessToken), b, "other"); err == nil {
+		t.Error("expected another user's key not to be deleted")
+	}
+	if err := s.deleteAPIKey(nil, bearerRequest(tokens.AccessToken), b, first.Prefix); err != nil || len(b.APIKeys) != 2 {
+		t.Fatal("expected key to be deleted by prefix", err, b.APIKeys)
+	}
+	if _, err := s.GetSession(nil, bearerRequest(first.Key)); err == nil {
+		t.Error("expected deleted key to be rejected")
+	}
+}
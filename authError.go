@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// Error codes sent to clients. They don't change between releases, so clients can rely on them instead of the message
+const ErrCodeInternal string = "internal_error"
+const ErrCodeInvalidRequest string = "invalid_request"
+const ErrCodeUnauthenticated string = "unauthenticated"
+const ErrCodeInvalidCredentials string = "invalid_credentials"
+const ErrCodeInvalidCSRF string = "invalid_csrf_token"
+const ErrCodeSessionExpired string = "session_expired"
+const ErrCodeForbidden string = "forbidden"
+const ErrCodeEmailNotVerified string = "email_not_verified"
+const ErrCodeAccountLocked string = "account_locked"
+const ErrCodeLoginCodeRequired string = "login_code_required"
+const ErrCodeInvalidCode string = "invalid_code"
+const ErrCodeTooManyAttempts string = "too_many_attempts"
+const ErrCodeUserNotFound string = "user_not_found"
+const ErrCodeUserExists string = "user_exists"
+const ErrCodeNotFound string = "not_found"
+const ErrCodeNotEnabled string = "not_enabled"
+
+var errorStatuses = map[string]int{
+	ErrCodeInternal:           http.StatusInternalServerError,
+	ErrCodeInvalidRequest:     http.StatusBadRequest,
+	ErrCodeUnauthenticated:    http.StatusUnauthorized,
+	ErrCodeInvalidCredentials: http.StatusUnauthorized,
+	ErrCodeInvalidCSRF:        http.StatusForbidden,
+	ErrCodeSessionExpired:     http.StatusUnauthorized,
+	ErrCodeForbidden:          http.StatusForbidden,
+	ErrCodeEmailNotVerified:   http.StatusForbidden,
+	ErrCodeAccountLocked:      http.StatusForbidden,
+	ErrCodeLoginCodeRequired:  http.StatusUnauthorized,
+	ErrCodeInvalidCode:        http.StatusBadRequest,
+	ErrCodeTooManyAttempts:    http.StatusTooManyRequests,
+	ErrCodeUserNotFound:       http.StatusNotFound,
+	ErrCodeUserExists:         http.StatusConflict,
+	ErrCodeNotFound:           http.StatusNotFound,
+	ErrCodeNotEnabled:         http.StatusNotFound,
+}
+
+// backendErrorCodes gives the code for errors from the backends, which are never sent to clients themselves
+var backendErrorCodes = map[error]string{
+	errUserNotFound:              ErrCodeUserNotFound,
+	errLoginNotFound:             ErrCodeInvalidCredentials,
+	errInvalidCredentials:        ErrCodeInvalidCredentials,
+	errUserAlreadyExists:         ErrCodeUserExists,
+	errSessionNotFound:           ErrCodeSessionExpired,
+	errRememberMeNotFound:        ErrCodeSessionExpired,
+	errRememberMeExpired:         ErrCodeSessionExpired,
+	errRefreshTokenNotFound:      ErrCodeSessionExpired,
+	errInvalidEmailVerifyHash:    ErrCodeInvalidCode,
+	errEmailSessionExpired:       ErrCodeInvalidCode,
+	errAuthorizationCodeNotFound: ErrCodeInvalidCode,
+	errOAuthClientNotFound:       ErrCodeNotFound,
+	errOAuthConsentNotFound:      ErrCodeNotFound,
+	errAPIKeyNotFound:            ErrCodeNotFound,
+	errRoleNotFound:              ErrCodeNotFound,
+	errQueuedEmailNotFound:       ErrCodeNotFound,
+}
+
+// defaultMessages are sent instead of the message of errors which aren't AuthErrors, because those can contain
+// database or library details
+var defaultMessages = map[string]string{
+	ErrCodeInternal:        "Something went wrong. Please try again later",
+	ErrCodeInvalidRequest:  "Invalid request",
+	ErrCodeUnauthenticated: "Authentication required",
+	ErrCodeSessionExpired:  "Your session has expired. Please log in again",
+	ErrCodeForbidden:       "Not authorized",
+	ErrCodeUserNotFound:    "User not found",
+	ErrCodeNotFound:        "Not found",
+}
+
+// AuthError struct holds detailed auth error info. The message is safe to show to users, while the inner error
+// is only logged
+type AuthError struct {
+	message    string
+	code       string
+	innerError error
+	shouldLog  bool
+	error
+}
+
+// NewError returns an AuthError with a code, for callers which need to send their own errors in the same form
+func NewError(code, message string, innerError error) *AuthError {
+	return &AuthError{message: message, code: code, innerError: innerError}
+}
+
+func newLoggedError(message string, innerError error) *AuthError {
+	return &AuthError{message: message, innerError: innerError, shouldLog: true}
+}
+
+func newAuthError(message string, innerError error) *AuthError {
+	return &AuthError{message: message, innerError: innerError}
+}
+
+func (a *AuthError) withCode(code string) *AuthError {
+	a.code = code
+	return a
+}
+
+func (a *AuthError) Error() string {
+	return a.message
+}
+
+// Code returns the code set on the error or the first inner error with one. Otherwise errors which are logged are
+// internal errors, and the others are mistakes in the request
+func (a *AuthError) Code() string {
+	var inner error = a
+	for inner != nil {
+		e, ok := inner.(*AuthError)
+		if !ok {
+			if code, ok := backendErrorCodes[inner]; ok {
+				return code
+			}
+			break
+		}
+		if e.code != "" {
+			return e.code
+		}
+		inner = e.innerError
+	}
+	if a.shouldLog {
+		return ErrCodeInternal
+	}
+	return ErrCodeInvalidRequest
+}
+
+// Status returns the HTTP status for the error's code
+func (a *AuthError) Status() int {
+	return ErrorStatus(a.Code())
+}
+
+func (a *AuthError) Trace() string {
+	trace := a.message + "\n"
+	indent := "  "
+	inner := a.innerError
+	for inner != nil {
+		trace += indent + inner.Error() + "\n"
+		e, ok := inner.(*AuthError)
+		if !ok {
+			break
+		}
+		indent += "  "
+		inner = e.innerError
+	}
+	return trace
+}
+
+// ErrorCode returns the code for any error. Errors which aren't AuthErrors are internal errors
+func ErrorCode(err error) string {
+	if a, ok := err.(*AuthError); ok {
+		return a.Code()
+	}
+	return ErrCodeInternal
+}
+
+// ErrorStatus returns the HTTP status for an error code
+func ErrorStatus(code string) int {
+	if status, ok := errorStatuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// PublicMessage returns the message of an AuthError, or a message for the code of any other error
+func PublicMessage(err error) string {
+	if a, ok := err.(*AuthError); ok {
+		return a.message
+	}
+	return DefaultMessage(ErrorCode(err))
+}
+
+// DefaultMessage returns a message for the code, for errors which don't have one of their own
+func DefaultMessage(code string) string {
+	if message, ok := defaultMessages[code]; ok {
+		return message
+	}
+	return defaultMessages[ErrCodeInternal]
+}
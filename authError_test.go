@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAuthError(t *testing.T) {
+	e3 := newAuthError("error 3", errors.New("other"))
+	e2 := newAuthError("error 2", e3)
+	e1 := newAuthError("error 1", e2)
+	if e1.message != "error 1" || e2.message != "error 2" || e1.Error() != e1.message || e2.Error() != e2.message ||
+		e1.Trace() != "error 1\n  error 2\n    error 3\n      other\n" ||
+		e2.Trace() != "error 2\n  error 3\n    other\n" ||
+		e3.Trace() != "error 3\n  other\n" {
+		t.Error("expected valid error structs", e1, e2, e3, e1.Trace(), e2.Trace(), e3.Trace())
+	}
+}
+
+func TestAuthErrorCode(t *testing.T) {
+	tests := []struct {
+		Err     error
+		Code    string
+		Status  int
+		Message string
+	}{
+		{newAuthError("Invalid email", nil), ErrCodeInvalidRequest, http.StatusBadRequest, "Invalid email"},
+		{newLoggedError("Unable to save user", errors.New("connection refused")), ErrCodeInternal, http.StatusInternalServerError, "Unable to save user"},
+		{newLoggedError("Failed to verify session", errSessionNotFound), ErrCodeSessionExpired, http.StatusUnauthorized, "Failed to verify session"},
+		{newLoggedError("Unable to get roles", newLoggedError("User not found", errUserNotFound)), ErrCodeUserNotFound, http.StatusNotFound, "Unable to get roles"},
+		{newLoggedError("Invalid username or password", errUserNotFound).withCode(ErrCodeInvalidCredentials), ErrCodeInvalidCredentials, http.StatusUnauthorized, "Invalid username or password"},
+		{newAuthError("Unable to log in", errMissingCSRF), ErrCodeInvalidCSRF, http.StatusForbidden, "Unable to log in"},
+		{errUserNotFound, ErrCodeInternal, http.StatusInternalServerError, "Something went wrong. Please try again later"},
+	}
+	for i, test := range tests {
+		code := ErrorCode(test.Err)
+		if code != test.Code || ErrorStatus(code) != test.Status || PublicMessage(test.Err) != test.Message {
+			t.Errorf("test %d: expected %s %d %q, got %s %d %q", i, test.Code, test.Status, test.Message, code, ErrorStatus(code), PublicMessage(test.Err))
+		}
+	}
+	if ErrorStatus("unknown") != http.StatusInternalServerError || DefaultMessage("unknown") != DefaultMessage(ErrCodeInternal) {
+		t.Error("expected unknown codes to be internal errors")
+	}
+}
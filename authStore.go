@@ -3,17 +3,15 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
-	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/pkg/errors"
 )
 
 var emailCookieName = "Email"
@@ -29,27 +27,119 @@ const sessionRenewDuration time.Duration = 5 * time.Minute
 const sessionExpireDuration time.Duration = time.Hour
 const rememberMeRenewDuration time.Duration = time.Hour
 const rememberMeExpireDuration time.Duration = time.Hour * 24 * 30 // 30 days
+const emailRevertExpireDuration time.Duration = 7 * 24 * time.Hour // 7 days
+const emailChangeExpireDuration time.Duration = 48 * time.Hour     // 2 days
 const passwordValidationMessage string = "Password must be at least 7 characters"
+const emailSessionPurposeRevertEmail string = "revertEmail"
+const emailSessionPurposeChangeEmail string = "changeEmail"
 
-var errInvalidCSRF = errors.New("Invalid CSRF token")
-var errMissingCSRF = errors.New("Missing CSRF token")
+var lockedPendingResetTimeUTC = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+var errInvalidCSRF = NewError(ErrCodeInvalidCSRF, "Invalid CSRF token", nil)
+var errMissingCSRF = NewError(ErrCodeInvalidCSRF, "Missing CSRF token", nil)
 
 // AuthStorer interface provides the necessary functionality to get and store authentication information
 type AuthStorer interface {
 	GetSession(w http.ResponseWriter, r *http.Request) (*LoginSession, error)
+	GetCookieSession(w http.ResponseWriter, r *http.Request) (*LoginSession, error)
 	GetBasicAuth(w http.ResponseWriter, r *http.Request) (*LoginSession, error)
 	OAuthLogin(w http.ResponseWriter, r *http.Request) (string, error)
 	Login(w http.ResponseWriter, r *http.Request) (*LoginSession, error)
 	Register(w http.ResponseWriter, r *http.Request, params EmailSendParams, password string) error
 	RequestPasswordReset(w http.ResponseWriter, r *http.Request, params EmailSendParams) error
 	Logout(w http.ResponseWriter, r *http.Request) error
+	LogoutAll(w http.ResponseWriter, r *http.Request) error
 	CreateProfile(w http.ResponseWriter, r *http.Request) (*LoginSession, error)
+	CreateInvitation(w http.ResponseWriter, r *http.Request, params EmailSendParams, roles []string) error
 	VerifyEmail(w http.ResponseWriter, r *http.Request, params EmailSendParams) (string, *User, error)
-	VerifyPasswordReset(w http.ResponseWriter, r *http.Request, emailVerificationCode string) (string, *User, error)
+	VerifyPasswordReset(w http.ResponseWriter, r *http.Request, params EmailSendParams) (string, *User, error)
 	CreateSecondaryEmail(w http.ResponseWriter, r *http.Request, templateName, emailSubject string) error
 	SetPrimaryEmail(w http.ResponseWriter, r *http.Request, templateName, emailSubject string) error
+	ConfirmEmailChange(w http.ResponseWriter, r *http.Request, code string) error
+	RevertEmailChange(w http.ResponseWriter, r *http.Request, revertCode string) error
+	RequestMagicLink(w http.ResponseWriter, r *http.Request, params EmailSendParams) error
+	ConsumeMagicLink(w http.ResponseWriter, r *http.Request, code string, rememberMe bool) (*LoginSession, error)
+	VerifyLoginCode(w http.ResponseWriter, r *http.Request, email, code string) (*LoginSession, error)
+	LoginToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error)
+	RefreshToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error)
+	RevokeToken(w http.ResponseWriter, r *http.Request) error
+	RegisterOAuthClient(w http.ResponseWriter, r *http.Request) (*OAuthClientRegistration, error)
+	OAuthAuthorize(w http.ResponseWriter, r *http.Request) (*OAuthAuthorization, error)
+	OAuthConsent(w http.ResponseWriter, r *http.Request) (*OAuthAuthorization, error)
+	OAuthToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error)
+	OAuthUserInfo(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error)
+	CreateAPIKey(w http.ResponseWriter, r *http.Request) (*NewAPIKey, error)
+	GetAPIKeys(w http.ResponseWriter, r *http.Request) ([]*APIKey, error)
+	DeleteAPIKey(w http.ResponseWriter, r *http.Request, keyID string) error
+	Authorize(session *LoginSession, roles, permissions []string) error
+	GetSessionRoles(session *LoginSession) ([]string, error)
+	GetRoles(w http.ResponseWriter, r *http.Request) ([]*Role, error)
+	SaveRole(w http.ResponseWriter, r *http.Request) (*Role, error)
+	DeleteRole(w http.ResponseWriter, r *http.Request, name string) error
+	GetUserRoles(w http.ResponseWriter, r *http.Request, email string) ([]string, error)
+	SetUserRoles(w http.ResponseWriter, r *http.Request) error
+	SetUserInfo(w http.ResponseWriter, r *http.Request) error
 	UpdatePassword(w http.ResponseWriter, r *http.Request) (*LoginSession, error)
 	UpdateInfo(userID string, info map[string]interface{}) error
+	RequestPhoneVerification(w http.ResponseWriter, r *http.Request, phoneNumber string, params EmailSendParams) error
+	VerifyPhone(w http.ResponseWriter, r *http.Request, code string) error
+	SetChannel(w http.ResponseWriter, r *http.Request, channel string) error
+}
+
+// AuthStoreConfig holds the optional settings for an AuthStorer
+type AuthStoreConfig struct {
+	PasswordChangedTemplate string
+	PasswordChangedSubject  string
+	EmailChangedTemplate    string
+	EmailChangedSubject     string
+
+	// OneTimeCodeLength is the number of digits (6-8) in codes sent when EmailSendParams.UseOneTimeCode is set
+	OneTimeCodeLength int
+
+	// MagicLinkCrossDevice allows a login link to be used from a browser other than the one that requested it
+	MagicLinkCrossDevice bool
+
+	// BaseURL is the scheme and host links in emails use when EmailSendParams.BaseURL isn't set, e.g.
+	// https://auth.example.com. When it's empty, the host requests were sent to is used only if it's in AllowedHosts
+	BaseURL      string
+	AllowedHosts []string
+
+	// LoginCodeTemplate turns on a second login step. Once the password or a magic link is checked, a one-time code
+	// is sent over the channel the user prefers, and the session or tokens are only issued when it is entered
+	LoginCodeTemplate string
+	LoginCodeSubject  string
+
+	// TokenMode issues JWT access tokens and refresh tokens and accepts "Authorization: Bearer" in GetSession
+	TokenMode                bool
+	TokenIssuer              string
+	TokenSigningAlgorithm    string
+	TokenKeyRotationDuration time.Duration
+	TokenKeyGraceDuration    time.Duration
+
+	// TokenKeys shares a KeyManager with the caller, e.g. to publish its JWKS. One is created when nil
+	TokenKeys *KeyManager
+
+	// OAuthServer lets registered applications sign users in with the authorization code flow. Tokens use the
+	// TokenIssuer and signing key settings. OAuthRegistrationToken must be presented to register a client
+	OAuthServer            bool
+	OAuthRegistrationToken string
+
+	// Channels send password resets, login links and notifications to users who prefer them to email, keyed by
+	// the channel name users choose with SetChannel, such as ChannelSMS. Email is used when a channel can't
+	// reach the user
+	Channels map[string]Channel
+
+	// FileStore saves the profile picture uploaded with CreateProfile and its thumbnail. Uploaded files are
+	// ignored when nil. MaxUploadBytes limits the picture's size, 5 MB when 0
+	FileStore      FileStorer
+	MaxUploadBytes int64
+
+	// Registration decides who may register. Anyone may when nil
+	Registration *RegistrationPolicy
+
+	// ProfileSchema declares the info fields users may set with CreateProfile and admins with SetUserInfo. Any
+	// field except the system ones may be set when nil
+	ProfileSchema *ProfileSchema
 }
 
 type emailCookie struct {
@@ -74,34 +164,97 @@ type authStore struct {
 	b           Backender
 	mailer      Mailer
 	cookieStore CookieStorer
+	conf        AuthStoreConfig
+	keys        *KeyManager
 }
 
 // NewAuthStore is used to create an AuthStorer for most authentication needs
 func NewAuthStore(b Backender, mailer Mailer, customPrefix, cookieDomain string, cookieKey []byte, secureOnly bool) AuthStorer {
+	s, _ := NewAuthStoreWithConfig(b, mailer, customPrefix, cookieDomain, cookieKey, secureOnly, AuthStoreConfig{}) // only token settings can fail
+	return s
+}
+
+// NewAuthStoreWithConfig is used to create an AuthStorer with the optional settings in config
+func NewAuthStoreWithConfig(b Backender, mailer Mailer, customPrefix, cookieDomain string, cookieKey []byte, secureOnly bool, config AuthStoreConfig) (AuthStorer, error) {
 	emailCookieName = customPrefix + "Email"
 	sessionCookieName = customPrefix + "Session"
 	rememberMeCookieName = customPrefix + "RememberMe"
-	return &authStore{b, mailer, newCookieStore(cookieKey, cookieDomain, secureOnly)}
+	magicLinkCookieName = customPrefix + "MagicLink"
+	s := &authStore{b: b, mailer: mailer, cookieStore: newCookieStore(cookieKey, cookieDomain, secureOnly), conf: config}
+	if config.ProfileSchema != nil {
+		if err := config.ProfileSchema.check(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Registration != nil && !contains(registrationModes, config.Registration.Mode) {
+		return nil, fmt.Errorf("Unknown registration mode: %s", config.Registration.Mode)
+	}
+	if config.TokenMode || config.OAuthServer {
+		s.keys = config.TokenKeys
+		if s.keys == nil {
+			keys, err := NewKeyManager(b, config.TokenSigningAlgorithm, config.TokenKeyRotationDuration, config.TokenKeyGraceDuration)
+			if err != nil {
+				return nil, err
+			}
+			s.keys = keys
+		}
+	}
+	return s, nil
 }
 
+// GetSession returns the session from the session cookie, an access token or an API key
 func (s *authStore) GetSession(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
 	b := s.b.Clone()
 	defer b.Close()
+	if key := getAPIKey(r); key != "" {
+		return s.getAPIKeySession(b, key)
+	}
 	return s.getSession(w, r, b)
 }
 
+// GetCookieSession returns the session like GetSession, but reads the session cookie without the CSRF token. It is
+// for checks which only read the session, such as auth subrequests for browser navigations, which never send the
+// token. Browsers send cookies cross-site, so the session must not be used to change anything
+func (s *authStore) GetCookieSession(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	if key := getAPIKey(r); key != "" {
+		return s.getAPIKeySession(b, key)
+	}
+	if accessToken := getBearerToken(r); accessToken != "" && s.conf.TokenMode {
+		return s.getTokenSession(accessToken)
+	}
+	return s.getCookieSession(w, r, b)
+}
+
 func (s *authStore) getSession(w http.ResponseWriter, r *http.Request, b Backender) (*LoginSession, error) {
+	if accessToken := getBearerToken(r); accessToken != "" && s.conf.TokenMode {
+		return s.getTokenSession(accessToken) // bearer tokens aren't sent automatically by browsers, so no CSRF check
+	}
 	csrfToken := r.Header.Get("X-CSRF-Token")
 	if csrfToken == "" {
 		return nil, errMissingCSRF
 	}
+	session, err := s.getCookieSession(w, r, b)
+	if err != nil {
+		return nil, err
+	}
+	if session.CSRFToken != csrfToken {
+		return nil, errInvalidCSRF
+	}
+	return session, nil
+}
+
+// getCookieSession returns the session from the session cookie without checking the CSRF token. Callers
+// must only read the session, or check the CSRF token themselves, because browsers send cookies cross-site
+func (s *authStore) getCookieSession(w http.ResponseWriter, r *http.Request, b Backender) (*LoginSession, error) {
 	cookie, err := s.getSessionCookie(w, r)
 	if err != nil || cookie.SessionID == "" { // impossible to get the session if there is no cookie
-		return nil, newAuthError("Session cookie not found", err)
+		return nil, newAuthError("Session cookie not found", err).withCode(ErrCodeUnauthenticated)
 	}
 	sessionHash, err := decodeStringToHash(cookie.SessionID)
 	if err != nil {
-		return nil, newAuthError("Unable to decode session cookie", err)
+		return nil, newAuthError("Unable to decode session cookie", err).withCode(ErrCodeUnauthenticated)
 	}
 
 	session, err := b.GetSession(sessionHash)
@@ -116,10 +269,6 @@ func (s *authStore) getSession(w http.ResponseWriter, r *http.Request, b Backend
 			return nil, err
 		}
 	}
-
-	if session.CSRFToken != csrfToken {
-		return nil, errInvalidCSRF
-	}
 	return session, nil
 }
 
@@ -130,29 +279,35 @@ func (s *authStore) GetBasicAuth(w http.ResponseWriter, r *http.Request) (*Login
 }
 
 func (s *authStore) getBasicAuth(w http.ResponseWriter, r *http.Request, b Backender) (*LoginSession, error) {
+	if key := getAPIKey(r); key != "" {
+		return s.getAPIKeySession(b, key) // checked before the password so keys skip the slow password hash
+	}
 	session, err := s.getSession(w, r, b)
 	if err == nil {
 		return session, nil
 	}
 
 	if email, password, ok := r.BasicAuth(); ok {
+		if s.conf.LoginCodeTemplate != "" { // each request would send a new code
+			return nil, newAuthError("Basic auth can't be used when login codes are required", nil).withCode(ErrCodeUnauthenticated)
+		}
 		session, err := s.login(w, r, b, email, password, false)
 		if err != nil {
 			return nil, err
 		}
 		return session, nil
 	}
-	return nil, newAuthError("Problem decoding credentials from basic auth", nil)
+	return nil, newAuthError("Problem decoding credentials from basic auth", nil).withCode(ErrCodeUnauthenticated)
 }
 
 func (s *authStore) getRememberMe(w http.ResponseWriter, r *http.Request, b Backender) (*rememberMeSession, error) {
 	cookie, err := s.getRememberMeCookie(w, r)
 	if err != nil || cookie.Selector == "" { // impossible to get the remember Me if there is no cookie
-		return nil, newAuthError("RememberMe cookie not found", err)
+		return nil, newAuthError("RememberMe cookie not found", err).withCode(ErrCodeUnauthenticated)
 	}
 	if cookie.ExpireTimeUTC.Before(time.Now().UTC()) {
 		s.deleteRememberMeCookie(w)
-		return nil, newAuthError("RememberMe cookie has expired", nil)
+		return nil, newAuthError("RememberMe cookie has expired", nil).withCode(ErrCodeSessionExpired)
 	}
 
 	rememberMe, err := b.GetRememberMe(cookie.Selector)
@@ -217,6 +372,32 @@ func (s *authStore) Logout(w http.ResponseWriter, r *http.Request) error {
 	return b.DeleteSession(session.SessionHash)
 }
 
+// LogoutAll ends every session and remember me of the logged in user, so they are logged out on all of their devices
+func (s *authStore) LogoutAll(w http.ResponseWriter, r *http.Request) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.logoutAll(w, r, b)
+}
+
+func (s *authStore) logoutAll(w http.ResponseWriter, r *http.Request, b Backender) error {
+	session, err := s.getSession(w, r, b)
+	s.deleteSessionCookie(w)
+	s.deleteRememberMeCookie(w)
+	if err != nil {
+		return err
+	}
+	if err := b.DeleteSessions(session.Email); err != nil {
+		return newLoggedError("Error while deleting login sessions", err)
+	}
+	if err := b.DeleteRememberMes(session.Email); err != nil {
+		return newLoggedError("Error while deleting remember me sessions", err)
+	}
+	if err := b.DeleteRefreshTokens(session.UserID); err != nil {
+		return newLoggedError("Error while deleting refresh tokens", err)
+	}
+	return nil
+}
+
 /******************************** Login ***********************************************/
 func (s *authStore) Login(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
 	credentials, err := getCredentials(r)
@@ -229,6 +410,18 @@ func (s *authStore) Login(w http.ResponseWriter, r *http.Request) (*LoginSession
 }
 
 func (s *authStore) login(w http.ResponseWriter, r *http.Request, b Backender, email, password string, rememberMe bool) (*LoginSession, error) {
+	login, err := s.authenticate(b, email, password)
+	if err != nil {
+		return nil, err
+	}
+	if s.conf.LoginCodeTemplate != "" {
+		return nil, s.sendLoginCode(b, login, rememberMe)
+	}
+	return s.createSession(w, r, b, login.UserID, email, login.Info, rememberMe)
+}
+
+// authenticate checks the email and password and that the user is allowed to log in
+func (s *authStore) authenticate(b Backender, email, password string) (*User, error) {
 	if !isValidEmail(email) {
 		return nil, newAuthError("Please enter a valid email address.", nil)
 	}
@@ -240,14 +433,17 @@ func (s *authStore) login(w http.ResponseWriter, r *http.Request, b Backender, e
 	// or same IP with multiple failed attempts
 	login, err := b.LoginAndGetUser(email, password)
 	if err != nil {
-		return nil, newLoggedError("Invalid username or password", err)
+		return nil, newLoggedError("Invalid username or password", err).withCode(ErrCodeInvalidCredentials)
 	}
 
 	if !login.IsEmailVerified {
-		return nil, newAuthError("Your email has not been verified.", nil)
+		return nil, newAuthError("Your email has not been verified.", nil).withCode(ErrCodeEmailNotVerified)
 	}
 
-	return s.createSession(w, r, b, login.UserID, email, login.Info, rememberMe)
+	if login.IsLockedOut() {
+		return nil, newAuthError("Your account is locked. Please reset your password.", nil).withCode(ErrCodeAccountLocked)
+	}
+	return login, nil
 }
 
 func (s *authStore) OAuthLogin(w http.ResponseWriter, r *http.Request) (string, error) {
@@ -263,6 +459,9 @@ func (s *authStore) OAuthLogin(w http.ResponseWriter, r *http.Request) (string,
 func (s *authStore) oauthLogin(w http.ResponseWriter, r *http.Request, b Backender, email string, info map[string]interface{}) (string, error) {
 	user, err := b.GetUser(email)
 	if user == nil || err != nil {
+		if _, err := s.checkRegistration(b, email, ""); err != nil {
+			return "", err
+		}
 		user, err = b.AddUserFull(email, "", info)
 		if err != nil {
 			return "", newLoggedError("Unable to create login", err)
@@ -388,6 +587,30 @@ type EmailSendParams struct {
 	SubjectSuccess   string
 	TemplateFailure  string
 	SubjectFailure   string
+
+	// UseOneTimeCode sends a short numeric code for clients which can't follow a verification link
+	UseOneTimeCode bool
+	// Locale selects the template and subject, e.g. verifyEmail.fr.html. The user's own InfoLocale is preferred
+	Locale string
+	// InviteCode is the code of the invitation Register is called with, sent by CreateInvitation
+	InviteCode string
+	// DestinationURL is where the user goes once the email is verified. It's kept in the session as destinationURL,
+	// which Info can't set since it's a system key
+	DestinationURL string
+}
+
+// sessionInfo is params.Info without the system keys, which callers pass on from clients, and with DestinationURL
+func sessionInfo(params *EmailSendParams) map[string]interface{} {
+	info := make(map[string]interface{})
+	for key, value := range params.Info {
+		if !contains(systemInfoKeys, key) {
+			info[key] = value
+		}
+	}
+	if params.DestinationURL != "" {
+		info["destinationURL"] = params.DestinationURL
+	}
+	return info
 }
 
 func (s *authStore) RequestPasswordReset(w http.ResponseWriter, r *http.Request, sendParams EmailSendParams) error {
@@ -403,23 +626,27 @@ func (s *authStore) requestPasswordReset(r *http.Request, b Backender, params Em
 
 	u, err := b.GetUser(params.Email)
 	if err != nil {
+		if params.TemplateFailure == "" {
+			return nil
+		}
 		if err := s.mailer.SendMessage(params.Email, params.TemplateFailure, params.SubjectFailure, params); err != nil {
 			return newLoggedError("An email has been sent to the user with instructions on how to reset their password", err)
 		}
 		return nil // user does not exist, send success message anyway to prevent fishing for user data. Email owner will be notified of attempt
 	}
 
-	for key, value := range params.Info {
+	for key, value := range sessionInfo(&params) {
 		u.Info[key] = value
 	}
+	params.Locale = userLocale(u.Info, params.Locale)
 
-	verifyCode, err := s.addEmailSession(b, u.UserID, params.Email, u.Info)
+	verifyCode, err := s.addVerificationSession(b, u.UserID, params.Email, u.Info, params.UseOneTimeCode)
 	if err != nil {
 		return newLoggedError("An email has been sent to the user with instructions on how to reset their password", err)
 	}
 
-	params.VerificationCode = verifyCode[:len(verifyCode)-1] // drop the "=" at the end of the code since it makes it look like a querystring
-	if err := s.mailer.SendMessage(params.Email, params.TemplateSuccess, params.SubjectSuccess, params); err != nil {
+	params.VerificationCode = verifyCode
+	if err := s.notifyUser(u, params.Email, params.TemplateSuccess, params.SubjectSuccess, params); err != nil {
 		return newLoggedError("An email has been sent to the user with instructions on how to reset their password", err)
 	}
 
@@ -433,17 +660,18 @@ func (s *authStore) Register(w http.ResponseWriter, r *http.Request, params Emai
 }
 
 func (s *authStore) register(r *http.Request, b Backender, params EmailSendParams, password string) error {
-	userID, err := getRegisterUserID(b, params, password)
+	userID, err := s.getRegisterUserID(b, &params, password)
 	if err != nil {
 		return err
 	}
 
-	verifyCode, err := s.addEmailSession(b, userID, params.Email, params.Info)
+	verifyCode, err := s.addVerificationSession(b, userID, params.Email, params.Info, params.UseOneTimeCode)
 	if err != nil {
 		return newLoggedError("Unable to save user", err)
 	}
 
-	params.VerificationCode = verifyCode[:len(verifyCode)-1] // drop the "=" at the end of the code since it makes it look like a querystring
+	params.VerificationCode = verifyCode
+	params.Locale = userLocale(params.Info, params.Locale)
 	if err := s.mailer.SendMessage(params.Email, params.TemplateSuccess, params.SubjectSuccess, params); err != nil {
 		return newLoggedError("Unable to send verification email", err)
 	}
@@ -451,19 +679,27 @@ func (s *authStore) register(r *http.Request, b Backender, params EmailSendParam
 	return nil
 }
 
-func getRegisterUserID(b Backender, params EmailSendParams, password string) (string, error) {
+// getRegisterUserID checks the registration policy and returns the ID of the user registering, or "" when the user
+// is created once the email is verified
+func (s *authStore) getRegisterUserID(b Backender, params *EmailSendParams, password string) (string, error) {
 	if !isValidEmail(params.Email) {
 		return "", newAuthError("Invalid email", nil)
 	}
+	params.Info = sessionInfo(params) // invited roles come only from the invitation
 
 	user, _ := b.GetUser(params.Email)
-	if user != nil {
-		if user.IsEmailVerified {
-			return "", newAuthError("User already registered", nil)
-		}
-		return user.UserID, nil
+	if user != nil && user.IsEmailVerified {
+		return "", newAuthError("User already registered", nil).withCode(ErrCodeUserExists)
+	}
+	invitation, err := s.checkRegistration(b, params.Email, params.InviteCode)
+	if err != nil {
+		return "", err
 	}
-	if password != "" {
+
+	userID := ""
+	if user != nil {
+		userID = user.UserID
+	} else if password != "" {
 		if !isValidPassword(password) {
 			return "", newAuthError(passwordValidationMessage, nil)
 		}
@@ -471,9 +707,26 @@ func getRegisterUserID(b Backender, params EmailSendParams, password string) (st
 		if err != nil {
 			return "", newLoggedError("Failed to add user", err)
 		}
-		return user.UserID, nil
+		userID = user.UserID
 	}
-	return "", nil
+	if invitation != nil {
+		if err := useInvitation(b, invitation, userID, params.Info); err != nil {
+			return "", err
+		}
+	}
+	return userID, nil
+}
+
+// addVerificationSession returns either a one-time code or a verification code suitable for a link
+func (s *authStore) addVerificationSession(b Backender, userID, email string, info map[string]interface{}, useOneTimeCode bool) (string, error) {
+	if useOneTimeCode {
+		return s.addOneTimeCodeSession(b, userID, email, info)
+	}
+	verifyCode, err := s.addEmailSession(b, userID, email, info)
+	if err != nil {
+		return "", err
+	}
+	return verifyCode[:len(verifyCode)-1], nil // drop the "=" at the end of the code since it makes it look like a querystring
 }
 
 func (s *authStore) addEmailSession(b Backender, userID, email string, info map[string]interface{}) (string, error) {
@@ -495,7 +748,48 @@ func (s *authStore) addEmailSession(b Backender, userID, email string, info map[
 	return verifyCode, nil
 }
 
+func (s *authStore) addEmailSessionWithExpire(b Backender, userID, email string, info map[string]interface{}, purpose string, expireTimeUTC time.Time) (string, error) {
+	verifyCode, verifyHash, err := generateStringAndHash()
+	if err != nil {
+		return "", newLoggedError("Problem generating email confirmation code", err)
+	}
+
+	csrfToken, err := generateRandomString()
+	if err != nil {
+		return "", newLoggedError("Problem generating csrf token", err)
+	}
+
+	err = b.CreateEmailSessionWithExpire(userID, email, info, verifyHash, csrfToken, purpose, expireTimeUTC)
+	if err != nil {
+		return "", newLoggedError("Problem saving email session", err)
+	}
+
+	return verifyCode, nil
+}
+
+func (s *authStore) getEmailSessionWithPurpose(b Backender, code, purpose string) (*emailSession, error) {
+	if !strings.HasSuffix(code, "=") { // add back the "=" then decode
+		code = code + "="
+	}
+	verifyHash, err := decodeStringToHash(code)
+	if err != nil {
+		return nil, newLoggedError("Invalid verification code", err).withCode(ErrCodeInvalidCode)
+	}
+
+	session, err := b.GetEmailSession(verifyHash)
+	if err != nil {
+		return nil, newLoggedError("Invalid or expired verification code", err).withCode(ErrCodeInvalidCode)
+	}
+	if session.Purpose != purpose {
+		return nil, newAuthError("Invalid verification code", nil).withCode(ErrCodeInvalidCode)
+	}
+	return session, nil
+}
+
 func (s *authStore) CreateProfile(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadBytes()+maxProfileFormBytes)
+	}
 	profile, err := getProfile(r)
 	if err != nil {
 		return nil, newAuthError("Unable to get profile information from form", err)
@@ -532,14 +826,36 @@ func (s *authStore) createProfile(w http.ResponseWriter, r *http.Request, b Back
 		return nil, errInvalidCSRF
 	}
 	mergedInfo := session.Info
-	for key, value := range userProfile.Info {
+	if mergedInfo == nil {
+		mergedInfo = make(map[string]interface{})
+	}
+	info, err := s.conf.ProfileSchema.validate(userProfile.Info, FieldAccessUser)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range info {
 		mergedInfo[key] = value
 	}
+	if err := s.conf.ProfileSchema.checkRequired(mergedInfo); err != nil {
+		return nil, err
+	}
+	savedAvatar, err := s.saveAvatar(r, mergedInfo)
+	if err != nil {
+		return nil, err
+	}
+	var oldAvatar []string
+	if len(savedAvatar) > 0 {
+		if user, err := b.GetUserByID(session.UserID); err == nil {
+			oldAvatar = avatarFiles(user.Info) // replaced once the user is updated
+		}
+	}
 
 	err = b.UpdateUser(session.UserID, userProfile.Password, mergedInfo)
 	if err != nil {
+		s.deleteFiles(savedAvatar)
 		return nil, newLoggedError("Unable to update user", err)
 	}
+	s.deleteFiles(oldAvatar)
 
 	err = b.DeleteEmailSession(session.EmailVerifyHash)
 	if err != nil {
@@ -564,18 +880,28 @@ func (s *authStore) VerifyEmail(w http.ResponseWriter, r *http.Request, params E
 
 func (s *authStore) verifyEmail(w http.ResponseWriter, r *http.Request, b Backender, params EmailSendParams) (string, *User, error) {
 	emailVerificationCode := params.VerificationCode
+	if isOneTimeCode(emailVerificationCode) {
+		code, err := s.exchangeOneTimeCode(b, params.Email, emailVerificationCode)
+		if err != nil {
+			return "", nil, err
+		}
+		emailVerificationCode = code
+	}
 	if !strings.HasSuffix(emailVerificationCode, "=") { // add back the "=" then decode
 		emailVerificationCode = emailVerificationCode + "="
 	}
 	emailVerifyHash, err := decodeStringToHash(emailVerificationCode)
 	if err != nil {
-		return "", nil, newLoggedError("Invalid verification code", err)
+		return "", nil, newLoggedError("Invalid verification code", err).withCode(ErrCodeInvalidCode)
 	}
 
 	session, err := b.GetEmailSession(emailVerifyHash)
 	if err != nil {
 		return "", nil, newLoggedError("Failed to verify email", err)
 	}
+	if session.Purpose != "" {
+		return "", nil, newAuthError("Invalid verification code", nil).withCode(ErrCodeInvalidCode)
+	}
 
 	userID, err := s.markAsVerified(w, b, session, emailVerificationCode)
 	if err != nil {
@@ -587,6 +913,7 @@ func (s *authStore) verifyEmail(w http.ResponseWriter, r *http.Request, b Backen
 		info[key] = value
 	}
 	params.Info = info
+	params.Locale = userLocale(info, params.Locale)
 	err = s.mailer.SendMessage(session.Email, params.TemplateSuccess, params.SubjectSuccess, params)
 	if err != nil {
 		return "", nil, newLoggedError("Failed to send welcome email", err)
@@ -605,10 +932,17 @@ func (s *authStore) markAsVerified(w http.ResponseWriter, b Backender, session *
 		return session.UserID, nil
 	}
 
+	roles := infoStrings(session.Info[infoInvitedRoles])
+	delete(session.Info, infoInvitedRoles)
 	userID, err := b.AddVerifiedUser(session.Email, session.Info)
 	if err != nil {
 		return "", newLoggedError("Failed to create user", err)
 	}
+	if len(roles) > 0 {
+		if err := b.UpdateUserRoles(userID, roles); err != nil {
+			return "", newLoggedError("Unable to give invited user roles", err)
+		}
+	}
 
 	err = b.UpdateEmailSession(session.EmailVerifyHash, userID)
 	if err != nil {
@@ -623,25 +957,36 @@ func (s *authStore) markAsVerified(w http.ResponseWriter, b Backender, session *
 	return userID, nil
 }
 
-func (s *authStore) VerifyPasswordReset(w http.ResponseWriter, r *http.Request, emailVerificationCode string) (string, *User, error) {
+func (s *authStore) VerifyPasswordReset(w http.ResponseWriter, r *http.Request, params EmailSendParams) (string, *User, error) {
 	b := s.b.Clone()
 	defer b.Close()
-	return s.verifyPasswordReset(w, r, b, emailVerificationCode)
+	return s.verifyPasswordReset(w, r, b, params)
 }
 
-func (s *authStore) verifyPasswordReset(w http.ResponseWriter, r *http.Request, b Backender, emailVerificationCode string) (string, *User, error) {
+func (s *authStore) verifyPasswordReset(w http.ResponseWriter, r *http.Request, b Backender, params EmailSendParams) (string, *User, error) {
+	emailVerificationCode := params.VerificationCode
+	if isOneTimeCode(emailVerificationCode) {
+		code, err := s.exchangeOneTimeCode(b, params.Email, emailVerificationCode)
+		if err != nil {
+			return "", nil, err
+		}
+		emailVerificationCode = code
+	}
 	if !strings.HasSuffix(emailVerificationCode, "=") { // add back the "=" then decode
 		emailVerificationCode = emailVerificationCode + "="
 	}
 	emailVerifyHash, err := decodeStringToHash(emailVerificationCode)
 	if err != nil {
-		return "", nil, newLoggedError("Invalid verification code", err)
+		return "", nil, newLoggedError("Invalid verification code", err).withCode(ErrCodeInvalidCode)
 	}
 
 	session, err := b.GetEmailSession(emailVerifyHash)
 	if err != nil {
 		return "", nil, newLoggedError("Failed to verify email", err)
 	}
+	if session.Purpose != "" {
+		return "", nil, newAuthError("Invalid verification code", nil).withCode(ErrCodeInvalidCode)
+	}
 
 	err = s.saveEmailCookie(w, emailVerificationCode, time.Now().UTC().Add(passwordResetEmailExpireDuration))
 	if err != nil {
@@ -661,8 +1006,140 @@ func (s *authStore) CreateSecondaryEmail(w http.ResponseWriter, r *http.Request,
 }
 
 func (s *authStore) SetPrimaryEmail(w http.ResponseWriter, r *http.Request, templateName, emailSubject string) error {
-	// be sure to require current email and password (i.e. require login) to change primary email
-	// invalidate old sessions?
+	credentials, err := getCredentials(r)
+	if err != nil {
+		return newAuthError("Unable to get credentials", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.setPrimaryEmail(w, r, b, credentials.Email, credentials.Password, templateName, emailSubject)
+}
+
+// setPrimaryEmail sends a code to the new email with the templateName email. The primary email only changes once
+// ConfirmEmailChange is called with the code, which proves the user can read mail sent there
+func (s *authStore) setPrimaryEmail(w http.ResponseWriter, r *http.Request, b Backender, newEmail, password, templateName, emailSubject string) error {
+	// require current email and password (i.e. require login) to change primary email
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return err
+	}
+	if !isValidEmail(newEmail) {
+		return newAuthError("Invalid email", nil)
+	}
+	if err := b.Login(session.Email, password); err != nil {
+		return newLoggedError("Invalid username or password", err).withCode(ErrCodeInvalidCredentials)
+	}
+	if templateName == "" {
+		return newAuthError("Email changes aren't enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	if user, _ := b.GetUser(newEmail); user != nil {
+		return newAuthError("Email is already in use", nil).withCode(ErrCodeUserExists)
+	}
+
+	code, err := s.addEmailSessionWithExpire(b, session.UserID, newEmail, map[string]interface{}{"oldEmail": session.Email}, emailSessionPurposeChangeEmail, time.Now().UTC().Add(emailChangeExpireDuration))
+	if err != nil {
+		return newLoggedError("Unable to create email change code", err)
+	}
+	params := EmailSendParams{VerificationCode: code[:len(code)-1], Email: newEmail, BaseURL: s.baseURL(r), Info: copyInfo(session.Info), Locale: userLocale(session.Info, "")}
+	params.Info["oldEmail"] = session.Email
+	if err := s.mailer.SendMessage(newEmail, templateName, emailSubject, params); err != nil {
+		return newLoggedError("Unable to send email change confirmation", err)
+	}
+	return nil
+}
+
+func (s *authStore) ConfirmEmailChange(w http.ResponseWriter, r *http.Request, code string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.confirmEmailChange(w, r, b, code)
+}
+
+// confirmEmailChange makes the email the code was sent to the primary email, logs out every session of the old one
+// and sends the old email a code to revert the change
+func (s *authStore) confirmEmailChange(w http.ResponseWriter, r *http.Request, b Backender, code string) error {
+	session, err := s.getEmailSessionWithPurpose(b, code, emailSessionPurposeChangeEmail)
+	if err != nil {
+		return err
+	}
+	oldEmail := GetInfoString(session.Info, "oldEmail")
+
+	if err := b.UpdatePrimaryEmail(session.UserID, session.Email); err != nil {
+		return newLoggedError("Unable to update primary email", err)
+	}
+	if err := b.DeleteEmailSession(session.EmailVerifyHash); err != nil {
+		return newLoggedError("Error while changing email", err)
+	}
+	if err := b.DeleteSessions(oldEmail); err != nil {
+		return newLoggedError("Error while deleting login sessions", err)
+	}
+	if err := b.DeleteRememberMes(oldEmail); err != nil {
+		return newLoggedError("Error while deleting remember me sessions", err)
+	}
+	s.deleteSessionCookie(w)
+	s.deleteRememberMeCookie(w)
+
+	var info map[string]interface{}
+	if user, err := b.GetUser(session.Email); err == nil {
+		info = user.Info
+	}
+	s.sendEmailChanged(r, b, session.UserID, oldEmail, session.Email, info)
+	return nil
+}
+
+// sendEmailChanged notifies the old email address of the change and includes a code to revert it. The change is
+// already saved, so failures are logged instead of returned
+func (s *authStore) sendEmailChanged(r *http.Request, b Backender, userID, oldEmail, newEmail string, info map[string]interface{}) {
+	if s.conf.EmailChangedTemplate == "" {
+		return
+	}
+
+	revertCode, err := s.addEmailSessionWithExpire(b, userID, oldEmail, map[string]interface{}{"newEmail": newEmail}, emailSessionPurposeRevertEmail, time.Now().UTC().Add(emailRevertExpireDuration))
+	if err != nil {
+		log.Println("Unable to create email change revert code:", err)
+		return
+	}
+
+	params := EmailSendParams{VerificationCode: revertCode[:len(revertCode)-1], Email: oldEmail, BaseURL: s.baseURL(r), Info: copyInfo(info), Locale: userLocale(info, "")}
+	params.Info["newEmail"] = newEmail
+	if err := s.mailer.SendMessage(oldEmail, s.conf.EmailChangedTemplate, s.conf.EmailChangedSubject, params); err != nil {
+		log.Println("Unable to send email changed notification:", err)
+	}
+}
+
+func (s *authStore) RevertEmailChange(w http.ResponseWriter, r *http.Request, revertCode string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.revertEmailChange(w, b, revertCode)
+}
+
+// revertEmailChange restores the previous primary email and locks the account until the password is reset
+func (s *authStore) revertEmailChange(w http.ResponseWriter, b Backender, revertCode string) error {
+	session, err := s.getEmailSessionWithPurpose(b, revertCode, emailSessionPurposeRevertEmail)
+	if err != nil {
+		return err
+	}
+	newEmail := GetInfoString(session.Info, "newEmail")
+
+	if err := b.UpdatePrimaryEmail(session.UserID, session.Email); err != nil {
+		return newLoggedError("Unable to revert primary email", err)
+	}
+	if err := b.UpdateLockout(session.UserID, &lockedPendingResetTimeUTC); err != nil {
+		return newLoggedError("Unable to lock account", err)
+	}
+	if err := b.DeleteSessions(newEmail); err != nil {
+		return newLoggedError("Error while deleting login sessions", err)
+	}
+	if err := b.DeleteRememberMes(newEmail); err != nil {
+		return newLoggedError("Error while deleting remember me sessions", err)
+	}
+	if err := b.DeleteRefreshTokens(session.UserID); err != nil {
+		return newLoggedError("Error while deleting refresh tokens", err)
+	}
+	if err := b.DeleteEmailSession(session.EmailVerifyHash); err != nil {
+		return newLoggedError("Error while reverting email change", err)
+	}
+	s.deleteSessionCookie(w)
+	s.deleteRememberMeCookie(w)
 	return nil
 }
 
@@ -714,11 +1191,23 @@ func (s *authStore) updatePassword(w http.ResponseWriter, r *http.Request, b Bac
 		return nil, newLoggedError("Error while deleting remember me sessions", err)
 	}
 
+	err = b.DeleteRefreshTokens(session.UserID)
+	if err != nil {
+		return nil, newLoggedError("Error while deleting refresh tokens", err)
+	}
+
 	err = b.UpdateUser(session.UserID, password, session.Info)
 	if err != nil {
 		return nil, newLoggedError("Unable to update password", err)
 	}
 
+	err = b.UpdateLockout(session.UserID, nil) // password reset unlocks the account
+	if err != nil {
+		return nil, newLoggedError("Unable to unlock account", err)
+	}
+
+	s.sendPasswordChanged(r, b, session.UserID, session.Email, session.Info)
+
 	ls, err := s.createSession(w, r, b, session.UserID, session.Email, nil, false)
 	if err != nil {
 		return nil, err
@@ -732,7 +1221,24 @@ func (s *authStore) updatePassword(w http.ResponseWriter, r *http.Request, b Bac
 	return ls, nil
 }
 
+// sendPasswordChanged notifies the user of the new password. Failures are logged since the password is already changed
+func (s *authStore) sendPasswordChanged(r *http.Request, b Backender, userID, email string, info map[string]interface{}) {
+	if s.conf.PasswordChangedTemplate == "" {
+		return
+	}
+	params := EmailSendParams{Email: email, BaseURL: s.baseURL(r), Info: info, Locale: userLocale(info, "")}
+	if err := s.notify(b, userID, email, s.conf.PasswordChangedTemplate, s.conf.PasswordChangedSubject, params); err != nil {
+		log.Println("Unable to send password changed notification:", err)
+	}
+}
+
+// UpdateInfo sets info fields of the user, including read-only ones. Values of schema fields are checked and
+// converted to the field types
 func (s *authStore) UpdateInfo(userID string, info map[string]interface{}) error {
+	info, err := s.conf.ProfileSchema.validate(info, FieldAccessReadOnly)
+	if err != nil {
+		return err
+	}
 	b := s.b.Clone()
 	defer b.Close()
 	return b.UpdateInfo(userID, info)
@@ -788,6 +1294,7 @@ type credentials struct {
 	Email      string
 	Password   string
 	RememberMe bool
+	Code       string
 }
 
 func getCredentials(r *http.Request) (*credentials, error) {
@@ -795,54 +1302,25 @@ func getCredentials(r *http.Request) (*credentials, error) {
 	return credentials, getJSON(r, credentials)
 }
 
-func generateThumbnail(filename string) (string, error) {
-	newName, err := generateRandomString()
-	if err != nil {
-		return "", newLoggedError("Unable to create new filename", err)
-	}
-	var args = []string{
-		"-s", "150",
-		"-o", newName,
-		filename,
-	}
-
-	var cmd *exec.Cmd
-	path, _ := exec.LookPath("vipsthumbnail")
-	cmd = exec.Command(path, args...)
-	err = cmd.Run()
-	if err != nil {
-		return "", newLoggedError("Error running vipsthumbnail", err)
-	}
-	return newName, nil
-}
-
 type profile struct {
 	Password string
 	Info     map[string]interface{}
 }
 
+// getProfile reads the password and info from the form. Files are left in r.MultipartForm for saveAvatar, and
+// system fields such as the avatar URLs are skipped so clients can't set them
 func getProfile(r *http.Request) (*profile, error) {
 	profile := &profile{Info: make(map[string]interface{})}
-	r.ParseMultipartForm(32 << 20) // 32 MB file
-
-	file, handler, err := r.FormFile("file")
-	if err == nil { // received the file, so save it
-		defer file.Close()
-
-		f, err := os.OpenFile(handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
-		if err != nil {
-			return nil, err
-		}
-		defer f.Close()
-		io.Copy(f, file)
-		profile.Info["filename"] = handler.Filename
-	}
+	r.ParseMultipartForm(32 << 20) // 32 MB in memory, the rest in temporary files
 
 	for key := range r.Form { // save form values
-		if key == "password" {
+		switch key {
+		case "password":
 			profile.Password = r.FormValue(key)
-		} else {
-			profile.Info[key] = r.FormValue(key)
+		default:
+			if !contains(systemInfoKeys, key) {
+				profile.Info[key] = r.FormValue(key)
+			}
 		}
 	}
 
@@ -858,6 +1336,59 @@ func getJSON(r *http.Request, result interface{}) error {
 	return json.Unmarshal(body, result)
 }
 
+// BaseURL returns the scheme and host links to this server should use. baseURL is used when it's set. Otherwise
+// the host the request was sent to, honoring proxy headers, is only used when it's in allowedHosts, so the Host and
+// X-Forwarded-Host headers can't point links in emails at another site. It returns "" when neither applies
+func BaseURL(r *http.Request, baseURL string, allowedHosts []string) string {
+	if baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	if r == nil {
+		return ""
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	if !isAllowedHost(host, allowedHosts) {
+		return ""
+	}
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme != "https" && scheme != "http" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + host
+}
+
+// isAllowedHost matches host with or without its port
+func isAllowedHost(host string, allowedHosts []string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range allowedHosts {
+		if host != "" && (strings.EqualFold(allowed, host) || strings.EqualFold(allowed, hostname)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *authStore) baseURL(r *http.Request) string {
+	return BaseURL(r, s.conf.BaseURL, s.conf.AllowedHosts)
+}
+
+func copyInfo(info map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(info))
+	for key, value := range info {
+		c[key] = value
+	}
+	return c
+}
+
 func isValidEmail(email string) bool {
 	return len(email) <= 254 && len(email) >= 6 && emailRegex.MatchString(email) == true
 }
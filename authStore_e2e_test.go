@@ -97,7 +97,7 @@ func TestAuthStoreEndToEnd(t *testing.T) {
 func _register(email string, b *backendMemory, m *TextMailer) (string, error) {
 	r := &http.Request{Header: http.Header{}}
 	c := newMockCookieStore(nil, false, false)
-	s := &authStore{b, m, c}
+	s := &authStore{b: b, mailer: m, cookieStore: c}
 	lenSessions := len(b.EmailSessions)
 
 	// register new user
@@ -122,7 +122,7 @@ func _register(email string, b *backendMemory, m *TextMailer) (string, error) {
 func _verify(verifyCode string, b *backendMemory, m *TextMailer) (string, *emailCookie, error) {
 	r := &http.Request{Header: http.Header{}}
 	c := newMockCookieStore(nil, false, false)
-	s := &authStore{b, m, c}
+	s := &authStore{b: b, mailer: m, cookieStore: c}
 	lenEmailSessions := len(b.EmailSessions)
 	lenUsers := len(b.Users)
 	emailVerifyHash, _ := decodeStringToHash(verifyCode + "=")
@@ -157,7 +157,7 @@ func _verify(verifyCode string, b *backendMemory, m *TextMailer) (string, *email
 func _createProfile(fullName, password string, emailCookie *emailCookie, b *backendMemory, m *TextMailer, csrfToken string) (string, *sessionCookie, error) {
 	r := &http.Request{Header: http.Header{}}
 	c := newMockCookieStore(map[string]interface{}{"Email": emailCookie}, false, false)
-	s := &authStore{b, m, c}
+	s := &authStore{b: b, mailer: m, cookieStore: c}
 	p := profile{Password: password}
 	emailVerifyHash, _ := decodeStringToHash(emailCookie.EmailVerificationCode)
 	oldEmailSession := b.getEmailSessionByEmailVerifyHash(emailVerifyHash)
@@ -199,7 +199,7 @@ func _createProfile(fullName, password string, emailCookie *emailCookie, b *back
 func _login(email, password string, remember bool, clientSessionCookie *sessionCookie, rememberCookie *rememberMeCookie, b *backendMemory, m *TextMailer) (string, *sessionCookie, *rememberMeCookie, error) {
 	r := &http.Request{Header: http.Header{}}
 	c := newMockCookieStore(map[string]interface{}{"Session": clientSessionCookie, "RememberMe": rememberCookie}, false, false)
-	s := &authStore{b, m, c}
+	s := &authStore{b: b, mailer: m, cookieStore: c}
 	lenUsers := len(b.Users)
 
 	// login
@@ -260,7 +260,7 @@ func _auth(clientSessionCookie *sessionCookie, rememberCookie *rememberMeCookie,
 	r := &http.Request{Header: http.Header{}}
 	r.Header.Add("X-CSRF-Token", csrfToken)
 	c := newMockCookieStore(map[string]interface{}{"Session": clientSessionCookie, "RememberMe": rememberCookie}, false, false)
-	s := &authStore{b, m, c}
+	s := &authStore{b: b, mailer: m, cookieStore: c}
 	session, err := s.GetSession(nil, r)
 	if err != nil {
 		return err
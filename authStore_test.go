@@ -19,7 +19,7 @@ var errFailed = errors.New("failed")
 
 func getAuthStore(emailCookie *emailCookie, sessionCookie *sessionCookie, rememberCookie *rememberMeCookie, hasCookieGetError, hasCookiePutError bool, mailErr error, backend *mockBackend) *authStore {
 	cookieStore := newMockCookieStore(map[string]interface{}{emailCookieName: emailCookie, sessionCookieName: sessionCookie, rememberMeCookieName: rememberCookie}, hasCookieGetError, hasCookiePutError)
-	return &authStore{backend, &TextMailer{Err: mailErr}, cookieStore}
+	return &authStore{b: backend, mailer: &TextMailer{Err: mailErr}, cookieStore: cookieStore}
 }
 
 func TestNewAuthStore(t *testing.T) {
@@ -811,3 +811,186 @@ func collectionEqual(expected, actual []string) bool {
 	}
 	return true
 }
+
+func TestAuthSetPrimaryEmailAndRevert(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	m := &TextMailer{}
+	c := newMockCookieStore(nil, false, false)
+	s := &authStore{b: b, mailer: m, cookieStore: c, conf: AuthStoreConfig{EmailChangedTemplate: "emailChanged", EmailChangedSubject: "Email Changed", BaseURL: "http://example.com/"}}
+	u, _ := b.AddUserFull("old@test.com", "password", map[string]interface{}{"key": "value"})
+	b.VerifyEmail("old@test.com")
+	session, err := s.createSession(nil, &http.Request{Header: http.Header{}}, b, u.UserID, "old@test.com", u.Info, false)
+	if err != nil {
+		t.Fatal("expected session", err)
+	}
+	r := &http.Request{Header: http.Header{"X-Csrf-Token": {session.CSRFToken}}, Host: "example.com"}
+
+	// wrong password
+	if err := s.setPrimaryEmail(nil, r, b, "new@test.com", "bogusPassword", "", ""); err == nil || err.Error() != "Invalid username or password" {
+		t.Fatal("expected password check", err)
+	}
+
+	if err := s.setPrimaryEmail(nil, r, b, "new@test.com", "password", "", ""); err == nil || ErrorCode(err) != ErrCodeNotEnabled {
+		t.Fatal("expected confirmation template to be required", err)
+	}
+	b.AddUserFull("taken@test.com", "password", nil)
+	if err := s.setPrimaryEmail(nil, r, b, "taken@test.com", "password", "confirmEmailChange", "Confirm"); err == nil || ErrorCode(err) != ErrCodeUserExists {
+		t.Fatal("expected email in use", err)
+	}
+	if err := s.setPrimaryEmail(nil, r, b, "new@test.com", "password", "confirmEmailChange", "Confirm"); err != nil {
+		t.Fatal("expected success", err)
+	}
+	data := m.MessageData.(EmailSendParams)
+	if b.getUserByID(u.UserID).PrimaryEmail != "old@test.com" || m.MessageTo != "new@test.com" || data.Info["oldEmail"] != "old@test.com" || data.VerificationCode == "" {
+		t.Fatal("expected confirmation to be sent to the new email before it changes", b.getUserByID(u.UserID), m.MessageTo, data)
+	}
+	if err := s.revertEmailChange(nil, b, data.VerificationCode); err == nil {
+		t.Fatal("expected confirmation code to be rejected as a revert code")
+	}
+
+	if err := s.confirmEmailChange(nil, r, b, data.VerificationCode); err != nil {
+		t.Fatal("expected email change to be confirmed", err)
+	}
+	if err := s.confirmEmailChange(nil, r, b, data.VerificationCode); err == nil {
+		t.Fatal("expected confirmation code to be single use")
+	}
+	data = m.MessageData.(EmailSendParams)
+	if b.getUserByID(u.UserID).PrimaryEmail != "new@test.com" || m.MessageTo != "old@test.com" || data.Info["newEmail"] != "new@test.com" || data.BaseURL != "http://example.com" || data.VerificationCode == "" {
+		t.Fatal("expected email to change and old address to be notified", b.getUserByID(u.UserID), m.MessageTo, data)
+	}
+	if _, err := s.getSession(nil, r, b); err == nil {
+		t.Fatal("expected sessions of the old email to be logged out")
+	}
+
+	// verify email can't be used with a revert code
+	if _, _, err := s.verifyEmail(nil, r, b, EmailSendParams{VerificationCode: data.VerificationCode}); err == nil {
+		t.Fatal("expected revert code to be rejected as email verification")
+	}
+
+	b.CreateRefreshToken(u.UserID, "new@test.com", "", "", "family", "selector", "tokenHash", futureTime)
+	if err := s.revertEmailChange(nil, b, data.VerificationCode); err != nil {
+		t.Fatal("expected revert to succeed", err)
+	}
+	if user := b.getUserByID(u.UserID); user.PrimaryEmail != "old@test.com" || user.LockoutEndTimeUTC == nil || len(b.RefreshTokens) != 0 {
+		t.Fatal("expected email to be reverted, account locked and refresh tokens deleted", user, b.RefreshTokens)
+	}
+	if _, err := s.login(nil, r, b, "old@test.com", "password", false); err == nil || err.Error() != "Your account is locked. Please reset your password." {
+		t.Fatal("expected locked account", err)
+	}
+
+	// single use
+	if err := s.revertEmailChange(nil, b, data.VerificationCode); err == nil {
+		t.Fatal("expected revert code to be single use")
+	}
+}
+
+func TestAuthConfirmEmailChangeNotificationFails(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	m := &TextMailer{Err: errFailed}
+	s := &authStore{b: b, mailer: m, cookieStore: newMockCookieStore(nil, false, false), conf: AuthStoreConfig{EmailChangedTemplate: "emailChanged"}}
+	u, _ := b.AddUserFull("old@test.com", "password", nil)
+	code, _ := s.addEmailSessionWithExpire(b, u.UserID, "new@test.com", map[string]interface{}{"oldEmail": "old@test.com"}, emailSessionPurposeChangeEmail, futureTime)
+	if err := s.confirmEmailChange(nil, &http.Request{Header: http.Header{}}, b, code); err != nil {
+		t.Fatal("expected the email change to succeed when the notification can't be sent", err)
+	}
+	if b.getUserByID(u.UserID).PrimaryEmail != "new@test.com" {
+		t.Fatal("expected email to change", b.getUserByID(u.UserID))
+	}
+}
+
+func TestAuthRevertEmailChangeExpired(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	s := &authStore{b: b, mailer: &TextMailer{}, cookieStore: newMockCookieStore(nil, false, false)}
+	code, err := s.addEmailSessionWithExpire(b, "1", "old@test.com", nil, emailSessionPurposeRevertEmail, pastTime)
+	if err != nil {
+		t.Fatal("expected success", err)
+	}
+	if err := s.revertEmailChange(nil, b, code); err == nil || err.Error() != "Invalid or expired verification code" {
+		t.Fatal("expected expired code", err)
+	}
+}
+
+func TestAuthUpdatePasswordNotifiesAndUnlocks(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	m := &TextMailer{}
+	u, _ := b.AddUserFull("test@test.com", "password", map[string]interface{}{})
+	b.VerifyEmail("test@test.com")
+	b.UpdateLockout(u.UserID, &lockedPendingResetTimeUTC)
+
+	code, _ := (&authStore{b: b}).addEmailSessionWithExpire(b, u.UserID, "test@test.com", map[string]interface{}{}, "", time.Time{})
+	session := b.EmailSessions[0]
+	c := newMockCookieStore(map[string]interface{}{emailCookieName: &emailCookie{EmailVerificationCode: code}}, false, false)
+	s := &authStore{b: b, mailer: m, cookieStore: c, conf: AuthStoreConfig{PasswordChangedTemplate: "passwordChanged", PasswordChangedSubject: "Password Changed"}}
+	b.CreateRefreshToken(u.UserID, "test@test.com", "", "", "family", "selector", "tokenHash", futureTime)
+
+	if _, err := s.updatePassword(nil, &http.Request{Header: http.Header{}}, b, session.CSRFToken, "newPassword"); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if m.MessageTo != "test@test.com" || b.getUserByID(u.UserID).LockoutEndTimeUTC != nil {
+		t.Fatal("expected password changed email and unlocked account", m.MessageTo, b.getUserByID(u.UserID))
+	}
+	if len(b.RefreshTokens) != 0 {
+		t.Fatal("expected refresh tokens to be deleted", b.RefreshTokens)
+	}
+
+	m.Err = errFailed
+	code, _ = s.addEmailSessionWithExpire(b, u.UserID, "test@test.com", map[string]interface{}{}, "", time.Time{})
+	c.cookies[emailCookieName] = &emailCookie{EmailVerificationCode: code}
+	if _, err := s.updatePassword(nil, &http.Request{Header: http.Header{}}, b, b.EmailSessions[0].CSRFToken, "newPassword2"); err != nil {
+		t.Fatal("expected the password change to succeed when the notification can't be sent", err)
+	}
+	if _, err := b.LoginAndGetUser("test@test.com", "newPassword2"); err != nil {
+		t.Fatal("expected new password to be saved", err)
+	}
+}
+
+func TestAuthLogoutAll(t *testing.T) {
+	s, b := getTokenStore()
+	b.AddUserFull("other@test.com", "password", nil)
+	future := time.Now().UTC().Add(time.Hour)
+	b.CreateSession("1", "test@test.com", nil, "hash1", "csrf1", future, future)
+	b.CreateSession("1", "test@test.com", nil, "hash2", "csrf2", future, future)
+	b.CreateSession("2", "other@test.com", nil, "hash3", "csrf3", future, future)
+	b.CreateRememberMe("1", "test@test.com", "selector", "tokenHash", future, future)
+	b.CreateRefreshToken("2", "other@test.com", "", "", "family", "selector", "tokenHash", future)
+
+	if err := s.logoutAll(nil, &http.Request{Header: http.Header{}}, b); err != errMissingCSRF {
+		t.Fatal("expected logged in user to be required", err)
+	}
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	if err := s.logoutAll(nil, bearerRequest(tokens.AccessToken), b); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if len(b.Sessions) != 1 || b.Sessions[0].Email != "other@test.com" || len(b.RememberMes) != 0 {
+		t.Fatal("expected only the user's sessions and remember mes to be deleted", b.Sessions, b.RememberMes)
+	}
+	if len(b.RefreshTokens) != 1 || b.RefreshTokens[0].UserID != "2" {
+		t.Fatal("expected only the user's refresh tokens to be deleted", b.RefreshTokens)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	allowed := []string{"auth.example.com"}
+	tests := []struct {
+		host, forwardedHost, forwardedProto, baseURL, expected string
+	}{
+		{"auth.example.com", "", "", "", "http://auth.example.com"},
+		{"AUTH.example.com:8080", "", "https", "", "https://AUTH.example.com:8080"},
+		{"localhost", "auth.example.com", "https", "", "https://auth.example.com"},
+		{"auth.example.com", "evil.com", "https", "", ""},
+		{"evil.com", "", "", "", ""},
+		{"auth.example.com", "", "javascript", "", "http://auth.example.com"},
+		{"evil.com", "evil.com", "", "https://auth.example.com/", "https://auth.example.com"},
+	}
+	for _, test := range tests {
+		r := &http.Request{Host: test.host, Header: http.Header{}}
+		r.Header.Set("X-Forwarded-Host", test.forwardedHost)
+		r.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+		if baseURL := BaseURL(r, test.baseURL, allowed); baseURL != test.expected {
+			t.Error("unexpected base URL", test, baseURL)
+		}
+	}
+	if BaseURL(nil, "", allowed) != "" {
+		t.Error("expected no base URL without a request")
+	}
+}
@@ -22,6 +22,18 @@ var errRememberMeNotFound = errors.New("DB: RememberMe not found")
 var errRememberMeNeedsRenew = errors.New("DB: RememberMe needs to be renewed")
 var errRememberMeExpired = errors.New("DB: RememberMe is expired")
 var errUserAlreadyExists = errors.New("DB: User already exists")
+var errEmailSessionExpired = errors.New("DB: Email session is expired")
+var errRefreshTokenNotFound = errors.New("DB: Refresh token not found")
+var errRefreshTokenSelectorExists = errors.New("DB: Refresh token selector already exists")
+var errSigningKeyNotFound = errors.New("DB: Signing key not found")
+var errOAuthClientNotFound = errors.New("DB: OAuth client not found")
+var errOAuthClientExists = errors.New("DB: OAuth client already exists")
+var errOAuthConsentNotFound = errors.New("DB: OAuth consent not found")
+var errAuthorizationCodeNotFound = errors.New("DB: Authorization code not found")
+var errAPIKeyNotFound = errors.New("DB: API key not found")
+var errAPIKeyExists = errors.New("DB: API key already exists")
+var errRoleNotFound = errors.New("DB: Role not found")
+var errQueuedEmailNotFound = errors.New("DB: Queued email not found")
 
 // Backender interface contains all the methods needed to read and write users, sessions and logins
 type Backender interface {
@@ -45,15 +57,56 @@ type userBackender interface {
 	AddVerifiedUser(email string, info map[string]interface{}) (string, error)
 	AddUserFull(email, password string, info map[string]interface{}) (*User, error)
 	GetUser(email string) (*User, error)
+	GetUserByID(userID string) (*User, error)
 	UpdateUser(userID, password string, info map[string]interface{}) error
 	UpdateInfo(userID string, info map[string]interface{}) error
 	UpdatePassword(userID, newPassword string) error
+	UpdateLockout(userID string, lockoutEndTimeUTC *time.Time) error
 	VerifyEmail(email string) error
+	// VerifyPhoneNumber saves the phone number the user entered the code sent to, replacing their number
+	VerifyPhoneNumber(userID, phoneNumber string) error
 
 	Login(email, password string) error
 	LoginAndGetUser(email, password string) (*User, error)
 	AddSecondaryEmail(userID, secondaryEmail string) error
 	UpdatePrimaryEmail(userID, newPrimaryEmail string) error
+
+	oauthClientBackender
+	apiKeyBackender
+	roleBackender
+}
+
+// oauthClientBackender stores the applications registered with the OAuth authorization server and the consent users gave them
+type oauthClientBackender interface {
+	CreateOAuthClient(client *oauthClient) error
+	GetOAuthClient(clientID string) (*oauthClient, error)
+	SaveOAuthConsent(userID, clientID, scope string) error
+	GetOAuthConsent(userID, clientID string) (*oauthConsent, error)
+}
+
+// apiKeyBackender stores the personal access tokens users create for scripts and CI jobs
+type apiKeyBackender interface {
+	CreateAPIKey(key *apiKey) error
+	GetAPIKey(keyID string) (*apiKey, error)
+	GetAPIKeys(userID string) ([]*apiKey, error)
+	UpdateAPIKeyLastUsed(keyID string, lastUsedTimeUTC time.Time) error
+	DeleteAPIKey(userID, keyID string) error
+}
+
+// roleBackender stores the roles which can be assigned to users and the permissions each role grants
+type roleBackender interface {
+	GetUserRoles(userID string) ([]string, error)
+	UpdateUserRoles(userID string, roles []string) error
+	SaveRole(role *Role) error
+	GetRoles() ([]*Role, error)
+	DeleteRole(name string) error
+}
+
+// authorizationCodeBackender stores the short-lived codes handed to OAuth clients by the authorization endpoint
+type authorizationCodeBackender interface {
+	CreateAuthorizationCode(code *authorizationCode) error
+	// ConsumeAuthorizationCode returns and deletes the code, so only one caller can ever redeem it
+	ConsumeAuthorizationCode(codeHash string) (*authorizationCode, error)
 }
 
 // SessionBackender interface holds methods for session management
@@ -64,9 +117,13 @@ type SessionBackender interface {
 
 type sessionBackender interface {
 	CreateEmailSession(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken string) error
+	CreateEmailSessionWithExpire(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken, purpose string, expireTimeUTC time.Time) error
 	GetEmailSession(verifyHash string) (*emailSession, error)
 	UpdateEmailSession(verifyHash string, userID string) error
 	DeleteEmailSession(verifyHash string) error
+	// IncrementCodeAttempts counts a guess at a one-time code for key in one step, so concurrent guesses are all
+	// counted, and returns the guesses so far. Counting starts again after the expireTimeUTC of the first guess
+	IncrementCodeAttempts(key string, expireTimeUTC time.Time) (int, error)
 
 	CreateSession(userID, email string, info map[string]interface{}, sessionHash, csrfToken string, sessionRenewTimeUTC, sessionExpireTimeUTC time.Time) (*LoginSession, error)
 	GetSession(sessionHash string) (*LoginSession, error)
@@ -80,14 +137,46 @@ type sessionBackender interface {
 	UpdateRememberMe(selector string, renewTimeUTC time.Time) error
 	DeleteRememberMe(selector string) error
 	DeleteRememberMes(email string) error
+
+	CreateRefreshToken(userID, email, clientID, scope, familyID, selector, tokenHash string, expireTimeUTC time.Time) (*refreshTokenSession, error)
+	GetRefreshToken(selector string) (*refreshTokenSession, error)
+	RotateRefreshToken(selector string) error
+	DeleteRefreshTokenFamily(familyID string) error
+	DeleteRefreshTokens(userID string) error
+
+	AddSigningKey(key *signingKey) error
+	GetSigningKeys() ([]*signingKey, error)
+	DeleteSigningKey(keyID string) error
+
+	authorizationCodeBackender
+	outboxBackender
+}
+
+// outboxBackender stores the emails waiting for delivery by an Outbox, and the ones it gave up on
+type outboxBackender interface {
+	QueueEmail(email *queuedEmail) error
+	// ClaimEmail returns the pending email which has been due the longest and hides it from other workers until
+	// leaseUntilUTC, so an email claimed by a worker which stops is delivered by another. errQueuedEmailNotFound
+	// is returned when none are due
+	ClaimEmail(nowUTC, leaseUntilUTC time.Time) (*queuedEmail, error)
+	UpdateQueuedEmail(email *queuedEmail) error
+	DeleteQueuedEmail(id string) error
+	GetQueuedEmails() ([]*queuedEmail, error)
 }
 
 type emailSession struct {
-	UserID          string                 `bson:"userID"    json:"userID"`
-	Email           string                 `bson:"email"     json:"email"`
-	Info            map[string]interface{} `bson:"info"      json:"info"`
-	EmailVerifyHash string                 `bson:"_id"       json:"emailVerifyHash"`
-	CSRFToken       string                 `bson:"csrfToken" json:"csrfToken"`
+	UserID          string                 `bson:"userID"        json:"userID"`
+	Email           string                 `bson:"email"         json:"email"`
+	Info            map[string]interface{} `bson:"info"          json:"info"`
+	EmailVerifyHash string                 `bson:"_id"           json:"emailVerifyHash"`
+	CSRFToken       string                 `bson:"csrfToken"     json:"csrfToken"`
+	Purpose         string                 `bson:"purpose"       json:"purpose"`
+	ExpireTimeUTC   time.Time              `bson:"expireTimeUTC" json:"expireTimeUTC"`
+}
+
+// isExpired returns true if the email session has an expiration time which has passed
+func (e *emailSession) isExpired() bool {
+	return !e.ExpireTimeUTC.IsZero() && e.ExpireTimeUTC.Before(time.Now().UTC())
 }
 
 type user struct {
@@ -98,14 +187,25 @@ type user struct {
 	Info              map[string]interface{}
 	LockoutEndTimeUTC *time.Time
 	AccessFailedCount int
+	Roles             []string
+	PhoneNumber       string
+	IsPhoneVerified   bool
 }
 
 // User is the struct which holds user information
 type User struct {
-	UserID          string                 `json:"userID"`
-	Email           string                 `json:"email"`
-	IsEmailVerified bool                   `json:"isEmailVerified"`
-	Info            map[string]interface{} `json:"info"`
+	UserID            string                 `json:"userID"`
+	Email             string                 `json:"email"`
+	IsEmailVerified   bool                   `json:"isEmailVerified"`
+	Info              map[string]interface{} `json:"info"`
+	LockoutEndTimeUTC *time.Time             `json:"lockoutEndTimeUTC,omitempty"`
+	PhoneNumber       string                 `json:"phoneNumber,omitempty"`
+	IsPhoneVerified   bool                   `json:"isPhoneVerified,omitempty"`
+}
+
+// IsLockedOut returns true if the user is currently locked out of their account
+func (u *User) IsLockedOut() bool {
+	return u != nil && u.LockoutEndTimeUTC != nil && u.LockoutEndTimeUTC.After(time.Now().UTC())
 }
 
 // LoginSession is the struct which holds session information
@@ -117,6 +217,9 @@ type LoginSession struct {
 	CSRFToken     string                 `bson:"csrfToken"     json:"csrfToken"`
 	RenewTimeUTC  time.Time              `bson:"renewTimeUTC"  json:"renewTimeUTC"`
 	ExpireTimeUTC time.Time              `bson:"expireTimeUTC" json:"expireTimeUTC"`
+
+	// Scopes limits what a session created from an API key may do. Empty means the session can do anything the user can
+	Scopes []string `bson:"scopes,omitempty" json:"scopes,omitempty"`
 }
 
 // GetInfo will return the named info as an interface{}
@@ -256,48 +359,102 @@ type rememberMeSession struct {
 	ExpireTimeUTC time.Time `bson:"expireTimeUTC" json:"expireTimeUTC"`
 }
 
-type loginProvider struct {
-	LoginProviderID   int
-	Name              string
-	OAuthClientID     string
-	OAuthClientSecret string
-	OAuthURL          string
+// refreshTokenSession uses the same selector/token design as rememberMeSession. Every token issued
+// from a single login shares a FamilyID so the whole chain can be revoked if a rotated token is reused
+type refreshTokenSession struct {
+	UserID        string    `bson:"userID"        json:"userID"`
+	Email         string    `bson:"email"         json:"email"`
+	ClientID      string    `bson:"clientID"      json:"clientID"`
+	Scope         string    `bson:"scope"         json:"scope"`
+	FamilyID      string    `bson:"familyID"      json:"familyID"`
+	Selector      string    `bson:"_id"           json:"selector"`
+	TokenHash     string    `bson:"tokenHash"     json:"tokenHash"`
+	IsRotated     bool      `bson:"isRotated"     json:"isRotated"`
+	ExpireTimeUTC time.Time `bson:"expireTimeUTC" json:"expireTimeUTC"`
 }
 
-// AuthError struct holds detailed auth error info
-type AuthError struct {
-	message    string
-	innerError error
-	shouldLog  bool
-	error
+// codeAttempts counts the guesses at the one-time codes for a key. They are kept apart from the code sessions so
+// sending a new code doesn't reset them
+type codeAttempts struct {
+	Key           string    `bson:"_id"           json:"key"`
+	Count         int       `bson:"count"         json:"count"`
+	ExpireTimeUTC time.Time `bson:"expireTimeUTC" json:"expireTimeUTC"`
 }
 
-func newLoggedError(message string, innerError error) *AuthError {
-	return &AuthError{message: message, innerError: innerError, shouldLog: true}
+type oauthClient struct {
+	ClientID       string    `bson:"_id"            json:"clientID"`
+	Name           string    `bson:"name"           json:"name"`
+	SecretHash     string    `bson:"secretHash"     json:"secretHash"` // empty for public clients
+	RedirectURIs   []string  `bson:"redirectURIs"   json:"redirectURIs"`
+	CreatedTimeUTC time.Time `bson:"createdTimeUTC" json:"createdTimeUTC"`
 }
 
-func newAuthError(message string, innerError error) *AuthError {
-	return &AuthError{message: message, innerError: innerError}
+// isPublic is true for clients such as single page and mobile apps which can't keep a secret
+func (c *oauthClient) isPublic() bool {
+	return c.SecretHash == ""
 }
 
-func (a *AuthError) Error() string {
-	return a.message
+type oauthConsent struct {
+	UserID   string `bson:"userID"   json:"userID"`
+	ClientID string `bson:"clientID" json:"clientID"`
+	Scope    string `bson:"scope"    json:"scope"`
 }
 
-func (a *AuthError) Trace() string {
-	trace := a.message + "\n"
-	indent := "  "
-	inner := a.innerError
-	for inner != nil {
-		trace += indent + inner.Error() + "\n"
-		e, ok := inner.(*AuthError)
-		if !ok {
-			break
-		}
-		indent += "  "
-		inner = e.innerError
-	}
-	return trace
+type authorizationCode struct {
+	CodeHash      string    `bson:"_id"           json:"codeHash"`
+	ClientID      string    `bson:"clientID"      json:"clientID"`
+	UserID        string    `bson:"userID"        json:"userID"`
+	Email         string    `bson:"email"         json:"email"`
+	RedirectURI   string    `bson:"redirectURI"   json:"redirectURI"`
+	Scope         string    `bson:"scope"         json:"scope"`
+	Nonce         string    `bson:"nonce"         json:"nonce"`
+	CodeChallenge string    `bson:"codeChallenge" json:"codeChallenge"`
+	ExpireTimeUTC time.Time `bson:"expireTimeUTC" json:"expireTimeUTC"`
+}
+
+// Role is a named set of permissions which can be assigned to users
+type Role struct {
+	Name        string   `bson:"_id"         json:"name"`
+	Permissions []string `bson:"permissions" json:"permissions"`
+}
+
+// apiKey is a personal access token as it is persisted. Only the hash of the secret part of the key is kept
+type apiKey struct {
+	KeyID           string    `bson:"_id"             json:"keyID"`
+	UserID          string    `bson:"userID"          json:"userID"`
+	Name            string    `bson:"name"            json:"name"`
+	Scopes          []string  `bson:"scopes"          json:"scopes"`
+	SecretHash      string    `bson:"secretHash"      json:"secretHash"`
+	CreatedTimeUTC  time.Time `bson:"createdTimeUTC"  json:"createdTimeUTC"`
+	ExpireTimeUTC   time.Time `bson:"expireTimeUTC"   json:"expireTimeUTC"`
+	LastUsedTimeUTC time.Time `bson:"lastUsedTimeUTC" json:"lastUsedTimeUTC"`
+}
+
+// signingKey is a token signing key as it is persisted. PrivateKey is PKCS #8 DER
+type signingKey struct {
+	KeyID          string    `bson:"_id"            json:"keyID"`
+	Algorithm      string    `bson:"algorithm"      json:"algorithm"`
+	PrivateKey     []byte    `bson:"privateKey"     json:"privateKey"`
+	CreatedTimeUTC time.Time `bson:"createdTimeUTC" json:"createdTimeUTC"`
+}
+
+// queuedEmail is a rendered email waiting in the outbox. IsDead is set once MaxAttempts deliveries have failed
+type queuedEmail struct {
+	ID                 string    `bson:"_id"                json:"id"`
+	Message            *Message  `bson:"message"            json:"message"`
+	Attempts           int       `bson:"attempts"           json:"attempts"`
+	LastError          string    `bson:"lastError"          json:"lastError"`
+	IsDead             bool      `bson:"isDead"             json:"isDead"`
+	NextAttemptTimeUTC time.Time `bson:"nextAttemptTimeUTC" json:"nextAttemptTimeUTC"`
+	CreatedTimeUTC     time.Time `bson:"createdTimeUTC"     json:"createdTimeUTC"`
+}
+
+type loginProvider struct {
+	LoginProviderID   int
+	Name              string
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthURL          string
 }
 
 type backend struct {
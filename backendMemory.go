@@ -3,7 +3,9 @@ package auth
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,10 +17,21 @@ type backendMemory struct {
 	Users          []*user
 	Sessions       []*LoginSession
 	RememberMes    []*rememberMeSession
+	RefreshTokens  []*refreshTokenSession
+	CodeAttempts   []*codeAttempts
+	SigningKeys    []*signingKey
+	OAuthClients   []*oauthClient
+	OAuthConsents  []*oauthConsent
+	AuthCodes      []*authorizationCode
+	APIKeys        []*apiKey
+	Roles          []*Role
+	Outbox         []*queuedEmail
 	LoginProviders []*loginProvider
 	LastUserID     int
 	LastLoginID    int
 	c              Crypter
+	outboxMu       sync.Mutex // outbox workers use the backend concurrently
+	attemptsMu     sync.Mutex // as do guesses at one-time codes
 }
 
 const loginProviderDefaultName string = "Default"
@@ -45,7 +58,7 @@ func (m *backendMemory) LoginAndGetUser(email, password string) (*User, error) {
 	if err := m.c.HashEquals(password, user.PasswordHash); err != nil {
 		return nil, err
 	}
-	return &User{user.UserID, user.PrimaryEmail, user.IsEmailVerified, user.Info}, nil
+	return &User{user.UserID, user.PrimaryEmail, user.IsEmailVerified, user.Info, user.LockoutEndTimeUTC, user.PhoneNumber, user.IsPhoneVerified}, nil
 }
 
 func (m *backendMemory) CreateSession(userID, email string, info map[string]interface{}, sessionHash, csrfToken string, sessionRenewTimeUTC, sessionExpireTimeUTC time.Time) (*LoginSession, error) {
@@ -54,7 +67,7 @@ func (m *backendMemory) CreateSession(userID, email string, info map[string]inte
 		return nil, errSessionAlreadyExists
 	}
 
-	session = &LoginSession{userID, email, info, sessionHash, csrfToken, sessionRenewTimeUTC, sessionExpireTimeUTC}
+	session = &LoginSession{userID, email, info, sessionHash, csrfToken, sessionRenewTimeUTC, sessionExpireTimeUTC, nil}
 	m.Sessions = append(m.Sessions, session)
 	return session, nil
 }
@@ -113,16 +126,29 @@ func (m *backendMemory) CreateEmailSession(userID, email string, info map[string
 		return errEmailVerifyHashExists
 	}
 
-	m.EmailSessions = append(m.EmailSessions, &emailSession{userID, email, info, emailVerifyHash, csrfToken})
+	m.EmailSessions = append(m.EmailSessions, &emailSession{userID, email, info, emailVerifyHash, csrfToken, "", time.Time{}})
 
 	return nil
 }
 
+func (m *backendMemory) CreateEmailSessionWithExpire(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken, purpose string, expireTimeUTC time.Time) error {
+	if m.getEmailSessionByEmailVerifyHash(emailVerifyHash) != nil {
+		return errEmailVerifyHashExists
+	}
+
+	m.EmailSessions = append(m.EmailSessions, &emailSession{userID, email, info, emailVerifyHash, csrfToken, purpose, expireTimeUTC})
+	return nil
+}
+
 func (m *backendMemory) GetEmailSession(emailVerifyHash string) (*emailSession, error) {
 	session := m.getEmailSessionByEmailVerifyHash(emailVerifyHash)
 	if session == nil {
 		return nil, errInvalidEmailVerifyHash
 	}
+	if session.isExpired() {
+		m.removeEmailSession(emailVerifyHash)
+		return nil, errEmailSessionExpired
+	}
 
 	return session, nil
 }
@@ -142,13 +168,29 @@ func (m *backendMemory) DeleteEmailSession(emailVerifyHash string) error {
 	return nil
 }
 
+func (m *backendMemory) IncrementCodeAttempts(key string, expireTimeUTC time.Time) (int, error) {
+	m.attemptsMu.Lock()
+	defer m.attemptsMu.Unlock()
+	for _, attempts := range m.CodeAttempts {
+		if attempts.Key == key {
+			if time.Since(attempts.ExpireTimeUTC) >= 0 {
+				attempts.Count, attempts.ExpireTimeUTC = 0, expireTimeUTC
+			}
+			attempts.Count++
+			return attempts.Count, nil
+		}
+	}
+	m.CodeAttempts = append(m.CodeAttempts, &codeAttempts{key, 1, expireTimeUTC})
+	return 1, nil
+}
+
 func (m *backendMemory) AddVerifiedUser(email string, info map[string]interface{}) (string, error) {
 	u := m.getUserByEmail(email)
 	if u != nil {
 		return "", errUserAlreadyExists
 	}
 	m.LastUserID++
-	m.Users = append(m.Users, &user{strconv.Itoa(m.LastUserID), email, "", true, info, nil, 0})
+	m.Users = append(m.Users, &user{strconv.Itoa(m.LastUserID), email, "", true, info, nil, 0, nil, "", false})
 	return strconv.Itoa(m.LastUserID), nil
 }
 
@@ -162,9 +204,9 @@ func (m *backendMemory) AddUserFull(email, password string, info map[string]inte
 		return nil, errUserAlreadyExists
 	}
 	m.LastUserID++
-	user := &user{strconv.Itoa(m.LastUserID), email, passwordHash, false, info, nil, 0}
+	user := &user{strconv.Itoa(m.LastUserID), email, passwordHash, false, info, nil, 0, nil, "", false}
 	m.Users = append(m.Users, user)
-	return &User{user.UserID, user.PrimaryEmail, user.IsEmailVerified, user.Info}, nil
+	return &User{user.UserID, user.PrimaryEmail, user.IsEmailVerified, user.Info, nil, "", false}, nil
 }
 
 func (m *backendMemory) GetUser(email string) (*User, error) {
@@ -172,7 +214,15 @@ func (m *backendMemory) GetUser(email string) (*User, error) {
 	if u == nil {
 		return nil, errUserNotFound
 	}
-	return &User{u.UserID, u.PrimaryEmail, u.IsEmailVerified, u.Info}, nil
+	return &User{u.UserID, u.PrimaryEmail, u.IsEmailVerified, u.Info, u.LockoutEndTimeUTC, u.PhoneNumber, u.IsPhoneVerified}, nil
+}
+
+func (m *backendMemory) GetUserByID(userID string) (*User, error) {
+	u := m.getUserByID(userID)
+	if u == nil {
+		return nil, errUserNotFound
+	}
+	return &User{u.UserID, u.PrimaryEmail, u.IsEmailVerified, u.Info, u.LockoutEndTimeUTC, u.PhoneNumber, u.IsPhoneVerified}, nil
 }
 
 func (m *backendMemory) UpdateUser(userID, password string, info map[string]interface{}) error {
@@ -226,6 +276,15 @@ func (m *backendMemory) UpdatePassword(userID, password string) error {
 	return nil
 }
 
+func (m *backendMemory) UpdateLockout(userID string, lockoutEndTimeUTC *time.Time) error {
+	user := m.getUserByID(userID)
+	if user == nil {
+		return errUserNotFound
+	}
+	user.LockoutEndTimeUTC = lockoutEndTimeUTC
+	return nil
+}
+
 func (m *backendMemory) VerifyEmail(email string) error {
 	user := m.getUserByEmail(email)
 	if user == nil {
@@ -236,11 +295,29 @@ func (m *backendMemory) VerifyEmail(email string) error {
 	return nil
 }
 
+func (m *backendMemory) VerifyPhoneNumber(userID, phoneNumber string) error {
+	user := m.getUserByID(userID)
+	if user == nil {
+		return errUserNotFound
+	}
+	user.PhoneNumber = phoneNumber
+	user.IsPhoneVerified = true
+	return nil
+}
+
 func (m *backendMemory) AddSecondaryEmail(userID, secondaryEmail string) error {
 	return nil
 }
 
 func (m *backendMemory) UpdatePrimaryEmail(userID, newPrimaryEmail string) error {
+	user := m.getUserByID(userID)
+	if user == nil {
+		return errUserNotFound
+	}
+	if u := m.getUserByEmail(newPrimaryEmail); u != nil && u != user {
+		return errUserAlreadyExists
+	}
+	user.PrimaryEmail = newPrimaryEmail
 	return nil
 }
 
@@ -258,7 +335,7 @@ func (m *backendMemory) DeleteSessions(email string) error {
 		session := m.Sessions[i]
 		if session.Email == email {
 			m.Sessions = append(m.Sessions[:i], m.Sessions[i+1:]...) // remove item
-			break
+			i--
 		}
 	}
 	return nil
@@ -269,7 +346,7 @@ func (m *backendMemory) DeleteRememberMes(email string) error {
 		rememberMe := m.RememberMes[i]
 		if rememberMe.Email == email {
 			m.RememberMes = append(m.RememberMes[:i], m.RememberMes[i+1:]...) // remove item
-			break
+			i--
 		}
 	}
 	return nil
@@ -280,6 +357,273 @@ func (m *backendMemory) DeleteRememberMe(selector string) error {
 	return nil
 }
 
+func (m *backendMemory) CreateRefreshToken(userID, email, clientID, scope, familyID, selector, tokenHash string, expireTimeUTC time.Time) (*refreshTokenSession, error) {
+	if m.getRefreshToken(selector) != nil {
+		return nil, errRefreshTokenSelectorExists
+	}
+	token := &refreshTokenSession{userID, email, clientID, scope, familyID, selector, tokenHash, false, expireTimeUTC}
+	m.RefreshTokens = append(m.RefreshTokens, token)
+	return token, nil
+}
+
+func (m *backendMemory) GetRefreshToken(selector string) (*refreshTokenSession, error) {
+	token := m.getRefreshToken(selector)
+	if token == nil {
+		return nil, errRefreshTokenNotFound
+	}
+	return token, nil
+}
+
+func (m *backendMemory) RotateRefreshToken(selector string) error {
+	token := m.getRefreshToken(selector)
+	if token == nil {
+		return errRefreshTokenNotFound
+	}
+	token.IsRotated = true
+	return nil
+}
+
+func (m *backendMemory) DeleteRefreshTokenFamily(familyID string) error {
+	var tokens []*refreshTokenSession
+	for _, token := range m.RefreshTokens {
+		if token.FamilyID != familyID {
+			tokens = append(tokens, token)
+		}
+	}
+	m.RefreshTokens = tokens
+	return nil
+}
+
+func (m *backendMemory) DeleteRefreshTokens(userID string) error {
+	var tokens []*refreshTokenSession
+	for _, token := range m.RefreshTokens {
+		if token.UserID != userID {
+			tokens = append(tokens, token)
+		}
+	}
+	m.RefreshTokens = tokens
+	return nil
+}
+
+func (m *backendMemory) CreateOAuthClient(client *oauthClient) error {
+	if _, err := m.GetOAuthClient(client.ClientID); err == nil {
+		return errOAuthClientExists
+	}
+	m.OAuthClients = append(m.OAuthClients, client)
+	return nil
+}
+
+func (m *backendMemory) GetOAuthClient(clientID string) (*oauthClient, error) {
+	for _, client := range m.OAuthClients {
+		if client.ClientID == clientID {
+			return client, nil
+		}
+	}
+	return nil, errOAuthClientNotFound
+}
+
+func (m *backendMemory) SaveOAuthConsent(userID, clientID, scope string) error {
+	if consent, err := m.GetOAuthConsent(userID, clientID); err == nil {
+		consent.Scope = scope
+		return nil
+	}
+	m.OAuthConsents = append(m.OAuthConsents, &oauthConsent{userID, clientID, scope})
+	return nil
+}
+
+func (m *backendMemory) GetOAuthConsent(userID, clientID string) (*oauthConsent, error) {
+	for _, consent := range m.OAuthConsents {
+		if consent.UserID == userID && consent.ClientID == clientID {
+			return consent, nil
+		}
+	}
+	return nil, errOAuthConsentNotFound
+}
+
+func (m *backendMemory) CreateAPIKey(key *apiKey) error {
+	if _, err := m.GetAPIKey(key.KeyID); err == nil {
+		return errAPIKeyExists
+	}
+	m.APIKeys = append(m.APIKeys, key)
+	return nil
+}
+
+func (m *backendMemory) GetAPIKey(keyID string) (*apiKey, error) {
+	for _, key := range m.APIKeys {
+		if key.KeyID == keyID {
+			return key, nil
+		}
+	}
+	return nil, errAPIKeyNotFound
+}
+
+func (m *backendMemory) GetAPIKeys(userID string) ([]*apiKey, error) {
+	var keys []*apiKey
+	for _, key := range m.APIKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *backendMemory) UpdateAPIKeyLastUsed(keyID string, lastUsedTimeUTC time.Time) error {
+	key, err := m.GetAPIKey(keyID)
+	if err != nil {
+		return err
+	}
+	key.LastUsedTimeUTC = lastUsedTimeUTC
+	return nil
+}
+
+func (m *backendMemory) DeleteAPIKey(userID, keyID string) error {
+	for i, key := range m.APIKeys {
+		if key.KeyID == keyID && key.UserID == userID {
+			m.APIKeys = append(m.APIKeys[:i], m.APIKeys[i+1:]...)
+			return nil
+		}
+	}
+	return errAPIKeyNotFound
+}
+
+func (m *backendMemory) GetUserRoles(userID string) ([]string, error) {
+	u := m.getUserByID(userID)
+	if u == nil {
+		return nil, errUserNotFound
+	}
+	return u.Roles, nil
+}
+
+func (m *backendMemory) UpdateUserRoles(userID string, roles []string) error {
+	u := m.getUserByID(userID)
+	if u == nil {
+		return errUserNotFound
+	}
+	u.Roles = roles
+	return nil
+}
+
+func (m *backendMemory) SaveRole(role *Role) error {
+	for i, existing := range m.Roles {
+		if existing.Name == role.Name {
+			m.Roles[i] = role
+			return nil
+		}
+	}
+	m.Roles = append(m.Roles, role)
+	return nil
+}
+
+func (m *backendMemory) GetRoles() ([]*Role, error) {
+	return append([]*Role(nil), m.Roles...), nil
+}
+
+func (m *backendMemory) DeleteRole(name string) error {
+	for i, role := range m.Roles {
+		if role.Name == name {
+			m.Roles = append(m.Roles[:i], m.Roles[i+1:]...)
+			return nil
+		}
+	}
+	return errRoleNotFound
+}
+
+func (m *backendMemory) CreateAuthorizationCode(code *authorizationCode) error {
+	m.AuthCodes = append(m.AuthCodes, code)
+	return nil
+}
+
+func (m *backendMemory) ConsumeAuthorizationCode(codeHash string) (*authorizationCode, error) {
+	for i, code := range m.AuthCodes {
+		if code.CodeHash == codeHash {
+			m.AuthCodes = append(m.AuthCodes[:i], m.AuthCodes[i+1:]...)
+			return code, nil
+		}
+	}
+	return nil, errAuthorizationCodeNotFound
+}
+
+func (m *backendMemory) QueueEmail(email *queuedEmail) error {
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	queued := *email
+	m.Outbox = append(m.Outbox, &queued)
+	return nil
+}
+
+func (m *backendMemory) ClaimEmail(nowUTC, leaseUntilUTC time.Time) (*queuedEmail, error) {
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	var due *queuedEmail
+	for _, email := range m.Outbox {
+		if !email.IsDead && !email.NextAttemptTimeUTC.After(nowUTC) && (due == nil || email.NextAttemptTimeUTC.Before(due.NextAttemptTimeUTC)) {
+			due = email
+		}
+	}
+	if due == nil {
+		return nil, errQueuedEmailNotFound
+	}
+	due.NextAttemptTimeUTC = leaseUntilUTC
+	claimed := *due
+	return &claimed, nil
+}
+
+func (m *backendMemory) UpdateQueuedEmail(email *queuedEmail) error {
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	for i, queued := range m.Outbox {
+		if queued.ID == email.ID {
+			updated := *email
+			m.Outbox[i] = &updated
+			return nil
+		}
+	}
+	return errQueuedEmailNotFound
+}
+
+func (m *backendMemory) DeleteQueuedEmail(id string) error {
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	for i, queued := range m.Outbox {
+		if queued.ID == id {
+			m.Outbox = append(m.Outbox[:i], m.Outbox[i+1:]...)
+			return nil
+		}
+	}
+	return errQueuedEmailNotFound
+}
+
+func (m *backendMemory) GetQueuedEmails() ([]*queuedEmail, error) {
+	m.outboxMu.Lock()
+	defer m.outboxMu.Unlock()
+	emails := make([]*queuedEmail, len(m.Outbox))
+	for i, queued := range m.Outbox {
+		email := *queued
+		emails[i] = &email
+	}
+	sort.Slice(emails, func(i, j int) bool { return emails[i].CreatedTimeUTC.Before(emails[j].CreatedTimeUTC) })
+	return emails, nil
+}
+
+func (m *backendMemory) AddSigningKey(key *signingKey) error {
+	m.SigningKeys = append(m.SigningKeys, key)
+	return nil
+}
+
+func (m *backendMemory) GetSigningKeys() ([]*signingKey, error) {
+	return append([]*signingKey(nil), m.SigningKeys...), nil
+}
+
+func (m *backendMemory) DeleteSigningKey(keyID string) error {
+	for i, key := range m.SigningKeys {
+		if key.KeyID == keyID {
+			m.SigningKeys = append(m.SigningKeys[:i], m.SigningKeys[i+1:]...)
+			return nil
+		}
+	}
+	return errSigningKeyNotFound
+}
+
 func (m *backendMemory) ToString() string {
 	var buf bytes.Buffer
 	buf.WriteString("Users:\n")
@@ -367,6 +711,15 @@ func (m *backendMemory) getSessionByHash(sessionHash string) *LoginSession {
 	return nil
 }
 
+func (m *backendMemory) getRefreshToken(selector string) *refreshTokenSession {
+	for _, token := range m.RefreshTokens {
+		if token.Selector == selector {
+			return token
+		}
+	}
+	return nil
+}
+
 func (m *backendMemory) getRememberMe(selector string) *rememberMeSession {
 	for _, rememberMe := range m.RememberMes {
 		if rememberMe.Selector == selector {
@@ -236,6 +236,36 @@ func TestMemoryDeleteRememberMe(t *testing.T) {
 	}
 }
 
+func TestMemoryIncrementCodeAttempts(t *testing.T) {
+	backend := NewBackendMemory(&hashStore{}).(*backendMemory)
+	backend.IncrementCodeAttempts("key", in5Minutes)
+	if count, err := backend.IncrementCodeAttempts("key", in1Hour); err != nil || count != 2 || backend.CodeAttempts[0].ExpireTimeUTC != in5Minutes {
+		t.Error("expected count to keep its expiry", count, err, backend.CodeAttempts[0])
+	}
+	backend.CodeAttempts[0].ExpireTimeUTC = time.Now().UTC().Add(-time.Minute)
+	if count, _ := backend.IncrementCodeAttempts("key", in1Hour); count != 1 || backend.CodeAttempts[0].ExpireTimeUTC != in1Hour {
+		t.Error("expected expired count to start again", count, backend.CodeAttempts[0])
+	}
+	if count, _ := backend.IncrementCodeAttempts("other", in1Hour); count != 1 {
+		t.Error("expected keys to be counted apart", count)
+	}
+}
+
+func TestMemorySigningKeys(t *testing.T) {
+	backend := NewBackendMemory(&hashStore{}).(*backendMemory)
+	backend.AddSigningKey(&signingKey{KeyID: "1"})
+	backend.AddSigningKey(&signingKey{KeyID: "2"})
+	if err := backend.DeleteSigningKey("1"); err != nil {
+		t.Fatal("expected to delete key", err)
+	}
+	if keys, _ := backend.GetSigningKeys(); len(keys) != 1 || keys[0].KeyID != "2" {
+		t.Error("expected one key to remain", keys)
+	}
+	if err := backend.DeleteSigningKey("1"); err != errSigningKeyNotFound {
+		t.Error("expected key not found", err)
+	}
+}
+
 func TestMemoryClose(t *testing.T) {
 	backend := NewBackendMemory(&hashStore{}).(*backendMemory)
 	backend.Close()
@@ -248,7 +278,7 @@ func TestToString(t *testing.T) {
 	backend.RememberMes = append(backend.RememberMes, &rememberMeSession{})
 
 	actual := backend.ToString()
-	expected := "Users:\n     {   false map[] <nil> 0}\nSessions:\n     {  map[]   0001-01-01 00:00:00 +0000 UTC 0001-01-01 00:00:00 +0000 UTC}\nRememberMe:\n     {    0001-01-01 00:00:00 +0000 UTC 0001-01-01 00:00:00 +0000 UTC}\n"
+	expected := "Users:\n     {   false map[] <nil> 0 []  false}\nSessions:\n     {  map[]   0001-01-01 00:00:00 +0000 UTC 0001-01-01 00:00:00 +0000 UTC []}\nRememberMe:\n     {    0001-01-01 00:00:00 +0000 UTC 0001-01-01 00:00:00 +0000 UTC}\n"
 	if actual != expected {
 		t.Error("expected different value", expected, "\n", actual)
 	}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/EndFirstCorp/onedb/mgo"
 	"github.com/pkg/errors"
+	mgo2 "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -23,6 +24,9 @@ type mongoUser struct {
 	Info              map[string]interface{} `bson:"info"              json:"info"`
 	LockoutEndTimeUTC *time.Time             `bson:"lockoutEndTimeUTC" json:"lockoutEndTimeUTC"`
 	AccessFailedCount int                    `bson:"accessFailedCount" json:"accessFailedCount"`
+	Roles             []string               `bson:"roles"             json:"roles"`
+	PhoneNumber       string                 `bson:"phoneNumber"       json:"phoneNumber"`
+	IsPhoneVerified   bool                   `bson:"isPhoneVerified"   json:"isPhoneVerified"`
 }
 
 type email struct {
@@ -61,7 +65,7 @@ func (b *backendMongo) AddUserFull(email, password string, info map[string]inter
 	}
 
 	id := bson.NewObjectId()
-	return &User{id.Hex(), strings.ToLower(email), false, info}, b.users().Insert(mongoUser{ID: id, PrimaryEmail: strings.ToLower(email), PasswordHash: passwordHash, Info: info})
+	return &User{id.Hex(), strings.ToLower(email), false, info, nil, "", false}, b.users().Insert(mongoUser{ID: id, PrimaryEmail: strings.ToLower(email), PasswordHash: passwordHash, Info: info})
 }
 
 func (b *backendMongo) getUser(email string) (*mongoUser, error) {
@@ -74,7 +78,18 @@ func (b *backendMongo) GetUser(email string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &User{u.ID.Hex(), u.PrimaryEmail, u.IsEmailVerified, u.Info}, nil
+	return &User{u.ID.Hex(), u.PrimaryEmail, u.IsEmailVerified, u.Info, u.LockoutEndTimeUTC, u.PhoneNumber, u.IsPhoneVerified}, nil
+}
+
+func (b *backendMongo) GetUserByID(userID string) (*User, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return nil, errUserNotFound
+	}
+	u := &mongoUser{}
+	if err := b.users().FindId(bson.ObjectIdHex(userID)).One(u); err != nil {
+		return nil, err
+	}
+	return &User{u.ID.Hex(), u.PrimaryEmail, u.IsEmailVerified, u.Info, u.LockoutEndTimeUTC, u.PhoneNumber, u.IsPhoneVerified}, nil
 }
 
 func (b *backendMongo) UpdateUser(userID, password string, info map[string]interface{}) error {
@@ -94,10 +109,21 @@ func (b *backendMongo) UpdatePassword(userID, password string) error {
 	return b.users().UpdateId(bson.ObjectIdHex(userID), bson.M{"$set": bson.M{"passwordHash": passwordHash}})
 }
 
+func (b *backendMongo) UpdateLockout(userID string, lockoutEndTimeUTC *time.Time) error {
+	return b.users().UpdateId(bson.ObjectIdHex(userID), bson.M{"$set": bson.M{"lockoutEndTimeUTC": lockoutEndTimeUTC}})
+}
+
 func (b *backendMongo) VerifyEmail(email string) error {
 	return b.users().Update(bson.M{"primaryEmail": email}, bson.M{"$set": bson.M{"isEmailVerified": true}})
 }
 
+func (b *backendMongo) VerifyPhoneNumber(userID, phoneNumber string) error {
+	if !bson.IsObjectIdHex(userID) {
+		return errUserNotFound
+	}
+	return b.users().UpdateId(bson.ObjectIdHex(userID), bson.M{"$set": bson.M{"phoneNumber": phoneNumber, "isPhoneVerified": true}})
+}
+
 func (b *backendMongo) UpdateInfo(userID string, info map[string]interface{}) error {
 	set := make(bson.M)
 	for k, v := range info {
@@ -125,7 +151,7 @@ func (b *backendMongo) LoginAndGetUser(email, password string) (*User, error) {
 	if err := b.c.HashEquals(password, u.PasswordHash); err != nil {
 		return nil, err
 	}
-	return &User{u.ID.Hex(), u.PrimaryEmail, u.IsEmailVerified, u.Info}, nil
+	return &User{u.ID.Hex(), u.PrimaryEmail, u.IsEmailVerified, u.Info, u.LockoutEndTimeUTC, u.PhoneNumber, u.IsPhoneVerified}, nil
 }
 
 func (b *backendMongo) Login(email, password string) error {
@@ -137,8 +163,12 @@ func (b *backendMongo) AddSecondaryEmail(userID, secondaryEmail string) error {
 	return nil
 }
 
-func (b *backendMongo) UpdatePrimaryEmail(userID, secondaryEmail string) error {
-	return nil
+func (b *backendMongo) UpdatePrimaryEmail(userID, newPrimaryEmail string) error {
+	u, err := b.getUser(newPrimaryEmail)
+	if err == nil && u.ID.Hex() != userID {
+		return errUserAlreadyExists
+	}
+	return b.users().UpdateId(bson.ObjectIdHex(userID), bson.M{"$set": bson.M{"primaryEmail": strings.ToLower(newPrimaryEmail)}})
 }
 
 func (b *backendMongo) CreateEmailSession(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken string) error {
@@ -147,12 +177,28 @@ func (b *backendMongo) CreateEmailSession(userID, email string, info map[string]
 	if c > 0 {
 		return errors.New("invalid emailVerifyHash")
 	}
-	return s.Insert(&emailSession{userID, strings.ToLower(email), info, emailVerifyHash, csrfToken})
+	return s.Insert(&emailSession{userID, strings.ToLower(email), info, emailVerifyHash, csrfToken, "", time.Time{}})
+}
+
+func (b *backendMongo) CreateEmailSessionWithExpire(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken, purpose string, expireTimeUTC time.Time) error {
+	s := b.emailSessions()
+	c, _ := s.FindId(emailVerifyHash).Count()
+	if c > 0 {
+		return errors.New("invalid emailVerifyHash")
+	}
+	return s.Insert(&emailSession{userID, strings.ToLower(email), info, emailVerifyHash, csrfToken, purpose, expireTimeUTC})
 }
 
 func (b *backendMongo) GetEmailSession(verifyHash string) (*emailSession, error) {
 	session := &emailSession{}
-	return session, b.emailSessions().FindId(verifyHash).One(session)
+	if err := b.emailSessions().FindId(verifyHash).One(session); err != nil {
+		return nil, err
+	}
+	if session.isExpired() {
+		b.emailSessions().RemoveId(verifyHash)
+		return nil, errEmailSessionExpired
+	}
+	return session, nil
 }
 
 func (b *backendMongo) UpdateEmailSession(verifyHash, userID string) error {
@@ -161,8 +207,14 @@ func (b *backendMongo) UpdateEmailSession(verifyHash, userID string) error {
 func (b *backendMongo) DeleteEmailSession(verifyHash string) error {
 	return b.emailSessions().RemoveId(verifyHash)
 }
+func (b *backendMongo) IncrementCodeAttempts(key string, expireTimeUTC time.Time) (int, error) {
+	b.codeAttempts().RemoveAll(bson.M{"_id": key, "expireTimeUTC": bson.M{"$lte": time.Now().UTC()}})
+	attempts := &codeAttempts{}
+	_, err := b.codeAttempts().FindId(key).Apply(mgo2.Change{Update: bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"expireTimeUTC": expireTimeUTC}}, Upsert: true, ReturnNew: true}, attempts)
+	return attempts.Count, err
+}
 func (b *backendMongo) CreateSession(userID, email string, info map[string]interface{}, sessionHash, csrfToken string, renewTimeUTC, expireTimeUTC time.Time) (*LoginSession, error) {
-	s := LoginSession{userID, strings.ToLower(email), info, sessionHash, csrfToken, renewTimeUTC, expireTimeUTC}
+	s := LoginSession{userID, strings.ToLower(email), info, sessionHash, csrfToken, renewTimeUTC, expireTimeUTC, nil}
 	return &s, b.loginSessions().Insert(s)
 }
 
@@ -205,9 +257,137 @@ func (b *backendMongo) DeleteRememberMes(e string) error {
 	return err
 }
 
+func (b *backendMongo) CreateRefreshToken(userID, email, clientID, scope, familyID, selector, tokenHash string, expireTimeUTC time.Time) (*refreshTokenSession, error) {
+	t := refreshTokenSession{userID, strings.ToLower(email), clientID, scope, familyID, selector, tokenHash, false, expireTimeUTC}
+	return &t, b.refreshTokens().Insert(&t)
+}
+func (b *backendMongo) GetRefreshToken(selector string) (*refreshTokenSession, error) {
+	token := &refreshTokenSession{}
+	return token, b.refreshTokens().FindId(selector).One(token)
+}
+func (b *backendMongo) RotateRefreshToken(selector string) error {
+	return b.refreshTokens().UpdateId(selector, bson.M{"$set": bson.M{"isRotated": true}})
+}
+func (b *backendMongo) DeleteRefreshTokenFamily(familyID string) error {
+	_, err := b.refreshTokens().RemoveAll(bson.M{"familyID": familyID})
+	return err
+}
+func (b *backendMongo) DeleteRefreshTokens(userID string) error {
+	_, err := b.refreshTokens().RemoveAll(bson.M{"userID": userID})
+	return err
+}
+
+func (b *backendMongo) CreateOAuthClient(client *oauthClient) error {
+	return b.oauthClients().Insert(client)
+}
+func (b *backendMongo) GetOAuthClient(clientID string) (*oauthClient, error) {
+	client := &oauthClient{}
+	return client, b.oauthClients().FindId(clientID).One(client)
+}
+func (b *backendMongo) SaveOAuthConsent(userID, clientID, scope string) error {
+	_, err := b.oauthConsents().UpsertId(userID+":"+clientID, &oauthConsent{userID, clientID, scope})
+	return err
+}
+func (b *backendMongo) GetOAuthConsent(userID, clientID string) (*oauthConsent, error) {
+	consent := &oauthConsent{}
+	return consent, b.oauthConsents().FindId(userID + ":" + clientID).One(consent)
+}
+
+func (b *backendMongo) CreateAPIKey(key *apiKey) error {
+	return b.apiKeys().Insert(key)
+}
+func (b *backendMongo) GetAPIKey(keyID string) (*apiKey, error) {
+	key := &apiKey{}
+	return key, b.apiKeys().FindId(keyID).One(key)
+}
+func (b *backendMongo) GetAPIKeys(userID string) ([]*apiKey, error) {
+	var keys []*apiKey
+	return keys, b.apiKeys().Find(bson.M{"userID": userID}).All(&keys)
+}
+func (b *backendMongo) UpdateAPIKeyLastUsed(keyID string, lastUsedTimeUTC time.Time) error {
+	return b.apiKeys().UpdateId(keyID, bson.M{"$set": bson.M{"lastUsedTimeUTC": lastUsedTimeUTC}})
+}
+func (b *backendMongo) DeleteAPIKey(userID, keyID string) error {
+	return b.apiKeys().Remove(bson.M{"_id": keyID, "userID": userID})
+}
+
+func (b *backendMongo) GetUserRoles(userID string) ([]string, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return nil, errUserNotFound
+	}
+	u := &mongoUser{}
+	if err := b.users().FindId(bson.ObjectIdHex(userID)).Select(bson.M{"roles": 1}).One(u); err != nil {
+		return nil, err
+	}
+	return u.Roles, nil
+}
+func (b *backendMongo) UpdateUserRoles(userID string, roles []string) error {
+	if !bson.IsObjectIdHex(userID) {
+		return errUserNotFound
+	}
+	return b.users().UpdateId(bson.ObjectIdHex(userID), bson.M{"$set": bson.M{"roles": roles}})
+}
+func (b *backendMongo) SaveRole(role *Role) error {
+	_, err := b.roles().UpsertId(role.Name, role)
+	return err
+}
+func (b *backendMongo) GetRoles() ([]*Role, error) {
+	var roles []*Role
+	return roles, b.roles().Find(nil).All(&roles)
+}
+func (b *backendMongo) DeleteRole(name string) error {
+	return b.roles().RemoveId(name)
+}
+
+func (b *backendMongo) CreateAuthorizationCode(code *authorizationCode) error {
+	return b.authorizationCodes().Insert(code)
+}
+func (b *backendMongo) ConsumeAuthorizationCode(codeHash string) (*authorizationCode, error) {
+	code := &authorizationCode{}
+	_, err := b.authorizationCodes().FindId(codeHash).Apply(mgo2.Change{Remove: true}, code)
+	return code, err
+}
+
+func (b *backendMongo) QueueEmail(email *queuedEmail) error {
+	return b.outbox().Insert(email)
+}
+func (b *backendMongo) ClaimEmail(nowUTC, leaseUntilUTC time.Time) (*queuedEmail, error) {
+	email := &queuedEmail{}
+	_, err := b.outbox().Find(bson.M{"isDead": false, "nextAttemptTimeUTC": bson.M{"$lte": nowUTC}}).Sort("nextAttemptTimeUTC").
+		Apply(mgo2.Change{Update: bson.M{"$set": bson.M{"nextAttemptTimeUTC": leaseUntilUTC}}, ReturnNew: true}, email)
+	if err == mgo2.ErrNotFound {
+		return nil, errQueuedEmailNotFound
+	}
+	return email, err
+}
+func (b *backendMongo) UpdateQueuedEmail(email *queuedEmail) error {
+	return b.outbox().UpdateId(email.ID, email)
+}
+func (b *backendMongo) DeleteQueuedEmail(id string) error {
+	return b.outbox().RemoveId(id)
+}
+func (b *backendMongo) GetQueuedEmails() ([]*queuedEmail, error) {
+	var emails []*queuedEmail
+	return emails, b.outbox().Find(nil).Sort("createdTimeUTC").All(&emails)
+}
+
+func (b *backendMongo) AddSigningKey(key *signingKey) error {
+	return b.signingKeys().Insert(key)
+}
+func (b *backendMongo) GetSigningKeys() ([]*signingKey, error) {
+	var keys []*signingKey
+	return keys, b.signingKeys().Find(nil).All(&keys)
+}
+func (b *backendMongo) DeleteSigningKey(keyID string) error {
+	return b.signingKeys().RemoveId(keyID)
+}
+
 func (b *backendMongo) users() mgo.Collectioner {
 	return b.m.DB("users").C("users")
 }
+func (b *backendMongo) codeAttempts() mgo.Collectioner {
+	return b.m.DB("users").C("codeAttempts")
+}
 func (b *backendMongo) emailSessions() mgo.Collectioner {
 	return b.m.DB("users").C("emailSessions")
 }
@@ -217,3 +397,27 @@ func (b *backendMongo) loginSessions() mgo.Collectioner {
 func (b *backendMongo) rememberMeSessions() mgo.Collectioner {
 	return b.m.DB("users").C("rememberMeSessions")
 }
+func (b *backendMongo) refreshTokens() mgo.Collectioner {
+	return b.m.DB("users").C("refreshTokens")
+}
+func (b *backendMongo) oauthClients() mgo.Collectioner {
+	return b.m.DB("users").C("oauthClients")
+}
+func (b *backendMongo) oauthConsents() mgo.Collectioner {
+	return b.m.DB("users").C("oauthConsents")
+}
+func (b *backendMongo) apiKeys() mgo.Collectioner {
+	return b.m.DB("users").C("apiKeys")
+}
+func (b *backendMongo) roles() mgo.Collectioner {
+	return b.m.DB("users").C("roles")
+}
+func (b *backendMongo) authorizationCodes() mgo.Collectioner {
+	return b.m.DB("users").C("authorizationCodes")
+}
+func (b *backendMongo) outbox() mgo.Collectioner {
+	return b.m.DB("users").C("outbox")
+}
+func (b *backendMongo) signingKeys() mgo.Collectioner {
+	return b.m.DB("users").C("signingKeys")
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/EndFirstCorp/onedb/redis"
+	redigo "github.com/garyburd/redigo/redis"
 	"github.com/pkg/errors"
 )
 
@@ -13,6 +14,18 @@ type backendRedisSession struct {
 	prefix string
 }
 
+type refreshTokenFamily struct {
+	Selectors []string `json:"selectors"`
+}
+
+type refreshTokenFamilyList struct {
+	FamilyIDs []string `json:"familyIDs"`
+}
+
+type signingKeyList struct {
+	Keys []*signingKey `json:"keys"`
+}
+
 // NewBackendRedisSession returns a SessionBackender for Redis
 func NewBackendRedisSession(server string, port int, password string, maxIdle, maxConnections int, keyPrefix string) SessionBackender {
 	r := redis.New(server, port, password, maxIdle, maxConnections)
@@ -21,12 +34,22 @@ func NewBackendRedisSession(server string, port int, password string, maxIdle, m
 
 // need to first check that this emailVerifyHash isn't being used, otherwise we'll clobber existing
 func (r *backendRedisSession) CreateEmailSession(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken string) error {
-	return r.saveEmailSession(&emailSession{userID, email, info, emailVerifyHash, csrfToken})
+	return r.saveEmailSession(&emailSession{userID, email, info, emailVerifyHash, csrfToken, "", time.Time{}})
+}
+
+func (r *backendRedisSession) CreateEmailSessionWithExpire(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken, purpose string, expireTimeUTC time.Time) error {
+	return r.saveEmailSession(&emailSession{userID, email, info, emailVerifyHash, csrfToken, purpose, expireTimeUTC})
 }
 
 func (r *backendRedisSession) GetEmailSession(emailVerifyHash string) (*emailSession, error) {
 	session := &emailSession{}
-	return session, r.db.GetStruct(r.getEmailSessionKey(emailVerifyHash), session)
+	if err := r.db.GetStruct(r.getEmailSessionKey(emailVerifyHash), session); err != nil {
+		return nil, err
+	}
+	if session.isExpired() {
+		return nil, errEmailSessionExpired
+	}
+	return session, nil
 }
 
 func (r *backendRedisSession) UpdateEmailSession(emailVerifyHash, userID string) error {
@@ -39,11 +62,20 @@ func (r *backendRedisSession) UpdateEmailSession(emailVerifyHash, userID string)
 }
 
 func (r *backendRedisSession) DeleteEmailSession(emailVerifyHash string) error {
-	return nil
+	return r.db.Del(r.getEmailSessionKey(emailVerifyHash))
+}
+
+// incrementCodeAttemptsScript counts a guess, setting the expiry when the count starts
+const incrementCodeAttemptsScript string = `local count = redis.call("INCR", KEYS[1])
+if count == 1 then redis.call("EXPIREAT", KEYS[1], ARGV[1]) end
+return count`
+
+func (r *backendRedisSession) IncrementCodeAttempts(key string, expireTimeUTC time.Time) (int, error) {
+	return redigo.Int(r.db.Do("EVAL", incrementCodeAttemptsScript, 1, r.getCodeAttemptsKey(key), expireTimeUTC.Unix()))
 }
 
 func (r *backendRedisSession) CreateSession(userID, email string, info map[string]interface{}, sessionHash, csrfToken string, renewTimeUTC, expireTimeUTC time.Time) (*LoginSession, error) {
-	session := LoginSession{userID, email, info, sessionHash, csrfToken, renewTimeUTC, expireTimeUTC}
+	session := LoginSession{userID, email, info, sessionHash, csrfToken, renewTimeUTC, expireTimeUTC, nil}
 	return &session, r.saveSession(&session)
 }
 
@@ -101,12 +133,217 @@ func (r *backendRedisSession) DeleteRememberMes(email string) error {
 	return nil
 }
 
+func (r *backendRedisSession) CreateRefreshToken(userID, email, clientID, scope, familyID, selector, tokenHash string, expireTimeUTC time.Time) (*refreshTokenSession, error) {
+	token := refreshTokenSession{userID, email, clientID, scope, familyID, selector, tokenHash, false, expireTimeUTC}
+	if err := r.saveRefreshToken(&token); err != nil {
+		return nil, err
+	}
+
+	// redis can't query by family, so keep a list of the selectors issued to each family
+	family := &refreshTokenFamily{}
+	r.db.GetStruct(r.getRefreshTokenFamilyKey(familyID), family)
+	if len(family.Selectors) == 0 { // a new family, so add it to the list of the user's families
+		families := &refreshTokenFamilyList{}
+		r.db.GetStruct(r.getUserRefreshTokensKey(userID), families)
+		families.FamilyIDs = append(families.FamilyIDs, familyID)
+		if err := r.save(r.getUserRefreshTokensKey(userID), families, round(rememberMeExpireDuration.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	family.Selectors = append(family.Selectors, selector)
+	return &token, r.save(r.getRefreshTokenFamilyKey(familyID), family, round(rememberMeExpireDuration.Seconds()))
+}
+
+func (r *backendRedisSession) GetRefreshToken(selector string) (*refreshTokenSession, error) {
+	token := &refreshTokenSession{}
+	return token, r.db.GetStruct(r.getRefreshTokenKey(selector), token)
+}
+
+func (r *backendRedisSession) RotateRefreshToken(selector string) error {
+	token, err := r.GetRefreshToken(selector)
+	if err != nil {
+		return err
+	}
+	token.IsRotated = true
+	return r.saveRefreshToken(token)
+}
+
+func (r *backendRedisSession) DeleteRefreshTokenFamily(familyID string) error {
+	family := &refreshTokenFamily{}
+	if err := r.db.GetStruct(r.getRefreshTokenFamilyKey(familyID), family); err != nil {
+		return err
+	}
+	for _, selector := range family.Selectors {
+		if err := r.db.Del(r.getRefreshTokenKey(selector)); err != nil {
+			return err
+		}
+	}
+	return r.db.Del(r.getRefreshTokenFamilyKey(familyID))
+}
+
+func (r *backendRedisSession) DeleteRefreshTokens(userID string) error {
+	families := &refreshTokenFamilyList{}
+	if err := r.db.GetStruct(r.getUserRefreshTokensKey(userID), families); err != nil {
+		if err == redigo.ErrNil {
+			return nil
+		}
+		return err
+	}
+	for _, familyID := range families.FamilyIDs {
+		if err := r.DeleteRefreshTokenFamily(familyID); err != nil && err != redigo.ErrNil { // expired families are gone
+			return err
+		}
+	}
+	return r.db.Del(r.getUserRefreshTokensKey(userID))
+}
+
+func (r *backendRedisSession) CreateAuthorizationCode(code *authorizationCode) error {
+	if time.Since(code.ExpireTimeUTC).Seconds() >= 0 {
+		return errors.New("Unable to save expired authorization code")
+	}
+	return r.save(r.getAuthorizationCodeKey(code.CodeHash), code, round(time.Until(code.ExpireTimeUTC).Seconds()))
+}
+
+func (r *backendRedisSession) ConsumeAuthorizationCode(codeHash string) (*authorizationCode, error) {
+	code := &authorizationCode{}
+	if err := r.db.GetStruct(r.getAuthorizationCodeKey(codeHash), code); err != nil {
+		return nil, err
+	}
+	// only the caller whose DEL removes the key gets the code
+	deleted, err := redigo.Int(r.db.Do("DEL", r.getAuthorizationCodeKey(codeHash)))
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		return nil, errAuthorizationCodeNotFound
+	}
+	return code, nil
+}
+
+// signing keys are few and read together, so they are kept in a single record
+func (r *backendRedisSession) AddSigningKey(key *signingKey) error {
+	keys := &signingKeyList{}
+	r.db.GetStruct(r.getSigningKeysKey(), keys)
+	keys.Keys = append(keys.Keys, key)
+	return r.save(r.getSigningKeysKey(), keys, round(signingKeyStoreDuration.Seconds()))
+}
+
+func (r *backendRedisSession) GetSigningKeys() ([]*signingKey, error) {
+	keys := &signingKeyList{}
+	if err := r.db.GetStruct(r.getSigningKeysKey(), keys); err != nil && err != redigo.ErrNil {
+		return nil, err
+	}
+	return keys.Keys, nil
+}
+
+func (r *backendRedisSession) DeleteSigningKey(keyID string) error {
+	keys := &signingKeyList{}
+	if err := r.db.GetStruct(r.getSigningKeysKey(), keys); err != nil {
+		return err
+	}
+	for i, key := range keys.Keys {
+		if key.KeyID == keyID {
+			keys.Keys = append(keys.Keys[:i], keys.Keys[i+1:]...)
+			return r.save(r.getSigningKeysKey(), keys, round(signingKeyStoreDuration.Seconds()))
+		}
+	}
+	return errSigningKeyNotFound
+}
+
+// queued emails are kept in a sorted set scored by their next attempt time, and dead letters in a plain set
+func (r *backendRedisSession) QueueEmail(email *queuedEmail) error {
+	if err := r.save(r.getQueuedEmailKey(email.ID), email, round(outboxStoreDuration.Seconds())); err != nil {
+		return err
+	}
+	_, err := r.db.Do("ZADD", r.getOutboxKey(), email.NextAttemptTimeUTC.Unix(), email.ID)
+	return err
+}
+
+// claimEmailScript moves the email due the longest to the end of its lease in one step, so only one worker gets it
+const claimEmailScript string = `local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 1)
+if #ids == 0 then return false end
+redis.call("ZADD", KEYS[1], ARGV[2], ids[1])
+return ids[1]`
+
+func (r *backendRedisSession) ClaimEmail(nowUTC, leaseUntilUTC time.Time) (*queuedEmail, error) {
+	id, err := redigo.String(r.db.Do("EVAL", claimEmailScript, 1, r.getOutboxKey(), nowUTC.Unix(), leaseUntilUTC.Unix()))
+	if err == redigo.ErrNil {
+		return nil, errQueuedEmailNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	email := &queuedEmail{}
+	if err := r.db.GetStruct(r.getQueuedEmailKey(id), email); err != nil {
+		r.db.Do("ZREM", r.getOutboxKey(), id) // the email expired
+		return nil, err
+	}
+	email.NextAttemptTimeUTC = leaseUntilUTC
+	return email, nil
+}
+
+func (r *backendRedisSession) UpdateQueuedEmail(email *queuedEmail) error {
+	if err := r.save(r.getQueuedEmailKey(email.ID), email, round(outboxStoreDuration.Seconds())); err != nil {
+		return err
+	}
+	if email.IsDead {
+		if _, err := r.db.Do("ZREM", r.getOutboxKey(), email.ID); err != nil {
+			return err
+		}
+		_, err := r.db.Do("SADD", r.getOutboxDeadKey(), email.ID)
+		return err
+	}
+	if _, err := r.db.Do("SREM", r.getOutboxDeadKey(), email.ID); err != nil {
+		return err
+	}
+	_, err := r.db.Do("ZADD", r.getOutboxKey(), email.NextAttemptTimeUTC.Unix(), email.ID)
+	return err
+}
+
+func (r *backendRedisSession) DeleteQueuedEmail(id string) error {
+	if _, err := r.db.Do("ZREM", r.getOutboxKey(), id); err != nil {
+		return err
+	}
+	if _, err := r.db.Do("SREM", r.getOutboxDeadKey(), id); err != nil {
+		return err
+	}
+	return r.db.Del(r.getQueuedEmailKey(id))
+}
+
+func (r *backendRedisSession) GetQueuedEmails() ([]*queuedEmail, error) {
+	pending, err := redigo.Strings(r.db.Do("ZRANGE", r.getOutboxKey(), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	dead, err := redigo.Strings(r.db.Do("SMEMBERS", r.getOutboxDeadKey()))
+	if err != nil {
+		return nil, err
+	}
+	var emails []*queuedEmail
+	for _, id := range append(pending, dead...) {
+		email := &queuedEmail{}
+		if err := r.db.GetStruct(r.getQueuedEmailKey(id), email); err == redigo.ErrNil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
 func (r *backendRedisSession) Close() error {
 	return r.db.Close()
 }
 
 func (r *backendRedisSession) saveEmailSession(session *emailSession) error {
-	return r.save(r.getEmailSessionKey(session.EmailVerifyHash), session, emailExpireMins*60)
+	expireSeconds := emailExpireMins * 60
+	if !session.ExpireTimeUTC.IsZero() {
+		if time.Since(session.ExpireTimeUTC).Seconds() >= 0 {
+			return errors.New("Unable to save expired email session")
+		}
+		expireSeconds = round(time.Until(session.ExpireTimeUTC).Seconds())
+	}
+	return r.save(r.getEmailSessionKey(session.EmailVerifyHash), session, expireSeconds)
 }
 
 func (r *backendRedisSession) saveSession(session *LoginSession) error {
@@ -123,10 +360,21 @@ func (r *backendRedisSession) saveRememberMe(rememberMe *rememberMeSession) erro
 	return r.save(r.getRememberMeKey(rememberMe.Selector), rememberMe, round(rememberMeExpireDuration.Seconds()))
 }
 
+func (r *backendRedisSession) saveRefreshToken(token *refreshTokenSession) error {
+	if time.Since(token.ExpireTimeUTC).Seconds() >= 0 {
+		return errors.New("Unable to save expired refresh token")
+	}
+	return r.save(r.getRefreshTokenKey(token.Selector), token, round(rememberMeExpireDuration.Seconds()))
+}
+
 func (r *backendRedisSession) getEmailSessionKey(emailVerifyHash string) string {
 	return r.prefix + "/email/" + emailVerifyHash
 }
 
+func (r *backendRedisSession) getCodeAttemptsKey(key string) string {
+	return r.prefix + "/codeAttempts/" + key
+}
+
 func (r *backendRedisSession) getSessionKey(sessionHash string) string {
 	return r.prefix + "/session/" + sessionHash
 }
@@ -135,6 +383,38 @@ func (r *backendRedisSession) getRememberMeKey(selector string) string {
 	return r.prefix + "/rememberMe/" + selector
 }
 
+func (r *backendRedisSession) getRefreshTokenKey(selector string) string {
+	return r.prefix + "/refreshToken/" + selector
+}
+
+func (r *backendRedisSession) getRefreshTokenFamilyKey(familyID string) string {
+	return r.prefix + "/refreshTokenFamily/" + familyID
+}
+
+func (r *backendRedisSession) getUserRefreshTokensKey(userID string) string {
+	return r.prefix + "/userRefreshTokens/" + userID
+}
+
+func (r *backendRedisSession) getAuthorizationCodeKey(codeHash string) string {
+	return r.prefix + "/authorizationCode/" + codeHash
+}
+
+func (r *backendRedisSession) getOutboxKey() string {
+	return r.prefix + "/outbox"
+}
+
+func (r *backendRedisSession) getOutboxDeadKey() string {
+	return r.prefix + "/outboxDead"
+}
+
+func (r *backendRedisSession) getQueuedEmailKey(id string) string {
+	return r.prefix + "/outbox/" + id
+}
+
+func (r *backendRedisSession) getSigningKeysKey() string {
+	return r.prefix + "/signingKeys"
+}
+
 func round(num float64) int {
 	return int(math.Floor(0.5 + num))
 }
@@ -131,3 +131,29 @@ func TestRedisDeleteRememberMe(t *testing.T) {
 		t.Error("expected success")
 	}
 }
+
+func TestRedisIncrementCodeAttempts(t *testing.T) {
+	m := redis.NewMock(nil, nil, nil, nil)
+	r := backendRedisSession{db: m, prefix: "test"}
+	r.IncrementCodeAttempts("key", time.Unix(100, 0))
+	m.VerifyNextCommand(t, "Do", "EVAL", incrementCodeAttemptsScript, 1, "test/codeAttempts/key", int64(100))
+}
+
+func TestRedisQueueEmail(t *testing.T) {
+	m := redis.NewMock(nil, nil, nil, nil)
+	r := backendRedisSession{db: m, prefix: "test"}
+	email := &queuedEmail{ID: "id", Message: &Message{To: "test@test.com"}, NextAttemptTimeUTC: time.Unix(100, 0)}
+	if err := r.QueueEmail(email); err != nil {
+		t.Error("expected success", err)
+	}
+	m.VerifyNextCommand(t, "SetWithExpire", email, 2592000)
+	m.VerifyNextCommand(t, "Do", "ZADD", "test/outbox", int64(100), "id")
+
+	email.IsDead = true
+	if err := r.UpdateQueuedEmail(email); err != nil {
+		t.Error("expected success", err)
+	}
+	m.VerifyNextCommand(t, "SetWithExpire", email, 2592000)
+	m.VerifyNextCommand(t, "Do", "ZREM", "test/outbox", "id")
+	m.VerifyNextCommand(t, "Do", "SADD", "test/outboxDead", "id")
+}
@@ -114,18 +114,6 @@ func TestGetInfoInts(t *testing.T) {
 	}
 }
 
-func TestAuthError(t *testing.T) {
-	e3 := newAuthError("error 3", errors.New("other"))
-	e2 := newAuthError("error 2", e3)
-	e1 := newAuthError("error 1", e2)
-	if e1.message != "error 1" || e2.message != "error 2" || e1.Error() != e1.message || e2.Error() != e2.message ||
-		e1.Trace() != "error 1\n  error 2\n    error 3\n      other\n" ||
-		e2.Trace() != "error 2\n  error 3\n    other\n" ||
-		e3.Trace() != "error 3\n  other\n" {
-		t.Error("expected valid error structs", e1, e2, e3, e1.Trace(), e2.Trace(), e3.Trace())
-	}
-}
-
 func TestBackendLogin(t *testing.T) {
 	m := &mockBackend{}
 	b := NewBackend(m, m)
@@ -328,6 +316,7 @@ type mockBackend struct {
 	UpdateUserErr         error
 	UpdatePasswordErr     error
 	UpdateInfoErr         error
+	UpdateLockoutErr      error
 	GetRememberMeVal      *rememberMeSession
 	GetRememberMeErr      error
 	UpdateRememberMeErr   error
@@ -392,6 +381,11 @@ func (b *mockBackend) CreateEmailSession(userID, email string, info map[string]i
 	return b.ErrReturn
 }
 
+func (b *mockBackend) CreateEmailSessionWithExpire(userID, email string, info map[string]interface{}, emailVerifyHash, csrfToken, purpose string, expireTimeUTC time.Time) error {
+	b.MethodsCalled = append(b.MethodsCalled, "CreateEmailSessionWithExpire")
+	return b.ErrReturn
+}
+
 func (b *mockBackend) GetEmailSession(emailVerifyHash string) (*emailSession, error) {
 	b.MethodsCalled = append(b.MethodsCalled, "GetEmailSession")
 	return b.GetEmailSessionVal, b.GetEmailSessionErr
@@ -422,6 +416,11 @@ func (b *mockBackend) UpdatePassword(userID, password string) error {
 	return b.UpdatePasswordErr
 }
 
+func (b *mockBackend) UpdateLockout(userID string, lockoutEndTimeUTC *time.Time) error {
+	b.MethodsCalled = append(b.MethodsCalled, "UpdateLockout")
+	return b.UpdateLockoutErr
+}
+
 func (b *mockBackend) UpdateInfo(userID string, info map[string]interface{}) error {
 	b.MethodsCalled = append(b.MethodsCalled, "UpdateInfo")
 	return b.UpdateInfoErr
@@ -466,7 +465,7 @@ func userSuccess() *User {
 }
 
 func sessionSuccess(renewTimeUTC, expireTimeUTC time.Time) *LoginSession {
-	return &LoginSession{"1", "test@test.com", map[string]interface{}{"info": "values"}, "sessionHash", "csrfToken", renewTimeUTC, expireTimeUTC}
+	return &LoginSession{"1", "test@test.com", map[string]interface{}{"info": "values"}, "sessionHash", "csrfToken", renewTimeUTC, expireTimeUTC, nil}
 }
 
 func rememberMe(renewTimeUTC, expireTimeUTC time.Time) *rememberMeSession { // hash of the word "token"
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// defaultInboxSize is how many messages an Inbox keeps before dropping the oldest
+const defaultInboxSize int = 100
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]+`)
+
+// FileSender writes each email to an .eml file in Dir instead of sending it, for development without a mail
+// server. The files open in any mail client
+type FileSender struct {
+	Dir                  string
+	FromEmail            string
+	EmailFromDisplayName string
+}
+
+// Inbox keeps the emails it is given in memory instead of sending them, so tests and local development can read
+// them and follow their links. It is safe for concurrent use
+type Inbox struct {
+	// Size is how many messages are kept. The oldest are dropped first
+	Size     int
+	mu       sync.Mutex
+	messages []*InboxMessage
+}
+
+// InboxMessage is an email received by an Inbox
+type InboxMessage struct {
+	ID string `json:"id"`
+	*Message
+	SentTimeUTC time.Time `json:"sentTimeUTC"`
+}
+
+// NewInbox creates an Inbox which keeps the last 100 messages
+func NewInbox() *Inbox {
+	return &Inbox{Size: defaultInboxSize}
+}
+
+// Send writes the email with a plain text part generated from body
+func (s *FileSender) Send(to, subject, body string) error {
+	return s.SendMultipart(&Message{To: to, Subject: subject, HTMLBody: body, TextBody: htmlToText(body)})
+}
+
+// SendMultipart writes the email to a file named for the time and recipient, so they sort in the order sent
+func (s *FileSender) SendMultipart(m *Message) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102-150405.000000000") + "-" + unsafeFileChars.ReplaceAllString(m.To, "_") + ".eml"
+	tmp, err := ioutil.TempFile(s.Dir, ".eml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := mimeMessage(s.FromEmail, s.EmailFromDisplayName, m).WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name)) // so readers never see a partial file
+}
+
+// Send keeps the email with a plain text part generated from body
+func (i *Inbox) Send(to, subject, body string) error {
+	return i.SendMultipart(&Message{To: to, Subject: subject, HTMLBody: body, TextBody: htmlToText(body)})
+}
+
+// SendMultipart keeps the email
+func (i *Inbox) SendMultipart(m *Message) error {
+	id, err := generateRandomString()
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.messages = append(i.messages, &InboxMessage{ID: id, Message: m, SentTimeUTC: time.Now().UTC()})
+	if i.Size > 0 && len(i.messages) > i.Size {
+		i.messages = i.messages[len(i.messages)-i.Size:]
+	}
+	return nil
+}
+
+// Messages returns the messages sent to the address, or all of them when to is empty, newest first
+func (i *Inbox) Messages(to string) []*InboxMessage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var messages []*InboxMessage
+	for j := len(i.messages) - 1; j >= 0; j-- {
+		if to == "" || strings.EqualFold(i.messages[j].To, to) {
+			messages = append(messages, i.messages[j])
+		}
+	}
+	return messages
+}
+
+// Latest returns the newest message sent to the address, or nil when there is none
+func (i *Inbox) Latest(to string) *InboxMessage {
+	if messages := i.Messages(to); len(messages) > 0 {
+		return messages[0]
+	}
+	return nil
+}
+
+// Get returns the message with the ID, or nil when it isn't in the inbox
+func (i *Inbox) Get(id string) *InboxMessage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, message := range i.messages {
+		if message.ID == id {
+			return message
+		}
+	}
+	return nil
+}
+
+// Clear deletes every message
+func (i *Inbox) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.messages = nil
+}
+
+// Links returns the URLs the HTML body links to, such as the verification link, in the order they appear
+func (m *InboxMessage) Links() []string {
+	var links []string
+	z := html.NewTokenizer(strings.NewReader(m.HTMLBody))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken:
+			name, hasAttr := z.TagName()
+			for string(name) == "a" && hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				if string(key) == "href" && len(value) > 0 {
+					links = append(links, string(value))
+				}
+			}
+		}
+	}
+}
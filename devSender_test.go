@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &FileSender{Dir: filepath.Join(dir, "outbox"), FromEmail: "noreply@example.com"}
+	if err := s.Send("Test User <test@test.com>", "Verify", `<a href="https://example.com/verify?code=1">Verify</a>`); err != nil {
+		t.Fatal("expected file", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "outbox", "*"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], "-Test_User_test@test.com_.eml") {
+		t.Fatal("expected one .eml file", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if eml := string(data); !strings.Contains(eml, "Subject: Verify") || !strings.Contains(eml, "multipart/alternative") ||
+		!strings.Contains(eml, "From: noreply@example.com") || !strings.Contains(eml, "text/plain") {
+		t.Error("expected multipart email", eml)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	inbox := NewInbox()
+	inbox.Size = 2
+	if inbox.Latest("") != nil {
+		t.Error("expected empty inbox")
+	}
+	inbox.Send("a@test.com", "First", "first")
+	inbox.Send("b@test.com", "Second", `<p>Click <a href="https://example.com/verify?code=1">here</a> or <a href="#top">top</a></p>`)
+	inbox.Send("A@test.com", "Third", "third")
+	if messages := inbox.Messages(""); len(messages) != 2 || messages[0].Subject != "Third" || messages[1].Subject != "Second" {
+		t.Error("expected the newest messages, newest first", messages)
+	}
+	if latest := inbox.Latest("a@test.com"); latest == nil || latest.Subject != "Third" || latest.TextBody != "third" {
+		t.Error("expected latest message to a@test.com", latest)
+	}
+	second := inbox.Latest("b@test.com")
+	if links := second.Links(); len(links) != 2 || links[0] != "https://example.com/verify?code=1" || inbox.Get(second.ID) != second {
+		t.Error("expected links and message by ID", links)
+	}
+	if inbox.Clear(); inbox.Get(second.ID) != nil || len(inbox.Messages("")) != 0 {
+		t.Error("expected cleared inbox")
+	}
+}
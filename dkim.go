@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DKIMAlgorithmRSA signs with RSASSA-PKCS1-v1_5 using SHA-256
+const DKIMAlgorithmRSA string = "rsa-sha256"
+
+// DKIMAlgorithmEd25519 signs with Ed25519 as described in RFC 8463
+const DKIMAlgorithmEd25519 string = "ed25519-sha256"
+
+// DKIMCanonicalizationRelaxed tolerates the whitespace and header case changes made by relays. It is the default
+const DKIMCanonicalizationRelaxed string = "relaxed"
+
+// DKIMCanonicalizationSimple signs the message exactly as sent
+const DKIMCanonicalizationSimple string = "simple"
+
+// defaultDKIMHeaders are signed when they are in the message. From is always signed
+var defaultDKIMHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+var whitespaceRun = regexp.MustCompile(`[ \t]+`)
+
+// DKIMSigner adds a DKIM-Signature header to outgoing messages, so receivers can check they came from Domain. The
+// public key must be published in a TXT record at <Selector>._domainkey.<Domain>, see DNSRecord
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	// HeaderCanonicalization and BodyCanonicalization are DKIMCanonicalizationRelaxed (default) or
+	// DKIMCanonicalizationSimple
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	// Headers are the names of the headers to sign when the message has them. defaultDKIMHeaders when empty
+	Headers []string
+
+	algorithm string
+	key       crypto.Signer
+}
+
+// NewDKIMSigner creates a DKIMSigner from a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key
+func NewDKIMSigner(domain, selector string, privateKeyPEM []byte) (*DKIMSigner, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("DKIM private key isn't PEM encoded")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read DKIM private key")
+	}
+	s := &DKIMSigner{Domain: domain, Selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm, s.key = DKIMAlgorithmRSA, k
+	case ed25519.PrivateKey:
+		s.algorithm, s.key = DKIMAlgorithmEd25519, k
+	default:
+		return nil, errors.New("DKIM private key must be RSA or Ed25519")
+	}
+	return s, nil
+}
+
+// LoadDKIMSigner reads the private key for NewDKIMSigner from keyFile
+func LoadDKIMSigner(domain, selector, keyFile string) (*DKIMSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewDKIMSigner(domain, selector, data)
+}
+
+// Algorithm returns DKIMAlgorithmRSA or DKIMAlgorithmEd25519, decided by the key
+func (s *DKIMSigner) Algorithm() string {
+	return s.algorithm
+}
+
+// DNSRecord returns the value of the TXT record to publish at <Selector>._domainkey.<Domain>
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	var keyType, publicKey string
+	switch k := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		keyType, publicKey = "rsa", base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		keyType, publicKey = "ed25519", base64.StdEncoding.EncodeToString(k)
+	}
+	return "v=DKIM1; k=" + keyType + "; p=" + publicKey, nil
+}
+
+// Sign returns the message with a DKIM-Signature header added before the others
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	message = crlfLines(message)
+	headers, body := splitMessage(message)
+	headerCanon, err := dkimCanonicalization(s.HeaderCanonicalization)
+	if err != nil {
+		return nil, err
+	}
+	bodyCanon, err := dkimCanonicalization(s.BodyCanonicalization)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyCanon))
+	signedHeaders := selectHeaders(headers, s.signedHeaderNames())
+	names := make([]string, len(signedHeaders))
+	for i, header := range signedHeaders {
+		names[i] = strings.ToLower(headerName(header))
+	}
+	signature := "DKIM-Signature: v=1; a=" + s.algorithm + "; c=" + headerCanon + "/" + bodyCanon + "; d=" + s.Domain +
+		"; s=" + s.Selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) + "; h=" + strings.Join(names, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+
+	var signed bytes.Buffer
+	for _, header := range signedHeaders {
+		signed.WriteString(canonicalHeader(header, headerCanon))
+	}
+	signed.WriteString(strings.TrimSuffix(canonicalHeader(signature+"\r\n", headerCanon), "\r\n"))
+	hash := sha256.Sum256(signed.Bytes())
+
+	var b []byte
+	if s.algorithm == DKIMAlgorithmEd25519 {
+		b, err = s.key.Sign(rand.Reader, hash[:], crypto.Hash(0)) // RFC 8463 signs the hash with PureEdDSA
+	} else {
+		b, err = s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signature+base64.StdEncoding.EncodeToString(b)+"\r\n"), message...), nil
+}
+
+// signedHeaderNames always includes From, which RFC 6376 requires
+func (s *DKIMSigner) signedHeaderNames() []string {
+	names := s.Headers
+	if len(names) == 0 {
+		names = defaultDKIMHeaders
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, "From") {
+			return names
+		}
+	}
+	return append([]string{"From"}, names...)
+}
+
+func dkimCanonicalization(canonicalization string) (string, error) {
+	switch strings.ToLower(canonicalization) {
+	case "", DKIMCanonicalizationRelaxed:
+		return DKIMCanonicalizationRelaxed, nil
+	case DKIMCanonicalizationSimple:
+		return DKIMCanonicalizationSimple, nil
+	}
+	return "", errors.New("DKIM canonicalization must be relaxed or simple: " + canonicalization)
+}
+
+// crlfLines ends every line with CRLF, as messages are sent
+func crlfLines(message []byte) []byte {
+	return bytes.Replace(bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+}
+
+// splitMessage returns the header fields, each with its folded lines and CRLF, and the body
+func splitMessage(message []byte) ([]string, []byte) {
+	head, body := message, []byte{}
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i != -1 {
+		head, body = message[:i+2], message[i+4:]
+	}
+	var headers []string
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+		} else {
+			headers = append(headers, line)
+		}
+	}
+	return headers, body
+}
+
+// selectHeaders returns the headers with the names, in order. Repeated headers are signed from the bottom up
+func selectHeaders(headers, names []string) []string {
+	used := make(map[int]bool)
+	var selected []string
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerName(headers[i]), name) {
+				used[i] = true
+				selected = append(selected, headers[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func headerName(header string) string {
+	return strings.TrimSpace(strings.SplitN(header, ":", 2)[0])
+}
+
+// canonicalHeader returns the header as it is signed. Relaxed lowercases the name, unfolds the value and
+// collapses its whitespace
+func canonicalHeader(header, canonicalization string) string {
+	if canonicalization == DKIMCanonicalizationSimple {
+		return header
+	}
+	parts := strings.SplitN(header, ":", 2)
+	value := ""
+	if len(parts) == 2 {
+		value = strings.Replace(parts[1], "\r\n", "", -1)
+		value = strings.TrimSpace(whitespaceRun.ReplaceAllString(value, " "))
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])) + ":" + value + "\r\n"
+}
+
+// canonicalBody returns the body as it is hashed. Both ignore empty lines at the end. Relaxed also removes the
+// whitespace at the end of lines and collapses the rest
+func canonicalBody(body []byte, canonicalization string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if canonicalization == DKIMCanonicalizationRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(whitespaceRun.ReplaceAllString(line, " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canonicalization == DKIMCanonicalizationRelaxed {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
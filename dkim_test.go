@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	keys := []struct {
+		PEM       []byte
+		Algorithm string
+	}{
+		{pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), DKIMAlgorithmRSA},
+		{pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}), DKIMAlgorithmEd25519},
+	}
+	message := mimeMessageBytes(t, &Message{To: "Test <test@test.com>", Subject: "Verify   your email", HTMLBody: "<p>Hello</p>", TextBody: "Hello  \r\n\r\n",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/unsubscribe>"}})
+
+	for _, key := range keys {
+		for _, canonicalization := range []string{DKIMCanonicalizationRelaxed, DKIMCanonicalizationSimple} {
+			s, err := NewDKIMSigner("example.com", "mail", key.PEM)
+			if err != nil || s.Algorithm() != key.Algorithm {
+				t.Fatal("expected signer", err)
+			}
+			s.HeaderCanonicalization, s.BodyCanonicalization = canonicalization, canonicalization
+			record, _ := s.DNSRecord()
+			signed, err := s.Sign(message)
+			if err != nil {
+				t.Fatal("expected signed message", err)
+			}
+			if err := verifyDKIM(signed, record); err != nil {
+				t.Error(key.Algorithm, canonicalization, "expected valid signature:", err)
+			}
+			if !strings.Contains(string(signed), "h=from:subject:date:to:mime-version:content-type:list-unsubscribe;") {
+				t.Error("expected signed headers", string(signed[:400]))
+			}
+			tampered := bytes.Replace(signed, []byte("Verify   your email"), []byte("Verify your account"), 1)
+			if err := verifyDKIM(tampered, record); err == nil {
+				t.Error(key.Algorithm, canonicalization, "expected changed subject to fail")
+			}
+			tampered = bytes.Replace(signed, []byte("<p>Hello</p>"), []byte("<p>Hi</p>"), 1)
+			if err := verifyDKIM(tampered, record); err == nil {
+				t.Error(key.Algorithm, canonicalization, "expected changed body to fail")
+			}
+		}
+	}
+
+	// relays may refold headers and change whitespace, which relaxed canonicalization allows
+	s, _ := NewDKIMSigner("example.com", "mail", keys[0].PEM)
+	record, _ := s.DNSRecord()
+	signed, _ := s.Sign(message)
+	relayed := bytes.Replace(signed, []byte("Subject: Verify   your email"), []byte("subject: Verify\r\n your  email"), 1)
+	if err := verifyDKIM(relayed, record); err != nil {
+		t.Error("expected refolded header to verify", err)
+	}
+}
+
+func TestDKIMSignerErrors(t *testing.T) {
+	if _, err := NewDKIMSigner("example.com", "mail", []byte("not pem")); err == nil {
+		t.Error("expected PEM error")
+	}
+	if _, err := NewDKIMSigner("example.com", "mail", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("bad")})); err == nil {
+		t.Error("expected key error")
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	s, _ := NewDKIMSigner("example.com", "mail", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	s.HeaderCanonicalization = "nowsp"
+	if _, err := s.Sign([]byte("From: a@example.com\r\n\r\nbody")); err == nil {
+		t.Error("expected canonicalization error")
+	}
+
+	dir, _ := ioutil.TempDir("", "dkim")
+	defer os.RemoveAll(dir)
+	if _, err := LoadDKIMSigner("example.com", "mail", filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected missing file error")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if s, err := LoadDKIMSigner("example.com", "mail", filepath.Join(dir, "key.pem")); err != nil || s.Algorithm() != DKIMAlgorithmEd25519 {
+		t.Error("expected signer from file", err)
+	}
+}
+
+// RFC 6376 section 3.4.5
+func TestDKIMCanonicalization(t *testing.T) {
+	headers, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	relaxed := canonicalHeader(headers[0], DKIMCanonicalizationRelaxed) + canonicalHeader(headers[1], DKIMCanonicalizationRelaxed)
+	if relaxed != "a:X\r\nb:Y Z\r\n" || headers[1] != "B : Y\t\r\n\tZ  \r\n" || canonicalHeader(headers[1], DKIMCanonicalizationSimple) != headers[1] {
+		t.Errorf("unexpected headers %q %q", relaxed, headers)
+	}
+	if c := string(canonicalBody(body, DKIMCanonicalizationRelaxed)); c != " C\r\nD E\r\n" {
+		t.Errorf("unexpected relaxed body %q", c)
+	}
+	if c := string(canonicalBody(body, DKIMCanonicalizationSimple)); c != " C \r\nD \t E\r\n" {
+		t.Errorf("unexpected simple body %q", c)
+	}
+	if string(canonicalBody(nil, DKIMCanonicalizationSimple)) != "\r\n" || len(canonicalBody(nil, DKIMCanonicalizationRelaxed)) != 0 {
+		t.Error("unexpected empty bodies")
+	}
+
+	// and the same examples through the verifier's own canonicalization
+	relaxed = verifierHeader(headers[0], DKIMCanonicalizationRelaxed) + verifierHeader(headers[1], DKIMCanonicalizationRelaxed)
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected verifier headers %q", relaxed)
+	}
+	if c := string(verifierBody(body, DKIMCanonicalizationRelaxed)); c != " C\r\nD E\r\n" {
+		t.Errorf("unexpected verifier relaxed body %q", c)
+	}
+	if c := string(verifierBody(body, DKIMCanonicalizationSimple)); c != " C \r\nD \t E\r\n" {
+		t.Errorf("unexpected verifier simple body %q", c)
+	}
+	if string(verifierBody(nil, DKIMCanonicalizationSimple)) != "\r\n" || len(verifierBody(nil, DKIMCanonicalizationRelaxed)) != 0 {
+		t.Error("unexpected verifier empty bodies")
+	}
+}
+
+// RFC 8463 appendix A
+func TestDKIMEd25519Vector(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	der, _ := x509.MarshalPKCS8PrivateKey(ed25519.NewKeyFromSeed(seed))
+	record := "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	message := strings.Join([]string{
+		"From: Joe SixPack <joe@football.example.com>",
+		"To: Suzie Q <suzie@shopping.example.net>",
+		"Subject: Is dinner ready?",
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)",
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>",
+		"",
+		"Hi.",
+		"",
+		"We lost the game.  Are you hungry yet?",
+		"",
+		"Joe.",
+		""}, "\r\n")
+	signature := strings.Join([]string{
+		"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;",
+		" d=football.example.com; i=@football.example.com;",
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :",
+		" subject : date : message-id : from : subject : date;",
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==",
+		""}, "\r\n")
+	if err := verifyDKIM([]byte(signature+message), record); err != nil {
+		t.Fatal("expected the RFC signature to verify", err)
+	}
+	if err := verifyDKIM([]byte(signature+strings.Replace(message, "hungry", "thirsty", 1)), record); err == nil {
+		t.Error("expected changed body to fail")
+	}
+
+	// the signer's canonicalization reproduces the data the RFC signed
+	headers, body := splitMessage([]byte(signature + message))
+	bodyHash := sha256.Sum256(canonicalBody(body, DKIMCanonicalizationRelaxed))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Error("expected RFC body hash")
+	}
+	var signed bytes.Buffer
+	for _, header := range selectHeaders(headers[1:], strings.Split("from:to:subject:date:message-id:from:subject:date", ":")) {
+		signed.WriteString(canonicalHeader(header, DKIMCanonicalizationRelaxed))
+	}
+	unsigned := headers[0][:strings.LastIndex(headers[0], "b=")+2]
+	signed.WriteString(strings.TrimSuffix(canonicalHeader(unsigned+"\r\n", DKIMCanonicalizationRelaxed), "\r\n"))
+	hash := sha256.Sum256(signed.Bytes())
+	rfcSignature, _ := base64.StdEncoding.DecodeString("/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==")
+	if !ed25519.Verify(ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey), hash[:], rfcSignature) {
+		t.Error("expected signer canonicalization to match the RFC")
+	}
+
+	s, err := NewDKIMSigner("football.example.com", "brisbane", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.DNSRecord(); r != record {
+		t.Error("expected RFC DNS record", r)
+	}
+	signedMessage, err := s.Sign([]byte(message))
+	if err != nil || verifyDKIM(signedMessage, record) != nil || !strings.Contains(string(signedMessage), "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;") {
+		t.Error("expected signature to verify with the RFC key", err, string(signedMessage))
+	}
+}
+
+/***************************************************************************************/
+
+func mimeMessageBytes(t *testing.T, m *Message) []byte {
+	var buf bytes.Buffer
+	if _, err := mimeMessage("noreply@example.com", "Example", m).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// verifyDKIM checks the first DKIM-Signature of message against the public key in the DNS record, as a receiver
+// would. It parses and canonicalizes the message itself, following RFC 6376, so it doesn't share the signer's mistakes
+func verifyDKIM(message []byte, record string) error {
+	head, body := message, []byte{}
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i != -1 {
+		head, body = message[:i+2], message[i+4:]
+	}
+	fields := headerField.FindAllString(string(head), -1)
+	if len(fields) == 0 || !strings.HasPrefix(strings.ToLower(fields[0]), "dkim-signature:") {
+		return errors.New("no signature")
+	}
+	tags := dkimTags(fields[0][strings.Index(fields[0], ":")+1:])
+	canon := strings.Split(tags["c"]+"/"+DKIMCanonicalizationSimple, "/")
+	if canon[0] == "" {
+		canon[0] = DKIMCanonicalizationSimple
+	}
+	bodyHash := sha256.Sum256(verifierBody(body, canon[1]))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash doesn't match")
+	}
+
+	// repeated fields are signed from the bottom up and names without a field left sign nothing
+	byName := make(map[string][]string)
+	for _, field := range fields[1:] {
+		name := strings.ToLower(strings.TrimRight(field[:strings.Index(field, ":")], " \t"))
+		byName[name] = append(byName[name], field)
+	}
+	var signed bytes.Buffer
+	for _, name := range strings.Split(tags["h"], ":") {
+		if n := len(byName[name]); n > 0 {
+			signed.WriteString(verifierHeader(byName[name][n-1], canon[0]))
+			byName[name] = byName[name][:n-1]
+		}
+	}
+	unsigned := signatureValue.ReplaceAllString(fields[0], "$1")
+	signed.WriteString(strings.TrimSuffix(verifierHeader(unsigned, canon[0]), "\r\n"))
+	hash := sha256.Sum256(signed.Bytes())
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	keyTags := dkimTags(record)
+	publicKey, _ := base64.StdEncoding.DecodeString(keyTags["p"])
+	switch tags["a"] {
+	case DKIMAlgorithmRSA:
+		key, err := x509.ParsePKIXPublicKey(publicKey)
+		if err != nil || keyTags["k"] != "rsa" {
+			return errors.New("invalid RSA key")
+		}
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash[:], signature)
+	case DKIMAlgorithmEd25519:
+		if keyTags["k"] != "ed25519" || !ed25519.Verify(ed25519.PublicKey(publicKey), hash[:], signature) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return errors.New("unknown algorithm")
+}
+
+// a header field with its folded lines
+var headerField = regexp.MustCompile(`(?m)^[^ \t\r\n][^\r\n]*\r\n(?:[ \t][^\r\n]*\r\n)*`)
+
+// the value of the b= tag, which is empty while signing
+var signatureValue = regexp.MustCompile(`([:;][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// verifierHeader follows RFC 6376 section 3.4.2 for relaxed header fields
+func verifierHeader(field, canonicalization string) string {
+	if canonicalization == DKIMCanonicalizationSimple {
+		return field
+	}
+	colon := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimRight(field[:colon], " \t"))
+	value := strings.Replace(field[colon+1:], "\r\n", "", -1)
+	return name + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+// verifierBody follows RFC 6376 sections 3.4.3 and 3.4.4
+func verifierBody(body []byte, canonicalization string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if canonicalization == DKIMCanonicalizationRelaxed {
+		for i, line := range lines {
+			var relaxed strings.Builder
+			space := false
+			for _, c := range line {
+				if isWSP(c) {
+					space = true
+					continue
+				}
+				if space {
+					relaxed.WriteByte(' ')
+					space = false
+				}
+				relaxed.WriteRune(c)
+			}
+			lines[i] = relaxed.String()
+		}
+	}
+	text := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if text == "" && canonicalization == DKIMCanonicalizationRelaxed {
+		return []byte{}
+	}
+	return []byte(text + "\r\n")
+}
+
+func isWSP(c rune) bool {
+	return c == ' ' || c == '\t'
+}
+
+func dkimTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		if parts := strings.SplitN(tag, "=", 2); len(parts) == 2 {
+			tags[strings.TrimSpace(parts[0])] = strings.Join(strings.Fields(parts[1]), "")
+		}
+	}
+	return tags
+}
@@ -17,30 +17,74 @@ func NewFakeStorer(config FakeStorerConfig) FakeStorer {
 
 // FakeStorerConfig stores the config for a Fake AuthStorer
 type FakeStorerConfig struct {
-	GetSessionVal           *LoginSession
-	GetSessionErr           error
-	GetBasicAuthVal         *LoginSession
-	GetBasicAuthErr         error
-	OAuthLoginVal           string
-	OAuthLoginErr           error
-	LoginVal                *LoginSession
-	LoginErr                error
-	RegisterErr             error
-	RequestPasswordResetErr error
-	LogoutErr               error
-	CreateProfileVal        *LoginSession
-	CreateProfileErr        error
-	VerifyEmailVal          string
-	VerifyEmailVal2         *User
-	VerifyEmailErr          error
-	VerifyPasswordResetVal  string
-	VerifyPasswordResetVal2 *User
-	VerifyPasswordResetErr  error
-	CreateSecondaryEmailErr error
-	SetPrimaryEmailErr      error
-	UpdatePasswordVal       *LoginSession
-	UpdatePasswordErr       error
-	UpdateInfoErr           error
+	GetSessionVal               *LoginSession
+	GetSessionErr               error
+	GetBasicAuthVal             *LoginSession
+	GetBasicAuthErr             error
+	OAuthLoginVal               string
+	OAuthLoginErr               error
+	LoginVal                    *LoginSession
+	LoginErr                    error
+	RegisterErr                 error
+	RequestPasswordResetErr     error
+	LogoutErr                   error
+	LogoutAllErr                error
+	CreateProfileVal            *LoginSession
+	CreateProfileErr            error
+	VerifyEmailVal              string
+	VerifyEmailVal2             *User
+	VerifyEmailErr              error
+	VerifyPasswordResetVal      string
+	VerifyPasswordResetVal2     *User
+	VerifyPasswordResetErr      error
+	CreateSecondaryEmailErr     error
+	SetPrimaryEmailErr          error
+	ConfirmEmailChangeErr       error
+	RevertEmailChangeErr        error
+	RequestMagicLinkErr         error
+	ConsumeMagicLinkVal         *LoginSession
+	ConsumeMagicLinkErr         error
+	VerifyLoginCodeVal          *LoginSession
+	VerifyLoginCodeErr          error
+	LoginTokenVal               *TokenResponse
+	LoginTokenErr               error
+	RefreshTokenVal             *TokenResponse
+	RefreshTokenErr             error
+	RevokeTokenErr              error
+	RegisterOAuthClientVal      *OAuthClientRegistration
+	RegisterOAuthClientErr      error
+	OAuthAuthorizeVal           *OAuthAuthorization
+	OAuthAuthorizeErr           error
+	OAuthConsentVal             *OAuthAuthorization
+	OAuthConsentErr             error
+	OAuthTokenVal               *TokenResponse
+	OAuthTokenErr               error
+	OAuthUserInfoVal            map[string]interface{}
+	OAuthUserInfoErr            error
+	CreateAPIKeyVal             *NewAPIKey
+	CreateAPIKeyErr             error
+	GetAPIKeysVal               []*APIKey
+	GetAPIKeysErr               error
+	DeleteAPIKeyErr             error
+	AuthorizeErr                error
+	GetSessionRolesVal          []string
+	GetSessionRolesErr          error
+	GetRolesVal                 []*Role
+	GetRolesErr                 error
+	SaveRoleVal                 *Role
+	SaveRoleErr                 error
+	DeleteRoleErr               error
+	GetUserRolesVal             []string
+	GetUserRolesErr             error
+	SetUserRolesErr             error
+	SetUserInfoErr              error
+	CreateInvitationErr         error
+	UpdatePasswordVal           *LoginSession
+	UpdatePasswordErr           error
+	UpdateInfoErr               error
+	RequestPhoneVerificationErr error
+	VerifyPhoneErr              error
+	SetChannelErr               error
 }
 
 type fakeAuthStore struct {
@@ -58,6 +102,11 @@ func (a *fakeAuthStore) GetSession(w http.ResponseWriter, r *http.Request) (*Log
 	return a.GetSessionVal, a.GetSessionErr
 }
 
+func (a *fakeAuthStore) GetCookieSession(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
+	a.Called = append(a.Called, "GetCookieSession")
+	return a.GetSessionVal, a.GetSessionErr
+}
+
 func (a *fakeAuthStore) GetBasicAuth(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
 	a.Called = append(a.Called, "GetBasicAuth")
 	return a.GetBasicAuthVal, a.GetBasicAuthErr
@@ -93,7 +142,7 @@ func (a *fakeAuthStore) VerifyEmail(w http.ResponseWriter, r *http.Request, para
 	return a.VerifyEmailVal, a.VerifyEmailVal2, a.VerifyEmailErr
 }
 
-func (a *fakeAuthStore) VerifyPasswordReset(w http.ResponseWriter, r *http.Request, emailVerificationCode string) (string, *User, error) {
+func (a *fakeAuthStore) VerifyPasswordReset(w http.ResponseWriter, r *http.Request, params EmailSendParams) (string, *User, error) {
 	a.Called = append(a.Called, "VerifyPasswordReset")
 	return a.VerifyPasswordResetVal, a.VerifyPasswordResetVal2, a.VerifyPasswordResetErr
 }
@@ -108,6 +157,131 @@ func (a *fakeAuthStore) SetPrimaryEmail(w http.ResponseWriter, r *http.Request,
 	return a.SetPrimaryEmailErr
 }
 
+func (a *fakeAuthStore) ConfirmEmailChange(w http.ResponseWriter, r *http.Request, code string) error {
+	a.Called = append(a.Called, "ConfirmEmailChange")
+	return a.ConfirmEmailChangeErr
+}
+
+func (a *fakeAuthStore) RevertEmailChange(w http.ResponseWriter, r *http.Request, revertCode string) error {
+	a.Called = append(a.Called, "RevertEmailChange")
+	return a.RevertEmailChangeErr
+}
+
+func (a *fakeAuthStore) RequestMagicLink(w http.ResponseWriter, r *http.Request, params EmailSendParams) error {
+	a.Called = append(a.Called, "RequestMagicLink")
+	return a.RequestMagicLinkErr
+}
+
+func (a *fakeAuthStore) ConsumeMagicLink(w http.ResponseWriter, r *http.Request, code string, rememberMe bool) (*LoginSession, error) {
+	a.Called = append(a.Called, "ConsumeMagicLink")
+	return a.ConsumeMagicLinkVal, a.ConsumeMagicLinkErr
+}
+
+func (a *fakeAuthStore) VerifyLoginCode(w http.ResponseWriter, r *http.Request, email, code string) (*LoginSession, error) {
+	a.Called = append(a.Called, "VerifyLoginCode")
+	return a.VerifyLoginCodeVal, a.VerifyLoginCodeErr
+}
+
+func (a *fakeAuthStore) LoginToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error) {
+	a.Called = append(a.Called, "LoginToken")
+	return a.LoginTokenVal, a.LoginTokenErr
+}
+
+func (a *fakeAuthStore) RefreshToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error) {
+	a.Called = append(a.Called, "RefreshToken")
+	return a.RefreshTokenVal, a.RefreshTokenErr
+}
+
+func (a *fakeAuthStore) RevokeToken(w http.ResponseWriter, r *http.Request) error {
+	a.Called = append(a.Called, "RevokeToken")
+	return a.RevokeTokenErr
+}
+
+func (a *fakeAuthStore) RegisterOAuthClient(w http.ResponseWriter, r *http.Request) (*OAuthClientRegistration, error) {
+	a.Called = append(a.Called, "RegisterOAuthClient")
+	return a.RegisterOAuthClientVal, a.RegisterOAuthClientErr
+}
+
+func (a *fakeAuthStore) OAuthAuthorize(w http.ResponseWriter, r *http.Request) (*OAuthAuthorization, error) {
+	a.Called = append(a.Called, "OAuthAuthorize")
+	return a.OAuthAuthorizeVal, a.OAuthAuthorizeErr
+}
+
+func (a *fakeAuthStore) OAuthConsent(w http.ResponseWriter, r *http.Request) (*OAuthAuthorization, error) {
+	a.Called = append(a.Called, "OAuthConsent")
+	return a.OAuthConsentVal, a.OAuthConsentErr
+}
+
+func (a *fakeAuthStore) OAuthToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error) {
+	a.Called = append(a.Called, "OAuthToken")
+	return a.OAuthTokenVal, a.OAuthTokenErr
+}
+
+func (a *fakeAuthStore) OAuthUserInfo(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	a.Called = append(a.Called, "OAuthUserInfo")
+	return a.OAuthUserInfoVal, a.OAuthUserInfoErr
+}
+
+func (a *fakeAuthStore) CreateAPIKey(w http.ResponseWriter, r *http.Request) (*NewAPIKey, error) {
+	a.Called = append(a.Called, "CreateAPIKey")
+	return a.CreateAPIKeyVal, a.CreateAPIKeyErr
+}
+
+func (a *fakeAuthStore) GetAPIKeys(w http.ResponseWriter, r *http.Request) ([]*APIKey, error) {
+	a.Called = append(a.Called, "GetAPIKeys")
+	return a.GetAPIKeysVal, a.GetAPIKeysErr
+}
+
+func (a *fakeAuthStore) DeleteAPIKey(w http.ResponseWriter, r *http.Request, keyID string) error {
+	a.Called = append(a.Called, "DeleteAPIKey")
+	return a.DeleteAPIKeyErr
+}
+
+func (a *fakeAuthStore) Authorize(session *LoginSession, roles, permissions []string) error {
+	a.Called = append(a.Called, "Authorize")
+	return a.AuthorizeErr
+}
+
+func (a *fakeAuthStore) GetSessionRoles(session *LoginSession) ([]string, error) {
+	a.Called = append(a.Called, "GetSessionRoles")
+	return a.GetSessionRolesVal, a.GetSessionRolesErr
+}
+
+func (a *fakeAuthStore) GetRoles(w http.ResponseWriter, r *http.Request) ([]*Role, error) {
+	a.Called = append(a.Called, "GetRoles")
+	return a.GetRolesVal, a.GetRolesErr
+}
+
+func (a *fakeAuthStore) SaveRole(w http.ResponseWriter, r *http.Request) (*Role, error) {
+	a.Called = append(a.Called, "SaveRole")
+	return a.SaveRoleVal, a.SaveRoleErr
+}
+
+func (a *fakeAuthStore) DeleteRole(w http.ResponseWriter, r *http.Request, name string) error {
+	a.Called = append(a.Called, "DeleteRole")
+	return a.DeleteRoleErr
+}
+
+func (a *fakeAuthStore) GetUserRoles(w http.ResponseWriter, r *http.Request, email string) ([]string, error) {
+	a.Called = append(a.Called, "GetUserRoles")
+	return a.GetUserRolesVal, a.GetUserRolesErr
+}
+
+func (a *fakeAuthStore) SetUserRoles(w http.ResponseWriter, r *http.Request) error {
+	a.Called = append(a.Called, "SetUserRoles")
+	return a.SetUserRolesErr
+}
+
+func (a *fakeAuthStore) CreateInvitation(w http.ResponseWriter, r *http.Request, params EmailSendParams, roles []string) error {
+	a.Called = append(a.Called, "CreateInvitation")
+	return a.CreateInvitationErr
+}
+
+func (a *fakeAuthStore) SetUserInfo(w http.ResponseWriter, r *http.Request) error {
+	a.Called = append(a.Called, "SetUserInfo")
+	return a.SetUserInfoErr
+}
+
 func (a *fakeAuthStore) UpdatePassword(w http.ResponseWriter, r *http.Request) (*LoginSession, error) {
 	a.Called = append(a.Called, "UpdatePassword")
 	return a.UpdatePasswordVal, a.UpdatePasswordErr
@@ -118,9 +292,29 @@ func (a *fakeAuthStore) Logout(w http.ResponseWriter, r *http.Request) error {
 	return a.LogoutErr
 }
 
+func (a *fakeAuthStore) LogoutAll(w http.ResponseWriter, r *http.Request) error {
+	a.Called = append(a.Called, "LogoutAll")
+	return a.LogoutAllErr
+}
+
 func (a *fakeAuthStore) UpdateInfo(userID string, info map[string]interface{}) error {
 	a.Called = append(a.Called, "UpdateInfo")
 	return a.UpdateInfoErr
 }
 
+func (a *fakeAuthStore) RequestPhoneVerification(w http.ResponseWriter, r *http.Request, phoneNumber string, params EmailSendParams) error {
+	a.Called = append(a.Called, "RequestPhoneVerification")
+	return a.RequestPhoneVerificationErr
+}
+
+func (a *fakeAuthStore) VerifyPhone(w http.ResponseWriter, r *http.Request, code string) error {
+	a.Called = append(a.Called, "VerifyPhone")
+	return a.VerifyPhoneErr
+}
+
+func (a *fakeAuthStore) SetChannel(w http.ResponseWriter, r *http.Request, channel string) error {
+	a.Called = append(a.Called, "SetChannel")
+	return a.SetChannelErr
+}
+
 var _ AuthStorer = &fakeAuthStore{}
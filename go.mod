@@ -6,6 +6,9 @@ require (
 	github.com/EndFirstCorp/configReader v0.0.0-20170802044638-188a03b4d2f3
 	github.com/EndFirstCorp/onedb v0.0.0-20200303162352-c70089b708c3
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/envoyproxy/go-control-plane v0.9.9
+	github.com/garyburd/redigo v1.6.0
+	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/securecookie v1.1.1
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
@@ -14,6 +17,9 @@ require (
 	github.com/sendgrid/sendgrid-go v3.5.0+incompatible
 	github.com/stretchr/testify v1.6.1 // indirect
 	github.com/tredoe/osutil v0.0.0-20161130133508-7d3ee1afa71c
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.36.0
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
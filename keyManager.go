@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// SigningAlgorithmRS256 signs tokens with RSASSA-PKCS1-v1_5 using SHA-256 and a 2048 bit key
+const SigningAlgorithmRS256 string = "RS256"
+
+// SigningAlgorithmEdDSA signs tokens with Ed25519
+const SigningAlgorithmEdDSA string = "EdDSA"
+
+const defaultTokenKeyRotationDuration time.Duration = 24 * time.Hour
+const defaultTokenKeyGraceDuration time.Duration = time.Hour
+const tokenKeyBits int = 2048
+
+// keyReloadDuration is how long keys are cached before checking the backend for keys added by other servers
+const keyReloadDuration time.Duration = time.Minute
+const keyMissReloadDuration time.Duration = 5 * time.Second
+
+// signingKeyStoreDuration is how long a backend with expiring records keeps signing keys after the last rotation
+const signingKeyStoreDuration time.Duration = 365 * 24 * time.Hour
+
+var errTokenKeyNotFound = errors.New("Token signing key not found")
+
+func init() {
+	jwt.RegisterSigningMethod(SigningAlgorithmEdDSA, func() jwt.SigningMethod { return signingMethodEd25519 })
+}
+
+// KeyManager signs tokens with its newest key and publishes the public half of every key which may
+// have signed a token that is still valid. Keys are persisted in the backend so every server sharing
+// the backend signs with, and accepts, the same keys
+type KeyManager struct {
+	sync.RWMutex
+	b              Backender
+	algorithm      string
+	rotateDuration time.Duration
+	graceDuration  time.Duration
+	keys           []*managedKey
+	loadedTimeUTC  time.Time
+}
+
+type managedKey struct {
+	*signingKey
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// JSONWebKey is the public part of a signing key as described in RFC 7517
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// NewKeyManager creates a KeyManager which signs with algorithm (SigningAlgorithmRS256 by default), replaces
+// its signing key every rotateDuration and keeps replaced keys for graceDuration so tokens they signed still verify
+func NewKeyManager(b Backender, algorithm string, rotateDuration, graceDuration time.Duration) (*KeyManager, error) {
+	if algorithm == "" {
+		algorithm = SigningAlgorithmRS256
+	}
+	if algorithm != SigningAlgorithmRS256 && algorithm != SigningAlgorithmEdDSA {
+		return nil, errors.Errorf("Unsupported token signing algorithm: %s", algorithm)
+	}
+	if rotateDuration <= 0 {
+		rotateDuration = defaultTokenKeyRotationDuration
+	}
+	if graceDuration <= 0 {
+		graceDuration = defaultTokenKeyGraceDuration
+	}
+	if graceDuration < accessTokenExpireDuration {
+		graceDuration = accessTokenExpireDuration
+	}
+	return &KeyManager{b: b, algorithm: algorithm, rotateDuration: rotateDuration, graceDuration: graceDuration}, nil
+}
+
+// Algorithm returns the algorithm new tokens are signed with
+func (k *KeyManager) Algorithm() string {
+	return k.algorithm
+}
+
+// Sign signs claims with the current key and names the key in the "kid" header
+func (k *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.KeyID
+	return token.SignedString(key.privateKey)
+}
+
+// Parse verifies tokenString against the key named in its "kid" header and fills claims
+func (k *KeyManager) Parse(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		key, err := k.verificationKey(keyID)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm { // don't let the token choose how it is verified
+			return nil, errTokenKeyNotFound
+		}
+		return key.publicKey, nil
+	})
+	return err
+}
+
+// JWKS returns the public keys which tokens may currently be signed with
+func (k *KeyManager) JWKS() (*JSONWebKeySet, error) {
+	if _, err := k.signingKey(); err != nil {
+		return nil, err
+	}
+	k.RLock()
+	defer k.RUnlock()
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, key.jsonWebKey())
+	}
+	return set, nil
+}
+
+// signingKey returns the current key, generating a new one when it is due for rotation
+func (k *KeyManager) signingKey() (*managedKey, error) {
+	k.RLock()
+	current := k.current()
+	stale := time.Since(k.loadedTimeUTC) >= keyReloadDuration
+	k.RUnlock()
+	if current != nil && !stale && !k.isDue(current) {
+		return current, nil
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	b := k.b.Clone()
+	defer b.Close()
+	if err := k.load(b); err != nil {
+		return nil, err
+	}
+	if current := k.current(); current != nil && !k.isDue(current) {
+		return current, nil // another server rotated it
+	}
+	return k.rotate(b)
+}
+
+// verificationKey returns the key with keyID, checking the backend in case another server just created it
+func (k *KeyManager) verificationKey(keyID string) (*managedKey, error) {
+	k.RLock()
+	key := k.find(keyID)
+	stale := time.Since(k.loadedTimeUTC) >= keyMissReloadDuration
+	k.RUnlock()
+	if key != nil || !stale {
+		return key, errorIfNil(key)
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	b := k.b.Clone()
+	defer b.Close()
+	if err := k.load(b); err != nil {
+		return nil, err
+	}
+	key = k.find(keyID)
+	return key, errorIfNil(key)
+}
+
+func errorIfNil(key *managedKey) error {
+	if key == nil {
+		return errTokenKeyNotFound
+	}
+	return nil
+}
+
+func (k *KeyManager) find(keyID string) *managedKey {
+	for _, key := range k.keys {
+		if key.KeyID == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *KeyManager) current() *managedKey {
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+func (k *KeyManager) isDue(key *managedKey) bool {
+	return key.Algorithm != k.algorithm || time.Since(key.CreatedTimeUTC) >= k.rotateDuration
+}
+
+// load replaces the cached keys with the unretired keys from the backend, oldest first
+func (k *KeyManager) load(b Backender) error {
+	stored, err := b.GetSigningKeys()
+	if err != nil {
+		return errors.Wrap(err, "Unable to load token signing keys")
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].CreatedTimeUTC.Before(stored[j].CreatedTimeUTC) })
+
+	var keys []*managedKey
+	for i, key := range stored {
+		if k.isRetired(stored, i) {
+			continue
+		}
+		if cached := k.find(key.KeyID); cached != nil {
+			keys = append(keys, cached)
+			continue
+		}
+		parsed, err := parseSigningKey(key)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, parsed)
+	}
+	k.keys = keys
+	k.loadedTimeUTC = time.Now().UTC()
+	return nil
+}
+
+// rotate adds a new signing key and deletes keys which were replaced more than the grace period ago
+func (k *KeyManager) rotate(b Backender) (*managedKey, error) {
+	key, err := newSigningKey(k.algorithm)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to generate token signing key")
+	}
+	if err := b.AddSigningKey(key.signingKey); err != nil {
+		return nil, errors.Wrap(err, "Unable to save token signing key")
+	}
+
+	stored, err := b.GetSigningKeys()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load token signing keys")
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].CreatedTimeUTC.Before(stored[j].CreatedTimeUTC) })
+	for i, old := range stored {
+		if k.isRetired(stored, i) {
+			b.DeleteSigningKey(old.KeyID) // best effort. Retired keys are ignored when loaded anyway
+		}
+	}
+
+	k.keys = append(k.keys, key)
+	return key, nil
+}
+
+// isRetired is true once the key after keys[i] has been signing for longer than the grace period
+func (k *KeyManager) isRetired(keys []*signingKey, i int) bool {
+	return i+1 < len(keys) && time.Since(keys[i+1].CreatedTimeUTC) > k.graceDuration
+}
+
+func newSigningKey(algorithm string) (*managedKey, error) {
+	var privateKey interface{}
+	var err error
+	switch algorithm {
+	case SigningAlgorithmEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		privateKey, err = rsa.GenerateKey(rand.Reader, tokenKeyBits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	id, err := generateRandomString()
+	if err != nil {
+		return nil, err
+	}
+	return parseSigningKey(&signingKey{KeyID: id[:16], Algorithm: algorithm, PrivateKey: der, CreatedTimeUTC: time.Now().UTC()})
+}
+
+func parseSigningKey(key *signingKey) (*managedKey, error) {
+	privateKey, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse token signing key")
+	}
+	switch p := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm == SigningAlgorithmRS256 {
+			return &managedKey{key, p, &p.PublicKey}, nil
+		}
+	case ed25519.PrivateKey:
+		if key.Algorithm == SigningAlgorithmEdDSA {
+			return &managedKey{key, p, p.Public()}, nil
+		}
+	}
+	return nil, errors.Errorf("Token signing key %s is not a valid %s key", key.KeyID, key.Algorithm)
+}
+
+func (key *managedKey) jsonWebKey() JSONWebKey {
+	jwk := JSONWebKey{Use: "sig", KeyID: key.KeyID, Algorithm: key.Algorithm}
+	switch p := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(p.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(p)
+	}
+	return jwk
+}
+
+// signingMethodEd25519 adds the EdDSA algorithm from RFC 8037, which jwt-go doesn't include
+var signingMethodEd25519 = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return SigningAlgorithmEdDSA
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestNewKeyManager(t *testing.T) {
+	b := NewBackendMemory(&hashStore{})
+	if _, err := NewKeyManager(b, "HS256", 0, 0); err == nil {
+		t.Fatal("expected unsupported algorithm")
+	}
+	k, err := NewKeyManager(b, "", 0, time.Minute)
+	if err != nil || k.Algorithm() != SigningAlgorithmRS256 || k.rotateDuration != defaultTokenKeyRotationDuration || k.graceDuration != accessTokenExpireDuration {
+		t.Fatal("expected defaults", err, k)
+	}
+}
+
+func TestKeyManagerSignAndParse(t *testing.T) {
+	for _, algorithm := range []string{SigningAlgorithmRS256, SigningAlgorithmEdDSA} {
+		k, _ := NewKeyManager(NewBackendMemory(&hashStore{}), algorithm, 0, 0)
+		token, err := k.Sign(jwt.StandardClaims{Subject: "1"})
+		if err != nil {
+			t.Fatal("expected token", algorithm, err)
+		}
+		claims := &jwt.StandardClaims{}
+		if err := k.Parse(token, claims); err != nil || claims.Subject != "1" {
+			t.Fatal("expected token to verify", algorithm, err, claims)
+		}
+		if err := k.Parse(token[:len(token)-4]+"AAAA", claims); err == nil {
+			t.Fatal("expected tampered token to fail", algorithm)
+		}
+	}
+
+	// a token may not pick a different algorithm than its key
+	k, _ := NewKeyManager(NewBackendMemory(&hashStore{}), SigningAlgorithmEdDSA, 0, 0)
+	key, _ := k.signingKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{})
+	token.Header["kid"] = key.KeyID
+	forged, _ := token.SignedString([]byte(key.publicKey.(ed25519.PublicKey)))
+	if err := k.Parse(forged, &jwt.StandardClaims{}); err == nil {
+		t.Fatal("expected algorithm mismatch to fail")
+	}
+}
+
+func TestKeyManagerRotation(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	k, _ := NewKeyManager(b, "", time.Hour, time.Hour)
+	first, err := k.signingKey()
+	if err != nil || len(b.SigningKeys) != 1 {
+		t.Fatal("expected key to be persisted", err)
+	}
+	if again, _ := k.signingKey(); again != first {
+		t.Fatal("expected key to be reused until rotation")
+	}
+
+	// another server sharing the backend uses the same key
+	other, _ := NewKeyManager(b, "", time.Hour, time.Hour)
+	if key, _ := other.signingKey(); key.KeyID != first.KeyID {
+		t.Fatal("expected persisted key to be shared", key.KeyID, first.KeyID)
+	}
+
+	b.SigningKeys[0].CreatedTimeUTC = time.Now().UTC().Add(-2 * time.Hour)
+	k.loadedTimeUTC = time.Time{}
+	second, _ := k.signingKey()
+	if second.KeyID == first.KeyID || len(b.SigningKeys) != 2 {
+		t.Fatal("expected key to rotate", b.SigningKeys)
+	}
+	if _, err := k.verificationKey(first.KeyID); err != nil {
+		t.Fatal("expected previous key to be kept during the grace period", err)
+	}
+	if jwks, _ := k.JWKS(); len(jwks.Keys) != 2 {
+		t.Fatal("expected both keys to be published", jwks)
+	}
+
+	// the other server picks up the new key for a token it hasn't seen
+	other.loadedTimeUTC = time.Time{}
+	if _, err := other.verificationKey(second.KeyID); err != nil {
+		t.Fatal("expected new key to be loaded", err)
+	}
+
+	b.SigningKeys[1].CreatedTimeUTC = time.Now().UTC().Add(-90 * time.Minute)
+	b.SigningKeys[0].CreatedTimeUTC = time.Now().UTC().Add(-3 * time.Hour)
+	k.loadedTimeUTC = time.Time{}
+	k.signingKey()
+	if len(b.SigningKeys) != 2 || b.SigningKeys[0].KeyID != second.KeyID {
+		t.Fatal("expected retired key to be deleted", b.SigningKeys)
+	}
+	if _, err := k.verificationKey(first.KeyID); err != errTokenKeyNotFound {
+		t.Fatal("expected old key to be retired", err)
+	}
+}
+
+func TestKeyManagerJWKS(t *testing.T) {
+	k, _ := NewKeyManager(NewBackendMemory(&hashStore{}), SigningAlgorithmEdDSA, 0, 0)
+	jwks, err := k.JWKS()
+	if err != nil || len(jwks.Keys) != 1 {
+		t.Fatal("expected a key to be created", err)
+	}
+	key := jwks.Keys[0]
+	if key.KeyType != "OKP" || key.Curve != "Ed25519" || key.Algorithm != "EdDSA" || key.Use != "sig" || len(key.X) != 43 || key.N != "" {
+		t.Error("expected Ed25519 key", key)
+	}
+
+	k, _ = NewKeyManager(NewBackendMemory(&hashStore{}), SigningAlgorithmRS256, 0, 0)
+	jwks, _ = k.JWKS()
+	key = jwks.Keys[0]
+	if key.KeyType != "RSA" || key.Algorithm != "RS256" || key.E != "AQAB" || len(key.N) != 342 || key.X != "" {
+		t.Error("expected RSA key", key)
+	}
+}
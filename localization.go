@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InfoLocale is the user info key holding the locale the user chose, such as "fr" or "pt-BR". It is preferred
+// over the locale negotiated from the request
+const InfoLocale string = "locale"
+
+const defaultLocale string = "en"
+
+// Localizer holds the message catalog of each supported locale
+type Localizer struct {
+	DefaultLocale string
+	catalogs      map[string]map[string]string
+}
+
+// NewLocalizer loads the catalogs in dir. Each is a JSON object of messages named for its locale, such as fr.json
+// or pt-BR.json. Error messages are keyed by the English message, e.g. "Invalid email", and a message keyed by an
+// error code, e.g. "invalid_request", is used for the messages of that code which have none of their own. Email
+// subjects are keyed by "<template>.subject", e.g. "verifyEmail.subject". A locale is only supported when it has a
+// catalog, even an empty one
+func NewLocalizer(dir, defaultLocaleName string) (*Localizer, error) {
+	l := &Localizer{DefaultLocale: canonicalLocale(defaultLocaleName), catalogs: make(map[string]map[string]string)}
+	if l.DefaultLocale == "" {
+		l.DefaultLocale = defaultLocale
+	}
+	if dir == "" {
+		return l, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		catalog := make(map[string]string)
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil, newAuthError("Unable to read catalog "+filepath.Base(file), err)
+		}
+		l.catalogs[canonicalLocale(strings.TrimSuffix(filepath.Base(file), ".json"))] = catalog
+	}
+	return l, nil
+}
+
+// Negotiate returns the first supported locale of preferred, then the best match for the Accept-Language header,
+// then the default locale
+func (l *Localizer) Negotiate(acceptLanguage string, preferred ...string) string {
+	for _, locale := range append(preferred, acceptedLocales(acceptLanguage)...) {
+		if supported := l.supported(locale); supported != "" {
+			return supported
+		}
+	}
+	return l.DefaultLocale
+}
+
+// supported returns the locale, or its language when only that has a catalog
+func (l *Localizer) supported(locale string) string {
+	for _, candidate := range localeCandidates(locale) {
+		if _, ok := l.catalogs[candidate]; ok || candidate == l.DefaultLocale {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Message returns the message for key in the locale or its language, or fallback when neither catalog has it
+func (l *Localizer) Message(locale, key, fallback string) string {
+	if l == nil {
+		return fallback
+	}
+	for _, candidate := range localeCandidates(locale) {
+		if message, ok := l.catalogs[candidate][key]; ok && message != "" {
+			return message
+		}
+	}
+	return fallback
+}
+
+// ErrorMessage returns the message in the locale or its language for an error's English message, then for its
+// code, or message when the catalogs have neither
+func (l *Localizer) ErrorMessage(locale, code, message string) string {
+	return l.Message(locale, message, l.Message(locale, code, message))
+}
+
+// acceptedLocales returns the locales of an Accept-Language header, most preferred first
+func acceptedLocales(acceptLanguage string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+	locales := make([]string, len(accepted))
+	for i, a := range accepted {
+		locales[i] = a.locale
+	}
+	return locales
+}
+
+// localeCandidates returns the locale and then its language, e.g. pt-BR and pt
+func localeCandidates(locale string) []string {
+	locale = canonicalLocale(locale)
+	if locale == "" {
+		return nil
+	}
+	if i := strings.Index(locale, "-"); i != -1 {
+		return []string{locale, locale[:i]}
+	}
+	return []string{locale}
+}
+
+// canonicalLocale writes a language tag the way catalog and template files are named: pt_br and PT-br become pt-BR
+func canonicalLocale(locale string) string {
+	parts := strings.FieldsFunc(strings.TrimSpace(locale), func(r rune) bool { return r == '-' || r == '_' })
+	for i, part := range parts {
+		switch {
+		case i == 0:
+			parts[i] = strings.ToLower(part)
+		case len(part) == 2:
+			parts[i] = strings.ToUpper(part)
+		case len(part) == 4:
+			parts[i] = strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		default:
+			parts[i] = strings.ToLower(part)
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// userLocale returns the locale the user chose, or locale when they haven't
+func userLocale(info map[string]interface{}, locale string) string {
+	if chosen, ok := info[InfoLocale].(string); ok && chosen != "" {
+		return chosen
+	}
+	return locale
+}
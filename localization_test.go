@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func getLocalizer(t *testing.T) *Localizer {
+	dir, err := ioutil.TempDir("", "catalogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "fr.json"), []byte(`{"invalid_code": "Code invalide", "invalid_request": "Requête invalide", "Invalid email": "E-mail invalide", "verifyEmail.subject": "Vérifiez votre e-mail"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "pt-BR.json"), []byte(`{"invalid_code": "Código inválido"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "pt.json"), []byte(`{}`), 0644)
+	l, err := NewLocalizer(dir, "")
+	if err != nil {
+		t.Fatal("expected catalogs", err)
+	}
+	return l
+}
+
+func TestNegotiate(t *testing.T) {
+	l := getLocalizer(t)
+	tests := []struct {
+		AcceptLanguage string
+		Preferred      string
+		Expected       string
+	}{
+		{"", "", "en"},
+		{"fr-CA,fr;q=0.9,en;q=0.8", "", "fr"},
+		{"de;q=0.9, pt-br", "", "pt-BR"},
+		{"pt-PT", "", "pt"},
+		{"de, en-GB;q=0.5", "", "en"},
+		{"fr;q=0, pt", "", "pt"},
+		{"fr", "pt_br", "pt-BR"},
+		{"fr", "de", "fr"},
+	}
+	for i, test := range tests {
+		if locale := l.Negotiate(test.AcceptLanguage, test.Preferred); locale != test.Expected {
+			t.Errorf("test %d: expected %s, got %s", i, test.Expected, locale)
+		}
+	}
+}
+
+func TestLocalizerMessage(t *testing.T) {
+	l := getLocalizer(t)
+	if m := l.Message("fr-CA", "invalid_code", "Invalid verification code"); m != "Code invalide" {
+		t.Error("expected message for the language", m)
+	}
+	if m := l.Message("pt", "invalid_code", "Invalid verification code"); m != "Invalid verification code" {
+		t.Error("expected fallback for missing message", m)
+	}
+	if m := (*Localizer)(nil).Message("fr", "invalid_code", "fallback"); m != "fallback" {
+		t.Error("expected nil localizer to use the fallback", m)
+	}
+
+	if m := l.ErrorMessage("fr", ErrCodeInvalidRequest, "Invalid email"); m != "E-mail invalide" {
+		t.Error("expected message for the error's own message", m)
+	}
+	if m := l.ErrorMessage("fr", ErrCodeInvalidRequest, "Invalid phone number"); m != "Requête invalide" {
+		t.Error("expected message for the code", m)
+	}
+	if m := l.ErrorMessage("pt", ErrCodeInvalidRequest, "Invalid email"); m != "Invalid email" {
+		t.Error("expected English message without either", m)
+	}
+
+	dir, _ := ioutil.TempDir("", "catalogs")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"invalid_code": 1}`), 0644)
+	if _, err := NewLocalizer(dir, "en"); err == nil || err.Error() != "Unable to read catalog de.json" {
+		t.Error("expected catalogs which aren't JSON objects of strings to fail", err)
+	}
+}
+
+func TestUserLocale(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	b.AddUserFull("test@test.com", "password", map[string]interface{}{InfoLocale: "fr"})
+	m := &TextMailer{}
+	s := &authStore{b: b, mailer: m}
+	if err := s.requestPasswordReset(&http.Request{}, b, EmailSendParams{Email: "test@test.com", Locale: "de", UseOneTimeCode: true}); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if params, ok := m.MessageData.(EmailSendParams); !ok || params.Locale != "fr" {
+		t.Error("expected the user's locale to be preferred", m.MessageData)
+	}
+	if locale := userLocale(nil, "de"); locale != "de" {
+		t.Error("expected the negotiated locale without a preference", locale)
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+const emailSessionPurposeLoginCode string = "loginCode"
+
+// loginCodeHash is the email session key for a login code. Each user has one outstanding code
+func loginCodeHash(userID string) string {
+	return encodeToString(hash([]byte(emailSessionPurposeLoginCode + ":" + userID)))
+}
+
+// sendLoginCode sends a one-time code over the channel the user prefers once their password has been checked. It
+// always returns an error with ErrCodeLoginCodeRequired, so the login only finishes when the code is entered
+func (s *authStore) sendLoginCode(b Backender, u *User, rememberMe bool) error {
+	code, err := generateOneTimeCode(s.oneTimeCodeLength())
+	if err != nil {
+		return newLoggedError("Problem generating login code", err)
+	}
+	csrfToken, err := generateRandomString()
+	if err != nil {
+		return newLoggedError("Problem generating csrf token", err)
+	}
+	info := map[string]interface{}{"rememberMe": rememberMe, "codeHash": encodeToString(hash([]byte(code)))}
+	codeSession := &emailSession{u.UserID, u.Email, info, loginCodeHash(u.UserID), csrfToken, emailSessionPurposeLoginCode, time.Now().UTC().Add(oneTimeCodeExpireDuration)}
+	if err := s.saveOneTimeCodeSession(b, codeSession); err != nil {
+		return err
+	}
+
+	params := EmailSendParams{VerificationCode: code, Email: u.Email, Info: copyInfo(u.Info), Locale: userLocale(u.Info, "")}
+	if err := s.notifyUser(u, u.Email, s.conf.LoginCodeTemplate, s.conf.LoginCodeSubject, params); err != nil {
+		return newLoggedError("Unable to send login code", err)
+	}
+	return newAuthError("Enter the code we sent you to finish logging in", nil).withCode(ErrCodeLoginCodeRequired)
+}
+
+// VerifyLoginCode finishes a login which needed a code, creating the session when the code is the one sent to the
+// user with email
+func (s *authStore) VerifyLoginCode(w http.ResponseWriter, r *http.Request, email, code string) (*LoginSession, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.verifyLoginCode(w, r, b, email, code)
+}
+
+func (s *authStore) verifyLoginCode(w http.ResponseWriter, r *http.Request, b Backender, email, code string) (*LoginSession, error) {
+	user, rememberMe, err := s.useLoginCode(b, email, code)
+	if err != nil {
+		return nil, err
+	}
+	return s.createSession(w, r, b, user.UserID, user.Email, user.Info, rememberMe)
+}
+
+// useLoginCode checks the code sent to the user with email. Codes are single use and wrong ones are counted
+func (s *authStore) useLoginCode(b Backender, email, code string) (*User, bool, error) {
+	user, err := b.GetUser(email)
+	if err != nil {
+		return nil, false, newLoggedError("Invalid or expired login code", err).withCode(ErrCodeInvalidCode)
+	}
+	session, err := b.GetEmailSession(loginCodeHash(user.UserID))
+	if err != nil || session.Purpose != emailSessionPurposeLoginCode {
+		return nil, false, newLoggedError("Invalid or expired login code", err).withCode(ErrCodeInvalidCode)
+	}
+	if err := s.useOneTimeCode(b, session, code); err != nil {
+		return nil, false, err
+	}
+	if user.IsLockedOut() {
+		return nil, false, newAuthError("Your account is locked. Please reset your password.", nil).withCode(ErrCodeAccountLocked)
+	}
+	return user, session.Info["rememberMe"] == true, nil
+}
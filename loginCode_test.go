@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLoginCode(t *testing.T) {
+	s, b := getTokenStore()
+	m := s.mailer.(*TextMailer)
+	c := s.cookieStore.(*MockCookieStore)
+	s.conf.LoginCodeTemplate = "loginCode"
+
+	if _, err := s.login(nil, &http.Request{}, b, "test@test.com", "password", true); err == nil || ErrorCode(err) != ErrCodeLoginCodeRequired {
+		t.Fatal("expected login code to be required", err)
+	}
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	if m.MessageTo != "test@test.com" || !isOneTimeCode(code) || len(b.Sessions) != 0 || c.cookies[sessionCookieName] != nil {
+		t.Fatal("expected code to be sent without a session", m.MessageTo, code, b.Sessions)
+	}
+
+	if _, err := s.verifyLoginCode(nil, &http.Request{}, b, "bogus@test.com", code); err == nil || ErrorCode(err) != ErrCodeInvalidCode {
+		t.Error("expected unknown user to fail", err)
+	}
+	if _, err := s.verifyLoginCode(nil, &http.Request{}, b, "test@test.com", "00000000"); err == nil || ErrorCode(err) != ErrCodeInvalidCode {
+		t.Error("expected wrong code to fail", err)
+	}
+	session, err := s.verifyLoginCode(nil, &http.Request{}, b, "test@test.com", code)
+	if err != nil || session.Email != "test@test.com" || len(b.Sessions) != 1 || c.cookies[rememberMeCookieName] == nil {
+		t.Fatal("expected remembered session", session, err)
+	}
+	if _, err := s.verifyLoginCode(nil, &http.Request{}, b, "test@test.com", code); err == nil {
+		t.Error("expected code to be single use")
+	}
+
+	r := &http.Request{Header: http.Header{}}
+	r.SetBasicAuth("test@test.com", "password")
+	if _, err := s.getBasicAuth(nil, r, b); err == nil || ErrorCode(err) != ErrCodeUnauthenticated {
+		t.Error("expected basic auth to be refused", err)
+	}
+
+	m.Err = errFailed
+	if _, err := s.login(nil, &http.Request{}, b, "test@test.com", "password", false); err == nil || err.Error() != "Unable to send login code" {
+		t.Error("expected send failure", err)
+	}
+}
+
+func TestLoginTokenWithCode(t *testing.T) {
+	s, b := getTokenStore()
+	m := s.mailer.(*TextMailer)
+	s.conf.LoginCodeTemplate = "loginCode"
+	if _, err := s.loginToken(b, "test@test.com", "password"); err == nil || ErrorCode(err) != ErrCodeLoginCodeRequired {
+		t.Fatal("expected login code to be required", err)
+	}
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	if _, err := s.loginTokenWithCode(b, "test@test.com", "00000000"); err == nil {
+		t.Error("expected wrong code to fail")
+	}
+	tokens, err := s.loginTokenWithCode(b, "test@test.com", code)
+	if err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Error("expected tokens", tokens, err)
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+var magicLinkCookieName = "MagicLink"
+
+const magicLinkExpireMins int = 15
+const magicLinkExpireDuration time.Duration = time.Duration(magicLinkExpireMins) * time.Minute
+const emailSessionPurposeMagicLink string = "magicLink"
+
+type magicLinkCookie struct {
+	BrowserToken  string
+	ExpireTimeUTC time.Time
+}
+
+func (s *authStore) RequestMagicLink(w http.ResponseWriter, r *http.Request, params EmailSendParams) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.requestMagicLink(w, r, b, params)
+}
+
+func (s *authStore) requestMagicLink(w http.ResponseWriter, r *http.Request, b Backender, params EmailSendParams) error {
+	if !isValidEmail(params.Email) {
+		return newAuthError("Invalid email", nil)
+	}
+	if params.BaseURL == "" {
+		params.BaseURL = s.baseURL(r)
+	}
+
+	u, err := b.GetUser(params.Email)
+	if err != nil {
+		if params.TemplateFailure == "" {
+			return nil
+		}
+		if err := s.mailer.SendMessage(params.Email, params.TemplateFailure, params.SubjectFailure, params); err != nil {
+			return newLoggedError("Unable to send login link", err)
+		}
+		return nil // user does not exist, send success message anyway to prevent fishing for user data
+	}
+
+	// tie the link to this browser so a link intercepted in transit can't be used elsewhere
+	browserToken, browserHash, err := generateStringAndHash()
+	if err != nil {
+		return newLoggedError("Problem generating login link", err)
+	}
+	info := sessionInfo(&params)
+	info["browserHash"] = browserHash
+
+	expireTimeUTC := time.Now().UTC().Add(magicLinkExpireDuration)
+	code, err := s.addEmailSessionWithExpire(b, u.UserID, u.Email, info, emailSessionPurposeMagicLink, expireTimeUTC)
+	if err != nil {
+		return newLoggedError("Unable to send login link", err)
+	}
+	if err := s.saveMagicLinkCookie(w, browserToken, expireTimeUTC); err != nil {
+		return newLoggedError("Unable to save login link cookie", err)
+	}
+
+	params.VerificationCode = code[:len(code)-1] // drop the "=" at the end of the code since it makes it look like a querystring
+	params.Locale = userLocale(u.Info, params.Locale)
+	if err := s.notifyUser(u, params.Email, params.TemplateSuccess, params.SubjectSuccess, params); err != nil {
+		return newLoggedError("Unable to send login link", err)
+	}
+	return nil
+}
+
+func (s *authStore) ConsumeMagicLink(w http.ResponseWriter, r *http.Request, code string, rememberMe bool) (*LoginSession, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.consumeMagicLink(w, r, b, code, rememberMe)
+}
+
+func (s *authStore) consumeMagicLink(w http.ResponseWriter, r *http.Request, b Backender, code string, rememberMe bool) (*LoginSession, error) {
+	session, err := s.getEmailSessionWithPurpose(b, code, emailSessionPurposeMagicLink)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie, err := s.getMagicLinkCookie(w, r)
+	if err != nil || cookie.BrowserToken == "" {
+		if !s.conf.MagicLinkCrossDevice {
+			return nil, newAuthError("Login link must be opened in the browser where it was requested", err)
+		}
+	} else if err := encodedHashEquals(cookie.BrowserToken, GetInfoString(session.Info, "browserHash")); err != nil {
+		return nil, newLoggedError("Login link was requested from a different browser", err)
+	}
+
+	if err := b.DeleteEmailSession(session.EmailVerifyHash); err != nil { // links are single use
+		return nil, newLoggedError("Unable to use login link", err)
+	}
+	s.deleteMagicLinkCookie(w)
+
+	user, err := b.GetUser(session.Email)
+	if err != nil {
+		return nil, newLoggedError("Unable to find user", err)
+	}
+	if user.IsLockedOut() {
+		return nil, newAuthError("Your account is locked. Please reset your password.", nil).withCode(ErrCodeAccountLocked)
+	}
+	if !user.IsEmailVerified { // the link was delivered to this address, so it has now been verified
+		if err := b.VerifyEmail(user.Email); err != nil {
+			return nil, newLoggedError("Failed to verify email", err)
+		}
+	}
+	if s.conf.LoginCodeTemplate != "" { // the link replaces the password, not the code
+		return nil, s.sendLoginCode(b, user, rememberMe)
+	}
+
+	return s.createSession(w, r, b, user.UserID, user.Email, user.Info, rememberMe)
+}
+
+func (s *authStore) getMagicLinkCookie(w http.ResponseWriter, r *http.Request) (*magicLinkCookie, error) {
+	magicLink := &magicLinkCookie{}
+	return magicLink, s.cookieStore.Get(w, r, magicLinkCookieName, magicLink)
+}
+
+func (s *authStore) saveMagicLinkCookie(w http.ResponseWriter, browserToken string, expireTimeUTC time.Time) error {
+	cookie := magicLinkCookie{BrowserToken: browserToken, ExpireTimeUTC: expireTimeUTC}
+	return s.cookieStore.PutWithExpire(w, magicLinkCookieName, magicLinkExpireMins, &cookie)
+}
+
+func (s *authStore) deleteMagicLinkCookie(w http.ResponseWriter) {
+	s.cookieStore.Delete(w, magicLinkCookieName)
+}
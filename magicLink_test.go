@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func getMagicLinkStore(crossDevice bool) (*authStore, *backendMemory, *TextMailer, *MockCookieStore) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	m := &TextMailer{}
+	c := newMockCookieStore(nil, false, false)
+	b.AddUserFull("test@test.com", "password", map[string]interface{}{"key": "value"})
+	return &authStore{b: b, mailer: m, cookieStore: c, conf: AuthStoreConfig{MagicLinkCrossDevice: crossDevice}}, b, m, c
+}
+
+func TestRequestMagicLink(t *testing.T) {
+	s, b, m, c := getMagicLinkStore(false)
+	s.conf.AllowedHosts = []string{"example.com"}
+	if err := s.requestMagicLink(nil, &http.Request{}, b, EmailSendParams{Email: "bogus"}); err == nil || err.Error() != "Invalid email" {
+		t.Fatal("expected invalid email", err)
+	}
+
+	// unknown user silently succeeds
+	if err := s.requestMagicLink(nil, &http.Request{}, b, EmailSendParams{Email: "unknown@test.com"}); err != nil || m.MessageTo != "" || len(b.EmailSessions) != 0 {
+		t.Fatal("expected no email to be sent", err, m.MessageTo)
+	}
+
+	if err := s.requestMagicLink(nil, &http.Request{Host: "example.com"}, b, EmailSendParams{Email: "test@test.com", TemplateSuccess: "magicLink"}); err != nil {
+		t.Fatal("expected success", err)
+	}
+	data := m.MessageData.(EmailSendParams)
+	session := b.EmailSessions[0]
+	if m.MessageTo != "test@test.com" || data.VerificationCode == "" || data.BaseURL != "http://example.com" ||
+		session.Purpose != emailSessionPurposeMagicLink || session.ExpireTimeUTC.IsZero() || c.cookies[magicLinkCookieName] == nil {
+		t.Fatal("expected magic link to be sent", m.MessageTo, data, session)
+	}
+
+	r := &http.Request{Host: "example.com", Header: http.Header{"X-Forwarded-Host": {"evil.com"}}}
+	if err := s.requestMagicLink(nil, r, b, EmailSendParams{Email: "test@test.com"}); err != nil || m.MessageData.(EmailSendParams).BaseURL != "" {
+		t.Fatal("expected links not to point at hosts which aren't allowed", err, m.MessageData)
+	}
+
+	m.Err = errFailed
+	if err := s.requestMagicLink(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com"}); err == nil || err.Error() != "Unable to send login link" {
+		t.Fatal("expected mail error", err)
+	}
+}
+
+func TestConsumeMagicLink(t *testing.T) {
+	s, b, m, c := getMagicLinkStore(false)
+	s.requestMagicLink(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com"})
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	browserCookie := c.cookies[magicLinkCookieName]
+
+	// different browser
+	c.cookies[magicLinkCookieName] = nil
+	if _, err := s.consumeMagicLink(nil, &http.Request{}, b, code, false); err == nil || err.Error() != "Login link must be opened in the browser where it was requested" {
+		t.Fatal("expected browser check", err)
+	}
+	c.cookies[magicLinkCookieName] = &magicLinkCookie{BrowserToken: "dG9rZW4="}
+	if _, err := s.consumeMagicLink(nil, &http.Request{}, b, code, false); err == nil || err.Error() != "Login link was requested from a different browser" {
+		t.Fatal("expected browser check", err)
+	}
+
+	c.cookies[magicLinkCookieName] = browserCookie
+	session, err := s.consumeMagicLink(nil, &http.Request{}, b, code, true)
+	if err != nil || session.Email != "test@test.com" || c.cookies[sessionCookieName] == nil || c.cookies[rememberMeCookieName] == nil || len(b.RememberMes) != 1 {
+		t.Fatal("expected login with rememberMe", err, session)
+	}
+	if !b.getUserByEmail("test@test.com").IsEmailVerified {
+		t.Fatal("expected email to be verified by the login link")
+	}
+
+	// single use
+	c.cookies[magicLinkCookieName] = browserCookie
+	if _, err := s.consumeMagicLink(nil, &http.Request{}, b, code, false); err == nil {
+		t.Fatal("expected link to be single use")
+	}
+
+	// wrong purpose
+	code, _ = s.addEmailSessionWithExpire(b, "1", "test@test.com", nil, emailSessionPurposeRevertEmail, futureTime)
+	if _, err := s.consumeMagicLink(nil, &http.Request{}, b, code, false); err == nil || err.Error() != "Invalid verification code" {
+		t.Fatal("expected purpose check", err)
+	}
+}
+
+func TestConsumeMagicLinkWithLoginCode(t *testing.T) {
+	s, b, m, _ := getMagicLinkStore(false)
+	s.conf.LoginCodeTemplate = "loginCode"
+	s.requestMagicLink(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com"})
+	link := m.MessageData.(EmailSendParams).VerificationCode
+	if _, err := s.consumeMagicLink(nil, &http.Request{}, b, link, true); err == nil || ErrorCode(err) != ErrCodeLoginCodeRequired {
+		t.Fatal("expected login code to be required", err)
+	}
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	if !isOneTimeCode(code) || len(b.Sessions) != 0 {
+		t.Fatal("expected code to be sent without a session", code, b.Sessions)
+	}
+	if session, err := s.verifyLoginCode(nil, &http.Request{}, b, "test@test.com", code); err != nil || len(b.RememberMes) != 1 {
+		t.Error("expected remembered session once the code is entered", session, err)
+	}
+}
+
+func TestConsumeMagicLinkCrossDevice(t *testing.T) {
+	s, b, m, c := getMagicLinkStore(true)
+	s.requestMagicLink(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com"})
+	c.cookies[magicLinkCookieName] = nil
+	session, err := s.consumeMagicLink(nil, &http.Request{}, b, m.MessageData.(EmailSendParams).VerificationCode, false)
+	if err != nil || session.Email != "test@test.com" || len(b.RememberMes) != 0 {
+		t.Fatal("expected cross device login", err, session)
+	}
+}
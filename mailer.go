@@ -2,13 +2,30 @@ package auth
 
 import (
 	"bytes"
+	"encoding/base64"
 	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+	"unicode"
 
 	sendgrid "github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
+	"golang.org/x/net/html"
 	gomail "gopkg.in/gomail.v2"
 )
 
+// templateCheckInterval is how often watched template files are checked for changes
+const templateCheckInterval time.Duration = time.Second
+
 // Mailer interface includes method needed to send communication to users on account updates
 type Mailer interface {
 	SendMessage(to, templateName, emailSubject string, data interface{}) error
@@ -18,10 +35,50 @@ type sender interface {
 	Send(to, subject, body string) error
 }
 
-// Emailer struct contains parsed glob of email templates a Sender interface to send emails
+// multipartSender is implemented by senders which can send the plain text part, headers and inline images.
+// Other senders are only given the HTML body
+type multipartSender interface {
+	SendMultipart(m *Message) error
+}
+
+// Emailer struct contains parsed glob of email templates a Sender interface to send emails. Templates for other
+// locales are named for the locale before the extension, such as verifyEmail.fr.html
 type Emailer struct {
 	TemplateCache *template.Template
-	Sender        sender
+	// TextTemplateCache holds the plain text versions of the templates, named with a .txt extension such as
+	// verifyEmail.txt. Plain text is generated from the HTML of templates which don't have one. Optional
+	TextTemplateCache *texttemplate.Template
+	Sender            sender
+	// Localizer translates the subjects. Optional
+	Localizer *Localizer
+	// Headers are added to every message, e.g. Reply-To or List-Unsubscribe. Values are templates executed with
+	// the message data, so "<{{.BaseURL}}/unsubscribe>" links to the server the user was on
+	Headers map[string]string
+	// Inline images are attached to the messages which show them with <img src="cid:logo.png">
+	Inline []*InlineImage
+
+	mu          sync.Mutex
+	watched     map[string]time.Time
+	htmlFiles   []string
+	textFiles   []string
+	checkedTime time.Time
+}
+
+// Message is an email with its HTML and plain text bodies
+type Message struct {
+	To       string            `json:"to"`
+	Subject  string            `json:"subject"`
+	HTMLBody string            `json:"htmlBody"`
+	TextBody string            `json:"textBody"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Inline   []*InlineImage    `json:"inline,omitempty"`
+}
+
+// InlineImage is an image embedded in messages and shown by its content ID, such as a logo
+type InlineImage struct {
+	ContentID   string `json:"contentID"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
 }
 
 type SmtpSender struct {
@@ -30,18 +87,60 @@ type SmtpSender struct {
 	SMTPFromEmail        string
 	SMTPPassword         string
 	EmailFromDisplayName string
+	// EnvelopeFrom is the MAIL FROM address bounces are sent to. SMTPFromEmail is used when it's empty
+	EnvelopeFrom string
+	// DKIM signs messages when it's set. Optional
+	DKIM *DKIMSigner
 }
 
+// SendGridSender sends with the SendGrid API. SendGrid sets the envelope sender from the domain authentication
 type SendGridSender struct {
 	APIKey               string
 	EmailFromDisplayName string
 	EmailFromAddress     string
 }
 
+// LoadInlineImage reads an image to embed in messages. Its content ID is the file name, e.g. cid:logo.png
+func LoadInlineImage(filePath string) (*InlineImage, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &InlineImage{ContentID: filepath.Base(filePath), ContentType: contentType, Data: data}, nil
+}
+
 // Send mails the provided email body to recipient at "to" with subject "subject"
 func (s *SendGridSender) Send(to, subject, body string) error {
-	from := mail.NewEmail(s.EmailFromDisplayName, s.EmailFromAddress)
-	message := mail.NewSingleEmail(from, subject, mail.NewEmail("", to), body, body)
+	return s.SendMultipart(&Message{To: to, Subject: subject, HTMLBody: body, TextBody: htmlToText(body)})
+}
+
+// SendMultipart mails both bodies with the headers and inline images of the message
+func (s *SendGridSender) SendMultipart(m *Message) error {
+	from := sgmail.NewEmail(s.EmailFromDisplayName, s.EmailFromAddress)
+	message := sgmail.NewSingleEmail(from, m.Subject, sgmail.NewEmail("", m.To), m.TextBody, m.HTMLBody)
+	for name, value := range m.Headers {
+		if strings.EqualFold(name, "Reply-To") { // SendGrid rejects Reply-To as a custom header
+			address, err := mail.ParseAddress(value)
+			if err != nil {
+				return err
+			}
+			message.SetReplyTo(sgmail.NewEmail(address.Name, address.Address))
+			continue
+		}
+		message.SetHeader(name, value)
+	}
+	for _, image := range m.Inline {
+		message.AddAttachment(sgmail.NewAttachment().
+			SetContent(base64.StdEncoding.EncodeToString(image.Data)).
+			SetType(image.ContentType).
+			SetFilename(image.ContentID).
+			SetDisposition("inline").
+			SetContentID(image.ContentID))
+	}
 	client := sendgrid.NewSendClient(s.APIKey)
 	_, err := client.Send(message)
 	return err
@@ -49,23 +148,316 @@ func (s *SendGridSender) Send(to, subject, body string) error {
 
 // Send mails the provided email body to recipient at "to" with subject "subject"
 func (s *SmtpSender) Send(to, subject, body string) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", m.FormatAddress(s.SMTPFromEmail, s.EmailFromDisplayName))
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
+	return s.SendMultipart(&Message{To: to, Subject: subject, HTMLBody: body, TextBody: htmlToText(body)})
+}
 
-	d := gomail.NewPlainDialer(s.SMTPServer, s.SMTPPort, s.SMTPFromEmail, s.SMTPPassword)
+// SendMultipart mails a multipart/alternative message, inside multipart/related when it has inline images
+func (s *SmtpSender) SendMultipart(m *Message) error {
+	var msg io.WriterTo = mimeMessage(s.SMTPFromEmail, s.EmailFromDisplayName, m)
+	if s.DKIM != nil {
+		var buf bytes.Buffer
+		if _, err := msg.WriteTo(&buf); err != nil {
+			return err
+		}
+		signed, err := s.DKIM.Sign(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		msg = bytes.NewBuffer(signed)
+	}
+	envelopeFrom := s.EnvelopeFrom
+	if envelopeFrom == "" {
+		envelopeFrom = s.SMTPFromEmail
+	}
+	sc, err := gomail.NewPlainDialer(s.SMTPServer, s.SMTPPort, s.SMTPFromEmail, s.SMTPPassword).Dial()
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	return sc.Send(envelopeFrom, []string{envelopeAddress(m.To)}, msg)
+}
+
+// envelopeAddress returns the address of a recipient such as "Name <name@example.com>"
+func envelopeAddress(to string) string {
+	if address, err := mail.ParseAddress(to); err == nil {
+		return address.Address
+	}
+	return to
+}
 
-	return d.DialAndSend(m)
+// mimeMessage builds the multipart message sent for m
+func mimeMessage(fromEmail, fromDisplayName string, m *Message) *gomail.Message {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", msg.FormatAddress(fromEmail, fromDisplayName))
+	msg.SetHeader("To", m.To)
+	msg.SetHeader("Subject", m.Subject)
+	for name, value := range m.Headers {
+		msg.SetHeader(name, value)
+	}
+	msg.SetBody("text/plain", m.TextBody)
+	msg.AddAlternative("text/html", m.HTMLBody)
+	for _, image := range m.Inline {
+		data := image.Data
+		msg.Embed(image.ContentID, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}), gomail.SetHeader(map[string][]string{
+			"Content-ID":   {"<" + image.ContentID + ">"},
+			"Content-Type": {image.ContentType},
+		}))
+	}
+	return msg
 }
 
-// SendMessage prepares an email with the provided template and passes it to Send for mailing
+// SendMessage prepares an email with the provided template and passes it to Send for mailing. When data is
+// EmailSendParams with a Locale, the template and subject for that locale are used if there are any
 func (e *Emailer) SendMessage(to, templateName, emailSubject string, data interface{}) error {
-	var buf bytes.Buffer
-	err := e.TemplateCache.ExecuteTemplate(&buf, templateName, data)
+	m, err := e.render(to, templateName, emailSubject, data)
 	if err != nil {
 		return err
 	}
-	return e.Sender.Send(to, emailSubject, buf.String())
+	return e.send(m)
+}
+
+// WatchTemplates reparses the HTML and plain text template files when one of them changes, so templates can be
+// edited without a restart. A change which doesn't parse is logged and the previous templates are kept
+func (e *Emailer) WatchTemplates(htmlFiles, textFiles []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.htmlFiles, e.textFiles = htmlFiles, textFiles
+	e.watched = make(map[string]time.Time)
+	for _, file := range append(append([]string{}, htmlFiles...), textFiles...) {
+		if info, err := os.Stat(file); err == nil {
+			e.watched[file] = info.ModTime()
+		}
+	}
+	e.checkedTime = time.Now()
+}
+
+// templates returns the template caches, reloading them first if a watched file changed
+func (e *Emailer) templates() (*template.Template, *texttemplate.Template) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.watched == nil || time.Since(e.checkedTime) < templateCheckInterval {
+		return e.TemplateCache, e.TextTemplateCache
+	}
+	e.checkedTime = time.Now()
+	changed := false
+	for file, modTime := range e.watched {
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(modTime) {
+			e.watched[file] = info.ModTime() // only try each change once, so a bad file is logged once
+			changed = true
+		}
+	}
+	if !changed {
+		return e.TemplateCache, e.TextTemplateCache
+	}
+	htmlCache, err := template.ParseFiles(e.htmlFiles...)
+	if err != nil {
+		log.Println("Keeping previous email templates.", err)
+		return e.TemplateCache, e.TextTemplateCache
+	}
+	textCache := e.TextTemplateCache
+	if len(e.textFiles) > 0 {
+		if textCache, err = texttemplate.ParseFiles(e.textFiles...); err != nil {
+			log.Println("Keeping previous email templates.", err)
+			return e.TemplateCache, e.TextTemplateCache
+		}
+	}
+	log.Println("Reloaded email templates")
+	e.TemplateCache, e.TextTemplateCache = htmlCache, textCache
+	return e.TemplateCache, e.TextTemplateCache
+}
+
+// render executes the templates of a message and the headers, and picks the inline images it shows
+func (e *Emailer) render(to, templateName, emailSubject string, data interface{}) (*Message, error) {
+	htmlCache, textCache := e.templates()
+	locale := dataLocale(data)
+	htmlName, emailSubject := e.localize(htmlCache, locale, templateName, emailSubject)
+	var buf bytes.Buffer
+	err := htmlCache.ExecuteTemplate(&buf, htmlName, data)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{To: to, Subject: emailSubject, HTMLBody: buf.String(), Headers: make(map[string]string)}
+	if m.TextBody, err = textBody(textCache, locale, templateName, htmlName, m.HTMLBody, data); err != nil {
+		return nil, err
+	}
+	for name, value := range e.Headers {
+		if m.Headers[name], err = executeText(value, data); err != nil {
+			return nil, err
+		}
+	}
+	for _, image := range e.Inline {
+		if strings.Contains(m.HTMLBody, "cid:"+image.ContentID) {
+			m.Inline = append(m.Inline, image)
+		}
+	}
+	return m, nil
+}
+
+// send passes the whole message to senders which can send it, and only the HTML body to the others
+func (e *Emailer) send(m *Message) error {
+	if multipart, ok := e.Sender.(multipartSender); ok {
+		return multipart.SendMultipart(m)
+	}
+	return e.Sender.Send(m.To, m.Subject, m.HTMLBody)
+}
+
+// localize returns the template and subject for the locale or its language, falling back to the defaults
+func (e *Emailer) localize(htmlCache *template.Template, locale, templateName, emailSubject string) (string, string) {
+	if locale == "" {
+		return templateName, emailSubject
+	}
+	ext := filepath.Ext(templateName)
+	base := strings.TrimSuffix(templateName, ext)
+	emailSubject = e.Localizer.Message(locale, base+".subject", emailSubject)
+	return localizedTemplate(locale, base, ext, templateName, func(name string) bool { return htmlCache.Lookup(name) != nil }), emailSubject
+}
+
+// textBody renders the .txt template paired with the HTML one, or converts the HTML when there isn't one. When the
+// HTML was localized, only the .txt of the same locale pairs with it, so the text isn't sent in another language
+func textBody(textCache *texttemplate.Template, locale, templateName, htmlName, htmlBody string, data interface{}) (string, error) {
+	if textCache == nil {
+		return htmlToText(htmlBody), nil
+	}
+	base := strings.TrimSuffix(templateName, filepath.Ext(templateName))
+	name := localizedTemplate(locale, base, ".txt", base+".txt", func(name string) bool { return textCache.Lookup(name) != nil })
+	if htmlName != templateName {
+		name = strings.TrimSuffix(htmlName, filepath.Ext(htmlName)) + ".txt"
+	}
+	if textCache.Lookup(name) == nil {
+		return htmlToText(htmlBody), nil
+	}
+	var buf bytes.Buffer
+	err := textCache.ExecuteTemplate(&buf, name, data)
+	return buf.String(), err
+}
+
+// localizedTemplate returns the first of base.<locale>.ext and base.<language>.ext which exists, or fallback
+func localizedTemplate(locale, base, ext, fallback string, exists func(name string) bool) string {
+	for _, candidate := range localeCandidates(locale) {
+		if name := base + "." + candidate + ext; exists(name) {
+			return name
+		}
+	}
+	return fallback
+}
+
+func executeText(text string, data interface{}) (string, error) {
+	t, err := texttemplate.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func dataLocale(data interface{}) string {
+	switch params := data.(type) {
+	case EmailSendParams:
+		return params.Locale
+	case *EmailSendParams:
+		return params.Locale
+	}
+	return ""
+}
+
+// htmlToText returns the text of an HTML email for its plain text part. Links are followed by their URL
+func htmlToText(body string) string {
+	var text strings.Builder
+	z := html.NewTokenizer(strings.NewReader(body))
+	skip := 0
+	var href string
+	linkStart := 0
+	for {
+		tokenType := z.Next()
+		name, hasAttr := z.TagName()
+		tag := string(name)
+		switch tokenType {
+		case html.ErrorToken:
+			return tidyText(text.String())
+		case html.TextToken:
+			if skip == 0 {
+				text.WriteString(strings.Map(func(r rune) rune {
+					if unicode.IsSpace(r) {
+						return ' '
+					}
+					return r
+				}, string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+			switch tag {
+			case "head", "style", "script", "title":
+				if tokenType == html.StartTagToken {
+					skip++
+				}
+			case "br":
+				text.WriteString("\n")
+			case "li":
+				text.WriteString("\n- ")
+			case "img":
+				text.WriteString(attrs["alt"])
+			case "a":
+				href, linkStart = attrs["href"], text.Len()
+			default:
+				if isBlockTag(tag) {
+					text.WriteString("\n\n")
+				}
+			}
+		case html.EndTagToken:
+			switch tag {
+			case "head", "style", "script", "title":
+				if skip > 0 {
+					skip--
+				}
+			case "a":
+				linkText := strings.TrimSpace(text.String()[linkStart:])
+				if href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(href, "cid:") && linkText != href && linkText != strings.TrimPrefix(href, "mailto:") {
+					text.WriteString(" (" + href + ")")
+				}
+				href = ""
+			default:
+				if isBlockTag(tag) {
+					text.WriteString("\n\n")
+				}
+			}
+		}
+	}
+}
+
+func isBlockTag(tag string) bool {
+	switch tag {
+	case "p", "div", "h1", "h2", "h3", "h4", "h5", "h6", "table", "tr", "ul", "ol", "blockquote", "section", "header", "footer", "hr":
+		return true
+	}
+	return false
+}
+
+// tidyText collapses the spaces in lines and keeps at most one blank line between paragraphs
+func tidyText(text string) string {
+	lines := strings.Split(text, "\n")
+	var result []string
+	blank := false
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			blank = len(result) > 0
+			continue
+		}
+		if blank {
+			result = append(result, "")
+			blank = false
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\n")
 }
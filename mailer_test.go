@@ -2,7 +2,13 @@ package auth
 
 import (
 	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	texttemplate "text/template"
+	"time"
 )
 
 const verifyEmailTmpl string = "email:{{ .Email }}"
@@ -20,6 +26,136 @@ func TestSends(t *testing.T) {
 	}
 }
 
+func TestSendsLocalized(t *testing.T) {
+	sender := &NilSender{}
+	m := Emailer{Sender: sender, Localizer: getLocalizer(t)}
+	m.TemplateCache = template.Must(template.New("verifyEmail.html").Parse(verifyEmailTmpl))
+	template.Must(m.TemplateCache.New("verifyEmail.fr.html").Parse("courriel:{{ .Email }}"))
+	template.Must(m.TemplateCache.New("verifyEmail.pt-BR.html").Parse("e-mail:{{ .Email }}"))
+
+	tests := []struct {
+		Locale  string
+		Body    string
+		Subject string
+	}{
+		{"", "email:test@test.com", "Verify"},
+		{"fr-CA", "courriel:test@test.com", "Vérifiez votre e-mail"},
+		{"pt-BR", "e-mail:test@test.com", "Verify"},
+		{"pt", "email:test@test.com", "Verify"},
+		{"de", "email:test@test.com", "Verify"},
+	}
+	for i, test := range tests {
+		if err := m.SendMessage("to", "verifyEmail.html", "Verify", EmailSendParams{Email: "test@test.com", Locale: test.Locale}); err != nil ||
+			sender.LastBody != test.Body || sender.LastSubject != test.Subject {
+			t.Errorf("test %d: expected %q %q, got %q %q %v", i, test.Body, test.Subject, sender.LastBody, sender.LastSubject, err)
+		}
+	}
+}
+
+func TestSendsMultipart(t *testing.T) {
+	sender := &MultipartSender{}
+	logo := &InlineImage{ContentID: "logo.png", ContentType: "image/png", Data: []byte("png")}
+	m := Emailer{
+		Sender:  sender,
+		Headers: map[string]string{"List-Unsubscribe": "<{{ .BaseURL }}/unsubscribe>", "Reply-To": "help@example.com"},
+		Inline:  []*InlineImage{logo, {ContentID: "banner.png"}},
+	}
+	m.TemplateCache = template.Must(template.New("verifyEmail.html").Parse(`<img src="cid:logo.png" alt="Logo"><p>Hi {{ .Email }}</p>`))
+	data := EmailSendParams{Email: "test@test.com", BaseURL: "https://example.com"}
+	if err := m.SendMessage("to", "verifyEmail.html", "Verify", data); err != nil || sender.Last.TextBody != "Logo\n\nHi test@test.com" ||
+		sender.Last.Headers["List-Unsubscribe"] != "<https://example.com/unsubscribe>" || sender.Last.Headers["Reply-To"] != "help@example.com" ||
+		len(sender.Last.Inline) != 1 || sender.Last.Inline[0] != logo || sender.Last.To != "to" || sender.Last.Subject != "Verify" {
+		t.Error("expected generated text, headers and logo", sender.Last, err)
+	}
+
+	m.TextTemplateCache = texttemplate.Must(texttemplate.New("verifyEmail.txt").Parse("Hi {{ .Email }}"))
+	texttemplate.Must(m.TextTemplateCache.New("verifyEmail.fr.txt").Parse("Salut {{ .Email }}"))
+	data.Locale = "fr-CA"
+	if err := m.SendMessage("to", "verifyEmail.html", "Verify", data); err != nil || sender.Last.TextBody != "Salut test@test.com" {
+		t.Error("expected localized text template", sender.Last.TextBody, err)
+	}
+	data.Locale = ""
+	if err := m.SendMessage("to", "verifyEmail.html", "Verify", data); err != nil || sender.Last.TextBody != "Hi test@test.com" {
+		t.Error("expected text template", sender.Last.TextBody, err)
+	}
+
+	welcome := Emailer{Sender: sender}
+	welcome.TemplateCache = template.Must(template.New("welcome.html").Parse("<p>Welcome {{ .Email }}</p>"))
+	template.Must(welcome.TemplateCache.New("welcome.fr.html").Parse("<p>Bienvenue {{ .Email }}</p>"))
+	welcome.TextTemplateCache = texttemplate.Must(texttemplate.New("welcome.txt").Parse("Welcome {{ .Email }}"))
+	if err := welcome.SendMessage("to", "welcome.html", "Welcome", EmailSendParams{Email: "test@test.com", Locale: "fr"}); err != nil || sender.Last.TextBody != "Bienvenue test@test.com" {
+		t.Error("expected text from the localized HTML rather than the default text template", sender.Last.TextBody, err)
+	}
+
+	m.Headers["Bad"] = "{{ .Missing"
+	if err := m.SendMessage("to", "verifyEmail.html", "Verify", data); err == nil {
+		t.Error("expected header template error")
+	}
+}
+
+func TestWatchTemplates(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	htmlFile, textFile := filepath.Join(dir, "verifyEmail.html"), filepath.Join(dir, "verifyEmail.txt")
+	ioutil.WriteFile(htmlFile, []byte("<p>one</p>"), 0644)
+	ioutil.WriteFile(textFile, []byte("one"), 0644)
+
+	sender := &MultipartSender{}
+	m := &Emailer{Sender: sender}
+	m.TemplateCache = template.Must(template.ParseFiles(htmlFile))
+	m.TextTemplateCache = texttemplate.Must(texttemplate.ParseFiles(textFile))
+	m.WatchTemplates([]string{htmlFile}, []string{textFile})
+
+	edit := func(file, content string, modTime time.Time) {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		os.Chtimes(file, modTime, modTime)
+		m.checkedTime = time.Time{} // skip the check interval
+	}
+	edit(htmlFile, "<p>two</p>", time.Now().Add(time.Minute))
+	edit(textFile, "two", time.Now().Add(time.Minute))
+	if err := m.SendMessage("to", "verifyEmail.html", "Verify", nil); err != nil || sender.Last.HTMLBody != "<p>two</p>" || sender.Last.TextBody != "two" {
+		t.Error("expected reloaded templates", sender.Last, err)
+	}
+
+	edit(htmlFile, "<p>{{ .Broken </p>", time.Now().Add(2*time.Minute))
+	if err := m.SendMessage("to", "verifyEmail.html", "Verify", nil); err != nil || sender.Last.HTMLBody != "<p>two</p>" {
+		t.Error("expected previous templates to be kept", sender.Last, err)
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		HTML string
+		Text string
+	}{
+		{"<html><head><title>Title</title><style>p { color: red; }</style></head><body><h1>Welcome</h1><p>Hello   there,\n friend</p></body></html>", "Welcome\n\nHello there, friend"},
+		{`<p>Click <a href="https://example.com/verify?code=1">here</a> to verify</p>`, "Click here (https://example.com/verify?code=1) to verify"},
+		{`<a href="https://example.com">https://example.com</a><br>Line two`, "https://example.com\nLine two"},
+		{"<ul><li>one</li><li>two</li></ul>", "- one\n- two"},
+		{`<img src="cid:logo.png" alt="Company"><script>alert(1)</script>`, "Company"},
+	}
+	for i, test := range tests {
+		if text := htmlToText(test.HTML); text != test.Text {
+			t.Errorf("test %d: expected %q, got %q", i, test.Text, text)
+		}
+	}
+}
+
+func TestLoadInlineImage(t *testing.T) {
+	if _, err := LoadInlineImage("testTemplates/missing.png"); err == nil {
+		t.Error("expected missing file error")
+	}
+	image, err := LoadInlineImage("testTemplates/verifyEmail.fr.html")
+	if err != nil || image.ContentID != "verifyEmail.fr.html" || image.ContentType != "text/html; charset=utf-8" || len(image.Data) == 0 {
+		t.Error("expected loaded image", image, err)
+	}
+}
+
 /***************************************************************************************/
 
 type NilSender struct {
@@ -35,6 +171,16 @@ func (s *NilSender) Send(to, subject, body string) error {
 	return nil
 }
 
+type MultipartSender struct {
+	NilSender
+	Last *Message
+}
+
+func (s *MultipartSender) SendMultipart(m *Message) error {
+	s.Last = m
+	return nil
+}
+
 type TextMailer struct {
 	Err error
 	Mailer
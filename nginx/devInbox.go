@@ -0,0 +1,131 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+const devInboxPath string = "/dev/inbox"
+
+// devInboxPage lists the emails kept by the dev mode inbox with the links in each, so they can be followed
+var devInboxPage = template.Must(template.New("inbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Inbox</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: .5em; border-bottom: 1px solid #ddd; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Inbox</h1>
+<p>Dev mode keeps the emails in memory instead of sending them.</p>
+<form method="POST" action="{{.Path}}/clear"><button type="submit">Clear</button></form>
+<table>
+<tr><th>Sent</th><th>To</th><th>Subject</th><th>Links</th></tr>
+{{range .Messages}}<tr>
+<td>{{.SentTimeUTC.Format "15:04:05"}}</td>
+<td>{{.To}}</td>
+<td><a href="{{$.Path}}/message?id={{.ID}}">{{.Subject}}</a></td>
+<td>{{range .Links}}<a href="{{.}}">{{.}}</a><br>{{end}}</td>
+</tr>{{else}}<tr><td colspan="4">No emails</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// newDevInbox replaces the mail sender with an in-memory inbox in dev mode
+func (n *authConf) newDevInbox(mailer *auth.Emailer) *auth.Inbox {
+	if !isTrue(n.DevMode) {
+		return nil
+	}
+	inbox := auth.NewInbox()
+	mailer.Sender = inbox
+	return inbox
+}
+
+func (s *nginxauth) serveDevInbox() {
+	http.HandleFunc(devInboxPath, s.devInbox)
+	http.HandleFunc(devInboxPath+"/messages", s.devInboxMessages)
+	http.HandleFunc(devInboxPath+"/message", s.devInboxMessage)
+	http.HandleFunc(devInboxPath+"/inline", s.devInboxInline)
+	http.HandleFunc(devInboxPath+"/clear", s.devInboxClear)
+	if s.sms != nil {
+		http.HandleFunc(devInboxPath+"/sms", s.devInboxSMS)
+	}
+}
+
+// devInbox shows the emails, newest first
+func (s *nginxauth) devInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodErr(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	devInboxPage.Execute(w, struct {
+		Path     string
+		Messages []*auth.InboxMessage
+	}{devInboxPath, s.inbox.Messages(r.FormValue("to"))})
+}
+
+// devInboxMessages sends the emails to the "to" address, or all of them, as JSON with their links, so scripts can
+// follow a verification link
+func (s *nginxauth) devInboxMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodErr(w)
+		return
+	}
+	type inboxMessage struct {
+		*auth.InboxMessage
+		Links []string `json:"links"`
+	}
+	messages := []inboxMessage{}
+	for _, message := range s.inbox.Messages(r.FormValue("to")) {
+		messages = append(messages, inboxMessage{message, message.Links()})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, messages)
+}
+
+// devInboxMessage shows the HTML body of an email, sandboxed so its scripts can't run
+func (s *nginxauth) devInboxMessage(w http.ResponseWriter, r *http.Request) {
+	message := s.inbox.Get(r.FormValue("id"))
+	if message == nil {
+		writeError(w, http.StatusNotFound, auth.ErrCodeNotFound, "Email not found")
+		return
+	}
+	inline := devInboxPath + "/inline?id=" + url.QueryEscape(message.ID) + "&cid="
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "sandbox allow-popups allow-popups-to-escape-sandbox allow-top-navigation-by-user-activation")
+	w.Write([]byte(strings.Replace(message.HTMLBody, `"cid:`, `"`+inline, -1)))
+}
+
+// devInboxInline sends an inline image of an email, such as the logo
+func (s *nginxauth) devInboxInline(w http.ResponseWriter, r *http.Request) {
+	if message := s.inbox.Get(r.FormValue("id")); message != nil {
+		for _, image := range message.Inline {
+			if image.ContentID == r.FormValue("cid") {
+				w.Header().Set("Content-Type", image.ContentType)
+				w.Write(image.Data)
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, auth.ErrCodeNotFound, "Image not found")
+}
+
+func (s *nginxauth) devInboxClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodErr(w)
+		return
+	}
+	s.inbox.Clear()
+	http.Redirect(w, r, devInboxPath, http.StatusSeeOther)
+}
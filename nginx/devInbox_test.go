@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+func TestNewDevInbox(t *testing.T) {
+	mailer := &auth.Emailer{}
+	if inbox := (&authConf{}).newDevInbox(mailer); inbox != nil || mailer.Sender != nil {
+		t.Error("expected no inbox outside dev mode")
+	}
+	if inbox := (&authConf{DevMode: "true"}).newDevInbox(mailer); inbox == nil || mailer.Sender != inbox {
+		t.Error("expected inbox to replace the sender")
+	}
+}
+
+func TestDevInbox(t *testing.T) {
+	s := &nginxauth{inbox: auth.NewInbox()}
+	s.inbox.SendMultipart(&auth.Message{To: "test@test.com", Subject: "Verify",
+		HTMLBody: `<img src="cid:logo.png"><a href="https://example.com/verify?code=1">Verify</a>`,
+		Inline:   []*auth.InlineImage{{ContentID: "logo.png", ContentType: "image/png", Data: []byte("png")}}})
+	message := s.inbox.Latest("")
+
+	w := httptest.NewRecorder()
+	s.devInbox(w, httptest.NewRequest("GET", "/dev/inbox", nil))
+	if body := w.Body.String(); !strings.Contains(body, "test@test.com") || !strings.Contains(body, `href="https://example.com/verify?code=1"`) {
+		t.Error("expected email and link", body)
+	}
+
+	w = httptest.NewRecorder()
+	s.devInboxMessages(w, httptest.NewRequest("GET", "/dev/inbox/messages?to=test@test.com", nil))
+	if body := w.Body.String(); !strings.Contains(body, `"links":["https://example.com/verify?code=1"]`) || !strings.Contains(body, `"subject":"Verify"`) {
+		t.Error("expected JSON with links", body)
+	}
+	w = httptest.NewRecorder()
+	s.devInboxMessages(w, httptest.NewRequest("GET", "/dev/inbox/messages?to=other@test.com", nil))
+	checkBody(t, "[]", w)
+
+	w = httptest.NewRecorder()
+	s.devInboxMessage(w, httptest.NewRequest("GET", "/dev/inbox/message?id="+message.ID, nil))
+	if body := w.Body.String(); !strings.Contains(body, `src="/dev/inbox/inline?id=`) || w.Header().Get("Content-Security-Policy") == "" {
+		t.Error("expected sandboxed body with inline image links", body)
+	}
+	w = httptest.NewRecorder()
+	s.devInboxMessage(w, httptest.NewRequest("GET", "/dev/inbox/message?id=unknown", nil))
+	if w.Code != 404 {
+		t.Error("expected not found", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.devInboxInline(w, httptest.NewRequest("GET", "/dev/inbox/inline?cid=logo.png&id="+message.ID, nil))
+	if w.Body.String() != "png" || w.Header().Get("Content-Type") != "image/png" {
+		t.Error("expected logo", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.devInboxClear(w, httptest.NewRequest("GET", "/dev/inbox/clear", nil))
+	if w.Code != 405 || s.inbox.Latest("") == nil {
+		t.Error("expected clear to need POST", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.devInboxClear(w, httptest.NewRequest("POST", "/dev/inbox/clear", nil))
+	if w.Code != 303 || s.inbox.Latest("") != nil {
+		t.Error("expected cleared inbox", w.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/EndFirstCorp/configReader"
+)
+
+// previewCode is the VerificationCode templates are previewed with, so it can be found in their links
+const previewCode string = "PREVIEW-CODE-1234"
+
+const previewEmail string = "jane.doe@example.com"
+
+const previewBaseURL string = "https://auth.example.com"
+
+// emailPreview is a configured template. Code is set when its links must include the VerificationCode
+type emailPreview struct {
+	File    string
+	Subject string
+	Code    bool
+}
+
+// previewEmailTemplates writes the previews for the config file and prints the problems found. It doesn't need the
+// databases, so templates can be checked before deploying them
+func previewEmailTemplates(configFile, dir string) error {
+	config := authConf{}
+	if err := configReader.ReadFile(configFile, &config); err != nil {
+		return err
+	}
+	problems, err := config.previewEmails(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Wrote email previews to", dir)
+	if len(problems) > 0 {
+		fmt.Println(strings.Join(problems, "\n"))
+		return fmt.Errorf("%d problems found in the email templates", len(problems))
+	}
+	return nil
+}
+
+func (n *authConf) emailPreviews() []emailPreview {
+	var previews []emailPreview
+	for _, p := range []emailPreview{
+		{n.VerifyEmailTemplate, n.VerifyEmailSubject, true},
+		{n.WelcomeTemplate, n.WelcomeSubject, false},
+		{n.NewLoginTemplate, n.NewLoginSubject, false},
+		{n.LockedOutTemplate, n.LockedOutSubject, false},
+		{n.EmailChangedTemplate, n.EmailChangedSubject, true},
+		{n.ConfirmEmailChangeTemplate, n.ConfirmEmailChangeSubject, true},
+		{n.PasswordChangedTemplate, n.PasswordChangedSubject, false},
+		{n.MagicLinkTemplate, n.MagicLinkSubject, true},
+		{n.PasswordResetTemplate, n.PasswordResetSubject, true},
+		{n.InvitationTemplate, n.InvitationSubject, true},
+		{n.LoginCodeTemplate, n.LoginCodeSubject, true},
+	} {
+		if p.File != "" {
+			previews = append(previews, p)
+		}
+	}
+	return previews
+}
+
+// previewEmails renders every configured template and its localized versions with sample data, and writes the
+// HTML and plain text of each to dir. Templates are executed with missingkey=error so fields missing from the info
+// are reported, as are verification links without the VerificationCode. It returns the problems found
+func (n *authConf) previewEmails(dir string) ([]string, error) {
+	info := map[string]interface{}{"fullName": "Jane Doe", "newEmail": "jane.new@example.com"}
+	if n.EmailPreviewInfo != "" {
+		if err := json.Unmarshal([]byte(n.EmailPreviewInfo), &info); err != nil {
+			return nil, fmt.Errorf("EmailPreviewInfo must be a JSON object: %v", err)
+		}
+	}
+	emailer, err := n.NewEmailer()
+	if err != nil {
+		return nil, err
+	}
+	emailer.TemplateCache.Option("missingkey=error")
+	if emailer.TextTemplateCache != nil {
+		emailer.TextTemplateCache.Option("missingkey=error")
+	}
+	if emailer.Localizer, err = auth.NewLocalizer(n.LocaleCatalogDir, n.DefaultLocale); err != nil {
+		return nil, err
+	}
+	inbox := auth.NewInbox()
+	emailer.Sender = inbox
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, p := range n.emailPreviews() {
+		ext := filepath.Ext(p.File)
+		base := strings.TrimSuffix(templateName(p.File), ext)
+		for _, file := range templateFiles(p.File) {
+			name := filepath.Base(file)
+			locale := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSuffix(name, ext), base), ".")
+			params := auth.EmailSendParams{VerificationCode: previewCode, Email: previewEmail, BaseURL: previewBaseURL, Info: previewInfo(info, locale), Locale: locale}
+			if err := emailer.SendMessage(previewEmail, templateName(p.File), p.Subject, params); err != nil {
+				problems = append(problems, name+": "+err.Error())
+				continue
+			}
+			m := inbox.Latest(previewEmail)
+			if p.Code && !hasPreviewCode(m, n.OneTimeCodeLength > 0 || p.File == n.LoginCodeTemplate) {
+				problems = append(problems, name+": no link includes the VerificationCode")
+			} else if p.Code && !strings.Contains(m.TextBody, previewCode) {
+				problems = append(problems, name+": the plain text version doesn't include the VerificationCode")
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(m.HTMLBody), 0644); err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, strings.TrimSuffix(name, ext)+".txt"), []byte("Subject: "+m.Subject+"\n\n"+m.TextBody), 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// hasPreviewCode checks the links of the message for the code. One-time codes may be shown instead of a link
+func hasPreviewCode(m *auth.InboxMessage, oneTimeCode bool) bool {
+	for _, link := range m.Links() {
+		if strings.Contains(link, previewCode) {
+			return true
+		}
+	}
+	return oneTimeCode && strings.Contains(m.HTMLBody, previewCode)
+}
+
+// previewInfo copies the sample info and sets the locale, as a user who chose it would have
+func previewInfo(info map[string]interface{}, locale string) map[string]interface{} {
+	copied := make(map[string]interface{}, len(info)+1)
+	for key, value := range info {
+		copied[key] = value
+	}
+	if locale != "" {
+		copied[auth.InfoLocale] = locale
+	}
+	return copied
+}
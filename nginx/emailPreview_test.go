@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreviewEmails(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "preview")
+	defer os.RemoveAll(dir)
+	templates := map[string]string{
+		"verifyEmail.html":    `<a href="{{.BaseURL}}/verify?code={{.VerificationCode}}">Verify, {{.Info.fullName}}</a>`,
+		"verifyEmail.fr.html": `<a href="{{.BaseURL}}/verify">Vérifier</a>`,
+		"welcome.html":        `Welcome {{.Info.nickname}}`,
+		"magicLink.html":      `<a href="{{.BaseURL}}/magic?code={{.VerificationCode}}">Log in</a>`,
+		"magicLink.txt":       `Log in at {{.BaseURL}}/magic`,
+	}
+	for name, content := range templates {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	n := authConf{VerifyEmailTemplate: filepath.Join(dir, "verifyEmail.html"), VerifyEmailSubject: "Verify",
+		WelcomeTemplate: filepath.Join(dir, "welcome.html"), MagicLinkTemplate: filepath.Join(dir, "magicLink.html")}
+
+	out := filepath.Join(dir, "out")
+	problems, err := n.previewEmails(out)
+	if err != nil || len(problems) != 3 {
+		t.Fatal("expected problems", problems, err)
+	}
+	if !strings.HasPrefix(problems[0], "verifyEmail.fr.html: no link") || !strings.Contains(problems[1], `map has no entry for key "nickname"`) ||
+		!strings.HasPrefix(problems[2], "magicLink.html: the plain text") {
+		t.Error("unexpected problems", problems)
+	}
+	if html, _ := ioutil.ReadFile(filepath.Join(out, "verifyEmail.html")); string(html) != `<a href="https://auth.example.com/verify?code=PREVIEW-CODE-1234">Verify, Jane Doe</a>` {
+		t.Error("expected HTML preview", string(html))
+	}
+	if text, _ := ioutil.ReadFile(filepath.Join(out, "verifyEmail.txt")); !strings.HasPrefix(string(text), "Subject: Verify\n\n") {
+		t.Error("expected plain text preview", string(text))
+	}
+	if _, err := os.Stat(filepath.Join(out, "welcome.html")); err == nil {
+		t.Error("expected no preview of a template which failed")
+	}
+
+	n.EmailPreviewInfo = `{"nickname": "jd"}`
+	if problems, err := n.previewEmails(out); err != nil || len(problems) != 2 {
+		t.Error("expected info from config", problems, err)
+	}
+	n.EmailPreviewInfo = `[]`
+	if _, err := n.previewEmails(out); err == nil {
+		t.Error("expected info error")
+	}
+}
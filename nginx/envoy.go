@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// envoyAuthServer implements the Envoy ext_authz v3 Check RPC. Each check is answered like an nginx auth_request
+type envoyAuthServer struct {
+	s         *nginxauth
+	authStore auth.AuthStorer
+}
+
+// envoyResponse records the auth_request response so it can be translated into a CheckResponse
+type envoyResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (s *nginxauth) serveEnvoyGRPC(port int) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Println("unable to start Envoy ext_authz server:", err)
+		return
+	}
+	if err := s.newEnvoyGRPCServer(s.a).Serve(listener); err != nil {
+		log.Println("Envoy ext_authz server stopped:", err)
+	}
+}
+
+func (s *nginxauth) newEnvoyGRPCServer(authStore auth.AuthStorer) *grpc.Server {
+	server := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(server, &envoyAuthServer{s: s, authStore: authStore})
+	return server
+}
+
+func (e *envoyAuthServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	w := &envoyResponse{header: http.Header{}}
+	e.s.authEnvoy(e.authStore, w, envoyRequest(req))
+	return e.s.checkResponse(w), nil
+}
+
+// envoyRequest builds an auth subrequest from the attributes of the request Envoy is checking. Required roles and
+// permissions come from the route's context extensions "role" and "permission", never from the client's headers
+func envoyRequest(req *authv3.CheckRequest) *http.Request {
+	attributes := req.GetAttributes()
+	request := attributes.GetRequest().GetHttp()
+	r, _ := http.NewRequest("GET", "/auth", nil)
+	for name, value := range request.GetHeaders() {
+		if !strings.HasPrefix(name, ":") {
+			r.Header.Set(name, value)
+		}
+	}
+	r.Host = request.GetHost()
+	r.Header.Del("X-Required-Role")
+	r.Header.Del("X-Required-Permission")
+	extensions := attributes.GetContextExtensions()
+	if role := extensions["role"]; role != "" {
+		r.Header.Set("X-Required-Role", role)
+	}
+	if permission := extensions["permission"]; permission != "" {
+		r.Header.Set("X-Required-Permission", permission)
+	}
+	r.Header.Set("X-Original-Method", request.GetMethod())
+	r.Header.Set("X-Original-URI", request.GetPath())
+	r.Header.Del("X-Real-IP")
+	if ip := attributes.GetSource().GetAddress().GetSocketAddress().GetAddress(); ip != "" {
+		r.Header.Set("X-Real-IP", ip)
+	}
+	return r
+}
+
+// envoyHTTP answers Envoy's ext_authz http_service, which sends the checked request to EnvoyHTTPPrefix followed by its
+// path. Envoy only forwards its allowed_headers, so Cookie must be allowed, and X-Real-IP should be set with
+// "%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%" for policies which check IP ranges
+func (s *nginxauth) envoyHTTP(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimSuffix(s.conf.EnvoyHTTPPrefix, "/")
+	r.Header.Set("X-Original-Method", r.Method)
+	r.Header.Set("X-Original-URI", "/"+strings.TrimPrefix(strings.TrimPrefix(r.URL.RequestURI(), prefix), "/"))
+	r.URL.RawQuery = ""
+	s.authEnvoy(authStore, w, r)
+}
+
+// authEnvoy checks basic auth when the request has it, so API clients get a WWW-Authenticate challenge
+func (s *nginxauth) authEnvoy(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+		s.authBasic(authStore, w, r)
+		return
+	}
+	s.authCookie(authStore, w, r)
+}
+
+// checkResponse allows the request with the user headers, replacing any the client sent, or denies it with the
+// auth_request response. Cookies from renewed sessions are sent to the client either way
+func (s *nginxauth) checkResponse(w *envoyResponse) *authv3.CheckResponse {
+	if w.status == 0 || w.status == http.StatusOK {
+		ok := &authv3.OkHttpResponse{}
+		for _, name := range s.userHeaders().names() {
+			if _, set := w.header[name]; !set {
+				ok.HeadersToRemove = append(ok.HeadersToRemove, strings.ToLower(name))
+			}
+		}
+		for name, values := range w.header {
+			if name == "Set-Cookie" {
+				ok.ResponseHeadersToAdd = append(ok.ResponseHeadersToAdd, headerValueOptions(name, values, true)...)
+			} else {
+				ok.Headers = append(ok.Headers, headerValueOptions(name, values, false)...)
+			}
+		}
+		return &authv3.CheckResponse{
+			Status:       &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: ok},
+		}
+	}
+
+	denied := &authv3.DeniedHttpResponse{Status: &typev3.HttpStatus{Code: typev3.StatusCode(w.status)}, Body: w.body.String()}
+	for name, values := range w.header {
+		denied.Headers = append(denied.Headers, headerValueOptions(name, values, true)...)
+	}
+	code := codes.PermissionDenied
+	if w.status == http.StatusUnauthorized {
+		code = codes.Unauthenticated
+	}
+	message := strings.TrimSpace(w.body.String())
+	body := &errorResponse{}
+	if err := json.Unmarshal(w.body.Bytes(), body); err == nil && body.Error.Message != "" {
+		message = body.Error.Message
+	}
+	return &authv3.CheckResponse{
+		Status:       &rpcstatus.Status{Code: int32(code), Message: message},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: denied},
+	}
+}
+
+func headerValueOptions(name string, values []string, appendValues bool) []*corev3.HeaderValueOption {
+	options := make([]*corev3.HeaderValueOption, len(values))
+	for i, value := range values {
+		options[i] = &corev3.HeaderValueOption{
+			Header: &corev3.HeaderValue{Key: strings.ToLower(name), Value: value},
+			Append: &wrappers.BoolValue{Value: appendValues || i > 0},
+		}
+	}
+	return options
+}
+
+func (w *envoyResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *envoyResponse) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *envoyResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func getEnvoyClient(t *testing.T, s *nginxauth, storer auth.AuthStorer) (authv3.AuthorizationClient, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := s.newEnvoyGRPCServer(storer)
+	go server.Serve(listener)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authv3.NewAuthorizationClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func checkRequest(method, path string, headers map[string]string, extensions map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+		Source: &authv3.AttributeContext_Peer{Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{Address: "10.0.0.1"}}}},
+		Request:           &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{Method: method, Path: path, Host: "app.example.com", Headers: headers}},
+		ContextExtensions: extensions,
+	}}
+}
+
+func TestEnvoyCheck(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getHeadersServer(t, authConf{UserHeaders: "X-User-Email=email"})
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "1", Email: "test@test.com"}})
+	client, closeClient := getEnvoyClient(t, s, storer)
+	defer closeClient()
+
+	response, err := client.Check(context.Background(), checkRequest("GET", "/app", map[string]string{":path": "/app", "cookie": "session=1", "x-user": "spoofed"}, nil))
+	if err != nil || codes.Code(response.Status.Code) != codes.OK {
+		t.Fatal("expected request to be allowed", err, response)
+	}
+	ok := response.GetOkResponse()
+	headers := map[string]string{}
+	for _, header := range ok.Headers {
+		headers[header.Header.Key] = header.Header.Value
+		if header.Append.Value {
+			t.Error("expected user headers to replace the client's", header)
+		}
+	}
+	if headers["x-user"] != `{"userID":"1","email":"test@test.com","isEmailVerified":false,"info":null}` || headers["x-user-email"] != "test@test.com" ||
+		strings.Join(ok.HeadersToRemove, ",") != "x-user-scopes" {
+		t.Error("expected user headers", headers, ok.HeadersToRemove)
+	}
+	checkMethods(t, []string{"GetCookieSession"}, storer)
+
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetBasicAuthErr: errors.New("failed")})
+	client, closeBasic := getEnvoyClient(t, s, storer)
+	defer closeBasic()
+	response, err = client.Check(context.Background(), checkRequest("GET", "/app", map[string]string{"authorization": "Basic dGVzdDp0ZXN0"}, nil))
+	denied := response.GetDeniedResponse()
+	if err != nil || codes.Code(response.Status.Code) != codes.Unauthenticated || denied.Status.Code != 401 || denied.Body != unauthenticatedBody || response.Status.Message != "Authentication required" {
+		t.Fatal("expected basic auth to be denied", err, response)
+	}
+	checkMethods(t, []string{"GetBasicAuth"}, storer)
+}
+
+func TestEnvoyRequest(t *testing.T) {
+	r := envoyRequest(checkRequest("post", "/api/posts?draft=1", map[string]string{"x-required-role": "none", "x-real-ip": "1.1.1.1", "cookie": "a=b"},
+		map[string]string{"role": "editor", "permission": "posts:write"}))
+	req := newPolicyRequest(r)
+	if req.Method != "post" || req.Path != "/api/posts" || req.IP.String() != "10.0.0.1" || strings.Join(req.Roles, ",") != "editor" ||
+		strings.Join(req.Permissions, ",") != "posts:write" || r.Header.Get("Cookie") != "a=b" || r.Host != "app.example.com" {
+		t.Error("expected request from check attributes", req, r.Header)
+	}
+}
+
+func TestEnvoyHTTP(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := &nginxauth{conf: authConf{EnvoyHTTPPrefix: "/envoy/"}}
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: errors.New("failed")})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/envoy/api/posts?id=1", nil)
+	s.envoyHTTP(storer, w, r)
+	if w.Code != http.StatusUnauthorized || r.Header.Get("X-Original-Method") != "DELETE" || r.Header.Get("X-Original-URI") != "/api/posts?id=1" {
+		t.Error("expected original request from the path", w.Code, r.Header)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+// forwardAuth answers Traefik ForwardAuth and Caddy forward_auth, which describe the checked request with
+// X-Forwarded-Method, X-Forwarded-Uri, X-Forwarded-Host and X-Forwarded-Proto. Browsers which aren't logged in are
+// redirected to ForwardAuthLoginURL with a returnTo parameter. API clients, decided by the Accept header, get a 401.
+// Like /auth, the session cookie is read without a CSRF token, since browser navigations never send one
+func (s *nginxauth) forwardAuth(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	forwardedRequest(r)
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+		s.authRequest(authStore, w, r, authStore.GetBasicAuth, basicErr)
+		return
+	}
+	s.authRequest(authStore, w, r, authStore.GetCookieSession, s.loginRedirect)
+}
+
+// forwardedRequest sets the headers nginx would send to /auth from the forwarded ones, so the policy sees the checked
+// request. Required roles and permissions can still be set in the forward auth address, e.g. /forwardAuth?role=admin.
+// The client IP is the last X-Forwarded-For address, the one the proxy appended, since clients can send the others.
+// X-Real-IP is always replaced for the same reason
+func forwardedRequest(r *http.Request) {
+	if method := r.Header.Get("X-Forwarded-Method"); method != "" {
+		r.Header.Set("X-Original-Method", method)
+	}
+	if uri := r.Header.Get("X-Forwarded-Uri"); uri != "" {
+		r.Header.Set("X-Original-URI", uri)
+	}
+	r.Header.Del("X-Real-IP")
+	forwardedFor := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if ip := strings.TrimSpace(forwardedFor[len(forwardedFor)-1]); ip != "" {
+		r.Header.Set("X-Real-IP", ip)
+	}
+}
+
+// loginRedirect sends browsers to the login page and returns them to the page they asked for once logged in
+func (s *nginxauth) loginRedirect(w http.ResponseWriter, r *http.Request, err error) {
+	if s.conf.ForwardAuthLoginURL == "" || r == nil || !acceptsHTML(r.Header.Get("Accept")) {
+		authErr(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, loginURL(s.conf.ForwardAuthLoginURL, forwardedURL(r)), http.StatusFound)
+}
+
+// forwardedURL is the URL of the request being checked
+func forwardedURL(r *http.Request) string {
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return uri
+	}
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme + "://" + host + uri
+}
+
+// acceptsHTML is true for browser navigation. API clients send application/json, */* or no Accept header
+func acceptsHTML(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+func TestForwardAuth(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := &nginxauth{conf: authConf{ForwardAuthLoginURL: "https://auth.example.com/login"}}
+	tests := []struct {
+		accept, authorization string
+		code                  int
+		location              string
+		methods               []string
+	}{
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "", 302, "https://auth.example.com/login?returnTo=https%3A%2F%2Fapp.example.com%2Fposts%3Fpage%3D2", []string{"GetCookieSession"}},
+		{"application/json", "", 401, "", []string{"GetCookieSession"}},
+		{"*/*", "", 401, "", []string{"GetCookieSession"}},
+		{"text/html;q=0, application/json", "", 401, "", []string{"GetCookieSession"}},
+		{"text/html", "Basic dGVzdDp0ZXN0", 401, "", []string{"GetBasicAuth"}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/forwardAuth", nil)
+		r.Header.Set("Accept", test.accept)
+		r.Header.Set("Authorization", test.authorization)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", "/posts?page=2")
+		w := httptest.NewRecorder()
+		storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: errors.New("failed"), GetBasicAuthErr: errors.New("failed")})
+		s.forwardAuth(storer, w, r)
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Error("unexpected response", test.accept, w.Code, w.Header())
+		}
+		checkMethods(t, test.methods, storer)
+	}
+
+	s.conf.ForwardAuthLoginURL = ""
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/forwardAuth", nil)
+	r.Header.Set("Accept", "text/html")
+	s.forwardAuth(auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: errors.New("failed")}), w, r)
+	if w.Code != 401 {
+		t.Error("expected 401 without a login URL", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.forwardAuth(auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "1"}}), w, httptest.NewRequest("GET", "/forwardAuth", nil))
+	if w.Code != 200 || w.Header().Get("X-User") == "" {
+		t.Error("expected user headers", w.Code, w.Header())
+	}
+}
+
+func TestForwardedRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/forwardAuth?role=admin", nil)
+	r.Header.Set("X-Forwarded-Method", "POST")
+	r.Header.Set("X-Forwarded-Uri", "/api/posts?draft=1")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 192.168.0.1")
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	forwardedRequest(r)
+	req := newPolicyRequest(r)
+	if req.Method != "POST" || req.Path != "/api/posts" || req.IP.String() != "192.168.0.1" || req.Roles[0] != "admin" {
+		t.Error("expected checked request from forwarded headers", req)
+	}
+
+	r = httptest.NewRequest("GET", "/forwardAuth", nil)
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	forwardedRequest(r)
+	if r.Header.Get("X-Real-IP") != "" {
+		t.Error("expected a client's X-Real-IP to be dropped", r.Header)
+	}
+	if forwardedURL(httptest.NewRequest("GET", "/forwardAuth", nil)) != "/" {
+		t.Error("expected root without forwarded headers")
+	}
+}
+
+func TestForwardAuthSessionCookie(t *testing.T) {
+	b := auth.NewBackendMemory(&auth.CryptoHashStore{})
+	b.AddUserFull("test@test.com", "password", map[string]interface{}{"fullName": "Name"})
+	b.VerifyEmail("test@test.com")
+	a := auth.NewAuthStore(b, nil, "", "", []byte("12345678901234567890123456789012"), false)
+	w := httptest.NewRecorder()
+	if _, err := a.Login(w, httptest.NewRequest("POST", "/login", strings.NewReader(`{"email":"test@test.com","password":"password"}`))); err != nil {
+		t.Fatal("expected login", err)
+	}
+
+	s := &nginxauth{conf: authConf{ForwardAuthLoginURL: "https://auth.example.com/login"}}
+	r := httptest.NewRequest("GET", "/forwardAuth", nil)
+	r.Header.Set("Accept", "text/html")
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	s.forwardAuth(a, w, r)
+	if w.Code != 200 || w.Header().Get("X-User") == "" {
+		t.Error("expected a browser navigation without a CSRF token to get the user headers", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+// localizedWriter carries the locale of the request to the error helpers, which are only given the ResponseWriter
+type localizedWriter struct {
+	http.ResponseWriter
+	localizer *auth.Localizer
+	locale    string
+}
+
+// locale is the user's chosen locale from info when it's supported, otherwise the best match for Accept-Language
+func (s *nginxauth) locale(r *http.Request, info map[string]interface{}) string {
+	if s.localizer == nil || r == nil {
+		return ""
+	}
+	chosen, _ := info[auth.InfoLocale].(string)
+	return s.localizer.Negotiate(r.Header.Get("Accept-Language"), chosen)
+}
+
+func (s *nginxauth) localized(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	locale := s.locale(r, nil)
+	if locale == "" {
+		return w
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	return &localizedWriter{ResponseWriter: w, localizer: s.localizer, locale: locale}
+}
+
+// localizeMessage returns the catalog message for the error message, then for its code, in the request's locale,
+// or message when the catalog has neither
+func localizeMessage(w http.ResponseWriter, code, message string) string {
+	if lw, ok := w.(*localizedWriter); ok {
+		return lw.localizer.ErrorMessage(lw.locale, code, message)
+	}
+	return message
+}
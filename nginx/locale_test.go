@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+func getLocaleServer(t *testing.T) *nginxauth {
+	localizer, err := auth.NewLocalizer("testdata/locales", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &nginxauth{localizer: localizer}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getLocaleServer(t)
+	r := httptest.NewRequest("POST", "/verifyEmail", strings.NewReader(`{"email": "test@test.com", "code": "bogus"}`))
+	r.Header.Set("Accept-Language", "fr-CA,fr;q=0.9,en;q=0.8")
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{VerifyEmailErr: auth.NewError(auth.ErrCodeInvalidCode, "Invalid verification code", nil)})
+	s.verifyEmail(storer, s.localized(w, r), r)
+	checkBody(t, `{"error":{"code":"invalid_code","message":"Code de vérification invalide"}}`+"\n", w)
+	if w.Header().Get("Vary") != "Accept-Language" {
+		t.Error("expected responses to vary by language", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	outputError(s.localized(w, r), auth.NewError(auth.ErrCodeInvalidRequest, "Invalid email", nil))
+	checkBody(t, `{"error":{"code":"invalid_request","message":"Adresse e-mail invalide"}}`+"\n", w)
+
+	r.Header.Set("Accept-Language", "de")
+	w = httptest.NewRecorder()
+	authErr(s.localized(w, r), r, errors.New("failed"))
+	checkBody(t, unauthenticatedBody, w)
+
+	w = httptest.NewRecorder()
+	authErr((&nginxauth{}).localized(w, r), r, errors.New("failed"))
+	checkBody(t, unauthenticatedBody, w)
+}
+
+func TestLocale(t *testing.T) {
+	s := getLocaleServer(t)
+	r := httptest.NewRequest("POST", "/register", nil)
+	r.Header.Set("Accept-Language", "fr")
+	if locale := s.locale(r, nil); locale != "fr" {
+		t.Error("expected locale from Accept-Language", locale)
+	}
+	if locale := s.locale(r, map[string]interface{}{auth.InfoLocale: "en-GB"}); locale != "en" {
+		t.Error("expected the user's locale to be preferred", locale)
+	}
+	if params := s.emailParams(r, &emailRequest{Email: "test@test.com"}, "", ""); params.Locale != "fr" {
+		t.Error("expected emails in the request's locale", params.Locale)
+	}
+	if locale := (&nginxauth{}).locale(r, nil); locale != "" {
+		t.Error("expected no locale without catalogs", locale)
+	}
+}
@@ -3,17 +3,25 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
 
 	"github.com/EndFirstCorp/auth"
 	"github.com/EndFirstCorp/configReader"
 	"github.com/EndFirstCorp/onedb/mgo"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/handlers"
 )
 
@@ -44,6 +52,12 @@ type authConf struct {
 	CookieBase64Key string
 	CookieDomain    string
 
+	// BaseURL is the scheme and host links in emails point to, e.g. https://auth.example.com. When it's empty, links
+	// use the host requests were sent to only if it's in AllowedHosts, a comma separated list. Otherwise they have
+	// no host, so the Host and X-Forwarded-Host headers can't point them at another site
+	BaseURL      string
+	AllowedHosts string
+
 	SMTPServer              string
 	SMTPPort                int
 	SMTPFromEmail           string
@@ -61,20 +75,204 @@ type authConf struct {
 	EmailChangedSubject     string
 	PasswordChangedTemplate string
 	PasswordChangedSubject  string
+	MagicLinkTemplate       string
+	MagicLinkSubject        string
+	PasswordResetTemplate   string
+	PasswordResetSubject    string
+	MagicLinkCrossDevice    string
+	OneTimeCodeLength       int
+	// ConfirmEmailChangeTemplate is sent to the new address of /setPrimaryEmail with the code for /confirmEmailChange.
+	// Users can't change their email without it
+	ConfirmEmailChangeTemplate string
+	ConfirmEmailChangeSubject  string
+	// LoginCodeTemplate sends a one-time code after the password or magic link is checked. /login, /magicLink and
+	// /token then answer login_code_required, and the login finishes with /verifyLoginCode or a /token request with
+	// the code
+	LoginCodeTemplate string
+	LoginCodeSubject  string
+	// SMTPEnvelopeFrom is the address bounces are sent to when it differs from SMTPFromEmail
+	SMTPEnvelopeFrom string
+	// EmailReplyTo and EmailListUnsubscribe set those headers on every email. They are templates executed with the
+	// email data, e.g. "<{{.BaseURL}}/unsubscribe>"
+	EmailReplyTo         string
+	EmailListUnsubscribe string
+	// EmailInlineImages is a comma separated list of images, such as a logo, which templates show with
+	// <img src="cid:logo.png">. Plain text versions of templates are read from a .txt file next to each one
+	EmailInlineImages string
+	// EmailOutbox queues emails in the session backend and delivers them in the background, retrying failures.
+	// Emails still undelivered after EmailOutboxMaxAge seconds (15 minutes by default) are given up on. Admins see
+	// the queue at /admin/outbox
+	EmailOutbox            string
+	EmailOutboxWorkers     int
+	EmailOutboxMaxAttempts int
+	EmailOutboxMaxAge      int
+	// DKIMDomain, DKIMSelector and DKIMPrivateKeyFile sign SMTP mail with an RSA or Ed25519 key. Run with
+	// -dkimRecord to get the TXT record to publish at <DKIMSelector>._domainkey.<DKIMDomain>
+	DKIMDomain         string
+	DKIMSelector       string
+	DKIMPrivateKeyFile string
+	// DKIMHeaderCanonicalization and DKIMBodyCanonicalization are "relaxed" (default) or "simple"
+	DKIMHeaderCanonicalization string
+	DKIMBodyCanonicalization   string
+	// EmailFileDir writes emails to .eml files in the directory instead of sending them
+	EmailFileDir string
+	// EmailPreviewInfo is a JSON object of the user info -previewEmails renders templates with, such as
+	// {"fullName": "Jane Doe"}
+	EmailPreviewInfo string
+	// DevMode keeps emails and text messages in memory instead of sending them and shows them at /dev/inbox. Never
+	// use it in production
+	DevMode string
+	// SMSProvider is "twilio" to send password resets, login links and notifications by SMS to users who verified
+	// their phone number and chose SMS. Templates are .sms files next to the email ones, e.g. passwordReset.sms.
+	// Dev mode keeps the messages in memory and shows them at /dev/inbox/sms
+	SMSProvider      string
+	SMSFrom          string
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	// VerifyPhoneTemplate is the .sms template of the code sent to verify a phone number
+	VerifyPhoneTemplate string
+
+	TokenMode               string
+	TokenIssuer             string
+	TokenSigningAlgorithm   string
+	TokenKeyRotationMinutes int
+	TokenKeyGraceMinutes    int
+
+	// UserHeaderFormat is "json" (default), "base64" for base64 encoded JSON, "jwt" to send X-User as a token
+	// signed with the keys in /.well-known/jwks.json or "none" to only send the headers in UserHeaders. Signed
+	// headers have the audience "identity", so they can't be used as access tokens
+	UserHeaderFormat string
+	// UserHeaders sends session fields in their own headers, e.g. "X-User-Id=userID, X-User-Email=email, X-User-Groups=roles"
+	UserHeaders string
+	// UserInfoAllowlist is a comma separated list of the info keys sent to upstream servers. All are sent when it's empty
+	UserInfoAllowlist   string
+	UserHeadersMaxBytes int
+
+	OAuthServer            string
+	OAuthRegistrationToken string
+	OAuthLoginURL          string
+	OAuthConsentTemplate   string
+
+	// EnvoyGRPCListenPort serves the Envoy ext_authz v3 Check RPC when it's set
+	EnvoyGRPCListenPort int
+	// EnvoyHTTPPrefix is the path_prefix of an Envoy ext_authz http_service, such as "/envoy"
+	EnvoyHTTPPrefix string
+
+	// ForwardAuthLoginURL is where /forwardAuth redirects browsers which aren't logged in. API clients get a 401
+	ForwardAuthLoginURL string
+
+	// HostedPages serves login, registration, verification, profile and password reset pages under /pages/.
+	// Verification and reset emails should link to {{.BaseURL}}/verify and {{.BaseURL}}/resetPassword with the code
+	HostedPages string
+	// HostedPagesTemplateDir holds pages which replace the built-in ones, e.g. login.html or layout.html
+	HostedPagesTemplateDir string
+	HostedPagesTitle       string
+	HostedPagesStylesheet  string
+	// HostedPagesDefaultURL is where users go after logging in when no returnTo was requested
+	HostedPagesDefaultURL string
+
+	// PolicyFile is a JSON route policy checked by /auth and /authBasic. It is reloaded when it changes
+	PolicyFile string
+
+	// LocaleCatalogDir holds a JSON catalog of messages for each supported locale, such as fr.json. Emails in
+	// those locales use templates named like verifyEmail.fr.html next to the default one when there are any
+	LocaleCatalogDir string
+	// DefaultLocale is the locale of the built-in messages and the default templates. It is "en" when empty
+	DefaultLocale string
+
+	// UploadDir stores profile pictures uploaded to /createProfile and their thumbnails, served at UploadBaseURL.
+	// UploadBaseURL is "/uploads" when empty, which this server serves from UploadDir
+	UploadDir     string
+	UploadBaseURL string
+	// S3Bucket stores uploads in an S3 compatible bucket instead. S3Endpoint is the AWS endpoint of S3Region when
+	// empty, and UploadBaseURL is where the bucket is served publicly, e.g. from a CDN
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	// UploadMaxBytes limits the size of profile pictures. It is 5 MB when 0
+	UploadMaxBytes int
+
+	// RegistrationMode is "open" (default), "domainAllowlist" to only let emails at RegistrationAllowedDomains, a
+	// comma separated list, register, "inviteOnly" or "closed". Admins invite users at /admin/invite. The
+	// InvitationTemplate should link to {{.BaseURL}}/pages/register?invite={{.VerificationCode}}&email={{.Email}}
+	RegistrationMode           string
+	RegistrationAllowedDomains string
+	// DisposableDomainsFile lists throwaway email domains which can't register, one on each line
+	DisposableDomainsFile string
+	// RegistrationCheckMX refuses emails at domains without mail servers
+	RegistrationCheckMX string
+	InvitationTemplate  string
+	InvitationSubject   string
+	// InvitationDays is how long invitations can be used, 7 days when 0
+	InvitationDays int
+
+	// ProfileSchemaFile is a JSON auth.ProfileSchema of the info fields users may set in /createProfile and admins
+	// in /admin/setUserInfo. Users may set any field except the ones the server manages when it's empty
+	ProfileSchemaFile string
 }
 
+const userHeaderFormatJWT string = "jwt"
+const userHeaderExpireDuration time.Duration = 5 * time.Minute
+
 type nginxauth struct {
-	backend  auth.Backender
-	a        auth.AuthStorer
-	conf     authConf
-	errorLog *os.File
+	backend   auth.Backender
+	a         auth.AuthStorer
+	keys      *auth.KeyManager
+	consent   *template.Template
+	pages     map[string]*template.Template
+	policy    *policyFile
+	headers   *userHeaders
+	localizer *auth.Localizer
+	outbox    *auth.Outbox
+	inbox     *auth.Inbox
+	sms       *auth.SMSStub
+	conf      authConf
+	errorLog  *os.File
+}
+
+type openIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                     string   `json:"token_endpoint,omitempty"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint,omitempty"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+}
+
+type userClaims struct {
+	Email  string                 `json:"email"`
+	Info   map[string]interface{} `json:"info,omitempty"`
+	Scopes []string               `json:"scopes,omitempty"`
+	jwt.StandardClaims
 }
 
 func main() {
 	configFile := flag.String("c", "/etc/nginxauth/nginxauth.conf", "config file location")
 	logfile := flag.String("l", "/var/log/nginxauth.log", "log file")
+	addAdmin := flag.String("addAdmin", "", "give the user with this email the admin role and exit")
+	policyTest := flag.String("policyTest", "", `explain how the policy decides a request such as "GET /admin/users" and exit`)
+	previewEmails := flag.String("previewEmails", "", "render the email templates with sample data into this directory, report the problems found and exit")
+	dkimRecord := flag.Bool("dkimRecord", false, "print the DKIM TXT record for the configured private key and exit")
+	policyEmail := flag.String("policyEmail", "", "email of the user making the -policyTest request. Anonymous when empty")
+	policyIP := flag.String("policyIP", "127.0.0.1", "client IP address of the -policyTest request")
 	flag.Parse()
 
+	if *previewEmails != "" {
+		if err := previewEmailTemplates(*configFile, *previewEmails); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	server, err := newNginxAuth(*configFile, *logfile)
 	if err != nil {
 		log.Fatal(err)
@@ -82,6 +280,32 @@ func main() {
 	defer server.backend.Close()
 	defer server.errorLog.Close()
 
+	if *addAdmin != "" {
+		if err := addAdminRole(server.backend, *addAdmin); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Added admin role to", *addAdmin)
+		return
+	}
+	if *dkimRecord {
+		if err := server.printDKIMRecord(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *policyTest != "" {
+		parts := strings.Fields(*policyTest)
+		if len(parts) != 2 {
+			log.Fatal(`-policyTest must be a method and a URI, e.g. "GET /admin/users"`)
+		}
+		decision, err := server.dryRun(parts[0], parts[1], *policyEmail, *policyIP)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(strings.Join(decision.Steps, "\n"))
+		return
+	}
+
 	server.serve(server.conf.AuthServerListenPort)
 }
 
@@ -105,78 +329,427 @@ func newNginxAuth(configFle, logfile string) (*nginxauth, error) {
 	s := auth.NewBackendRedisSession(config.RedisServer, config.RedisPort, config.RedisPassword, config.RedisMaxIdle, config.RedisMaxConnections, config.StoragePrefix)
 	b := auth.NewBackend(auth.NewBackendMongo(m, &auth.CryptoHashStore{}), s)
 
+	localizer, err := auth.NewLocalizer(config.LocaleCatalogDir, config.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
 	mailer, err := config.NewEmailer()
 	if err != nil {
 		return nil, err
 	}
+	mailer.Localizer = localizer
+	inbox := config.newDevInbox(mailer)
+	if inbox != nil {
+		log.Println("Dev mode: emails are kept in memory and shown at " + devInboxPath)
+	}
+	smsChannel, sms, err := config.newSMSChannel()
+	if err != nil {
+		return nil, err
+	}
+	var sender auth.Mailer = mailer
+	outbox := config.newOutbox(mailer, b)
+	if outbox != nil {
+		sender = outbox
+	}
 
 	cookieKey, err := base64.URLEncoding.DecodeString(config.CookieBase64Key)
 	if err != nil {
 		return nil, err
 	}
 
-	return &nginxauth{b, auth.NewAuthStore(b, mailer, config.StoragePrefix, config.CookieDomain, cookieKey, false), config, eLog}, nil
+	headers, err := newUserHeaders(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys *auth.KeyManager
+	if isTrue(config.TokenMode) || isTrue(config.OAuthServer) || config.UserHeaderFormat == userHeaderFormatJWT || headers.uses("", headerEncodingSigned) {
+		keys, err = auth.NewKeyManager(b, config.TokenSigningAlgorithm, minutes(config.TokenKeyRotationMinutes), minutes(config.TokenKeyGraceMinutes))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	storeConfig := config.authStoreConfig(keys)
+	if smsChannel != nil {
+		storeConfig.Channels = map[string]auth.Channel{auth.ChannelSMS: smsChannel}
+	}
+	if storeConfig.ProfileSchema, err = config.profileSchema(); err != nil {
+		return nil, err
+	}
+	if storeConfig.Registration, err = config.registrationPolicy(); err != nil {
+		return nil, err
+	}
+	a, err := auth.NewAuthStoreWithConfig(b, sender, config.StoragePrefix, config.CookieDomain, cookieKey, false, storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	consent, err := config.consentTemplate()
+	if err != nil {
+		return nil, err
+	}
+	pages, err := config.pageTemplates()
+	if err != nil {
+		return nil, err
+	}
+	var policy *policyFile
+	if config.PolicyFile != "" {
+		if policy, err = loadPolicyFile(config.PolicyFile); err != nil {
+			return nil, err
+		}
+	}
+	return &nginxauth{backend: b, a: a, keys: keys, consent: consent, pages: pages, policy: policy, headers: headers, localizer: localizer, outbox: outbox, inbox: inbox, sms: sms, conf: config, errorLog: eLog}, nil
+}
+
+func (n *authConf) authStoreConfig(keys *auth.KeyManager) auth.AuthStoreConfig {
+	return auth.AuthStoreConfig{
+		PasswordChangedTemplate:  templateName(n.PasswordChangedTemplate),
+		PasswordChangedSubject:   n.PasswordChangedSubject,
+		EmailChangedTemplate:     templateName(n.EmailChangedTemplate),
+		EmailChangedSubject:      n.EmailChangedSubject,
+		MagicLinkCrossDevice:     isTrue(n.MagicLinkCrossDevice),
+		BaseURL:                  n.BaseURL,
+		AllowedHosts:             splitValues([]string{n.AllowedHosts}),
+		LoginCodeTemplate:        templateName(n.LoginCodeTemplate),
+		LoginCodeSubject:         n.LoginCodeSubject,
+		OneTimeCodeLength:        n.OneTimeCodeLength,
+		TokenMode:                isTrue(n.TokenMode),
+		TokenIssuer:              n.TokenIssuer,
+		TokenSigningAlgorithm:    n.TokenSigningAlgorithm,
+		TokenKeyRotationDuration: minutes(n.TokenKeyRotationMinutes),
+		TokenKeyGraceDuration:    minutes(n.TokenKeyGraceMinutes),
+		TokenKeys:                keys,
+		OAuthServer:              isTrue(n.OAuthServer),
+		OAuthRegistrationToken:   n.OAuthRegistrationToken,
+		FileStore:                n.fileStore(),
+		MaxUploadBytes:           int64(n.UploadMaxBytes),
+	}
+}
+
+func minutes(value int) time.Duration {
+	return time.Duration(value) * time.Minute
+}
+
+// isTrue parses a boolean config value. configReader only fills string and int fields
+func isTrue(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
+}
+
+// templateName returns the name template.ParseFiles gives to the template at filePath
+func templateName(filePath string) string {
+	if filePath == "" {
+		return ""
+	}
+	return filepath.Base(filePath)
 }
 
 func (n *authConf) NewEmailer() (*auth.Emailer, error) {
-	sender := &auth.SmtpSender{n.SMTPServer, n.SMTPPort, n.SMTPFromEmail, n.SMTPPassword, n.EmailFromDisplayName}
-	templateCache, err := template.ParseFiles(n.VerifyEmailTemplate, n.WelcomeTemplate,
-		n.NewLoginTemplate, n.LockedOutTemplate, n.EmailChangedTemplate, n.PasswordChangedTemplate)
+	sender := &auth.SmtpSender{SMTPServer: n.SMTPServer, SMTPPort: n.SMTPPort, SMTPFromEmail: n.SMTPFromEmail, SMTPPassword: n.SMTPPassword,
+		EmailFromDisplayName: n.EmailFromDisplayName, EnvelopeFrom: n.SMTPEnvelopeFrom}
+	templates := n.emailTemplates()
+	htmlFiles, textFiles := templateFiles(templates...), textTemplateFiles(templates...)
+	templateCache, err := template.ParseFiles(htmlFiles...)
 	if err != nil {
 		return nil, err
 	}
-	return &auth.Emailer{
+	if sender.DKIM, err = n.dkimSigner(); err != nil {
+		return nil, err
+	}
+	emailer := &auth.Emailer{
 		TemplateCache: templateCache,
 		Sender:        sender,
-	}, nil
+		Headers:       make(map[string]string),
+	}
+	if n.EmailFileDir != "" {
+		emailer.Sender = &auth.FileSender{Dir: n.EmailFileDir, FromEmail: n.SMTPFromEmail, EmailFromDisplayName: n.EmailFromDisplayName}
+	}
+	if len(textFiles) > 0 {
+		if emailer.TextTemplateCache, err = texttemplate.ParseFiles(textFiles...); err != nil {
+			return nil, err
+		}
+	}
+	emailer.WatchTemplates(htmlFiles, textFiles)
+	if n.EmailReplyTo != "" {
+		emailer.Headers["Reply-To"] = n.EmailReplyTo
+	}
+	if n.EmailListUnsubscribe != "" {
+		emailer.Headers["List-Unsubscribe"] = n.EmailListUnsubscribe
+	}
+	for _, filePath := range strings.Split(n.EmailInlineImages, ",") {
+		if filePath = strings.TrimSpace(filePath); filePath == "" {
+			continue
+		}
+		image, err := auth.LoadInlineImage(filePath)
+		if err != nil {
+			return nil, err
+		}
+		emailer.Inline = append(emailer.Inline, image)
+	}
+	return emailer, nil
+}
+
+// emailTemplates are the configured email templates. Optional ones which aren't configured are empty
+func (n *authConf) emailTemplates() []string {
+	return []string{n.VerifyEmailTemplate, n.WelcomeTemplate, n.NewLoginTemplate, n.LockedOutTemplate, n.EmailChangedTemplate,
+		n.ConfirmEmailChangeTemplate, n.PasswordChangedTemplate, n.MagicLinkTemplate, n.PasswordResetTemplate, n.InvitationTemplate,
+		n.LoginCodeTemplate}
+}
+
+// dkimSigner returns nil when DKIM signing isn't configured
+func (n *authConf) dkimSigner() (*auth.DKIMSigner, error) {
+	if n.DKIMPrivateKeyFile == "" {
+		return nil, nil
+	}
+	signer, err := auth.LoadDKIMSigner(n.DKIMDomain, n.DKIMSelector, n.DKIMPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer.HeaderCanonicalization = n.DKIMHeaderCanonicalization
+	signer.BodyCanonicalization = n.DKIMBodyCanonicalization
+	return signer, nil
+}
+
+// textTemplateFiles returns the plain text templates next to the configured ones, such as verifyEmail.txt and
+// verifyEmail.fr.txt for verifyEmail.html
+func textTemplateFiles(filePaths ...string) []string {
+	return pairedTemplateFiles(".txt", filePaths...)
+}
+
+// smsTemplateFiles returns the text message templates next to the configured ones, such as passwordReset.sms and
+// passwordReset.fr.sms for passwordReset.html
+func smsTemplateFiles(filePaths ...string) []string {
+	return pairedTemplateFiles(".sms", filePaths...)
+}
+
+func pairedTemplateFiles(ext string, filePaths ...string) []string {
+	var files []string
+	for _, filePath := range filePaths {
+		if filePath != "" {
+			base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+			if _, err := os.Stat(base + ext); err == nil {
+				files = append(files, base+ext)
+			}
+			localized, _ := filepath.Glob(base + ".*" + ext)
+			files = append(files, localized...)
+		}
+	}
+	return files
+}
+
+// templateFiles skips optional templates that haven't been configured, and adds the localized versions of the
+// others, such as verifyEmail.fr.html for verifyEmail.html
+func templateFiles(filePaths ...string) []string {
+	var files []string
+	for _, filePath := range filePaths {
+		if filePath != "" {
+			ext := filepath.Ext(filePath)
+			localized, _ := filepath.Glob(strings.TrimSuffix(filePath, ext) + ".*" + ext)
+			files = append(append(files, filePath), localized...)
+		}
+	}
+	return files
 }
 
 func (s *nginxauth) serve(port int) {
-	http.HandleFunc("/auth", s.method("GET", authCookie))
-	http.HandleFunc("/authBasic", s.method("GET", authBasic))
+	http.HandleFunc("/auth", s.method("GET", s.authCookie))
+	http.HandleFunc("/authBasic", s.method("GET", s.authBasic))
+	http.HandleFunc("/forwardAuth", s.method("GET", s.forwardAuth))
 	http.HandleFunc("/createProfile", s.method("POST", createProfile))
 	http.HandleFunc("/login", s.method("POST", login))
+	http.HandleFunc("/token", s.method("POST", loginToken))
+	http.HandleFunc("/token/refresh", s.method("POST", refreshToken))
+	http.HandleFunc("/token/revoke", s.method("POST", revokeToken))
 	http.HandleFunc("/oauth", s.method("GET", oauthLogin))
-	http.HandleFunc("/register", s.method("POST", register))
-	http.HandleFunc("/verifyEmail", s.method("POST", verifyEmail))
+	http.HandleFunc("/requestMagicLink", s.method("POST", s.requestMagicLink))
+	http.HandleFunc("/magicLink", s.method("POST", magicLink))
+	http.HandleFunc("/verifyLoginCode", s.method("POST", verifyLoginCode))
+	http.HandleFunc("/register", s.method("POST", s.register))
+	http.HandleFunc("/verifyEmail", s.method("POST", s.verifyEmail))
+	http.HandleFunc("/logout", s.method("POST", logout))
+	http.HandleFunc("/logoutAll", s.method("POST", logoutAll))
+	http.HandleFunc("/requestPasswordReset", s.method("POST", s.requestPasswordReset))
+	http.HandleFunc("/verifyPasswordReset", s.method("POST", s.verifyPasswordReset))
+	http.HandleFunc("/me", s.method("GET", me))
 	http.HandleFunc("/createSecondaryEmail", s.method("POST", createSecondaryEmail))
-	http.HandleFunc("/setPrimaryEmail", s.method("POST", setPrimaryEmail))
+	http.HandleFunc("/setPrimaryEmail", s.method("POST", s.setPrimaryEmail))
+	http.HandleFunc("/confirmEmailChange", s.method("POST", confirmEmailChange))
+	http.HandleFunc("/revertEmailChange", s.method("POST", revertEmailChange))
 	http.HandleFunc("/updatePassword", s.method("POST", updatePassword))
+	http.HandleFunc("/requestPhoneVerification", s.method("POST", s.requestPhoneVerification))
+	http.HandleFunc("/verifyPhone", s.method("POST", verifyPhone))
+	http.HandleFunc("/setChannel", s.method("POST", setChannel))
+	http.HandleFunc("/apiKeys", s.method("GET", getAPIKeys))
+	http.HandleFunc("/createAPIKey", s.method("POST", createAPIKey))
+	http.HandleFunc("/deleteAPIKey", s.method("POST", deleteAPIKey))
+	http.HandleFunc("/admin/roles", s.method("GET", getRoles))
+	http.HandleFunc("/admin/saveRole", s.method("POST", saveRole))
+	http.HandleFunc("/admin/deleteRole", s.method("POST", deleteRole))
+	http.HandleFunc("/admin/userRoles", s.method("GET", getUserRoles))
+	http.HandleFunc("/admin/setUserRoles", s.method("POST", setUserRoles))
+	http.HandleFunc("/admin/setUserInfo", s.method("POST", setUserInfo))
+	http.HandleFunc("/admin/invite", s.method("POST", s.invite))
+	if s.outbox != nil {
+		http.HandleFunc("/admin/outbox", s.method("GET", s.outboxStatus))
+		http.HandleFunc("/admin/discardEmail", s.method("POST", s.discardEmail))
+	}
+	if s.inbox != nil {
+		s.serveDevInbox()
+	}
+	if s.conf.UploadDir != "" && s.conf.S3Bucket == "" {
+		s.serveUploads()
+	}
+	if s.keys != nil {
+		http.HandleFunc("/.well-known/jwks.json", s.method("GET", s.jwks))
+		http.HandleFunc("/.well-known/openid-configuration", s.method("GET", s.openIDConfiguration))
+	}
+	if isTrue(s.conf.HostedPages) {
+		s.servePages()
+	}
+	if s.conf.EnvoyHTTPPrefix != "" {
+		http.HandleFunc(strings.TrimSuffix(s.conf.EnvoyHTTPPrefix, "/")+"/", func(w http.ResponseWriter, r *http.Request) {
+			s.envoyHTTP(s.a, w, r)
+		})
+	}
+	if s.conf.EnvoyGRPCListenPort != 0 {
+		go s.serveEnvoyGRPC(s.conf.EnvoyGRPCListenPort)
+	}
+	if isTrue(s.conf.OAuthServer) {
+		http.HandleFunc("/oauth2/register", s.method("POST", registerOAuthClient))
+		http.HandleFunc("/oauth2/authorize", s.method("GET", s.oauthAuthorize))
+		http.HandleFunc("/oauth2/consent", s.method("POST", s.oauthConsent))
+		http.HandleFunc("/oauth2/token", s.method("POST", oauthToken))
+		http.HandleFunc("/oauth2/userinfo", s.method("GET", oauthUserInfo))
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%d", port), handlers.CompressHandler(http.DefaultServeMux))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handlers.CompressHandler(http.DefaultServeMux)}
+	stopped := make(chan struct{})
+	go func() {
+		s.shutdownOnSignal(server)
+		close(stopped)
+	}()
+	if s.outbox != nil {
+		s.outbox.Start()
+	}
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Println(err)
+		return
+	}
+	<-stopped
 }
 
 func (s *nginxauth) method(name string, handler func(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != name {
-			http.Error(w, "Unsupported method", http.StatusInternalServerError)
+			methodErr(w)
 			return
 		}
-		handler(s.a, w, r)
+		handler(s.a, s.localized(w, r), r)
 	}
 }
 
-func authCookie(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
-	session, err := authStore.GetSession(w, r)
-	if err != nil {
-		authErr(w, r, err)
+// authCookie reads the session cookie without a CSRF token, since nginx checks browser navigations which never send one
+func (s *nginxauth) authCookie(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	s.authRequest(authStore, w, r, authStore.GetCookieSession, authErr)
+}
+
+// authRequest answers an nginx auth_request: 401 when the user must log in, 403 when the user is logged in
+// but not allowed by the policy or the required role and permission, otherwise 200 with the user headers
+func (s *nginxauth) authRequest(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request,
+	getSession func(http.ResponseWriter, *http.Request) (*auth.LoginSession, error), unauthorized func(http.ResponseWriter, *http.Request, error)) {
+	session, err := getSession(w, r)
+	decision := s.evaluate(authStore, newPolicyRequest(r), session, err)
+	switch {
+	case decision.Status == http.StatusUnauthorized:
+		unauthorized(w, r, decision.Err)
+		return
+	case decision.Status == http.StatusForbidden:
+		forbiddenErr(w, decision.Err)
+		return
+	case session == nil: // public rule and not logged in
 		return
 	}
 
-	user, err := json.Marshal(&auth.User{Email: session.Email, UserID: session.UserID, Info: session.Info})
-	if err != nil {
-		authErr(w, r, err)
-		return
+	if err := s.addUserHeaders(authStore, w, session); err != nil {
+		userHeadersErr(w, err)
 	}
+}
+
+// errorResponse is the body of every error, except from the OAuth endpoints which send the errors from RFC 6749
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
 
-	addUserHeader(string(user), w)
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
+// writeError sends the error envelope. The message is shown to users, so it must never come from err.Error()
+// of errors which aren't AuthErrors
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	message = localizeMessage(w, code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{errorDetail{code, message}})
+}
+
+// authErr is sent by the auth_request and forward auth endpoints when the user must log in. nginx only passes on a
+// 401 or 403 from auth_request, so the status is always 401 and the code says why. Other endpoints use outputError
 func authErr(w http.ResponseWriter, r *http.Request, err error) {
-	http.Error(w, "Authentication required: "+err.Error(), http.StatusUnauthorized)
+	statusErr(w, http.StatusUnauthorized, auth.ErrCodeUnauthenticated, err)
+}
+
+// forbiddenErr is sent when the user is logged in but isn't allowed to access the location
+func forbiddenErr(w http.ResponseWriter, err error) {
+	statusErr(w, http.StatusForbidden, auth.ErrCodeForbidden, err)
+}
+
+// statusErr sends err with a fixed status. Internal errors are sent as defaultCode so they aren't described
+func statusErr(w http.ResponseWriter, status int, defaultCode string, err error) {
+	code, message := auth.ErrorCode(err), auth.PublicMessage(err)
+	if code == auth.ErrCodeInternal {
+		code, message = defaultCode, auth.DefaultMessage(defaultCode)
+	}
+	writeError(w, status, code, message)
 	logError(err)
 }
 
+func methodErr(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, auth.ErrCodeInvalidRequest, "Unsupported method")
+}
+
+// requestErr is sent when the request body can't be read
+func requestErr(w http.ResponseWriter, err error) {
+	outputError(w, auth.NewError(auth.ErrCodeInvalidRequest, "Invalid request body", err))
+}
+
+// requiredAccess returns the roles (any of) and permissions (all of) required by the location being
+// authorized. They come from /auth?role=admin&permission=posts:write or from the X-Required-Role and
+// X-Required-Permission headers set by nginx. Values can be comma separated
+func requiredAccess(r *http.Request) ([]string, []string) {
+	if r == nil {
+		return nil, nil
+	}
+	query := r.URL.Query()
+	roles := splitValues(append(query["role"], r.Header["X-Required-Role"]...))
+	permissions := splitValues(append(query["permission"], r.Header["X-Required-Permission"]...))
+	return roles, permissions
+}
+
+func splitValues(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
+
 func logError(err error) {
 	if a, ok := err.(*auth.AuthError); ok {
 		log.Println(a.Trace())
@@ -185,26 +758,37 @@ func logError(err error) {
 	}
 }
 
-func authBasic(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
-	session, err := authStore.GetBasicAuth(w, r)
-	if err != nil {
-		basicErr(w, r, err)
-		return
-	}
+func (s *nginxauth) authBasic(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	s.authRequest(authStore, w, r, authStore.GetBasicAuth, basicErr)
+}
 
-	user, err := json.Marshal(&auth.User{Email: session.Email, UserID: session.UserID, Info: session.Info})
-	if err != nil {
-		basicErr(w, r, err)
-		return
+// userHeader returns the X-User value for session, as JSON or as a short-lived signed token
+func (s *nginxauth) userHeader(session *auth.LoginSession, info map[string]interface{}) (string, error) {
+	if s.conf.UserHeaderFormat != userHeaderFormatJWT || s.keys == nil {
+		user, err := json.Marshal(&auth.User{Email: session.Email, UserID: session.UserID, Info: info})
+		if s.conf.UserHeaderFormat == userHeaderFormatBase64 {
+			return base64.StdEncoding.EncodeToString(user), err
+		}
+		return string(user), err
 	}
-
-	addUserHeader(string(user), w)
+	now := time.Now().UTC()
+	return s.keys.Sign(userClaims{
+		Email:  session.Email,
+		Info:   info,
+		Scopes: session.Scopes,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  auth.IdentityTokenAudience,
+			Subject:   session.UserID,
+			Issuer:    s.conf.TokenIssuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(userHeaderExpireDuration).Unix(),
+		},
+	})
 }
 
 func basicErr(w http.ResponseWriter, r *http.Request, err error) {
 	w.Header().Set("WWW-Authenticate", "Basic realm='Endfirst.com'")
-	http.Error(w, "Authentication required: "+err.Error(), http.StatusUnauthorized)
-	logError(err)
+	authErr(w, r, err)
 }
 
 func oauthLogin(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
@@ -215,8 +799,199 @@ func login(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
 	runWithProfile(authStore.Login, w, r)
 }
 
-func register(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
-	outputMessage(w, `{ "result": "Success" }`, authStore.Register(w, r, auth.EmailSendParams{}, ""))
+// emailRequest is the JSON body of the endpoints which send or verify an email. DestinationURL is where the user
+// goes once the email is verified, and is dropped unless it's on this site or CookieDomain
+type emailRequest struct {
+	Email          string `json:"email"`
+	Password       string `json:"password"`
+	Code           string `json:"code"`
+	DestinationURL string `json:"destinationURL"`
+	InviteCode     string `json:"inviteCode"`
+}
+
+func getEmailRequest(r *http.Request) (*emailRequest, error) {
+	req := &emailRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// emailParams sends the template and subject from the config, with links to the server the request was sent to
+func (s *nginxauth) emailParams(r *http.Request, req *emailRequest, template, subject string) auth.EmailSendParams {
+	params := auth.EmailSendParams{
+		Email:            req.Email,
+		VerificationCode: req.Code,
+		BaseURL:          s.baseURL(r),
+		TemplateSuccess:  templateName(template),
+		SubjectSuccess:   subject,
+		UseOneTimeCode:   s.conf.OneTimeCodeLength > 0,
+		Locale:           s.locale(r, nil),
+		InviteCode:       req.InviteCode,
+	}
+	if req.DestinationURL != "" && s.isSafeReturnTo(r, req.DestinationURL) {
+		params.DestinationURL = req.DestinationURL
+	}
+	return params
+}
+
+func (s *nginxauth) requestMagicLink(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	req, err := getEmailRequest(r)
+	if err != nil {
+		requestErr(w, err)
+		return
+	}
+	params := s.emailParams(r, req, s.conf.MagicLinkTemplate, s.conf.MagicLinkSubject)
+	outputMessage(w, `{ "result": "Success" }`, authStore.RequestMagicLink(w, r, params))
+}
+
+func magicLink(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	runWithProfile(func(w http.ResponseWriter, r *http.Request) (*auth.LoginSession, error) {
+		return authStore.ConsumeMagicLink(w, r, r.FormValue("code"), r.FormValue("rememberMe") == "true")
+	}, w, r)
+}
+
+func verifyLoginCode(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	runWithProfile(func(w http.ResponseWriter, r *http.Request) (*auth.LoginSession, error) {
+		req, err := getEmailRequest(r)
+		if err != nil {
+			return nil, auth.NewError(auth.ErrCodeInvalidRequest, "Unable to get login code", err)
+		}
+		return authStore.VerifyLoginCode(w, r, req.Email, req.Code)
+	}, w, r)
+}
+
+func loginToken(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	runWithToken(authStore.LoginToken, w, r)
+}
+
+func refreshToken(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	runWithToken(authStore.RefreshToken, w, r)
+}
+
+func revokeToken(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.RevokeToken(w, r))
+}
+
+func (s *nginxauth) jwks(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	jwks, err := s.keys.JWKS()
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	outputData(w, jwks)
+}
+
+func (s *nginxauth) openIDConfiguration(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	issuer := s.issuer(r)
+	baseURL := strings.TrimSuffix(issuer, "/")
+	config := openIDConfiguration{
+		Issuer:                           issuer,
+		JWKSURI:                          baseURL + "/.well-known/jwks.json",
+		ResponseTypesSupported:           []string{},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{s.keys.Algorithm()},
+	}
+	if isTrue(s.conf.TokenMode) {
+		config.TokenEndpoint = baseURL + "/token"
+	}
+	if isTrue(s.conf.OAuthServer) {
+		config.AuthorizationEndpoint = baseURL + "/oauth2/authorize"
+		config.TokenEndpoint = baseURL + "/oauth2/token"
+		config.UserInfoEndpoint = baseURL + "/oauth2/userinfo"
+		if s.conf.OAuthRegistrationToken != "" {
+			config.RegistrationEndpoint = baseURL + "/oauth2/register"
+		}
+		config.ScopesSupported = auth.OAuthScopes
+		config.ResponseTypesSupported = []string{"code"}
+		config.GrantTypesSupported = []string{"authorization_code", "refresh_token"}
+		config.CodeChallengeMethodsSupported = []string{"S256"}
+		config.TokenEndpointAuthMethodsSupported = []string{"client_secret_basic", "client_secret_post", "none"}
+	}
+	outputData(w, config)
+}
+
+// issuer is the configured TokenIssuer, or the URL this server was reached at
+func (s *nginxauth) issuer(r *http.Request) string {
+	if s.conf.TokenIssuer != "" {
+		return s.conf.TokenIssuer
+	}
+	return s.baseURL(r)
+}
+
+// baseURL is the configured BaseURL, or the URL this server was reached at when its host is in AllowedHosts
+func (s *nginxauth) baseURL(r *http.Request) string {
+	return auth.BaseURL(r, s.conf.BaseURL, splitValues([]string{s.conf.AllowedHosts}))
+}
+
+func (s *nginxauth) register(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	req, err := getEmailRequest(r)
+	if err != nil {
+		requestErr(w, err)
+		return
+	}
+	params := s.emailParams(r, req, s.conf.VerifyEmailTemplate, s.conf.VerifyEmailSubject)
+	outputMessage(w, `{ "result": "Success" }`, authStore.Register(w, r, params, req.Password))
+}
+
+func logout(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.Logout(w, r))
+}
+
+func logoutAll(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.LogoutAll(w, r))
+}
+
+// requestPasswordReset succeeds whether or not the email has an account, so it can't be used to find out who does
+func (s *nginxauth) requestPasswordReset(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	req, err := getEmailRequest(r)
+	if err != nil {
+		requestErr(w, err)
+		return
+	}
+	params := s.emailParams(r, req, s.conf.PasswordResetTemplate, s.conf.PasswordResetSubject)
+	outputMessage(w, `{ "result": "Success" }`, authStore.RequestPasswordReset(w, r, params))
+}
+
+// verifyPasswordReset returns the CSRF token to send with the new password to /updatePassword
+func (s *nginxauth) verifyPasswordReset(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	req, err := getEmailRequest(r)
+	if err != nil {
+		requestErr(w, err)
+		return
+	}
+	csrfToken, user, err := authStore.VerifyPasswordReset(w, r, s.emailParams(r, req, "", ""))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	outputData(w, verifyEmailResponse{user.GetInfoString("destinationURL"), user.Email, csrfToken})
+}
+
+// meResponse describes the logged in user and their session
+type meResponse struct {
+	UserID        string                 `json:"userID"`
+	Email         string                 `json:"email"`
+	Info          map[string]interface{} `json:"info"`
+	Roles         []string               `json:"roles"`
+	Scopes        []string               `json:"scopes,omitempty"`
+	ExpireTimeUTC time.Time              `json:"expireTimeUTC"`
+}
+
+func me(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	session, err := authStore.GetSession(w, r)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	roles, err := authStore.GetSessionRoles(session)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, meResponse{session.UserID, session.Email, session.Info, roles, session.Scopes, session.ExpireTimeUTC})
 }
 
 func createProfile(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
@@ -227,8 +1002,16 @@ func createSecondaryEmail(authStore auth.AuthStorer, w http.ResponseWriter, r *h
 	outputMessage(w, `{ "result": "Success" }`, authStore.CreateSecondaryEmail(w, r, "", ""))
 }
 
-func setPrimaryEmail(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
-	outputMessage(w, `{ "result": "Success" }`, authStore.SetPrimaryEmail(w, r, "", ""))
+func (s *nginxauth) setPrimaryEmail(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.SetPrimaryEmail(w, r, templateName(s.conf.ConfirmEmailChangeTemplate), s.conf.ConfirmEmailChangeSubject))
+}
+
+func confirmEmailChange(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.ConfirmEmailChange(w, r, r.FormValue("code")))
+}
+
+func revertEmailChange(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.RevertEmailChange(w, r, r.FormValue("code")))
 }
 
 func updatePassword(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
@@ -236,14 +1019,129 @@ func updatePassword(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Re
 	outputMessage(w, `{ "result": "Success" }`, err)
 }
 
+func getAPIKeys(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	keys, err := authStore.GetAPIKeys(w, r)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	outputData(w, keys)
+}
+
+func createAPIKey(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	key, err := authStore.CreateAPIKey(w, r)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, key)
+}
+
+func deleteAPIKey(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.DeleteAPIKey(w, r, r.FormValue("id")))
+}
+
+func getRoles(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	roles, err := authStore.GetRoles(w, r)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	outputData(w, roles)
+}
+
+func saveRole(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	role, err := authStore.SaveRole(w, r)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	outputData(w, role)
+}
+
+func deleteRole(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.DeleteRole(w, r, r.FormValue("name")))
+}
+
+func getUserRoles(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	roles, err := authStore.GetUserRoles(w, r, r.FormValue("email"))
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	outputData(w, roles)
+}
+
+func setUserRoles(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.SetUserRoles(w, r))
+}
+
+// setUserInfo sets the info fields of the user, e.g. {"email": "jane@example.com", "info": {"plan": "pro"}}
+func setUserInfo(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.SetUserInfo(w, r))
+}
+
+// profileSchema reads ProfileSchemaFile. The schema is nil when there isn't one
+func (n *authConf) profileSchema() (*auth.ProfileSchema, error) {
+	if n.ProfileSchemaFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(n.ProfileSchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ParseProfileSchema(data)
+}
+
+// printDKIMRecord shows the DNS record receivers check DKIM signatures with
+func (s *nginxauth) printDKIMRecord() error {
+	signer, err := s.conf.dkimSigner()
+	if err != nil {
+		return err
+	}
+	if signer == nil {
+		return errors.New("DKIMPrivateKeyFile isn't configured")
+	}
+	record, err := signer.DNSRecord()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s._domainkey.%s TXT \"%s\"\n", signer.Selector, signer.Domain, record)
+	return nil
+}
+
+// addAdminRole gives the first administrator access to the admin API
+func addAdminRole(b auth.Backender, email string) error {
+	user, err := b.GetUser(email)
+	if err != nil {
+		return fmt.Errorf("user %s not found: %v", email, err)
+	}
+	roles, err := b.GetUserRoles(user.UserID)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if role == auth.RoleAdmin {
+			return nil
+		}
+	}
+	return b.UpdateUserRoles(user.UserID, append(roles, auth.RoleAdmin))
+}
+
 type verifyEmailResponse struct {
 	DestinationURL string `json:"destinationURL"`
 	Email          string `json:"email"`
 	CSRFToken      string `json:"csrfToken"`
 }
 
-func verifyEmail(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
-	csrfToken, user, err := authStore.VerifyEmail(w, r, auth.EmailSendParams{})
+func (s *nginxauth) verifyEmail(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	req, err := getEmailRequest(r)
+	if err != nil {
+		requestErr(w, err)
+		return
+	}
+	csrfToken, user, err := authStore.VerifyEmail(w, r, s.emailParams(r, req, s.conf.WelcomeTemplate, s.conf.WelcomeSubject))
 	if err != nil {
 		outputError(w, err)
 		return
@@ -258,12 +1156,22 @@ func run(name string, method func(http.ResponseWriter, *http.Request) error, w h
 func runWithProfile(method func(http.ResponseWriter, *http.Request) (*auth.LoginSession, error), w http.ResponseWriter, r *http.Request) {
 	s, err := method(w, r)
 	if err != nil {
-		authErr(w, r, err)
+		outputError(w, err)
 		return
 	}
 	outputData(w, &auth.User{Email: s.Email, UserID: s.UserID, Info: s.Info})
 }
 
+func runWithToken(method func(http.ResponseWriter, *http.Request) (*auth.TokenResponse, error), w http.ResponseWriter, r *http.Request) {
+	tokens, err := method(w, r)
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, tokens)
+}
+
 func runWithCSRF(method func(http.ResponseWriter, *http.Request) (string, error), w http.ResponseWriter, r *http.Request) {
 	csrfToken, err := method(w, r)
 	outputMessage(w, fmt.Sprintf(`{ "result": "Success", "csrfToken": "%s" }`, csrfToken), err)
@@ -279,11 +1187,11 @@ func outputMessage(w http.ResponseWriter, message string, err error) {
 	fmt.Fprint(w, message)
 }
 
+// outputError sends err with the status for its code
 func outputError(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), http.StatusInternalServerError)
-	if aerr, ok := err.(*auth.AuthError); ok {
-		log.Println(aerr.Trace())
-	}
+	code := auth.ErrorCode(err)
+	writeError(w, auth.ErrorStatus(code), code, auth.PublicMessage(err))
+	logError(err)
 }
 
 func outputData(w http.ResponseWriter, data interface{}) {
@@ -291,10 +1199,6 @@ func outputData(w http.ResponseWriter, data interface{}) {
 	outputMessage(w, string(outData), err)
 }
 
-func addUserHeader(userJSON string, w http.ResponseWriter) {
-	w.Header().Add("X-User", userJSON)
-}
-
 func createLogfile(logFile string) (*os.File, error) {
 	dir := path.Dir(logFile)
 	if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
 	"log"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/EndFirstCorp/auth"
 	"github.com/pkg/errors"
 )
 
+const unauthenticatedBody = `{"error":{"code":"unauthenticated","message":"Authentication required"}}` + "\n"
+const internalErrorBody = `{"error":{"code":"internal_error","message":"Something went wrong. Please try again later"}}` + "\n"
+const invalidRequestBody = `{"error":{"code":"invalid_request","message":"Invalid request body"}}` + "\n"
+
 type nilWriter struct{}
 
 func (w *nilWriter) Write(p []byte) (n int, err error) {
@@ -42,42 +55,184 @@ func TestNewEmailer(t *testing.T) {
 		EmailChangedSubject:     "emailChangedSubject",
 		PasswordChangedTemplate: "../testTemplates/passwordChanged.html",
 		PasswordChangedSubject:  "passwordChangedSubject",
+		MagicLinkTemplate:       "../testTemplates/magicLink.html",
+		MagicLinkSubject:        "magicLinkSubject",
+	}
+	emailer, err := n.NewEmailer()
+	if err != nil || emailer.TemplateCache.Lookup("verifyEmail.html") == nil || emailer.TemplateCache.Lookup("verifyEmail.fr.html") == nil {
+		t.Error("expected default and localized templates", err)
+	}
+	if emailer.TextTemplateCache == nil || emailer.TextTemplateCache.Lookup("verifyEmail.txt") == nil || len(emailer.Inline) != 0 || len(emailer.Headers) != 0 {
+		t.Error("expected text template", emailer)
+	}
+
+	n.EmailReplyTo = "help@example.com"
+	n.EmailListUnsubscribe = "<{{.BaseURL}}/unsubscribe>"
+	n.EmailInlineImages = "../testTemplates/verifyEmail.html, "
+	n.SMTPEnvelopeFrom = "bounces@example.com"
+	emailer, err = n.NewEmailer()
+	if err != nil || emailer.Headers["Reply-To"] != "help@example.com" || emailer.Headers["List-Unsubscribe"] != "<{{.BaseURL}}/unsubscribe>" ||
+		len(emailer.Inline) != 1 || emailer.Inline[0].ContentID != "verifyEmail.html" || emailer.Sender.(*auth.SmtpSender).EnvelopeFrom != "bounces@example.com" {
+		t.Error("expected headers, inline image and envelope sender", emailer, err)
+	}
+
+	n.DKIMPrivateKeyFile = "../testTemplates/missing.pem"
+	if _, err := n.NewEmailer(); err == nil {
+		t.Error("expected missing DKIM key error")
+	}
+	n.DKIMPrivateKeyFile = ""
+
+	n.EmailFileDir = "/tmp/mail"
+	if emailer, err = n.NewEmailer(); err != nil || emailer.Sender.(*auth.FileSender).Dir != "/tmp/mail" {
+		t.Error("expected file sender", emailer, err)
+	}
+
+	n.EmailInlineImages = "../testTemplates/missing.png"
+	if _, err := n.NewEmailer(); err == nil {
+		t.Error("expected missing image error")
 	}
-	n.NewEmailer()
 }
 
 func TestAuth(t *testing.T) {
 	log.SetOutput(&nilWriter{})
 	w := httptest.NewRecorder()
+	s := &nginxauth{}
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: errors.New("failed")})
-	authCookie(storer, w, nil)
-	checkBodyAndMethods(t, "Authentication required: failed\n", []string{"GetSession"}, w, storer)
+	s.authCookie(storer, w, nil)
+	checkBodyAndMethods(t, unauthenticatedBody, []string{"GetCookieSession"}, w, storer)
 
 	w = httptest.NewRecorder()
 	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "1", Email: "test@test.com", Info: map[string]interface{}{"fullName": "Name"}}})
-	authCookie(storer, w, nil)
-	checkHeaderAndMethods(t, `{"userID":"1","email":"test@test.com","isEmailVerified":false,"info":{"fullName":"Name"}}`, []string{"GetSession"}, w, storer)
+	s.authCookie(storer, w, nil)
+	checkHeaderAndMethods(t, `{"userID":"1","email":"test@test.com","isEmailVerified":false,"info":{"fullName":"Name"}}`, []string{"GetCookieSession"}, w, storer)
 }
 
 func TestAuthBasic(t *testing.T) {
 	log.SetOutput(&nilWriter{})
 	w := httptest.NewRecorder()
+	s := &nginxauth{}
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetBasicAuthErr: errors.New("failed")})
-	authBasic(storer, w, nil)
-	checkBodyAndMethods(t, "Authentication required: failed\n", []string{"GetBasicAuth"}, w, storer)
+	s.authBasic(storer, w, nil)
+	checkBodyAndMethods(t, unauthenticatedBody, []string{"GetBasicAuth"}, w, storer)
 
 	w = httptest.NewRecorder()
 	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetBasicAuthVal: &auth.LoginSession{UserID: "0", Email: "test@test.com"}})
-	authBasic(storer, w, nil)
+	s.authBasic(storer, w, nil)
 	checkHeaderAndMethods(t, `{"userID":"0","email":"test@test.com","isEmailVerified":false,"info":null}`, []string{"GetBasicAuth"}, w, storer)
 }
 
+func TestAuthRequiredAccess(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := &nginxauth{}
+	session := &auth.LoginSession{UserID: "1", Email: "test@test.com"}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: session, AuthorizeErr: errors.New("Not authorized")})
+	s.authCookie(storer, w, httptest.NewRequest("GET", "/auth?role=admin", nil))
+	if w.Code != 403 || w.Header().Get("X-User") != "" {
+		t.Error("expected forbidden", w.Code, w.Header())
+	}
+	checkMethods(t, []string{"GetCookieSession", "Authorize"}, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetBasicAuthVal: session})
+	r := httptest.NewRequest("GET", "/authBasic", nil)
+	r.Header.Set("X-Required-Permission", "posts:write")
+	s.authBasic(storer, w, r)
+	if w.Code != 200 || w.Header().Get("X-User") == "" {
+		t.Error("expected authorized", w.Code, w.Header())
+	}
+	checkMethods(t, []string{"GetBasicAuth", "Authorize"}, storer)
+}
+
+func TestRequiredAccess(t *testing.T) {
+	r := httptest.NewRequest("GET", "/auth?role=admin,editor&permission=posts:read&permission=posts:write", nil)
+	r.Header.Add("X-Required-Role", "viewer")
+	r.Header.Add("X-Required-Permission", " posts:delete, ")
+	roles, permissions := requiredAccess(r)
+	if strings.Join(roles, " ") != "admin editor viewer" || strings.Join(permissions, " ") != "posts:read posts:write posts:delete" {
+		t.Error("expected roles and permissions from query and headers", roles, permissions)
+	}
+	if roles, permissions := requiredAccess(httptest.NewRequest("GET", "/auth", nil)); roles != nil || permissions != nil {
+		t.Error("expected nothing required", roles, permissions)
+	}
+}
+
+func TestAuthAPIKeyScopes(t *testing.T) {
+	s := &nginxauth{}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetBasicAuthVal: &auth.LoginSession{UserID: "0", Scopes: []string{"read", "deploy:write"}}})
+	s.authBasic(storer, w, nil)
+	if w.Header().Get("X-User-Scopes") != "read deploy:write" {
+		t.Error("expected scopes header", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "0"}})
+	s.authCookie(storer, w, nil)
+	if _, ok := w.Header()["X-User-Scopes"]; ok {
+		t.Error("expected no scopes header for an unrestricted session", w.Header())
+	}
+}
+
+func TestAuthSignedUserHeader(t *testing.T) {
+	keys, _ := auth.NewKeyManager(auth.NewBackendMemory(&auth.CryptoHashStore{}), auth.SigningAlgorithmEdDSA, 0, 0)
+	s := &nginxauth{keys: keys, conf: authConf{UserHeaderFormat: "jwt", TokenIssuer: "https://auth.example.com"}}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "1", Email: "test@test.com", Info: map[string]interface{}{"fullName": "Name"}}})
+	s.authCookie(storer, w, nil)
+
+	claims := &userClaims{}
+	if err := keys.Parse(w.Header().Get("X-User"), claims); err != nil || claims.Subject != "1" || claims.Email != "test@test.com" ||
+		claims.Info["fullName"] != "Name" || claims.Issuer != "https://auth.example.com" || claims.Audience != auth.IdentityTokenAudience {
+		t.Error("expected signed user header", err, claims)
+	}
+
+	a, _ := auth.NewAuthStoreWithConfig(auth.NewBackendMemory(&auth.CryptoHashStore{}), nil, "", "", nil, false,
+		auth.AuthStoreConfig{TokenMode: true, TokenIssuer: "https://auth.example.com", TokenKeys: keys})
+	r := httptest.NewRequest("GET", "/me", nil)
+	r.Header.Set("Authorization", "Bearer "+w.Header().Get("X-User"))
+	if _, err := a.GetSession(httptest.NewRecorder(), r); err == nil || auth.ErrorCode(err) != auth.ErrCodeUnauthenticated {
+		t.Error("expected X-User to be refused as a bearer token", err)
+	}
+}
+
+func TestJWKSAndDiscovery(t *testing.T) {
+	keys, _ := auth.NewKeyManager(auth.NewBackendMemory(&auth.CryptoHashStore{}), "", 0, 0)
+	s := &nginxauth{keys: keys, conf: authConf{TokenMode: "true", AllowedHosts: "auth.example.com"}}
+	w := httptest.NewRecorder()
+	s.jwks(nil, w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	jwks := &auth.JSONWebKeySet{}
+	if err := json.Unmarshal(w.Body.Bytes(), jwks); err != nil || len(jwks.Keys) != 1 || jwks.Keys[0].Algorithm != "RS256" || w.Header().Get("Cache-Control") == "" {
+		t.Error("expected key set", err, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	r.Host = "auth.example.com"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	s.openIDConfiguration(nil, w, r)
+	checkBody(t, `{"issuer":"https://auth.example.com","token_endpoint":"https://auth.example.com/token","jwks_uri":"https://auth.example.com/.well-known/jwks.json",`+
+		`"response_types_supported":[],"subject_types_supported":["public"],"id_token_signing_alg_values_supported":["RS256"]}`, w)
+
+	s.conf = authConf{TokenIssuer: "https://issuer.example.com/"}
+	w = httptest.NewRecorder()
+	s.openIDConfiguration(nil, w, r)
+	checkBody(t, `{"issuer":"https://issuer.example.com/","jwks_uri":"https://issuer.example.com/.well-known/jwks.json",`+
+		`"response_types_supported":[],"subject_types_supported":["public"],"id_token_signing_alg_values_supported":["RS256"]}`, w)
+}
+
 func TestLogin(t *testing.T) {
 	log.SetOutput(&nilWriter{})
 	w := httptest.NewRecorder()
-	storer := auth.NewFakeStorer(auth.FakeStorerConfig{LoginErr: errors.New("failed")})
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{LoginErr: auth.NewError(auth.ErrCodeInvalidCredentials, "Invalid username or password", nil)})
 	login(storer, w, nil)
-	checkBodyAndMethods(t, "Authentication required: failed\n", []string{"Login"}, w, storer)
+	checkBodyAndMethods(t, `{"error":{"code":"invalid_credentials","message":"Invalid username or password"}}`+"\n", []string{"Login"}, w, storer)
+
+	w = httptest.NewRecorder()
+	login(auth.NewFakeStorer(auth.FakeStorerConfig{LoginErr: auth.NewError(auth.ErrCodeAccountLocked, "Your account is locked. Please reset your password.", nil)}), w, nil)
+	if w.Code != 403 {
+		t.Error("expected locked account to be forbidden", w.Code)
+	}
 
 	w = httptest.NewRecorder()
 	storer = auth.NewFakeStorer(auth.FakeStorerConfig{LoginVal: &auth.LoginSession{}})
@@ -87,25 +242,179 @@ func TestLogin(t *testing.T) {
 
 func TestRegister(t *testing.T) {
 	log.SetOutput(&nilWriter{})
+	s := &nginxauth{conf: authConf{VerifyEmailTemplate: "../testTemplates/verifyEmail.html", VerifyEmailSubject: "Verify"}}
 	w := httptest.NewRecorder()
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{RegisterErr: errors.New("failed")})
-	register(storer, w, nil)
-	checkBodyAndMethods(t, "failed\n", []string{"Register"}, w, storer)
+	s.register(storer, w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"email": "test@test.com"}`)))
+	checkBodyAndMethods(t, internalErrorBody, []string{"Register"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.register(storer, w, httptest.NewRequest("POST", "/register", strings.NewReader(`{"email": "test@test.com", "password": "password"}`)))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"Register"}, w, storer)
+}
+
+func TestEmailParams(t *testing.T) {
+	s := &nginxauth{conf: authConf{OneTimeCodeLength: 6, AllowedHosts: "localhost, auth.example.com"}}
+	r := httptest.NewRequest("POST", "/register", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "auth.example.com")
+	params := s.emailParams(r, &emailRequest{Email: "test@test.com", Code: "123456", DestinationURL: "/app"}, "../testTemplates/verifyEmail.html", "Verify")
+	if params.Email != "test@test.com" || params.VerificationCode != "123456" || params.BaseURL != "https://auth.example.com" ||
+		params.TemplateSuccess != "verifyEmail.html" || params.SubjectSuccess != "Verify" || !params.UseOneTimeCode || params.DestinationURL != "/app" {
+		t.Error("expected params from config and request", params)
+	}
+	if params := s.emailParams(r, &emailRequest{DestinationURL: "https://evil.example.com/"}, "", ""); params.DestinationURL != "" {
+		t.Error("expected destination on another site to be dropped", params.Info)
+	}
+
+	r.Header.Set("X-Forwarded-Host", "evil.com")
+	if params := s.emailParams(r, &emailRequest{}, "", ""); params.BaseURL != "" {
+		t.Error("expected links not to point at hosts which aren't allowed", params.BaseURL)
+	}
+	s.conf.BaseURL = "https://auth.example.com"
+	if params := s.emailParams(r, &emailRequest{}, "", ""); params.BaseURL != "https://auth.example.com" {
+		t.Error("expected configured base URL", params.BaseURL)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{LogoutErr: errors.New("failed")})
+	logout(storer, w, nil)
+	checkBodyAndMethods(t, internalErrorBody, []string{"Logout"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	logoutAll(storer, w, nil)
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"LogoutAll"}, w, storer)
+}
+
+func TestPasswordReset(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := &nginxauth{conf: authConf{PasswordResetTemplate: "../testTemplates/passwordReset.html", PasswordResetSubject: "Reset"}}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.requestPasswordReset(storer, w, httptest.NewRequest("POST", "/requestPasswordReset", strings.NewReader(`{"email": "test@test.com"}`)))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"RequestPasswordReset"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{VerifyPasswordResetErr: errors.New("failed")})
+	s.verifyPasswordReset(storer, w, httptest.NewRequest("POST", "/verifyPasswordReset", strings.NewReader(`{"email": "test@test.com", "code": "bogus"}`)))
+	checkBodyAndMethods(t, internalErrorBody, []string{"VerifyPasswordReset"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{VerifyPasswordResetVal: "csrf", VerifyPasswordResetVal2: &auth.User{Email: "test@test.com", Info: map[string]interface{}{"destinationURL": "/app"}}})
+	s.verifyPasswordReset(storer, w, httptest.NewRequest("POST", "/verifyPasswordReset", strings.NewReader(`{"email": "test@test.com", "code": "code"}`)))
+	checkBodyAndMethods(t, `{"destinationURL":"/app","email":"test@test.com","csrfToken":"csrf"}`, []string{"VerifyPasswordReset"}, w, storer)
+}
+
+func TestMe(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: auth.NewError(auth.ErrCodeUnauthenticated, "Authentication required", nil)})
+	me(storer, w, nil)
+	checkBodyAndMethods(t, unauthenticatedBody, []string{"GetSession"}, w, storer)
+
+	w = httptest.NewRecorder()
+	expires := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "1", Email: "test@test.com", ExpireTimeUTC: expires}, GetSessionRolesVal: []string{"editor"}})
+	me(storer, w, nil)
+	checkBodyAndMethods(t, `{"userID":"1","email":"test@test.com","info":null,"roles":["editor"],"expireTimeUTC":"2030-01-01T00:00:00Z"}`, []string{"GetSession", "GetSessionRoles"}, w, storer)
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("expected user not to be cached")
+	}
+}
+
+func TestRequestMagicLink(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := &nginxauth{conf: authConf{MagicLinkTemplate: "../testTemplates/magicLink.html", MagicLinkSubject: "Log in"}}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.requestMagicLink(storer, w, httptest.NewRequest("POST", "/requestMagicLink", strings.NewReader(`{"email": "test@test.com"}`)))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"RequestMagicLink"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.requestMagicLink(storer, w, httptest.NewRequest("POST", "/requestMagicLink", strings.NewReader(`bogus`)))
+	checkBodyAndMethods(t, invalidRequestBody, nil, w, storer)
+}
+
+func TestMagicLink(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{ConsumeMagicLinkErr: errors.New("failed")})
+	magicLink(storer, w, httptest.NewRequest("POST", "/magicLink?code=1234", nil))
+	checkBodyAndMethods(t, internalErrorBody, []string{"ConsumeMagicLink"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{ConsumeMagicLinkVal: &auth.LoginSession{UserID: "1", Email: "test@test.com"}})
+	magicLink(storer, w, httptest.NewRequest("POST", "/magicLink?code=1234&rememberMe=true", nil))
+	checkBodyAndMethods(t, `{"userID":"1","email":"test@test.com","isEmailVerified":false,"info":null}`, []string{"ConsumeMagicLink"}, w, storer)
+}
+
+func TestVerifyLoginCode(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{})
+	verifyLoginCode(storer, w, httptest.NewRequest("POST", "/verifyLoginCode", strings.NewReader("bogus")))
+	if w.Code != 400 || len(storer.MethodsCalled()) != 0 {
+		t.Error("expected invalid request", w.Code, storer.MethodsCalled())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{VerifyLoginCodeVal: &auth.LoginSession{UserID: "1", Email: "test@test.com"}})
+	verifyLoginCode(storer, w, httptest.NewRequest("POST", "/verifyLoginCode", strings.NewReader(`{"email":"test@test.com","code":"123456"}`)))
+	checkBodyAndMethods(t, `{"userID":"1","email":"test@test.com","isEmailVerified":false,"info":null}`, []string{"VerifyLoginCode"}, w, storer)
+}
+
+func TestLoginToken(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{LoginTokenErr: auth.NewError(auth.ErrCodeLoginCodeRequired, "Enter the code we sent you to finish logging in", nil)})
+	loginToken(storer, w, nil)
+	checkBodyAndMethods(t, `{"error":{"code":"login_code_required","message":"Enter the code we sent you to finish logging in"}}`+"\n", []string{"LoginToken"}, w, storer)
+	if w.Code != 401 {
+		t.Error("expected login code to be required", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{RefreshTokenVal: &auth.TokenResponse{AccessToken: "access", TokenType: "Bearer", ExpiresIn: 900, RefreshToken: "refresh"}})
+	refreshToken(storer, w, nil)
+	checkBodyAndMethods(t, `{"access_token":"access","token_type":"Bearer","expires_in":900,"refresh_token":"refresh"}`, []string{"RefreshToken"}, w, storer)
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("expected tokens not to be cached")
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{RevokeTokenErr: errors.New("failed")})
+	revokeToken(storer, w, nil)
+	checkBodyAndMethods(t, internalErrorBody, []string{"RevokeToken"}, w, storer)
 }
 
 func TestCreateProfile(t *testing.T) {
 	w := httptest.NewRecorder()
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{CreateProfileErr: errors.New("failed")})
 	createProfile(storer, w, nil)
-	checkBodyAndMethods(t, "Authentication required: failed\n", []string{"CreateProfile"}, w, storer)
+	checkBodyAndMethods(t, internalErrorBody, []string{"CreateProfile"}, w, storer)
 }
 
 func TestSetPrimaryEmail(t *testing.T) {
 	log.SetOutput(&nilWriter{})
 	w := httptest.NewRecorder()
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{SetPrimaryEmailErr: errors.New("failed")})
-	setPrimaryEmail(storer, w, nil)
-	checkBodyAndMethods(t, "failed\n", []string{"SetPrimaryEmail"}, w, storer)
+	s := &nginxauth{conf: authConf{ConfirmEmailChangeTemplate: "confirmEmailChange.html"}}
+	s.setPrimaryEmail(storer, w, nil)
+	checkBodyAndMethods(t, internalErrorBody, []string{"SetPrimaryEmail"}, w, storer)
+}
+
+func TestConfirmEmailChange(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{})
+	confirmEmailChange(storer, w, httptest.NewRequest("POST", "/confirmEmailChange?code=1234", nil))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"ConfirmEmailChange"}, w, storer)
 }
 
 func TestCreateSecondaryEmail(t *testing.T) {
@@ -113,7 +422,125 @@ func TestCreateSecondaryEmail(t *testing.T) {
 	w := httptest.NewRecorder()
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{CreateSecondaryEmailErr: errors.New("failed")})
 	createSecondaryEmail(storer, w, nil)
-	checkBodyAndMethods(t, "failed\n", []string{"CreateSecondaryEmail"}, w, storer)
+	checkBodyAndMethods(t, internalErrorBody, []string{"CreateSecondaryEmail"}, w, storer)
+}
+
+func TestRevertEmailChange(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{RevertEmailChangeErr: errors.New("failed")})
+	revertEmailChange(storer, w, httptest.NewRequest("POST", "/revertEmailChange?code=1234", nil))
+	checkBodyAndMethods(t, internalErrorBody, []string{"RevertEmailChange"}, w, storer)
+}
+
+func TestAPIKeys(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{CreateAPIKeyVal: &auth.NewAPIKey{APIKey: auth.APIKey{ID: "1", Name: "CI"}, Key: "nak_1_secret"}})
+	createAPIKey(storer, w, nil)
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("expected new key not to be cached")
+	}
+	checkBodyAndMethods(t, `{"id":"1","name":"CI","prefix":"","scopes":null,"createdTimeUTC":"0001-01-01T00:00:00Z","expireTimeUTC":"0001-01-01T00:00:00Z","key":"nak_1_secret"}`, []string{"CreateAPIKey"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetAPIKeysErr: auth.NewError(auth.ErrCodeSessionExpired, "Your session has expired. Please log in again", nil)})
+	getAPIKeys(storer, w, nil)
+	if w.Code != 401 {
+		t.Error("expected unauthorized", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	getAPIKeys(auth.NewFakeStorer(auth.FakeStorerConfig{GetAPIKeysErr: errors.New("failed")}), w, nil)
+	if w.Code != 500 {
+		t.Error("expected internal error", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetAPIKeysVal: []*auth.APIKey{{ID: "1", Scopes: []string{"read"}}}})
+	getAPIKeys(storer, w, nil)
+	checkBodyAndMethods(t, `[{"id":"1","name":"","prefix":"","scopes":["read"],"createdTimeUTC":"0001-01-01T00:00:00Z","expireTimeUTC":"0001-01-01T00:00:00Z"}]`, []string{"GetAPIKeys"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	deleteAPIKey(storer, w, httptest.NewRequest("POST", "/deleteAPIKey?id=1", nil))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"DeleteAPIKey"}, w, storer)
+}
+
+func TestRoleAdministration(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetRolesVal: []*auth.Role{{Name: "admin", Permissions: []string{"*"}}}})
+	getRoles(storer, w, nil)
+	checkBodyAndMethods(t, `[{"name":"admin","permissions":["*"]}]`, []string{"GetRoles"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{SaveRoleErr: auth.NewError(auth.ErrCodeForbidden, "Not authorized. Requires permission: auth:admin", nil)})
+	saveRole(storer, w, nil)
+	checkBodyAndMethods(t, `{"error":{"code":"forbidden","message":"Not authorized. Requires permission: auth:admin"}}`+"\n", []string{"SaveRole"}, w, storer)
+	if w.Code != 403 {
+		t.Error("expected non-admin to be forbidden", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	getUserRoles(auth.NewFakeStorer(auth.FakeStorerConfig{GetUserRolesErr: auth.NewError(auth.ErrCodeUserNotFound, "User not found", nil)}), w, httptest.NewRequest("GET", "/admin/userRoles?email=bogus@test.com", nil))
+	if w.Code != 404 {
+		t.Error("expected unknown user", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetUserRolesVal: []string{"editor"}})
+	getUserRoles(storer, w, httptest.NewRequest("GET", "/admin/userRoles?email=test@test.com", nil))
+	checkBodyAndMethods(t, `["editor"]`, []string{"GetUserRoles"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	deleteRole(storer, w, httptest.NewRequest("POST", "/admin/deleteRole?name=editor", nil))
+	setUserRoles(storer, w, nil)
+	setUserInfo(storer, w, nil)
+	checkMethods(t, []string{"DeleteRole", "SetUserRoles", "SetUserInfo"}, storer)
+}
+
+func TestProfileSchema(t *testing.T) {
+	if schema, err := (&authConf{}).profileSchema(); schema != nil || err != nil {
+		t.Error("expected no schema when it isn't configured", schema, err)
+	}
+	dir, _ := ioutil.TempDir("", "schema")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "profile.json")
+	ioutil.WriteFile(file, []byte(`{"fields": [{"name": "fullName", "required": true}]}`), 0644)
+	if schema, err := (&authConf{ProfileSchemaFile: file}).profileSchema(); err != nil || len(schema.Fields) != 1 || schema.Fields[0].Name != "fullName" {
+		t.Error("expected schema", schema, err)
+	}
+	ioutil.WriteFile(file, []byte(`{"fields": [{"name": "roles"}]}`), 0644)
+	if _, err := (&authConf{ProfileSchemaFile: file}).profileSchema(); err == nil {
+		t.Error("expected invalid schema error")
+	}
+}
+
+func TestAddAdminRole(t *testing.T) {
+	b := auth.NewBackendMemory(&auth.CryptoHashStore{})
+	if err := addAdminRole(b, "test@test.com"); err == nil {
+		t.Error("expected unknown user to fail")
+	}
+	b.AddVerifiedUser("test@test.com", nil)
+	addAdminRole(b, "test@test.com")
+	if err := addAdminRole(b, "test@test.com"); err != nil {
+		t.Fatal("expected admin role to be added", err)
+	}
+	if roles, _ := b.GetUserRoles("1"); len(roles) != 1 || roles[0] != auth.RoleAdmin {
+		t.Error("expected admin role only once", roles)
+	}
+}
+
+func TestAuthStoreConfig(t *testing.T) {
+	n := authConf{PasswordChangedTemplate: "../testTemplates/passwordChanged.html", PasswordChangedSubject: "subject", TokenMode: "true", TokenKeyRotationMinutes: 60, TokenKeyGraceMinutes: 30}
+	keys := &auth.KeyManager{}
+	c := n.authStoreConfig(keys)
+	if c.PasswordChangedTemplate != "passwordChanged.html" || c.PasswordChangedSubject != "subject" || c.EmailChangedTemplate != "" ||
+		!c.TokenMode || c.MagicLinkCrossDevice || c.TokenKeyRotationDuration != time.Hour || c.TokenKeyGraceDuration != 30*time.Minute || c.TokenKeys != keys {
+		t.Error("expected config to be converted", c)
+	}
 }
 
 func TestUpdatePassword(t *testing.T) {
@@ -121,22 +548,21 @@ func TestUpdatePassword(t *testing.T) {
 	w := httptest.NewRecorder()
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{UpdatePasswordErr: errors.New("failed")})
 	updatePassword(storer, w, nil)
-	checkBodyAndMethods(t, "failed\n", []string{"UpdatePassword"}, w, storer)
+	checkBodyAndMethods(t, internalErrorBody, []string{"UpdatePassword"}, w, storer)
 }
 
 func TestVerifyEmail(t *testing.T) {
 	log.SetOutput(&nilWriter{})
+	s := &nginxauth{}
 	w := httptest.NewRecorder()
 	storer := auth.NewFakeStorer(auth.FakeStorerConfig{VerifyEmailErr: errors.New("failed")})
-	verifyEmail(storer, w, nil)
-	checkBodyAndMethods(t, "failed\n", []string{"VerifyEmail"}, w, storer)
-}
+	s.verifyEmail(storer, w, httptest.NewRequest("POST", "/verifyEmail", strings.NewReader(`{"email": "test@test.com", "code": "code"}`)))
+	checkBodyAndMethods(t, internalErrorBody, []string{"VerifyEmail"}, w, storer)
 
-func TestAddUserHeader(t *testing.T) {
-	log.SetOutput(&nilWriter{})
-	w := httptest.NewRecorder()
-	addUserHeader(`{"name": "value"}`, w)
-	checkHeader(t, `{"name": "value"}`, w)
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.verifyEmail(storer, w, httptest.NewRequest("POST", "/verifyEmail", strings.NewReader(`bogus`)))
+	checkBodyAndMethods(t, invalidRequestBody, nil, w, storer)
 }
 
 func checkBodyAndMethods(t *testing.T, expectedBody string, expectedMethodsCalled []string, w *httptest.ResponseRecorder, storer auth.FakeStorer) {
@@ -166,3 +592,54 @@ func checkMethods(t *testing.T, expectedMethodsCalled []string, storer auth.Fake
 		t.Errorf("want methods: %v, got %v", expectedMethodsCalled, methodsCalled)
 	}
 }
+
+func TestErrorEnvelope(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	outputError(w, auth.NewError(auth.ErrCodeUserExists, "User already registered", errors.New("DB: User already exists")))
+	if w.Code != 409 || w.Header().Get("Content-Type") != "application/json" {
+		t.Error("expected status for code", w.Code, w.Header())
+	}
+	checkBody(t, `{"error":{"code":"user_exists","message":"User already registered"}}`+"\n", w)
+
+	w = httptest.NewRecorder()
+	authErr(w, nil, auth.NewError(auth.ErrCodeAccountLocked, "Your account is locked. Please reset your password.", nil))
+	if w.Code != 401 {
+		t.Error("expected auth_request to get a 401 whatever the code", w.Code)
+	}
+	checkBody(t, `{"error":{"code":"account_locked","message":"Your account is locked. Please reset your password."}}`+"\n", w)
+
+	w = httptest.NewRecorder()
+	forbiddenErr(w, errors.New("IP address 10.0.0.1 is not in 192.168.0.0/16"))
+	if w.Code != 403 {
+		t.Error("expected forbidden", w.Code)
+	}
+	checkBody(t, `{"error":{"code":"forbidden","message":"Not authorized"}}`+"\n", w)
+
+	w = httptest.NewRecorder()
+	s := &nginxauth{}
+	s.method("POST", login)(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != 405 {
+		t.Error("expected method not allowed", w.Code)
+	}
+	checkBody(t, `{"error":{"code":"invalid_request","message":"Unsupported method"}}`+"\n", w)
+}
+
+func TestDKIMSigner(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	dir, _ := ioutil.TempDir("", "dkim")
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "dkim.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	n := &authConf{}
+	if signer, err := n.dkimSigner(); signer != nil || err != nil {
+		t.Error("expected no signer", err)
+	}
+	n = &authConf{DKIMDomain: "example.com", DKIMSelector: "mail", DKIMPrivateKeyFile: keyFile, DKIMHeaderCanonicalization: "simple"}
+	signer, err := n.dkimSigner()
+	if err != nil || signer.Domain != "example.com" || signer.Selector != "mail" || signer.HeaderCanonicalization != "simple" || signer.Algorithm() != auth.DKIMAlgorithmEd25519 {
+		t.Error("expected configured signer", signer, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+// defaultConsentTemplate is used when OAuthConsentTemplate isn't configured. It posts to
+// /oauth2/consent relative to /oauth2/authorize so it works behind a path prefix
+const defaultConsentTemplate string = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize {{.ClientName}}</title></head>
+<body>
+<form method="POST" action="consent">
+  <p><strong>{{.ClientName}}</strong> would like to:</p>
+  <ul>
+    {{range .Scopes}}<li>{{if eq . "openid"}}Sign you in{{else if eq . "email"}}See your email address{{else if eq . "profile"}}See your profile{{else}}{{.}}{{end}}</li>
+    {{end}}
+  </ul>
+  {{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+  {{end}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+  <button type="submit" name="decision" value="approve">Allow</button>
+  <button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`
+
+// authorizeParams are passed back to /oauth2/authorize after the user logs in from the consent form
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"}
+
+func (n *authConf) consentTemplate() (*template.Template, error) {
+	if n.OAuthConsentTemplate != "" {
+		return template.ParseFiles(n.OAuthConsentTemplate)
+	}
+	return template.New("consent").Parse(defaultConsentTemplate)
+}
+
+func registerOAuthClient(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	client, err := authStore.RegisterOAuthClient(w, r)
+	if err != nil {
+		oauthErr(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(client)
+}
+
+func (s *nginxauth) oauthAuthorize(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	result, err := authStore.OAuthAuthorize(w, r)
+	s.authorizeResult(w, r, result, err)
+}
+
+func (s *nginxauth) oauthConsent(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	result, err := authStore.OAuthConsent(w, r)
+	s.authorizeResult(w, r, result, err)
+}
+
+// authorizeResult sends the browser back to the client, to the login page, or shows the consent screen
+func (s *nginxauth) authorizeResult(w http.ResponseWriter, r *http.Request, result *auth.OAuthAuthorization, err error) {
+	if err != nil {
+		if oerr, ok := err.(*auth.OAuthError); ok && oerr.RedirectURL != "" {
+			http.Redirect(w, r, oerr.RedirectURL, http.StatusFound)
+			return
+		}
+		oauthErr(w, err)
+		return
+	}
+	switch {
+	case result.RedirectURL != "":
+		http.Redirect(w, r, result.RedirectURL, http.StatusFound)
+	case result.LoginRequired && s.conf.OAuthLoginURL != "":
+		http.Redirect(w, r, loginURL(s.conf.OAuthLoginURL, authorizeReturnTo(r)), http.StatusFound)
+	case result.LoginRequired:
+		writeError(w, http.StatusUnauthorized, auth.ErrCodeUnauthenticated, "Login required")
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY") // the consent buttons must not be clickjacked
+		if err := s.consent.Execute(w, result.Consent); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// authorizeReturnTo is the authorization request to resume once the user has logged in
+func authorizeReturnTo(r *http.Request) string {
+	if r.Method == "GET" {
+		return r.URL.RequestURI()
+	}
+	params := url.Values{}
+	for _, name := range authorizeParams {
+		if value := r.PostForm.Get(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+	return strings.TrimSuffix(r.URL.Path, "consent") + "authorize?" + params.Encode()
+}
+
+func loginURL(login, returnTo string) string {
+	u, err := url.Parse(login)
+	if err != nil {
+		return login
+	}
+	query := u.Query()
+	query.Set("returnTo", returnTo)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func oauthToken(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	tokens, err := authStore.OAuthToken(w, r)
+	if err != nil {
+		oauthErr(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, tokens)
+}
+
+func oauthUserInfo(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	info, err := authStore.OAuthUserInfo(w, r)
+	if err != nil {
+		if oerr, ok := err.(*auth.OAuthError); ok {
+			w.Header().Set("WWW-Authenticate", `Bearer error="`+oerr.Code+`"`)
+		}
+		oauthErr(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, info)
+}
+
+// oauthErr writes the JSON error body from RFC 6749. Errors which aren't from the OAuth flow keep the status and code
+// of their error code, and are server errors when the status is 500 or more
+func oauthErr(w http.ResponseWriter, err error) {
+	logError(err)
+	status := http.StatusBadRequest
+	oerr, ok := err.(*auth.OAuthError)
+	if !ok {
+		code := auth.ErrorCode(err)
+		status = auth.ErrorStatus(code)
+		if status >= http.StatusInternalServerError {
+			code = "server_error"
+		}
+		oerr = &auth.OAuthError{Code: code, Description: auth.PublicMessage(err)}
+	}
+	switch oerr.Code {
+	case "invalid_client", "invalid_token":
+		status = http.StatusUnauthorized
+	case "insufficient_scope":
+		status = http.StatusForbidden
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oerr)
+}
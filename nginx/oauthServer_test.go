@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+func getOAuthServer() *nginxauth {
+	conf := authConf{OAuthServer: "true", OAuthLoginURL: "https://auth.example.com/login", TokenIssuer: "https://auth.example.com"}
+	consent, _ := conf.consentTemplate()
+	keys, _ := auth.NewKeyManager(auth.NewBackendMemory(&auth.CryptoHashStore{}), "", 0, 0)
+	return &nginxauth{conf: conf, consent: consent, keys: keys}
+}
+
+func TestOAuthAuthorize(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getOAuthServer()
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{OAuthAuthorizeVal: &auth.OAuthAuthorization{RedirectURL: "https://app.example.com/callback?code=1"}})
+	s.oauthAuthorize(storer, w, httptest.NewRequest("GET", "/oauth2/authorize", nil))
+	if w.Code != 302 || w.Header().Get("Location") != "https://app.example.com/callback?code=1" {
+		t.Error("expected redirect to client", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthAuthorizeVal: &auth.OAuthAuthorization{LoginRequired: true}})
+	s.oauthAuthorize(storer, w, httptest.NewRequest("GET", "/oauth2/authorize?client_id=app&state=1", nil))
+	if w.Code != 302 || w.Header().Get("Location") != "https://auth.example.com/login?returnTo=%2Foauth2%2Fauthorize%3Fclient_id%3Dapp%26state%3D1" {
+		t.Error("expected redirect to login", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthAuthorizeVal: &auth.OAuthAuthorization{Consent: &auth.OAuthConsent{ClientName: "<App>", Scopes: []string{"openid", "email"},
+		CSRFToken: "csrf", Params: map[string]string{"client_id": "app", "state": `"1"`}}}})
+	s.oauthAuthorize(storer, w, httptest.NewRequest("GET", "/oauth2/authorize", nil))
+	body := w.Body.String()
+	if w.Code != 200 || w.Header().Get("X-Frame-Options") != "DENY" || !strings.Contains(body, "&lt;App&gt;") || !strings.Contains(body, "See your email address") ||
+		!strings.Contains(body, `name="state" value="&#34;1&#34;"`) || !strings.Contains(body, `name="csrf_token" value="csrf"`) {
+		t.Error("expected consent screen", w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthAuthorizeErr: &auth.OAuthError{Code: "invalid_scope", RedirectURL: "https://app.example.com/callback?error=invalid_scope"}})
+	s.oauthAuthorize(storer, w, httptest.NewRequest("GET", "/oauth2/authorize", nil))
+	if w.Code != 302 || w.Header().Get("Location") != "https://app.example.com/callback?error=invalid_scope" {
+		t.Error("expected error redirect to client", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthAuthorizeErr: &auth.OAuthError{Code: "invalid_request", Description: "Unknown client"}})
+	s.oauthAuthorize(storer, w, httptest.NewRequest("GET", "/oauth2/authorize", nil))
+	checkBody(t, `{"error":"invalid_request","error_description":"Unknown client"}`+"\n", w)
+}
+
+func TestOAuthConsentLoginReturnTo(t *testing.T) {
+	s := getOAuthServer()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/oauth2/consent", strings.NewReader("client_id=app&csrf_token=csrf&decision=approve"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{OAuthConsentVal: &auth.OAuthAuthorization{LoginRequired: true}})
+	s.oauthConsent(storer, w, r)
+	if w.Header().Get("Location") != "https://auth.example.com/login?returnTo=%2Foauth2%2Fauthorize%3Fclient_id%3Dapp" {
+		t.Error("expected login to resume the authorization request", w.Header())
+	}
+}
+
+func TestOAuthToken(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{OAuthTokenErr: &auth.OAuthError{Code: "invalid_client", Description: "Unknown client"}})
+	oauthToken(storer, w, nil)
+	if w.Code != 401 {
+		t.Error("expected unauthorized", w.Code)
+	}
+	checkBodyAndMethods(t, `{"error":"invalid_client","error_description":"Unknown client"}`+"\n", []string{"OAuthToken"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthTokenErr: errors.New("failed")})
+	oauthToken(storer, w, nil)
+	if w.Code != 500 {
+		t.Error("expected server error", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthTokenErr: auth.NewError(auth.ErrCodeForbidden, "Not allowed", nil)})
+	oauthToken(storer, w, nil)
+	if w.Code != 403 {
+		t.Error("expected the status of the error code", w.Code)
+	}
+	checkBody(t, `{"error":"forbidden","error_description":"Not allowed"}`+"\n", w)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthTokenVal: &auth.TokenResponse{AccessToken: "access", TokenType: "Bearer", IDToken: "id"}})
+	oauthToken(storer, w, nil)
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("expected tokens not to be cached")
+	}
+	checkBody(t, `{"access_token":"access","token_type":"Bearer","expires_in":0,"refresh_token":"","id_token":"id"}`, w)
+}
+
+func TestOAuthUserInfo(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{OAuthUserInfoErr: &auth.OAuthError{Code: "invalid_token"}})
+	oauthUserInfo(storer, w, nil)
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+		t.Error("expected bearer challenge", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{OAuthUserInfoVal: map[string]interface{}{"sub": "1"}})
+	oauthUserInfo(storer, w, nil)
+	checkBody(t, `{"sub":"1"}`, w)
+}
+
+func TestRegisterOAuthClientHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{RegisterOAuthClientVal: &auth.OAuthClientRegistration{ClientID: "app", ClientName: "App"}})
+	registerOAuthClient(storer, w, nil)
+	if w.Code != 201 {
+		t.Error("expected created", w.Code)
+	}
+	checkBody(t, `{"client_id":"app","client_name":"App","redirect_uris":null}`+"\n", w)
+}
+
+func TestOAuthDiscovery(t *testing.T) {
+	s := getOAuthServer()
+	s.conf.OAuthRegistrationToken = "token"
+	w := httptest.NewRecorder()
+	s.openIDConfiguration(nil, w, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	config := openIDConfiguration{}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil || config.AuthorizationEndpoint != "https://auth.example.com/oauth2/authorize" ||
+		config.TokenEndpoint != "https://auth.example.com/oauth2/token" || config.UserInfoEndpoint != "https://auth.example.com/oauth2/userinfo" ||
+		config.RegistrationEndpoint != "https://auth.example.com/oauth2/register" || config.ResponseTypesSupported[0] != "code" || config.CodeChallengeMethodsSupported[0] != "S256" {
+		t.Error("expected OAuth endpoints", err, w.Body.String())
+	}
+}
+
+func TestConsentTemplate(t *testing.T) {
+	if _, err := (&authConf{OAuthConsentTemplate: "bogus.html"}).consentTemplate(); err == nil {
+		t.Error("expected missing template to fail")
+	}
+}
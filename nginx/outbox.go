@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+// shutdownTimeout is how long requests and email deliveries in progress have to finish once the server is stopped
+const shutdownTimeout time.Duration = 30 * time.Second
+
+// newOutbox queues emails in b when EmailOutbox is set, so they are delivered in the background
+func (n *authConf) newOutbox(mailer *auth.Emailer, b auth.Backender) *auth.Outbox {
+	if !isTrue(n.EmailOutbox) {
+		return nil
+	}
+	outbox := auth.NewOutbox(mailer, b)
+	if n.EmailOutboxWorkers > 0 {
+		outbox.Workers = n.EmailOutboxWorkers
+	}
+	if n.EmailOutboxMaxAttempts > 0 {
+		outbox.MaxAttempts = n.EmailOutboxMaxAttempts
+	}
+	if n.EmailOutboxMaxAge > 0 {
+		outbox.MaxAge = time.Duration(n.EmailOutboxMaxAge) * time.Second
+	}
+	return outbox
+}
+
+// shutdownOnSignal stops accepting requests on SIGINT or SIGTERM, then waits for the requests and email deliveries
+// in progress. Emails which haven't been delivered stay in the outbox for the next start
+func (s *nginxauth) shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("Stopping auth server")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Unable to finish requests:", err)
+	}
+	if s.outbox != nil {
+		if err := s.outbox.Shutdown(ctx); err != nil {
+			log.Println("Unable to finish email deliveries:", err)
+		}
+	}
+}
+
+// outboxStatus counts the emails waiting for delivery and lists the dead letters. Admins only
+func (s *nginxauth) outboxStatus(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(authStore, w, r) {
+		return
+	}
+	status, err := s.outbox.Status()
+	if err != nil {
+		outputError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, status)
+}
+
+// discardEmail deletes the dead letter with the id form value. Admins only
+func (s *nginxauth) discardEmail(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(authStore, w, r) {
+		return
+	}
+	outputMessage(w, `{ "result": "Success" }`, s.outbox.Discard(r.FormValue("id")))
+}
+
+// requireAdmin sends an error unless the user is logged in with the admin permission
+func requireAdmin(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) bool {
+	session, err := authStore.GetSession(w, r)
+	if err != nil {
+		outputError(w, err)
+		return false
+	}
+	if err := authStore.Authorize(session, nil, []string{auth.PermissionAdmin}); err != nil {
+		forbiddenErr(w, err)
+		return false
+	}
+	return true
+}
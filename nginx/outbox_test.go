@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+func TestNewOutbox(t *testing.T) {
+	n := &authConf{}
+	if n.newOutbox(&auth.Emailer{}, nil) != nil {
+		t.Error("expected no outbox unless it's enabled")
+	}
+	n = &authConf{EmailOutbox: "true", EmailOutboxWorkers: 4, EmailOutboxMaxAttempts: 2, EmailOutboxMaxAge: 60}
+	if outbox := n.newOutbox(&auth.Emailer{}, nil); outbox == nil || outbox.Workers != 4 || outbox.MaxAttempts != 2 || outbox.MaxAge != time.Minute {
+		t.Error("expected configured outbox", outbox)
+	}
+}
+
+func TestOutboxStatus(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	emailer := &auth.Emailer{TemplateCache: template.Must(template.New("verifyEmail.html").Parse("{{ .Email }}"))}
+	s := &nginxauth{outbox: auth.NewOutbox(emailer, auth.NewBackendMemory(nil))}
+	if err := s.outbox.SendMessage("test@test.com", "verifyEmail.html", "Verify", auth.EmailSendParams{Email: "test@test.com"}); err != nil {
+		t.Fatal("expected queued email", err)
+	}
+
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: auth.NewError(auth.ErrCodeUnauthenticated, "Authentication required", nil)})
+	s.outboxStatus(storer, w, nil)
+	checkBodyAndMethods(t, unauthenticatedBody, []string{"GetSession"}, w, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{}, AuthorizeErr: errors.New("failed")})
+	s.discardEmail(storer, w, nil)
+	if w.Code != 403 {
+		t.Error("expected forbidden", w.Code)
+	}
+	checkMethods(t, []string{"GetSession", "Authorize"}, storer)
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{}})
+	s.outboxStatus(storer, w, nil)
+	checkBodyAndMethods(t, `{"pending":1,"retrying":0,"dead":0,"deadLetters":[]}`, []string{"GetSession", "Authorize"}, w, storer)
+
+	w = httptest.NewRecorder()
+	s.discardEmail(storer, w, httptest.NewRequest("POST", "/admin/discardEmail?id=unknown", nil))
+	if w.Code != 404 {
+		t.Error("expected dead letter not found", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+// pagesPath is where the hosted pages are served. Forms post to paths relative to it so it works behind a prefix
+const pagesPath string = "/pages/"
+const pageCSRFCookieName string = "PageCSRF"
+
+var errPasswordsDontMatch = auth.NewError(auth.ErrCodeInvalidRequest, "Passwords don't match", nil)
+
+// pageFields are sent by the hosted forms but aren't part of the user's profile info
+var pageFields = []string{"csrf", "token", "returnTo", "confirmPassword"}
+
+// defaultLayoutPage wraps each page. A layout.html in HostedPagesTemplateDir replaces it
+const defaultLayoutPage string = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{block "title" .}}{{if .Title}}{{.Title}}{{else}}Account{{end}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f5f5f5; margin: 0; }
+main { max-width: 360px; margin: 10vh auto; background: #fff; padding: 2em; border-radius: 8px; box-shadow: 0 1px 4px rgba(0,0,0,.1); }
+label { display: block; margin: 1em 0 .25em; }
+input[type=email], input[type=password], input[type=text] { width: 100%; box-sizing: border-box; padding: .5em; }
+button { margin-top: 1.5em; width: 100%; padding: .75em; }
+.error { color: #b00020; }
+</style>
+{{if .Stylesheet}}<link rel="stylesheet" href="{{.Stylesheet}}">{{end}}
+</head>
+<body>
+<main>
+{{if .Title}}<h1>{{.Title}}</h1>{{end}}
+{{if .Error}}<p class="error" role="alert">{{.Error}}</p>{{end}}
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{template "content" .}}
+</main>
+</body>
+</html>
+`
+
+// defaultPages are the built-in pages. Each can be replaced by a file of the same name in HostedPagesTemplateDir
+var defaultPages = map[string]string{
+	"login": `<h2>Log in</h2>
+<form method="POST" action="login">
+  <label for="email">Email</label><input type="email" id="email" name="email" value="{{.Email}}" autocomplete="username" required autofocus>
+  <label for="password">Password</label><input type="password" id="password" name="password" autocomplete="current-password" required>
+  <label><input type="checkbox" name="rememberMe" value="true"> Remember me</label>
+  <input type="hidden" name="returnTo" value="{{.ReturnTo}}"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+  <button type="submit">Log in</button>
+</form>
+<p><a href="reset?returnTo={{.ReturnTo}}">Forgot your password?</a> · <a href="register?returnTo={{.ReturnTo}}">Create an account</a></p>
+`,
+	"register": `<h2>Create an account</h2>
+<form method="POST" action="register">
+  <label for="email">Email</label><input type="email" id="email" name="email" value="{{.Email}}" autocomplete="email" required autofocus>
+  <input type="hidden" name="returnTo" value="{{.ReturnTo}}"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+  {{if .Invite}}<input type="hidden" name="invite" value="{{.Invite}}">{{end}}
+  <button type="submit">Continue</button>
+</form>
+<p><a href="login?returnTo={{.ReturnTo}}">Already have an account?</a></p>
+`,
+	"code": `<h2>Enter your code</h2>
+<form method="POST" action="{{.Action}}">
+  <label for="email">Email</label><input type="email" id="email" name="email" value="{{.Email}}" autocomplete="email">
+  <label for="code">Code</label><input type="text" id="code" name="code" value="{{.Code}}" inputmode="numeric" autocomplete="one-time-code" required{{if not .Code}} autofocus{{end}}>
+  <input type="hidden" name="returnTo" value="{{.ReturnTo}}"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+  <button type="submit">Continue</button>
+</form>
+`,
+	"profile": `<h2>Create your profile</h2>
+<form method="POST" action="profile">
+  <p>{{.Email}}</p>
+  <label for="fullName">Full name</label><input type="text" id="fullName" name="fullName" value="{{.FullName}}" autocomplete="name">
+  <label for="password">Password</label><input type="password" id="password" name="password" autocomplete="new-password" required autofocus>
+  <label for="confirmPassword">Confirm password</label><input type="password" id="confirmPassword" name="confirmPassword" autocomplete="new-password" required>
+  <input type="hidden" name="token" value="{{.Token}}"><input type="hidden" name="returnTo" value="{{.ReturnTo}}"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+  <button type="submit">Create profile</button>
+</form>
+`,
+	"reset": `<h2>Reset your password</h2>
+<form method="POST" action="reset">
+  <label for="email">Email</label><input type="email" id="email" name="email" value="{{.Email}}" autocomplete="email" required autofocus>
+  <input type="hidden" name="returnTo" value="{{.ReturnTo}}"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+  <button type="submit">Send reset email</button>
+</form>
+<p><a href="login?returnTo={{.ReturnTo}}">Back to log in</a></p>
+`,
+	"newPassword": `<h2>Choose a new password</h2>
+<form method="POST" action="newPassword">
+  <p>{{.Email}}</p>
+  <label for="password">New password</label><input type="password" id="password" name="password" autocomplete="new-password" required autofocus>
+  <label for="confirmPassword">Confirm password</label><input type="password" id="confirmPassword" name="confirmPassword" autocomplete="new-password" required>
+  <input type="hidden" name="token" value="{{.Token}}"><input type="hidden" name="returnTo" value="{{.ReturnTo}}"><input type="hidden" name="csrf" value="{{.CSRFToken}}">
+  <button type="submit">Update password</button>
+</form>
+`,
+}
+
+// pageData is passed to every page template
+type pageData struct {
+	Title      string
+	Stylesheet string
+	CSRFToken  string
+	ReturnTo   string
+	Email      string
+	FullName   string
+	Code       string
+	Action     string // where the code page posts: verify, resetPassword or loginCode
+	Token      string // the CSRF token of the email session, needed to create the profile or update the password
+	Invite     string // the invitation code registration links from invitation emails carry
+	Error      string
+	Message    string
+}
+
+// pageTemplates parses the layout and each page, preferring the files in HostedPagesTemplateDir
+func (n *authConf) pageTemplates() (map[string]*template.Template, error) {
+	layout, err := n.pageSource("layout", defaultLayoutPage)
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*template.Template)
+	for name, defaultSource := range defaultPages {
+		source, err := n.pageSource(name, defaultSource)
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(name).Parse(layout)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New("content").Parse(source); err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+func (n *authConf) pageSource(name, defaultSource string) (string, error) {
+	if n.HostedPagesTemplateDir == "" {
+		return defaultSource, nil
+	}
+	source, err := ioutil.ReadFile(filepath.Join(n.HostedPagesTemplateDir, name+".html"))
+	if os.IsNotExist(err) {
+		return defaultSource, nil
+	}
+	return string(source), err
+}
+
+func (s *nginxauth) servePages() {
+	http.HandleFunc(pagesPath+"login", s.page(s.loginPage))
+	http.HandleFunc(pagesPath+"loginCode", s.page(s.loginCodePage))
+	http.HandleFunc(pagesPath+"register", s.page(s.registerPage))
+	http.HandleFunc(pagesPath+"verify", s.page(s.verifyPage))
+	http.HandleFunc(pagesPath+"profile", s.page(s.profilePage))
+	http.HandleFunc(pagesPath+"reset", s.page(s.resetPage))
+	http.HandleFunc(pagesPath+"resetPassword", s.page(s.resetPasswordPage))
+	http.HandleFunc(pagesPath+"newPassword", s.page(s.newPasswordPage))
+}
+
+// page accepts GET and POST. Every POST must carry the token from the PageCSRF cookie
+func (s *nginxauth) page(handler func(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != "GET" && r.Method != "POST":
+			methodErr(w)
+		case r.Method == "POST" && !validPageCSRF(r):
+			writeError(w, http.StatusForbidden, auth.ErrCodeInvalidCSRF, "Invalid form token. Please go back, reload the page and try again")
+		default:
+			handler(s.a, s.localized(w, r), r)
+		}
+	}
+}
+
+func (s *nginxauth) loginPage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Email: r.FormValue("email")}
+	if r.Method == "GET" {
+		if session, err := authStore.GetCookieSession(w, r); err == nil && session != nil {
+			s.redirectAfterLogin(w, r, data.ReturnTo)
+			return
+		}
+		s.renderPage(w, r, "login", data)
+		return
+	}
+
+	credentials, _ := json.Marshal(map[string]interface{}{"email": data.Email, "password": r.PostFormValue("password"), "rememberMe": isTrue(r.PostFormValue("rememberMe"))})
+	r.Body = ioutil.NopCloser(bytes.NewReader(credentials))
+	if _, err := authStore.Login(w, r); auth.ErrorCode(err) == auth.ErrCodeLoginCodeRequired {
+		data.Action = "loginCode"
+		data.Message = localizeMessage(w, auth.ErrCodeLoginCodeRequired, auth.PublicMessage(err))
+		s.renderPage(w, r, "code", data)
+		return
+	} else if err != nil {
+		s.pageErr(w, r, "login", data, err)
+		return
+	}
+	s.redirectAfterLogin(w, r, data.ReturnTo)
+}
+
+// loginCodePage is the second login step when LoginCodeTemplate is set. The code was sent once the password matched
+func (s *nginxauth) loginCodePage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Email: r.FormValue("email"), Code: r.FormValue("code"), Action: "loginCode"}
+	if r.Method == "GET" {
+		http.Redirect(w, r, "login", http.StatusFound)
+		return
+	}
+	if _, err := authStore.VerifyLoginCode(w, r, data.Email, data.Code); err != nil {
+		s.pageErr(w, r, "code", data, err)
+		return
+	}
+	s.redirectAfterLogin(w, r, data.ReturnTo)
+}
+
+func (s *nginxauth) registerPage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Email: r.FormValue("email"), Invite: r.FormValue("invite")}
+	if r.Method == "GET" {
+		s.renderPage(w, r, "register", data)
+		return
+	}
+	params := s.pageEmailParams(r, data, s.conf.VerifyEmailTemplate, s.conf.VerifyEmailSubject)
+	params.InviteCode = data.Invite
+	if err := authStore.Register(w, r, params, ""); err != nil {
+		s.pageErr(w, r, "register", data, err)
+		return
+	}
+	data.Action = "verify"
+	data.Message = "We've sent an email to " + data.Email + ". Follow the link in it or enter the code to continue."
+	s.renderPage(w, r, "code", data)
+}
+
+// verifyPage is the landing page for verification emails. Opening the link only shows the code, so link
+// scanners can't use it up. Posting it verifies the email and continues to profile creation
+func (s *nginxauth) verifyPage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Email: r.FormValue("email"), Code: r.FormValue("code"), Action: "verify"}
+	if r.Method == "GET" {
+		s.renderPage(w, r, "code", data)
+		return
+	}
+	params := auth.EmailSendParams{VerificationCode: data.Code, Email: data.Email, BaseURL: s.pageBaseURL(r),
+		TemplateSuccess: templateName(s.conf.WelcomeTemplate), SubjectSuccess: s.conf.WelcomeSubject}
+	token, user, err := authStore.VerifyEmail(w, r, params)
+	if err != nil {
+		s.pageErr(w, r, "code", data, err)
+		return
+	}
+	data.Token, data.Email, data.Code = token, user.Email, ""
+	if data.ReturnTo == "" {
+		data.ReturnTo = user.GetInfoString("destinationURL")
+	}
+	s.renderPage(w, r, "profile", data)
+}
+
+func (s *nginxauth) profilePage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		http.Redirect(w, r, "register", http.StatusFound)
+		return
+	}
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Token: r.FormValue("token"), FullName: r.FormValue("fullName")}
+	if r.PostFormValue("password") != r.PostFormValue("confirmPassword") {
+		s.pageErr(w, r, "profile", data, errPasswordsDontMatch)
+		return
+	}
+	r.Header.Set("X-CSRF-Token", data.Token)
+	removePageFields(r)
+	session, err := authStore.CreateProfile(w, r)
+	if err != nil {
+		s.pageErr(w, r, "profile", data, err)
+		return
+	}
+	s.redirectAfterLogin(w, r, data.ReturnTo, session.GetInfoString("destinationURL"))
+}
+
+func (s *nginxauth) resetPage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Email: r.FormValue("email")}
+	if r.Method == "GET" {
+		s.renderPage(w, r, "reset", data)
+		return
+	}
+	params := s.pageEmailParams(r, data, s.conf.PasswordResetTemplate, s.conf.PasswordResetSubject)
+	if err := authStore.RequestPasswordReset(w, r, params); err != nil {
+		logError(err) // the same page is shown either way so it can't be used to find out who has an account
+	}
+	data.Action = "resetPassword"
+	data.Message = "If " + data.Email + " has an account, we've sent it an email. Follow the link in it or enter the code to continue."
+	s.renderPage(w, r, "code", data)
+}
+
+// resetPasswordPage is the landing page for password reset emails
+func (s *nginxauth) resetPasswordPage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Email: r.FormValue("email"), Code: r.FormValue("code"), Action: "resetPassword"}
+	if r.Method == "GET" {
+		s.renderPage(w, r, "code", data)
+		return
+	}
+	token, user, err := authStore.VerifyPasswordReset(w, r, auth.EmailSendParams{VerificationCode: data.Code, Email: data.Email})
+	if err != nil {
+		s.pageErr(w, r, "code", data, err)
+		return
+	}
+	data.Token, data.Email, data.Code = token, user.Email, ""
+	s.renderPage(w, r, "newPassword", data)
+}
+
+func (s *nginxauth) newPasswordPage(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		http.Redirect(w, r, "reset", http.StatusFound)
+		return
+	}
+	data := &pageData{ReturnTo: r.FormValue("returnTo"), Token: r.FormValue("token")}
+	if r.PostFormValue("password") != r.PostFormValue("confirmPassword") {
+		s.pageErr(w, r, "newPassword", data, errPasswordsDontMatch)
+		return
+	}
+	r.Header.Set("X-CSRF-Token", data.Token)
+	removePageFields(r)
+	session, err := authStore.UpdatePassword(w, r)
+	if err != nil {
+		s.pageErr(w, r, "newPassword", data, err)
+		return
+	}
+	s.redirectAfterLogin(w, r, data.ReturnTo, session.GetInfoString("destinationURL"))
+}
+
+// pageEmailParams sends one-time codes when OneTimeCodeLength is set. The return URL is kept as destinationURL
+// when it's on this site or CookieDomain
+func (s *nginxauth) pageEmailParams(r *http.Request, data *pageData, template, subject string) auth.EmailSendParams {
+	params := auth.EmailSendParams{
+		Email:           data.Email,
+		BaseURL:         s.pageBaseURL(r),
+		TemplateSuccess: templateName(template),
+		SubjectSuccess:  subject,
+		UseOneTimeCode:  s.conf.OneTimeCodeLength > 0,
+		Locale:          s.locale(r, nil),
+	}
+	if data.ReturnTo != "" && s.isSafeReturnTo(r, data.ReturnTo) {
+		params.DestinationURL = data.ReturnTo
+	}
+	return params
+}
+
+func (s *nginxauth) renderPage(w http.ResponseWriter, r *http.Request, name string, data *pageData) {
+	data.Title = s.conf.HostedPagesTitle
+	data.Stylesheet = s.conf.HostedPagesStylesheet
+	data.CSRFToken = pageCSRFToken(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if data.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err := s.pages[name].Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *nginxauth) pageErr(w http.ResponseWriter, r *http.Request, name string, data *pageData, err error) {
+	logError(err)
+	data.Error = localizeMessage(w, auth.ErrorCode(err), auth.PublicMessage(err))
+	s.renderPage(w, r, name, data)
+}
+
+// redirectAfterLogin returns the user to the first of returnTo which is on this site or under CookieDomain
+func (s *nginxauth) redirectAfterLogin(w http.ResponseWriter, r *http.Request, returnTo ...string) {
+	location := s.conf.HostedPagesDefaultURL
+	if location == "" {
+		location = "/"
+	}
+	for _, candidate := range returnTo {
+		if candidate != "" && s.isSafeReturnTo(r, candidate) {
+			location = candidate
+			break
+		}
+	}
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
+
+// isSafeReturnTo stops the login pages being used to redirect users to other sites
+func (s *nginxauth) isSafeReturnTo(r *http.Request, returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil || strings.ContainsAny(returnTo, "\\\r\n") {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(returnTo, "/") && !strings.HasPrefix(returnTo, "//")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if requestHost, _, err := net.SplitHostPort(r.Host); err == nil && strings.EqualFold(host, requestHost) || strings.EqualFold(host, r.Host) {
+		return true
+	}
+	domain := strings.ToLower(strings.TrimPrefix(s.conf.CookieDomain, "."))
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// removePageFields keeps the form fields which aren't profile info out of CreateProfile and UpdatePassword
+func removePageFields(r *http.Request) {
+	for _, field := range pageFields {
+		r.Form.Del(field)
+		r.PostForm.Del(field)
+	}
+}
+
+// pageBaseURL is the base URL links in emails should use to reach the pages
+func (s *nginxauth) pageBaseURL(r *http.Request) string {
+	return s.baseURL(r) + strings.TrimSuffix(pagesPath, "/")
+}
+
+// pageCSRFToken returns the token from the PageCSRF cookie, setting a new one if there isn't one yet
+func pageCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(pageCSRFCookieName); err == nil && len(cookie.Value) >= 32 {
+		return cookie.Value
+	}
+	token := make([]byte, 32)
+	rand.Read(token)
+	value := base64.RawURLEncoding.EncodeToString(token)
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	http.SetCookie(w, &http.Cookie{Name: pageCSRFCookieName, Value: value, Path: pagesPath, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode})
+	return value
+}
+
+func validPageCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(pageCSRFCookieName)
+	return err == nil && len(cookie.Value) >= 32 && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue("csrf"))) == 1
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+const testPageCSRF string = "0123456789abcdef0123456789abcdef"
+
+func getPagesServer(t *testing.T, conf authConf) *nginxauth {
+	pages, err := conf.pageTemplates()
+	if err != nil {
+		t.Fatal("expected pages to parse", err)
+	}
+	return &nginxauth{pages: pages, conf: conf}
+}
+
+func pageRequest(method, target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: pageCSRFCookieName, Value: testPageCSRF})
+	return r
+}
+
+func TestPageTemplates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pages")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "login.html"), []byte(`<p>Custom login for {{.ReturnTo}}</p>`), 0644)
+	s := getPagesServer(t, authConf{HostedPagesTemplateDir: dir, HostedPagesTitle: "Example", HostedPagesStylesheet: "/theme.css"})
+	w := httptest.NewRecorder()
+	s.renderPage(w, httptest.NewRequest("GET", "/pages/login", nil), "login", &pageData{ReturnTo: "/app"})
+	body := w.Body.String()
+	if !strings.Contains(body, "<p>Custom login for /app</p>") || !strings.Contains(body, "<h1>Example</h1>") || !strings.Contains(body, `href="/theme.css"`) ||
+		w.Header().Get("X-Frame-Options") != "DENY" || !strings.HasPrefix(w.Header().Get("Set-Cookie"), pageCSRFCookieName+"=") {
+		t.Error("expected overridden page in the default layout", body, w.Header())
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "layout.html"), []byte(`{{if}}`), 0644)
+	if _, err := (&authConf{HostedPagesTemplateDir: dir}).pageTemplates(); err == nil {
+		t.Error("expected invalid layout to fail")
+	}
+}
+
+func TestLoginPage(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getPagesServer(t, authConf{CookieDomain: ".example.com"})
+	handler := func(storer auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+		s.a = storer
+		s.page(s.loginPage)(w, r)
+	}
+
+	w := httptest.NewRecorder()
+	handler(auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionErr: errors.New("failed")}), w, httptest.NewRequest("GET", "/pages/login?returnTo=https://app.example.com/posts", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `name="returnTo" value="https://app.example.com/posts"`) || !strings.Contains(w.Body.String(), `name="rememberMe"`) {
+		t.Error("expected login form", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: &auth.LoginSession{UserID: "1"}})
+	handler(storer, w, httptest.NewRequest("GET", "/pages/login?returnTo=/app", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/app" {
+		t.Error("expected a logged in user to be redirected without a CSRF token", w.Code, w.Header())
+	}
+	checkMethods(t, []string{"GetCookieSession"}, storer)
+
+	form := url.Values{"email": {"test@test.com"}, "password": {"password"}, "rememberMe": {"true"}, "returnTo": {"https://app.example.com/posts"}, "csrf": {testPageCSRF}}
+	w = httptest.NewRecorder()
+	handler(auth.NewFakeStorer(auth.FakeStorerConfig{LoginVal: &auth.LoginSession{}}), w, pageRequest("POST", "/pages/login", form))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "https://app.example.com/posts" {
+		t.Error("expected redirect back to the requested page", w.Code, w.Header())
+	}
+
+	form.Set("returnTo", "https://evil.com/")
+	w = httptest.NewRecorder()
+	handler(auth.NewFakeStorer(auth.FakeStorerConfig{LoginVal: &auth.LoginSession{}}), w, pageRequest("POST", "/pages/login", form))
+	if w.Header().Get("Location") != "/" {
+		t.Error("expected other sites not to be redirected to", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	handler(auth.NewFakeStorer(auth.FakeStorerConfig{LoginErr: auth.NewError(auth.ErrCodeInvalidCredentials, "Invalid username or password", nil)}), w, pageRequest("POST", "/pages/login", form))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "Invalid username or password") || !strings.Contains(w.Body.String(), `value="test@test.com"`) {
+		t.Error("expected form with error", w.Code, w.Body.String())
+	}
+
+	form.Set("csrf", "wrong")
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{})
+	handler(storer, w, pageRequest("POST", "/pages/login", form))
+	if w.Code != 403 || len(storer.MethodsCalled()) != 0 {
+		t.Error("expected invalid form token to be rejected", w.Code)
+	}
+}
+
+func TestLoginCodePage(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getPagesServer(t, authConf{})
+	form := url.Values{"email": {"test@test.com"}, "password": {"password"}, "returnTo": {"/app"}}
+	w := httptest.NewRecorder()
+	s.loginPage(auth.NewFakeStorer(auth.FakeStorerConfig{LoginErr: auth.NewError(auth.ErrCodeLoginCodeRequired, "Enter the code we sent you to finish logging in", nil)}), w, pageRequest("POST", "/pages/login", form))
+	if body := w.Body.String(); w.Code != 200 || !strings.Contains(body, `action="loginCode"`) || !strings.Contains(body, "Enter the code we sent you") ||
+		!strings.Contains(body, `value="test@test.com"`) || !strings.Contains(body, `name="returnTo" value="/app"`) {
+		t.Error("expected code prompt", w.Code, body)
+	}
+
+	form = url.Values{"email": {"test@test.com"}, "code": {"123456"}, "returnTo": {"/app"}}
+	w = httptest.NewRecorder()
+	s.loginCodePage(auth.NewFakeStorer(auth.FakeStorerConfig{VerifyLoginCodeErr: auth.NewError(auth.ErrCodeInvalidCode, "Invalid verification code", nil)}), w, pageRequest("POST", "/pages/loginCode", form))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "Invalid verification code") || !strings.Contains(w.Body.String(), `action="loginCode"`) {
+		t.Error("expected code prompt with error", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{VerifyLoginCodeVal: &auth.LoginSession{}})
+	s.loginCodePage(storer, w, pageRequest("POST", "/pages/loginCode", form))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/app" {
+		t.Error("expected redirect once the code is entered", w.Code, w.Header())
+	}
+	checkMethods(t, []string{"VerifyLoginCode"}, storer)
+}
+
+func TestPageEmailParams(t *testing.T) {
+	s := &nginxauth{conf: authConf{CookieDomain: ".example.com"}}
+	r := httptest.NewRequest("POST", "/pages/register", nil)
+	if params := s.pageEmailParams(r, &pageData{Email: "test@test.com", ReturnTo: "https://app.example.com/posts"}, "verifyEmail.html", "Verify"); params.DestinationURL != "https://app.example.com/posts" {
+		t.Error("expected return URL to be kept", params.Info)
+	}
+	if params := s.pageEmailParams(r, &pageData{Email: "test@test.com", ReturnTo: "https://evil.com/"}, "verifyEmail.html", "Verify"); params.DestinationURL != "" {
+		t.Error("expected other sites to be dropped", params.Info)
+	}
+}
+
+func TestRegistrationPages(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getPagesServer(t, authConf{})
+
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.registerPage(storer, w, pageRequest("POST", "/pages/register", url.Values{"email": {"test@test.com"}, "returnTo": {"/app"}}))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `action="verify"`) || !strings.Contains(w.Body.String(), "sent an email to test@test.com") {
+		t.Error("expected code prompt", w.Code, w.Body.String())
+	}
+	checkMethods(t, []string{"Register"}, storer)
+
+	w = httptest.NewRecorder()
+	s.registerPage(storer, w, httptest.NewRequest("GET", "/pages/register?invite=xyz&email=jane@example.com", nil))
+	if body := w.Body.String(); !strings.Contains(body, `name="invite" value="xyz"`) || !strings.Contains(body, `value="jane@example.com"`) {
+		t.Error("expected invitation in form", body)
+	}
+
+	w = httptest.NewRecorder()
+	s.verifyPage(storer, w, httptest.NewRequest("GET", "/pages/verify?code=abc", nil))
+	if !strings.Contains(w.Body.String(), `name="code" value="abc"`) || len(storer.MethodsCalled()) != 1 {
+		t.Error("expected opening the link to only show the code", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{VerifyEmailVal: "token", VerifyEmailVal2: &auth.User{Email: "test@test.com", Info: map[string]interface{}{"destinationURL": "/app"}}})
+	s.verifyPage(storer, w, pageRequest("POST", "/pages/verify", url.Values{"code": {"abc"}}))
+	if !strings.Contains(w.Body.String(), `action="profile"`) || !strings.Contains(w.Body.String(), `name="token" value="token"`) || !strings.Contains(w.Body.String(), `name="returnTo" value="/app"`) {
+		t.Error("expected profile form", w.Body.String())
+	}
+
+	form := url.Values{"token": {"token"}, "password": {"password"}, "confirmPassword": {"other"}, "fullName": {"Name"}, "returnTo": {"/app"}, "csrf": {testPageCSRF}}
+	w = httptest.NewRecorder()
+	s.profilePage(storer, w, pageRequest("POST", "/pages/profile", form))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "Passwords don&#39;t match") {
+		t.Error("expected mismatched passwords to fail", w.Code, w.Body.String())
+	}
+
+	form.Set("confirmPassword", "password")
+	w = httptest.NewRecorder()
+	r := pageRequest("POST", "/pages/profile", form)
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{CreateProfileVal: &auth.LoginSession{}})
+	s.profilePage(storer, w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/app" || r.Header.Get("X-CSRF-Token") != "token" ||
+		r.Form.Get("fullName") != "Name" || r.Form.Get("csrf") != "" || r.Form.Get("returnTo") != "" {
+		t.Error("expected profile to be created without the page fields", w.Code, w.Header(), r.Form)
+	}
+}
+
+func TestPasswordResetPages(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s := getPagesServer(t, authConf{HostedPagesDefaultURL: "/home"})
+
+	w := httptest.NewRecorder()
+	s.resetPage(auth.NewFakeStorer(auth.FakeStorerConfig{RequestPasswordResetErr: errors.New("failed")}), w, pageRequest("POST", "/pages/reset", url.Values{"email": {"test@test.com"}}))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `action="resetPassword"`) {
+		t.Error("expected the same code prompt whether or not the email has an account", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.resetPasswordPage(auth.NewFakeStorer(auth.FakeStorerConfig{VerifyPasswordResetErr: auth.NewError(auth.ErrCodeInvalidCode, "Invalid verification code", nil)}), w, pageRequest("POST", "/pages/resetPassword", url.Values{"code": {"123456"}}))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "Invalid verification code") || !strings.Contains(w.Body.String(), `value="123456"`) {
+		t.Error("expected code prompt with error", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{VerifyPasswordResetVal: "token", VerifyPasswordResetVal2: &auth.User{Email: "test@test.com"}})
+	s.resetPasswordPage(storer, w, pageRequest("POST", "/pages/resetPassword", url.Values{"code": {"abc"}}))
+	if !strings.Contains(w.Body.String(), `action="newPassword"`) || !strings.Contains(w.Body.String(), `name="token" value="token"`) {
+		t.Error("expected new password form", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{UpdatePasswordVal: &auth.LoginSession{}})
+	s.newPasswordPage(storer, w, pageRequest("POST", "/pages/newPassword", url.Values{"token": {"token"}, "password": {"password"}, "confirmPassword": {"password"}}))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/home" {
+		t.Error("expected redirect to the default URL", w.Code, w.Header())
+	}
+	checkMethods(t, []string{"UpdatePassword"}, storer)
+}
+
+func TestIsSafeReturnTo(t *testing.T) {
+	s := &nginxauth{conf: authConf{CookieDomain: ".example.com"}}
+	r := httptest.NewRequest("GET", "/pages/login", nil)
+	r.Host = "auth.other.com:8080"
+	for returnTo, safe := range map[string]bool{"/app": true, "//evil.com": false, "/\\evil.com": false, "https://example.com/": true, "https://a.b.example.com/x": true,
+		"https://evilexample.com": false, "http://auth.other.com/": true, "javascript:alert(1)": false, "https://evil.com/?a=.example.com": false} {
+		if s.isSafeReturnTo(r, returnTo) != safe {
+			t.Error("unexpected result", returnTo, safe)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+// policyCheckInterval is how often the policy file's modification time is checked for changes
+const policyCheckInterval time.Duration = time.Second
+
+var policyDays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+// routePolicy is read from the JSON PolicyFile. Rules are checked in order and the first rule whose path and
+// method match the request decides it. Requests which don't match a rule only need to be logged in
+type routePolicy struct {
+	Rules []*policyRule `json:"rules"`
+}
+
+// policyRule limits access to the paths matching Path. Path is a path.Match pattern, or a prefix when it
+// ends with "/**". Roles are "any of" and Permissions are "all of", like the /auth?role= and ?permission= checks
+type policyRule struct {
+	Name         string        `json:"name"`
+	Path         string        `json:"path"`
+	Methods      []string      `json:"methods"`
+	Public       bool          `json:"public"`
+	Roles        []string      `json:"roles"`
+	Permissions  []string      `json:"permissions"`
+	EmailDomains []string      `json:"emailDomains"`
+	IPRanges     []string      `json:"ipRanges"`
+	TimeWindows  []*timeWindow `json:"timeWindows"`
+
+	networks []*net.IPNet
+}
+
+// timeWindow allows access on Days (e.g. "mon") between Start and End ("15:04") in TimeZone. A window
+// whose End is before its Start continues past midnight
+type timeWindow struct {
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	TimeZone string   `json:"timeZone"`
+
+	days       map[time.Weekday]bool
+	start, end int // minutes after midnight
+	location   *time.Location
+}
+
+// policyRequest is what the rules are checked against. Method and Path come from the X-Original-Method
+// and X-Original-URI headers nginx sends with the auth subrequest. Path is unescaped and cleaned the way the
+// upstream server sees it, and PathErr is set when it can't be
+type policyRequest struct {
+	Method      string
+	Path        string
+	PathErr     error
+	IP          net.IP
+	Time        time.Time
+	Roles       []string
+	Permissions []string
+}
+
+// policyDecision is the result of checking a request, with the steps taken so dry runs can explain it
+type policyDecision struct {
+	Rule   string
+	Status int
+	Err    error
+	Steps  []string
+}
+
+// policyFile reloads the policy when the file changes. An invalid change is logged and the previous policy is kept
+type policyFile struct {
+	path        string
+	mu          sync.Mutex
+	policy      *routePolicy
+	modTime     time.Time
+	checkedTime time.Time
+}
+
+func loadPolicyFile(filePath string) (*policyFile, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := readPolicy(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &policyFile{path: filePath, policy: policy, modTime: info.ModTime(), checkedTime: time.Now()}, nil
+}
+
+func (p *policyFile) get() *routePolicy {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.checkedTime) < policyCheckInterval {
+		return p.policy
+	}
+	p.checkedTime = time.Now()
+	info, err := os.Stat(p.path)
+	if err != nil || info.ModTime().Equal(p.modTime) {
+		return p.policy
+	}
+	p.modTime = info.ModTime() // only try each change once, so a bad file is logged once
+	policy, err := readPolicy(p.path)
+	if err != nil {
+		log.Println("Keeping previous policy.", err)
+		return p.policy
+	}
+	log.Println("Reloaded policy from", p.path)
+	p.policy = policy
+	return p.policy
+}
+
+func readPolicy(filePath string) (*routePolicy, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	policy := &routePolicy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrap(err, "invalid policy file "+filePath)
+	}
+	for i, rule := range policy.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, errors.Wrapf(err, "invalid policy rule %d", i+1)
+		}
+	}
+	return policy, nil
+}
+
+func (rule *policyRule) compile() error {
+	if rule.Path == "" || !strings.HasPrefix(rule.Path, "/") {
+		return errors.New("path must start with /")
+	}
+	if _, err := path.Match(rule.Path, "/"); err != nil {
+		return err
+	}
+	if rule.Name == "" {
+		rule.Name = rule.Path
+	}
+	for _, ipRange := range rule.IPRanges {
+		if !strings.Contains(ipRange, "/") {
+			if ip := net.ParseIP(ipRange); ip != nil && ip.To4() != nil {
+				ipRange += "/32"
+			} else {
+				ipRange += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return err
+		}
+		rule.networks = append(rule.networks, network)
+	}
+	for _, window := range rule.TimeWindows {
+		if err := window.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *timeWindow) compile() error {
+	var err error
+	if w.location, err = time.LoadLocation(w.TimeZone); err != nil {
+		return err
+	}
+	if w.start, err = minutesAfterMidnight(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = minutesAfterMidnight(w.End); err != nil {
+		return err
+	}
+	w.days = make(map[time.Weekday]bool)
+	for _, day := range w.Days {
+		weekday, ok := policyDays[strings.ToLower(day)]
+		if !ok {
+			return errors.New("unknown day " + day)
+		}
+		w.days[weekday] = true
+	}
+	return nil
+}
+
+func minutesAfterMidnight(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p *routePolicy) match(method, requestPath string) *policyRule {
+	for _, rule := range p.Rules {
+		if rule.matches(method, requestPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *policyRule) matches(method, requestPath string) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, method) {
+		return false
+	}
+	if prefix := strings.TrimSuffix(rule.Path, "/**"); prefix != rule.Path {
+		return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+	}
+	matched, _ := path.Match(rule.Path, requestPath)
+	return matched
+}
+
+func (rule *policyRule) checkNetwork(ip net.IP) error {
+	if len(rule.networks) == 0 {
+		return nil
+	}
+	for _, network := range rule.networks {
+		if ip != nil && network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP address %v is not in %s", ip, strings.Join(rule.IPRanges, ", "))
+}
+
+func (rule *policyRule) checkTime(now time.Time) error {
+	if len(rule.TimeWindows) == 0 {
+		return nil
+	}
+	for _, window := range rule.TimeWindows {
+		if window.contains(now) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside the allowed time windows", now.Format(time.RFC1123))
+}
+
+func (w *timeWindow) contains(now time.Time) bool {
+	local := now.In(w.location)
+	minutes := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if w.end <= w.start && minutes < w.end { // early morning part of a window which started the day before
+		day = (day + 6) % 7
+		return len(w.days) == 0 || w.days[day]
+	}
+	if len(w.days) > 0 && !w.days[day] {
+		return false
+	}
+	if w.end <= w.start {
+		return minutes >= w.start
+	}
+	return minutes >= w.start && minutes < w.end
+}
+
+func (rule *policyRule) checkEmail(email string) error {
+	if len(rule.EmailDomains) == 0 {
+		return nil
+	}
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	if !containsFold(rule.EmailDomains, domain) {
+		return fmt.Errorf("email domain %s is not one of %s", domain, strings.Join(rule.EmailDomains, ", "))
+	}
+	return nil
+}
+
+// newPolicyRequest gets the request being authorized from the headers nginx sends to /auth. The client IP is
+// taken from X-Real-IP, so the auth location must set it with "proxy_set_header X-Real-IP $remote_addr"
+func newPolicyRequest(r *http.Request) *policyRequest {
+	req := &policyRequest{Time: time.Now()}
+	if r == nil {
+		return req
+	}
+	req.Roles, req.Permissions = requiredAccess(r)
+	req.Method = r.Header.Get("X-Original-Method")
+	if req.Method == "" {
+		req.Method = r.Method
+	}
+	uri := r.Header.Get("X-Original-URI")
+	if uri == "" && r.URL != nil {
+		uri = r.URL.RequestURI()
+	}
+	req.Path, req.PathErr = cleanRequestPath(uri)
+	ip := r.Header.Get("X-Real-IP")
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	req.IP = net.ParseIP(strings.TrimSpace(ip))
+	return req
+}
+
+// cleanRequestPath returns the unescaped and cleaned path of a request URI, so "//admin", "/%61dmin" and
+// "/public/../admin" all match the rules for "/admin". A trailing slash is kept
+func cleanRequestPath(uri string) (string, error) {
+	uri = strings.SplitN(uri, "?", 2)[0]
+	if !strings.HasPrefix(uri, "/") { // absolute form, e.g. "GET http://example.com/admin HTTP/1.1"
+		u, err := url.Parse(uri)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid request path %q", uri)
+		}
+		uri = u.EscapedPath()
+	}
+	unescaped, err := url.PathUnescape(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid request path %q", uri)
+	}
+	if !strings.HasPrefix(unescaped, "/") {
+		unescaped = "/" + unescaped
+	}
+	cleaned := path.Clean(unescaped)
+	if strings.HasSuffix(unescaped, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// evaluate decides a request given the session found for it, or the error from looking the session up
+func (s *nginxauth) evaluate(authStore auth.AuthStorer, req *policyRequest, session *auth.LoginSession, sessionErr error) *policyDecision {
+	d := &policyDecision{Status: http.StatusOK}
+	if req.PathErr != nil {
+		return d.deny(http.StatusForbidden, req.PathErr)
+	}
+	var rule *policyRule
+	if policy := s.policy.get(); policy != nil {
+		rule = policy.match(req.Method, req.Path)
+	}
+	if rule == nil {
+		d.step("no policy rule matches %s %s, so login is required", req.Method, req.Path)
+	} else {
+		d.Rule = rule.Name
+		d.step("rule %q matches %s %s", rule.Name, req.Method, req.Path)
+		if err := rule.checkNetwork(req.IP); err != nil {
+			return d.deny(http.StatusForbidden, err)
+		}
+		if err := rule.checkTime(req.Time); err != nil {
+			return d.deny(http.StatusForbidden, err)
+		}
+		if rule.Public {
+			d.step("rule is public")
+			return d
+		}
+	}
+
+	if sessionErr != nil || session == nil {
+		if sessionErr == nil {
+			sessionErr = errors.New("Session not found")
+		}
+		return d.deny(http.StatusUnauthorized, sessionErr)
+	}
+	d.step("logged in as %s", session.Email)
+	if rule != nil {
+		if err := rule.checkEmail(session.Email); err != nil {
+			return d.deny(http.StatusForbidden, err)
+		}
+		if err := authorize(authStore, session, rule.Roles, rule.Permissions); err != nil {
+			return d.deny(http.StatusForbidden, err)
+		}
+	}
+	if err := authorize(authStore, session, req.Roles, req.Permissions); err != nil {
+		return d.deny(http.StatusForbidden, err)
+	}
+	d.step("allowed")
+	return d
+}
+
+func authorize(authStore auth.AuthStorer, session *auth.LoginSession, roles, permissions []string) error {
+	if len(roles) == 0 && len(permissions) == 0 {
+		return nil
+	}
+	return authStore.Authorize(session, roles, permissions)
+}
+
+func (d *policyDecision) step(format string, args ...interface{}) {
+	d.Steps = append(d.Steps, fmt.Sprintf(format, args...))
+}
+
+func (d *policyDecision) deny(status int, err error) *policyDecision {
+	d.Status = status
+	d.Err = err
+	d.step("denied with %d %s: %v", status, http.StatusText(status), err)
+	return d
+}
+
+// dryRun explains how the policy decides a request from a user, or from an anonymous user when email is empty
+func (s *nginxauth) dryRun(method, uri, email, ip string) (*policyDecision, error) {
+	req := newPolicyRequest(subrequest(method, uri, ip))
+	if email == "" {
+		return s.evaluate(s.a, req, nil, errors.New("not logged in")), nil
+	}
+	user, err := s.backend.GetUser(email)
+	if err != nil {
+		return nil, fmt.Errorf("user %s not found: %v", email, err)
+	}
+	return s.evaluate(s.a, req, &auth.LoginSession{UserID: user.UserID, Email: user.Email, Info: user.Info}, nil), nil
+}
+
+// subrequest builds the auth subrequest nginx would send for a request to uri
+func subrequest(method, uri, ip string) *http.Request {
+	r, _ := http.NewRequest("GET", "/auth", nil)
+	r.Header.Set("X-Original-Method", strings.ToUpper(method))
+	r.Header.Set("X-Original-URI", uri)
+	r.Header.Set("X-Real-IP", ip)
+	return r
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+const testPolicy string = `{"rules": [
+	{"name": "health", "path": "/health", "public": true},
+	{"name": "office", "path": "/admin/**", "ipRanges": ["10.0.0.0/8", "192.168.1.5"], "roles": ["admin"]},
+	{"name": "writes", "path": "/api/*/posts", "methods": ["POST", "put"], "permissions": ["posts:write"], "emailDomains": ["example.com"]},
+	{"name": "hours", "path": "/reports", "timeWindows": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "09:00", "end": "17:00", "timeZone": "UTC"}]}
+]}`
+
+func writePolicy(t *testing.T, dir, policy string) string {
+	filePath := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(filePath, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func getPolicyServer(t *testing.T) (*nginxauth, string) {
+	dir, _ := ioutil.TempDir("", "policy")
+	policy, err := loadPolicyFile(writePolicy(t, dir, testPolicy))
+	if err != nil {
+		t.Fatal("expected policy to load", err)
+	}
+	return &nginxauth{policy: policy}, dir
+}
+
+func TestPolicyAuthRequest(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s, dir := getPolicyServer(t)
+	defer os.RemoveAll(dir)
+	session := &auth.LoginSession{UserID: "1", Email: "test@example.com"}
+	tests := []struct {
+		method, uri, ip string
+		session         *auth.LoginSession
+		authorizeErr    error
+		code            int
+		methods         []string
+	}{
+		{"GET", "/health?check=1", "1.2.3.4", nil, nil, 200, []string{"GetCookieSession"}},
+		{"GET", "/other", "1.2.3.4", nil, nil, 401, []string{"GetCookieSession"}},
+		{"GET", "/other", "1.2.3.4", session, nil, 200, []string{"GetCookieSession"}},
+		{"GET", "/admin/users", "1.2.3.4", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/admin", "10.1.2.3", session, nil, 200, []string{"GetCookieSession", "Authorize"}},
+		{"GET", "/admin/users", "192.168.1.5", session, errors.New("Not authorized"), 403, []string{"GetCookieSession", "Authorize"}},
+		{"PUT", "/api/v1/posts", "1.2.3.4", &auth.LoginSession{UserID: "1", Email: "test@other.com"}, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/api/v1/posts", "1.2.3.4", &auth.LoginSession{UserID: "1", Email: "test@other.com"}, nil, 200, []string{"GetCookieSession"}},
+		// paths are matched the way the upstream server sees them
+		{"GET", "//admin/users", "1.2.3.4", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/%61dmin/users", "1.2.3.4", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/health/../admin/users", "1.2.3.4", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/./admin/./users?x=/health", "1.2.3.4", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "http://example.com/admin/users", "1.2.3.4", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/admin/%zz", "10.1.2.3", session, nil, 403, []string{"GetCookieSession"}},
+		{"GET", "/%68ealth", "1.2.3.4", nil, nil, 200, []string{"GetCookieSession"}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: test.session, AuthorizeErr: test.authorizeErr})
+		s.authCookie(storer, w, subrequest(test.method, test.uri, test.ip))
+		if w.Code != test.code || strings.Join(storer.MethodsCalled(), ",") != strings.Join(test.methods, ",") {
+			t.Error("unexpected result", test.method, test.uri, test.ip, w.Code, storer.MethodsCalled())
+		}
+	}
+}
+
+func TestPolicyTimeWindows(t *testing.T) {
+	s, dir := getPolicyServer(t)
+	defer os.RemoveAll(dir)
+	rule := s.policy.get().match("GET", "/reports")
+	monday := time.Date(2024, time.January, 1, 9, 0, 0, 0, time.UTC)
+	if rule.checkTime(monday) != nil || rule.checkTime(monday.Add(-time.Minute)) == nil || rule.checkTime(monday.Add(8*time.Hour)) == nil || rule.checkTime(monday.Add(-48*time.Hour)) == nil {
+		t.Error("expected weekday office hours")
+	}
+
+	overnight := &timeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00", TimeZone: "UTC"}
+	if err := overnight.compile(); err != nil {
+		t.Fatal(err)
+	}
+	friday := time.Date(2024, time.January, 5, 23, 0, 0, 0, time.UTC)
+	if !overnight.contains(friday) || !overnight.contains(friday.Add(2*time.Hour)) || overnight.contains(friday.Add(4*time.Hour)) || overnight.contains(friday.Add(-24*time.Hour)) {
+		t.Error("expected window to continue past midnight into Saturday")
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	log.SetOutput(&nilWriter{})
+	s, dir := getPolicyServer(t)
+	defer os.RemoveAll(dir)
+	if s.policy.get().match("GET", "/new") != nil {
+		t.Fatal("expected no rule")
+	}
+
+	writePolicy(t, dir, `{"rules": [{"path": "/new", "public": true}]}`)
+	os.Chtimes(s.policy.path, time.Now(), time.Now().Add(time.Minute))
+	s.policy.checkedTime = time.Time{}
+	if rule := s.policy.get().match("GET", "/new"); rule == nil || !rule.Public || rule.Name != "/new" {
+		t.Fatal("expected policy to be reloaded", rule)
+	}
+
+	writePolicy(t, dir, `{"rules": [{"path": "no slash"}]}`)
+	os.Chtimes(s.policy.path, time.Now(), time.Now().Add(2*time.Minute))
+	s.policy.checkedTime = time.Time{}
+	if s.policy.get().match("GET", "/new") == nil {
+		t.Error("expected invalid policy to keep the previous one")
+	}
+}
+
+func TestReadPolicyErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "policy")
+	defer os.RemoveAll(dir)
+	for _, policy := range []string{`{`, `{"rules": [{"path": "/[", "public": true}]}`, `{"rules": [{"path": "/", "ipRanges": ["bogus"]}]}`,
+		`{"rules": [{"path": "/", "timeWindows": [{"start": "9am", "end": "17:00"}]}]}`, `{"rules": [{"path": "/", "timeWindows": [{"days": ["someday"], "start": "09:00", "end": "17:00"}]}]}`} {
+		if _, err := readPolicy(writePolicy(t, dir, policy)); err == nil {
+			t.Error("expected invalid policy to fail", policy)
+		}
+	}
+	if _, err := loadPolicyFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected missing policy file to fail")
+	}
+}
+
+func TestPolicyDryRun(t *testing.T) {
+	s, dir := getPolicyServer(t)
+	defer os.RemoveAll(dir)
+	b := auth.NewBackendMemory(&auth.CryptoHashStore{})
+	b.AddVerifiedUser("test@example.com", nil)
+	s.backend = b
+	s.a = auth.NewAuthStore(b, nil, "", "", nil, false)
+
+	decision, err := s.dryRun("get", "/admin/users", "test@example.com", "10.0.0.1")
+	if err != nil || decision.Status != 403 || decision.Rule != "office" || len(decision.Steps) != 3 ||
+		decision.Steps[0] != `rule "office" matches GET /admin/users` || !strings.HasPrefix(decision.Steps[2], "denied with 403 Forbidden: Not authorized. Requires role: admin") {
+		t.Error("expected explanation", err, decision)
+	}
+
+	b.UpdateUserRoles("1", []string{auth.RoleAdmin})
+	if decision, _ := s.dryRun("GET", "/admin/users", "test@example.com", "10.0.0.1"); decision.Status != 200 || decision.Steps[len(decision.Steps)-1] != "allowed" {
+		t.Error("expected admin to be allowed", decision)
+	}
+	if decision, _ := s.dryRun("GET", "/other", "", "10.0.0.1"); decision.Status != 401 {
+		t.Error("expected anonymous request to require login", decision)
+	}
+	if _, err := s.dryRun("GET", "/", "missing@example.com", ""); err == nil {
+		t.Error("expected unknown user to fail")
+	}
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	tests := map[string]string{"/": "/", "/a/b/": "/a/b/", "//a//b": "/a/b", "/a/../../b": "/b", "/a%2Fb": "/a/b", "/%2e%2e/a": "/a", "https://example.com/a?b": "/a", "https://example.com": "/"}
+	for uri, expected := range tests {
+		if actual, err := cleanRequestPath(uri); err != nil || actual != expected {
+			t.Error("expected", expected, "for", uri, actual, err)
+		}
+	}
+	for _, uri := range []string{"/a%", "/%zz", "a/b", "http:///a"} {
+		if _, err := cleanRequestPath(uri); err == nil {
+			t.Error("expected invalid path", uri)
+		}
+	}
+}
+
+func TestNewPolicyRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/auth?role=admin", nil)
+	r.RemoteAddr = "192.168.0.1:1234"
+	req := newPolicyRequest(r)
+	if req.Method != "GET" || req.Path != "/auth" || !req.IP.Equal(net.ParseIP("192.168.0.1")) || req.Roles[0] != "admin" {
+		t.Error("expected request to fall back to the auth request", req)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+type invitationRequest struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+// registrationPolicy returns nil when registration is open to anyone
+func (n *authConf) registrationPolicy() (*auth.RegistrationPolicy, error) {
+	if n.RegistrationMode == "" && n.DisposableDomainsFile == "" && !isTrue(n.RegistrationCheckMX) && n.InvitationDays == 0 {
+		return nil, nil
+	}
+	policy := &auth.RegistrationPolicy{Mode: n.RegistrationMode, InvitationDuration: time.Duration(n.InvitationDays) * 24 * time.Hour}
+	for _, domain := range strings.Split(n.RegistrationAllowedDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			policy.AllowedDomains = append(policy.AllowedDomains, domain)
+		}
+	}
+	if n.DisposableDomainsFile != "" {
+		domains, err := auth.ReadDomainList(n.DisposableDomainsFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.DisposableDomains = domains
+	}
+	if isTrue(n.RegistrationCheckMX) {
+		policy.MXResolver = net.DefaultResolver
+	}
+	return policy, nil
+}
+
+// invite emails an invitation to register, e.g. {"email": "jane@example.com", "roles": ["editor"]}
+func (s *nginxauth) invite(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	req := &invitationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		requestErr(w, err)
+		return
+	}
+	params := auth.EmailSendParams{Email: req.Email, BaseURL: s.baseURL(r), TemplateSuccess: templateName(s.conf.InvitationTemplate),
+		SubjectSuccess: s.conf.InvitationSubject}
+	outputMessage(w, `{ "result": "Success" }`, authStore.CreateInvitation(w, r, params, req.Roles))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+func TestRegistrationPolicy(t *testing.T) {
+	if policy, err := (&authConf{}).registrationPolicy(); policy != nil || err != nil {
+		t.Error("expected open registration by default", policy, err)
+	}
+
+	dir, _ := ioutil.TempDir("", "registration")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "disposable.txt")
+	ioutil.WriteFile(file, []byte("mailinator.com\n"), 0644)
+	n := &authConf{RegistrationMode: auth.RegistrationDomainAllowlist, RegistrationAllowedDomains: "example.com, example.org", DisposableDomainsFile: file,
+		RegistrationCheckMX: "true", InvitationDays: 2}
+	policy, err := n.registrationPolicy()
+	if err != nil || policy.Mode != auth.RegistrationDomainAllowlist || len(policy.AllowedDomains) != 2 || policy.AllowedDomains[1] != "example.org" ||
+		len(policy.DisposableDomains) != 1 || policy.MXResolver != net.DefaultResolver || policy.InvitationDuration != 48*time.Hour {
+		t.Error("expected configured policy", policy, err)
+	}
+
+	n.DisposableDomainsFile = filepath.Join(dir, "missing.txt")
+	if _, err := n.registrationPolicy(); err == nil {
+		t.Error("expected missing file error")
+	}
+}
+
+func TestInvite(t *testing.T) {
+	s := &nginxauth{conf: authConf{InvitationTemplate: "/templates/invitation.html"}}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{})
+	s.invite(storer, w, httptest.NewRequest("POST", "/admin/invite", strings.NewReader(`{"email": "jane@example.com", "roles": ["editor"]}`)))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"CreateInvitation"}, w, storer)
+
+	w = httptest.NewRecorder()
+	s.invite(storer, w, httptest.NewRequest("POST", "/admin/invite", strings.NewReader(`{"email": `)))
+	if w.Code != 400 {
+		t.Error("expected invalid request", w.Code)
+	}
+}
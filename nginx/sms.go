@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	texttemplate "text/template"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+const smsProviderTwilio string = "twilio"
+
+// newSMSChannel sends text messages through SMSProvider, or keeps them in memory in dev mode. The channel is nil
+// when neither is configured
+func (n *authConf) newSMSChannel() (*auth.SMSChannel, *auth.SMSStub, error) {
+	var provider auth.SMSProvider
+	var stub *auth.SMSStub
+	switch {
+	case isTrue(n.DevMode):
+		stub = &auth.SMSStub{}
+		provider = stub
+	case n.SMSProvider == smsProviderTwilio:
+		provider = &auth.TwilioSMSProvider{AccountSID: n.TwilioAccountSID, AuthToken: n.TwilioAuthToken, From: n.SMSFrom}
+	case n.SMSProvider == "":
+		return nil, nil, nil
+	default:
+		return nil, nil, errors.New("unknown SMSProvider: " + n.SMSProvider)
+	}
+
+	channel := &auth.SMSChannel{Provider: provider}
+	if files := append(smsTemplateFiles(n.emailTemplates()...), templateFiles(n.VerifyPhoneTemplate)...); len(files) > 0 {
+		templates, err := texttemplate.ParseFiles(files...)
+		if err != nil {
+			return nil, nil, err
+		}
+		channel.TemplateCache = templates
+	}
+	return channel, stub, nil
+}
+
+// requestPhoneVerification texts a code to the phoneNumber form value, which is saved for the logged in user once
+// the code is sent to /verifyPhone
+func (s *nginxauth) requestPhoneVerification(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	params := auth.EmailSendParams{BaseURL: s.baseURL(r), TemplateSuccess: templateName(s.conf.VerifyPhoneTemplate), Locale: s.locale(r, nil)}
+	outputMessage(w, `{ "result": "Success" }`, authStore.RequestPhoneVerification(w, r, r.FormValue("phoneNumber"), params))
+}
+
+func verifyPhone(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.VerifyPhone(w, r, r.FormValue("code")))
+}
+
+// setChannel saves the channel form value, "email" or "sms", as the one the user prefers codes to be sent over
+func setChannel(authStore auth.AuthStorer, w http.ResponseWriter, r *http.Request) {
+	outputMessage(w, `{ "result": "Success" }`, authStore.SetChannel(w, r, r.FormValue("channel")))
+}
+
+// devInboxSMS sends the text messages to the "to" number, or all of them, as JSON
+func (s *nginxauth) devInboxSMS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodErr(w)
+		return
+	}
+	messages := s.sms.Messages(r.FormValue("to"))
+	if messages == nil {
+		messages = []*auth.SMS{}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	outputData(w, messages)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+func TestNewSMSChannel(t *testing.T) {
+	if channel, stub, err := (&authConf{}).newSMSChannel(); channel != nil || stub != nil || err != nil {
+		t.Error("expected no channel when SMS isn't configured", channel, err)
+	}
+	if _, _, err := (&authConf{SMSProvider: "pigeon"}).newSMSChannel(); err == nil {
+		t.Error("expected unknown provider error")
+	}
+
+	dir, _ := ioutil.TempDir("", "sms")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "passwordReset.html"), []byte("reset"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "passwordReset.sms"), []byte("Reset: {{.VerificationCode}}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "passwordReset.fr.sms"), []byte("Réinitialiser : {{.VerificationCode}}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "verifyPhone.sms"), []byte("Code: {{.VerificationCode}}"), 0644)
+	n := &authConf{SMSProvider: smsProviderTwilio, TwilioAccountSID: "AC123", PasswordResetTemplate: filepath.Join(dir, "passwordReset.html"),
+		VerifyPhoneTemplate: filepath.Join(dir, "verifyPhone.sms")}
+	channel, stub, err := n.newSMSChannel()
+	if err != nil || stub != nil || channel.Provider.(*auth.TwilioSMSProvider).AccountSID != "AC123" {
+		t.Fatal("expected Twilio channel", err)
+	}
+	for _, name := range []string{"passwordReset.sms", "passwordReset.fr.sms", "verifyPhone.sms"} {
+		if channel.TemplateCache.Lookup(name) == nil {
+			t.Error("expected template", name)
+		}
+	}
+
+	n.DevMode = "true"
+	channel, stub, err = n.newSMSChannel()
+	if err != nil || stub == nil || channel.Provider != stub {
+		t.Fatal("expected stub in dev mode", err)
+	}
+	to := &auth.Recipient{PhoneNumber: "+14155550123"}
+	if err := channel.Notify(to, "passwordReset.html", "Reset", auth.EmailSendParams{VerificationCode: "123456", Locale: "fr"}); err != nil ||
+		stub.Latest("").Body != "Réinitialiser : 123456" {
+		t.Error("expected localized SMS", err, stub.Messages(""))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "verifyPhone.sms"), []byte("{{.VerificationCode"), 0644)
+	if _, _, err := n.newSMSChannel(); err == nil {
+		t.Error("expected template error")
+	}
+}
+
+func TestPhoneHandlers(t *testing.T) {
+	s := &nginxauth{conf: authConf{VerifyPhoneTemplate: "/templates/verifyPhone.sms"}}
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{VerifyPhoneErr: auth.NewError(auth.ErrCodeInvalidCode, "Invalid verification code", nil)})
+	w := httptest.NewRecorder()
+	s.requestPhoneVerification(storer, w, httptest.NewRequest("POST", "/requestPhoneVerification?phoneNumber=%2B14155550123", nil))
+	checkBody(t, `{ "result": "Success" }`, w)
+
+	w = httptest.NewRecorder()
+	verifyPhone(storer, w, httptest.NewRequest("POST", "/verifyPhone?code=000000", nil))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), auth.ErrCodeInvalidCode) {
+		t.Error("expected invalid code", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	setChannel(storer, w, httptest.NewRequest("POST", "/setChannel?channel=sms", nil))
+	checkBodyAndMethods(t, `{ "result": "Success" }`, []string{"RequestPhoneVerification", "VerifyPhone", "SetChannel"}, w, storer)
+}
+
+func TestDevInboxSMS(t *testing.T) {
+	s := &nginxauth{sms: &auth.SMSStub{}}
+	w := httptest.NewRecorder()
+	s.devInboxSMS(w, httptest.NewRequest("GET", "/dev/inbox/sms", nil))
+	checkBody(t, "[]", w)
+
+	s.sms.SendSMS("+14155550123", "Code: 123456")
+	w = httptest.NewRecorder()
+	s.devInboxSMS(w, httptest.NewRequest("GET", "/dev/inbox/sms?to=%2B14155550123", nil))
+	if body := w.Body.String(); !strings.Contains(body, `"to":"+14155550123","body":"Code: 123456"`) {
+		t.Error("expected SMS as JSON", body)
+	}
+	w = httptest.NewRecorder()
+	s.devInboxSMS(w, httptest.NewRequest("POST", "/dev/inbox/sms", nil))
+	if w.Code != 405 {
+		t.Error("expected method error", w.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+const defaultUploadBaseURL string = "/uploads"
+
+// fileStore saves profile pictures in S3Bucket or UploadDir. It is nil when neither is configured, so uploads are
+// ignored
+func (n *authConf) fileStore() auth.FileStorer {
+	switch {
+	case n.S3Bucket != "":
+		endpoint := n.S3Endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + n.S3Region + ".amazonaws.com"
+		}
+		return &auth.S3FileStore{Endpoint: endpoint, Region: n.S3Region, Bucket: n.S3Bucket, AccessKeyID: n.S3AccessKeyID,
+			SecretAccessKey: n.S3SecretAccessKey, BaseURL: n.UploadBaseURL}
+	case n.UploadDir != "":
+		return &auth.LocalFileStore{Dir: n.UploadDir, BaseURL: n.uploadBaseURL()}
+	}
+	return nil
+}
+
+func (n *authConf) uploadBaseURL() string {
+	if n.UploadBaseURL == "" {
+		return defaultUploadBaseURL
+	}
+	return strings.TrimSuffix(n.UploadBaseURL, "/")
+}
+
+// serveUploads serves UploadDir when UploadBaseURL is a path on this server. Another web server or CDN serves it
+// when UploadBaseURL is a full URL
+func (s *nginxauth) serveUploads() {
+	if path := s.conf.uploadBaseURL(); strings.HasPrefix(path, "/") {
+		http.Handle(path+"/", http.StripPrefix(path, uploadsHandler(s.conf.UploadDir)))
+	}
+}
+
+// uploadsHandler serves the files in dir without directory listings. Browsers must use the content type the file
+// was saved as, so an upload can't be run as a script
+func uploadsHandler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodErr(w)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") || strings.HasPrefix(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], ".") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		files.ServeHTTP(w, r)
+	})
+}
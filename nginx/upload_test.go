@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+)
+
+func TestFileStore(t *testing.T) {
+	if store := (&authConf{}).fileStore(); store != nil {
+		t.Error("expected no store when uploads aren't configured", store)
+	}
+	if store, ok := (&authConf{UploadDir: "/var/uploads"}).fileStore().(*auth.LocalFileStore); !ok || store.Dir != "/var/uploads" || store.BaseURL != "/uploads" {
+		t.Error("expected local store", store)
+	}
+	n := &authConf{UploadDir: "/var/uploads", S3Region: "eu-west-1", S3Bucket: "avatars", UploadBaseURL: "https://cdn.example.com"}
+	if store, ok := n.fileStore().(*auth.S3FileStore); !ok || store.Endpoint != "https://s3.eu-west-1.amazonaws.com" || store.Bucket != "avatars" ||
+		store.BaseURL != "https://cdn.example.com" {
+		t.Error("expected S3 store", store)
+	}
+	if config := (&authConf{UploadDir: "/var/uploads", UploadMaxBytes: 1 << 20}).authStoreConfig(nil); config.FileStore == nil || config.MaxUploadBytes != 1<<20 {
+		t.Error("expected upload settings in store config", config)
+	}
+}
+
+func TestUploadsHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "uploads")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "abc.png"), []byte("\x89PNG\r\n\x1a\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".upload123"), []byte("partial"), 0644)
+	h := uploadsHandler(dir)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/abc.png", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("expected picture", w.Code, w.Header())
+	}
+	for _, path := range []string{"/", "/.upload123", "/missing.png"} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 404 {
+			t.Error("expected not found for", path, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/abc.png", nil))
+	if w.Code != 405 {
+		t.Error("expected method error", w.Code)
+	}
+}
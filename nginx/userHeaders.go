@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/EndFirstCorp/auth"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const userHeaderFormatBase64 string = "base64"
+const userHeaderFormatNone string = "none"
+
+const headerEncodingPlain string = "plain"
+const headerEncodingBase64 string = "base64"
+const headerEncodingSigned string = "signed"
+
+// defaultUserHeadersMaxBytes keeps the identity headers well inside the 8k header buffers of nginx and most upstreams
+const defaultUserHeadersMaxBytes int = 4096
+
+const infoSourcePrefix string = "info."
+
+var headerNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// headerProjection sends one field of the session, such as the email or an info key, in its own header
+type headerProjection struct {
+	Header   string
+	Source   string
+	Encoding string
+}
+
+// userHeaders is the parsed UserHeaders, UserInfoAllowlist and UserHeadersMaxBytes config
+type userHeaders struct {
+	projections []*headerProjection
+	allowlist   map[string]bool
+	maxBytes    int
+}
+
+type headerClaims struct {
+	Header string `json:"header"`
+	Value  string `json:"value"`
+	jwt.StandardClaims
+}
+
+// newUserHeaders parses a UserHeaders value such as "X-User-Id=userID, X-User-Email=email, X-User-Name=info.fullName:base64".
+// Sources are userID, email, roles, scopes or info.<key>, and encodings are plain (default), base64 or signed
+func newUserHeaders(conf authConf) (*userHeaders, error) {
+	h := &userHeaders{maxBytes: conf.UserHeadersMaxBytes}
+	if h.maxBytes <= 0 {
+		h.maxBytes = defaultUserHeadersMaxBytes
+	}
+	if keys := splitValues([]string{conf.UserInfoAllowlist}); len(keys) > 0 {
+		h.allowlist = make(map[string]bool)
+		for _, key := range keys {
+			h.allowlist[key] = true
+		}
+	}
+
+	seen := map[string]bool{"X-User": true, "X-User-Scopes": true}
+	for _, spec := range splitValues([]string{conf.UserHeaders}) {
+		p, err := parseHeaderProjection(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[p.Header] {
+			return nil, fmt.Errorf("UserHeaders: %s is already sent", p.Header)
+		}
+		seen[p.Header] = true
+		if key := strings.TrimPrefix(p.Source, infoSourcePrefix); key != p.Source && !h.allowed(key) {
+			return nil, fmt.Errorf("UserHeaders: info key %s isn't in UserInfoAllowlist", key)
+		}
+		h.projections = append(h.projections, p)
+	}
+	return h, nil
+}
+
+func parseHeaderProjection(spec string) (*headerProjection, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || !headerNameRegex.MatchString(strings.TrimSpace(parts[0])) {
+		return nil, fmt.Errorf("UserHeaders: %q must be Header=source[:encoding]", spec)
+	}
+	p := &headerProjection{Header: http.CanonicalHeaderKey(strings.TrimSpace(parts[0])), Encoding: headerEncodingPlain}
+	source := strings.TrimSpace(parts[1])
+	if i := strings.LastIndex(source, ":"); i != -1 {
+		source, p.Encoding = source[:i], source[i+1:]
+	}
+	switch {
+	case source == "userID", source == "email", source == "roles", source == "scopes":
+	case strings.HasPrefix(source, infoSourcePrefix) && len(source) > len(infoSourcePrefix):
+	default:
+		return nil, fmt.Errorf("UserHeaders: unknown source %q for %s. Use userID, email, roles, scopes or info.<key>", source, p.Header)
+	}
+	if p.Encoding != headerEncodingPlain && p.Encoding != headerEncodingBase64 && p.Encoding != headerEncodingSigned {
+		return nil, fmt.Errorf("UserHeaders: unknown encoding %q for %s. Use plain, base64 or signed", p.Encoding, p.Header)
+	}
+	p.Source = source
+	return p, nil
+}
+
+func (h *userHeaders) allowed(infoKey string) bool {
+	return h.allowlist == nil || h.allowlist[infoKey]
+}
+
+// filterInfo returns the info keys in the allowlist
+func (h *userHeaders) filterInfo(info map[string]interface{}) map[string]interface{} {
+	if h.allowlist == nil || info == nil {
+		return info
+	}
+	filtered := make(map[string]interface{})
+	for key, value := range info {
+		if h.allowlist[key] {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+func (h *userHeaders) uses(source, encoding string) bool {
+	for _, p := range h.projections {
+		if (source == "" || p.Source == source) && (encoding == "" || p.Encoding == encoding) {
+			return true
+		}
+	}
+	return false
+}
+
+// names returns every header that can carry the user's identity
+func (h *userHeaders) names() []string {
+	names := []string{"X-User", "X-User-Scopes"}
+	for _, p := range h.projections {
+		names = append(names, p.Header)
+	}
+	return names
+}
+
+// value returns the header value before encoding, or false when the session doesn't have the field
+func (p *headerProjection) value(session *auth.LoginSession, info map[string]interface{}, roles []string) (string, bool, error) {
+	switch p.Source {
+	case "userID":
+		return session.UserID, session.UserID != "", nil
+	case "email":
+		return session.Email, session.Email != "", nil
+	case "roles":
+		return strings.Join(roles, ","), len(roles) > 0, nil
+	case "scopes":
+		return strings.Join(session.Scopes, ","), len(session.Scopes) > 0, nil
+	}
+	infoValue, ok := info[strings.TrimPrefix(p.Source, infoSourcePrefix)]
+	if !ok || infoValue == nil {
+		return "", false, nil
+	}
+	switch v := infoValue.(type) {
+	case string:
+		return v, true, nil
+	case []string:
+		return strings.Join(v, ","), true, nil
+	case []interface{}:
+		if values, ok := stringValues(v); ok {
+			return strings.Join(values, ","), true, nil
+		}
+	}
+	value, err := json.Marshal(infoValue)
+	return string(value), true, err
+}
+
+func stringValues(values []interface{}) ([]string, bool) {
+	result := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		result[i] = s
+	}
+	return result, true
+}
+
+// userHeaders returns the configured projection, or the default of X-User and X-User-Scopes only
+func (s *nginxauth) userHeaders() *userHeaders {
+	if s.headers == nil {
+		return &userHeaders{maxBytes: defaultUserHeadersMaxBytes}
+	}
+	return s.headers
+}
+
+// addUserHeaders sets X-User in UserHeaderFormat, X-User-Scopes for API keys and each header in UserHeaders.
+// Nothing is set when the headers together are over UserHeadersMaxBytes
+func (s *nginxauth) addUserHeaders(authStore auth.AuthStorer, w http.ResponseWriter, session *auth.LoginSession) error {
+	h := s.userHeaders()
+	info := h.filterInfo(session.Info)
+	headers := http.Header{}
+	if s.conf.UserHeaderFormat != userHeaderFormatNone {
+		user, err := s.userHeader(session, info)
+		if err != nil {
+			return err
+		}
+		headers.Set("X-User", user)
+	}
+	if len(session.Scopes) > 0 {
+		headers.Set("X-User-Scopes", strings.Join(session.Scopes, " "))
+	}
+
+	var roles []string
+	if h.uses("roles", "") {
+		var err error
+		if roles, err = authStore.GetSessionRoles(session); err != nil {
+			return err
+		}
+	}
+	for _, p := range h.projections {
+		value, ok, err := p.value(session, info, roles)
+		if err != nil {
+			return fmt.Errorf("unable to get %s: %v", p.Header, err)
+		}
+		if !ok {
+			continue
+		}
+		if value, err = s.encodeHeader(p, session, value); err != nil {
+			return err
+		}
+		headers.Set(p.Header, value)
+	}
+
+	if err := checkHeadersSize(headers, h.maxBytes); err != nil {
+		return err
+	}
+	for name, values := range headers {
+		w.Header()[name] = values
+	}
+	return nil
+}
+
+func (s *nginxauth) encodeHeader(p *headerProjection, session *auth.LoginSession, value string) (string, error) {
+	switch p.Encoding {
+	case headerEncodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(value)), nil
+	case headerEncodingSigned:
+		if s.keys == nil {
+			return "", fmt.Errorf("%s is signed but no signing keys are configured", p.Header)
+		}
+		now := time.Now().UTC()
+		return s.keys.Sign(headerClaims{
+			Header: p.Header,
+			Value:  value,
+			StandardClaims: jwt.StandardClaims{
+				Audience:  auth.IdentityTokenAudience,
+				Subject:   session.UserID,
+				Issuer:    s.conf.TokenIssuer,
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(userHeaderExpireDuration).Unix(),
+			},
+		})
+	}
+	if strings.IndexFunc(value, func(r rune) bool { return r < ' ' || r == 0x7f }) != -1 {
+		return "", fmt.Errorf("%s contains control characters. Use the base64 encoding", p.Header)
+	}
+	return value, nil
+}
+
+// checkHeadersSize returns an error naming the largest headers when all of them are over maxBytes
+func checkHeadersSize(headers http.Header, maxBytes int) error {
+	total := 0
+	sizes := make(map[string]int)
+	for name, values := range headers {
+		for _, value := range values {
+			sizes[name] += len(name) + len(value) + len(": \r\n")
+		}
+		total += sizes[name]
+	}
+	if total <= maxBytes {
+		return nil
+	}
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return sizes[names[i]] > sizes[names[j]] || sizes[names[i]] == sizes[names[j]] && names[i] < names[j]
+	})
+	largest := make([]string, len(names))
+	for i, name := range names {
+		largest[i] = fmt.Sprintf("%s (%d bytes)", name, sizes[name])
+	}
+	return fmt.Errorf("user headers are %d bytes, over the UserHeadersMaxBytes limit of %d: %s. Limit the info sent with UserInfoAllowlist or raise the limit",
+		total, maxBytes, strings.Join(largest, ", "))
+}
+
+// userHeadersErr is sent when the user is allowed but their identity can't be passed on to the upstream server
+func userHeadersErr(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusInternalServerError, auth.ErrCodeInternal, "Unable to send user headers")
+	logError(err)
+}
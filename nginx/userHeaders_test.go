@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/EndFirstCorp/auth"
+	"github.com/pkg/errors"
+)
+
+func getHeadersServer(t *testing.T, conf authConf) *nginxauth {
+	headers, err := newUserHeaders(conf)
+	if err != nil {
+		t.Fatal("expected user headers to parse", err)
+	}
+	return &nginxauth{headers: headers, conf: conf}
+}
+
+func TestNewUserHeaders(t *testing.T) {
+	h, err := newUserHeaders(authConf{UserHeaders: " x-user-id=userID, X-User-Name=info.fullName:base64,X-User-Groups=roles:signed", UserInfoAllowlist: "fullName"})
+	if err != nil || len(h.projections) != 3 || h.maxBytes != defaultUserHeadersMaxBytes || *h.projections[0] != (headerProjection{"X-User-Id", "userID", "plain"}) ||
+		*h.projections[1] != (headerProjection{"X-User-Name", "info.fullName", "base64"}) || !h.uses("roles", headerEncodingSigned) || h.uses("", "other") {
+		t.Fatal("expected projections", err, h)
+	}
+
+	for _, spec := range []string{"X-User-Id", "X User=userID", "X-User-Id=password", "X-User-Id=userID:gzip", "X-User=email", "X-A=email,x-a=userID", "X-Org=info.org", "X-Info=info."} {
+		if _, err := newUserHeaders(authConf{UserHeaders: spec, UserInfoAllowlist: "fullName"}); err == nil {
+			t.Error("expected invalid UserHeaders to fail", spec)
+		}
+	}
+}
+
+func TestAddUserHeaders(t *testing.T) {
+	s := getHeadersServer(t, authConf{UserHeaderFormat: "base64", UserInfoAllowlist: "fullName, groups, quota, missing",
+		UserHeaders: "X-User-Id=userID, X-User-Email=email, X-User-Groups=roles, X-User-Name=info.fullName:base64, X-User-Teams=info.groups, X-User-Quota=info.quota, X-User-Missing=info.missing"})
+	session := &auth.LoginSession{UserID: "1", Email: "test@test.com", Info: map[string]interface{}{"fullName": "Näme", "groups": []interface{}{"a", "b"}, "quota": 5, "secret": "hidden"}}
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionRolesVal: []string{"admin", "editor"}})
+	w := httptest.NewRecorder()
+	if err := s.addUserHeaders(storer, w, session); err != nil {
+		t.Fatal("expected headers", err)
+	}
+	user, _ := base64.StdEncoding.DecodeString(w.Header().Get("X-User"))
+	name, _ := base64.StdEncoding.DecodeString(w.Header().Get("X-User-Name"))
+	if string(user) != `{"userID":"1","email":"test@test.com","isEmailVerified":false,"info":{"fullName":"Näme","groups":["a","b"],"quota":5}}` ||
+		w.Header().Get("X-User-Id") != "1" || w.Header().Get("X-User-Email") != "test@test.com" || w.Header().Get("X-User-Groups") != "admin,editor" ||
+		string(name) != "Näme" || w.Header().Get("X-User-Teams") != "a,b" || w.Header().Get("X-User-Quota") != "5" || len(w.Header()) != 7 {
+		t.Error("expected projected headers", string(user), w.Header())
+	}
+	checkMethods(t, []string{"GetSessionRoles"}, storer)
+
+	s.conf.UserHeaderFormat = userHeaderFormatNone
+	storer = auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionRolesErr: errors.New("failed")})
+	if err := s.addUserHeaders(storer, httptest.NewRecorder(), session); err == nil {
+		t.Error("expected roles error")
+	}
+
+	s = getHeadersServer(t, authConf{UserHeaderFormat: userHeaderFormatNone, UserHeaders: "X-User-Note=info.note"})
+	w = httptest.NewRecorder()
+	if err := s.addUserHeaders(nil, w, &auth.LoginSession{Info: map[string]interface{}{"note": "a\r\nX-Injected: 1"}}); err == nil || len(w.Header()) != 0 {
+		t.Error("expected control characters to be rejected", err, w.Header())
+	}
+}
+
+func TestAddSignedUserHeaders(t *testing.T) {
+	keys, _ := auth.NewKeyManager(auth.NewBackendMemory(&auth.CryptoHashStore{}), auth.SigningAlgorithmEdDSA, 0, 0)
+	s := getHeadersServer(t, authConf{UserHeaderFormat: "jwt", UserInfoAllowlist: "fullName", UserHeaders: "X-User-Email=email:signed", TokenIssuer: "https://auth.example.com"})
+	session := &auth.LoginSession{UserID: "1", Email: "test@test.com", Info: map[string]interface{}{"fullName": "Name", "secret": "hidden"}}
+	if err := s.addUserHeaders(nil, httptest.NewRecorder(), session); err == nil {
+		t.Error("expected signed header to require keys")
+	}
+
+	s.keys = keys
+	w := httptest.NewRecorder()
+	if err := s.addUserHeaders(nil, w, session); err != nil {
+		t.Fatal("expected signed headers", err)
+	}
+	claims := &headerClaims{}
+	if err := keys.Parse(w.Header().Get("X-User-Email"), claims); err != nil || claims.Header != "X-User-Email" || claims.Value != "test@test.com" || claims.Subject != "1" || claims.Audience != auth.IdentityTokenAudience {
+		t.Error("expected signed email", err, claims)
+	}
+	user := &userClaims{}
+	if err := keys.Parse(w.Header().Get("X-User"), user); err != nil || user.Info["fullName"] != "Name" || user.Info["secret"] != nil {
+		t.Error("expected allowlisted info in the signed user", err, user)
+	}
+}
+
+func TestUserHeadersMaxBytes(t *testing.T) {
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(&nilWriter{})
+	s := getHeadersServer(t, authConf{UserHeadersMaxBytes: 200, UserHeaders: "X-User-Bio=info.bio"})
+	session := &auth.LoginSession{UserID: "1", Info: map[string]interface{}{"bio": strings.Repeat("a", 150)}}
+	w := httptest.NewRecorder()
+	storer := auth.NewFakeStorer(auth.FakeStorerConfig{GetSessionVal: session})
+	s.authCookie(storer, w, nil)
+	if w.Code != 500 || w.Header().Get("X-User") != "" || w.Body.String() != `{"error":{"code":"internal_error","message":"Unable to send user headers"}}`+"\n" ||
+		!strings.Contains(logged.String(), "user headers are 391 bytes, over the UserHeadersMaxBytes limit of 200: "+
+			"X-User (227 bytes), X-User-Bio (164 bytes). Limit the info sent with UserInfoAllowlist or raise the limit") {
+		t.Error("expected size error", w.Code, w.Body.String(), logged.String())
+	}
+
+	s.headers.maxBytes = 400
+	w = httptest.NewRecorder()
+	s.authCookie(storer, w, nil)
+	if w.Code != 200 || len(w.Header().Get("X-User-Bio")) != 150 {
+		t.Error("expected headers under the limit", w.Code, w.Header())
+	}
+}
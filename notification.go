@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ChannelEmail sends messages by email. It is always available
+const ChannelEmail string = "email"
+
+// ChannelSMS sends text messages to the user's verified phone number
+const ChannelSMS string = "sms"
+
+// InfoChannel is the user info key holding the channel the user prefers codes and notifications to be sent over,
+// such as "sms". Email is used when it is empty
+const InfoChannel string = "channel"
+
+// ErrChannelUnavailable is returned by a Channel which can't send a message, because it has no address for the
+// recipient or no template for the message. The message is sent by email instead
+var ErrChannelUnavailable = errors.New("Channel is unable to send the message")
+
+// Recipient is who a message is for, with their address on each channel. PhoneNumber is only set once verified
+type Recipient struct {
+	Email       string
+	PhoneNumber string
+}
+
+// Channel sends out-of-band messages, such as verification codes, over a medium like email or SMS. The template
+// name and data are the ones an email would be sent with, so a channel picks its own template for the message
+type Channel interface {
+	Notify(to *Recipient, templateName, subject string, data interface{}) error
+}
+
+// MailerChannel sends messages by email
+type MailerChannel struct {
+	Mailer Mailer
+}
+
+// Notify sends the email
+func (c *MailerChannel) Notify(to *Recipient, templateName, subject string, data interface{}) error {
+	if to.Email == "" {
+		return ErrChannelUnavailable
+	}
+	return c.Mailer.SendMessage(to.Email, templateName, subject, data)
+}
+
+// notify sends the message to the user with userID over the channel they prefer. The user is only looked up when
+// channels other than email are configured
+func (s *authStore) notify(b Backender, userID, email, templateName, subject string, params EmailSendParams) error {
+	if len(s.conf.Channels) > 0 {
+		if u, err := b.GetUserByID(userID); err == nil {
+			return s.notifyUser(u, email, templateName, subject, params)
+		}
+	}
+	return s.mailer.SendMessage(email, templateName, subject, params)
+}
+
+// notifyUser sends the message over the channel the user prefers, and by email to the address when that channel
+// can't reach them
+func (s *authStore) notifyUser(u *User, email, templateName, subject string, params EmailSendParams) error {
+	to := &Recipient{Email: email}
+	if u.IsPhoneVerified {
+		to.PhoneNumber = u.PhoneNumber
+	}
+	if channel, ok := s.conf.Channels[GetInfoString(u.Info, InfoChannel)]; ok {
+		if err := channel.Notify(to, templateName, subject, params); err != ErrChannelUnavailable {
+			return err
+		}
+	}
+	return s.mailer.SendMessage(email, templateName, subject, params)
+}
+
+// SetChannel saves the channel the logged in user prefers codes and notifications to be sent over
+func (s *authStore) SetChannel(w http.ResponseWriter, r *http.Request, channel string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.setChannel(w, r, b, channel)
+}
+
+func (s *authStore) setChannel(w http.ResponseWriter, r *http.Request, b Backender, channel string) error {
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.conf.Channels[channel]; !ok && channel != ChannelEmail {
+		return newAuthError("Unknown channel: "+channel, nil)
+	}
+	if channel == ChannelSMS {
+		u, err := b.GetUserByID(session.UserID)
+		if err != nil {
+			return newLoggedError("Unable to get user", err)
+		}
+		if !u.IsPhoneVerified {
+			return newAuthError("Please verify your phone number first", nil)
+		}
+	}
+	if err := b.UpdateInfo(session.UserID, map[string]interface{}{InfoChannel: channel}); err != nil {
+		return newLoggedError("Unable to save channel", err)
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const authorizationCodeExpireDuration time.Duration = 5 * time.Minute
+
+const oauthScopeOpenID string = "openid"
+const oauthScopeEmail string = "email"
+const oauthScopeProfile string = "profile"
+
+// OAuthScopes are the scopes clients may request from the authorization server
+var OAuthScopes = []string{oauthScopeOpenID, oauthScopeEmail, oauthScopeProfile}
+
+const tokenEndpointAuthNone string = "none"
+const tokenEndpointAuthSecretBasic string = "client_secret_basic"
+const tokenEndpointAuthSecretPost string = "client_secret_post"
+
+// OAuthError is an error response from RFC 6749. When RedirectURL is set, the error belongs to
+// the client and the browser should be redirected there instead of being shown the error
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	RedirectURL string `json:"-"`
+	innerError  error
+}
+
+func newOAuthError(code, description string, innerError error) *OAuthError {
+	return &OAuthError{Code: code, Description: description, innerError: innerError}
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// OAuthClientRegistration is the client metadata from RFC 7591 used to register a client
+type OAuthClientRegistration struct {
+	ClientID                string   `json:"client_id,omitempty"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+}
+
+// OAuthAuthorization is the outcome of an authorization request. Either the browser is redirected back to the
+// client, the user has to log in first, or the user has to consent to the client getting the requested scopes
+type OAuthAuthorization struct {
+	RedirectURL   string
+	LoginRequired bool
+	Consent       *OAuthConsent
+}
+
+// OAuthConsent holds what the consent screen shows. Params and CSRFToken must be posted back with the decision
+type OAuthConsent struct {
+	ClientName string
+	Scopes     []string
+	CSRFToken  string
+	Params     map[string]string
+}
+
+type authorizeRequest struct {
+	client        *oauthClient
+	redirectURI   string
+	scope         string
+	state         string
+	nonce         string
+	codeChallenge string
+	prompt        string
+}
+
+func (s *authStore) RegisterOAuthClient(w http.ResponseWriter, r *http.Request) (*OAuthClientRegistration, error) {
+	token := s.conf.OAuthRegistrationToken
+	if token == "" || subtle.ConstantTimeCompare([]byte(getBearerToken(r)), []byte(token)) != 1 {
+		return nil, newOAuthError("invalid_token", "Invalid registration token", nil)
+	}
+	req := &OAuthClientRegistration{}
+	if err := getJSON(r, req); err != nil {
+		return nil, newOAuthError("invalid_client_metadata", "Unable to get client metadata", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.registerOAuthClient(b, req)
+}
+
+func (s *authStore) registerOAuthClient(b Backender, req *OAuthClientRegistration) (*OAuthClientRegistration, error) {
+	if req.ClientName == "" {
+		return nil, newOAuthError("invalid_client_metadata", "client_name is required", nil)
+	}
+	if len(req.RedirectURIs) == 0 {
+		return nil, newOAuthError("invalid_redirect_uri", "At least one redirect URI is required", nil)
+	}
+	for _, redirectURI := range req.RedirectURIs {
+		if !isValidRedirectURI(redirectURI) {
+			return nil, newOAuthError("invalid_redirect_uri", "Redirect URIs must use https, or http on localhost: "+redirectURI, nil)
+		}
+	}
+	switch req.TokenEndpointAuthMethod {
+	case "":
+		req.TokenEndpointAuthMethod = tokenEndpointAuthSecretBasic
+	case tokenEndpointAuthNone, tokenEndpointAuthSecretBasic, tokenEndpointAuthSecretPost:
+	default:
+		return nil, newOAuthError("invalid_client_metadata", "Unsupported token_endpoint_auth_method", nil)
+	}
+
+	clientID, err := generateRandomString()
+	if err != nil {
+		return nil, newLoggedError("Problem generating client ID", err)
+	}
+	client := &oauthClient{ClientID: strings.TrimRight(clientID, "="), Name: req.ClientName, RedirectURIs: req.RedirectURIs, CreatedTimeUTC: time.Now().UTC()}
+	req.ClientSecret = ""
+	if req.TokenEndpointAuthMethod != tokenEndpointAuthNone {
+		secret, secretHash, err := generateStringAndHash()
+		if err != nil {
+			return nil, newLoggedError("Problem generating client secret", err)
+		}
+		client.SecretHash = secretHash
+		req.ClientSecret = secret
+	}
+	if err := b.CreateOAuthClient(client); err != nil {
+		return nil, newLoggedError("Unable to save client", err)
+	}
+	req.ClientID = client.ClientID
+	return req, nil
+}
+
+// isValidRedirectURI allows absolute https URIs, and http only for loopback addresses during development
+func isValidRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	return u.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback()))
+}
+
+// OAuthAuthorize handles the authorization endpoint. It issues a code when the logged in user has
+// already consented to the requested scopes
+func (s *authStore) OAuthAuthorize(w http.ResponseWriter, r *http.Request) (*OAuthAuthorization, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.oauthAuthorize(w, r, b)
+}
+
+func (s *authStore) oauthAuthorize(w http.ResponseWriter, r *http.Request, b Backender) (*OAuthAuthorization, error) {
+	req, err := s.getAuthorizeRequest(r, b)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.getCookieSession(w, r, b) // no CSRF token on a navigation. Codes only go to a registered redirect URI after consent
+	if err != nil {
+		if req.prompt == "none" {
+			return nil, req.error("login_required", "The user is not logged in")
+		}
+		return &OAuthAuthorization{LoginRequired: true}, nil
+	}
+
+	consent, err := b.GetOAuthConsent(session.UserID, req.client.ClientID)
+	if err != nil || req.prompt == "consent" || !scopesIncluded(req.scope, consent.Scope) {
+		if req.prompt == "none" {
+			return nil, req.error("consent_required", "The user has not consented to this client")
+		}
+		return &OAuthAuthorization{Consent: req.consent(r, session)}, nil
+	}
+	return s.issueAuthorizationCode(b, req, session)
+}
+
+// OAuthConsent handles the decision posted from the consent screen
+func (s *authStore) OAuthConsent(w http.ResponseWriter, r *http.Request) (*OAuthAuthorization, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.oauthConsent(w, r, b)
+}
+
+func (s *authStore) oauthConsent(w http.ResponseWriter, r *http.Request, b Backender) (*OAuthAuthorization, error) {
+	req, err := s.getAuthorizeRequest(r, b)
+	if err != nil {
+		return nil, err
+	}
+	session, err := s.getCookieSession(w, r, b)
+	if err != nil {
+		return &OAuthAuthorization{LoginRequired: true}, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("csrf_token")), []byte(session.CSRFToken)) != 1 {
+		return nil, errInvalidCSRF
+	}
+	if r.PostForm.Get("decision") != "approve" {
+		return nil, req.error("access_denied", "The user denied the request")
+	}
+	if err := b.SaveOAuthConsent(session.UserID, req.client.ClientID, req.scope); err != nil {
+		return nil, newLoggedError("Unable to save consent", err)
+	}
+	return s.issueAuthorizationCode(b, req, session)
+}
+
+// getAuthorizeRequest validates the client and redirect URI first, since errors can only be sent to a redirect URI we trust
+func (s *authStore) getAuthorizeRequest(r *http.Request, b Backender) (*authorizeRequest, error) {
+	if s.keys == nil {
+		return nil, newAuthError("OAuth is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, newOAuthError("invalid_request", "Unable to parse request", err)
+	}
+	client, err := b.GetOAuthClient(r.Form.Get("client_id"))
+	if err != nil {
+		return nil, newOAuthError("invalid_request", "Unknown client", err)
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !contains(client.RedirectURIs, redirectURI) {
+		return nil, newOAuthError("invalid_request", "Redirect URI is not registered for this client", nil)
+	}
+
+	req := &authorizeRequest{
+		client:        client,
+		redirectURI:   redirectURI,
+		scope:         strings.Join(strings.Fields(r.Form.Get("scope")), " "),
+		state:         r.Form.Get("state"),
+		nonce:         r.Form.Get("nonce"),
+		codeChallenge: r.Form.Get("code_challenge"),
+		prompt:        r.Form.Get("prompt"),
+	}
+	if r.Form.Get("response_type") != "code" {
+		return nil, req.error("unsupported_response_type", "Only the code response type is supported")
+	}
+	if req.codeChallenge == "" && client.isPublic() {
+		return nil, req.error("invalid_request", "code_challenge is required for public clients")
+	}
+	if req.codeChallenge != "" && r.Form.Get("code_challenge_method") != "S256" {
+		return nil, req.error("invalid_request", "code_challenge_method must be S256")
+	}
+	for _, scope := range strings.Fields(req.scope) {
+		if !contains(OAuthScopes, scope) {
+			return nil, req.error("invalid_scope", "Unsupported scope: "+scope)
+		}
+	}
+	return req, nil
+}
+
+func (req *authorizeRequest) error(code, description string) *OAuthError {
+	err := newOAuthError(code, description, nil)
+	err.RedirectURL = withQuery(req.redirectURI, url.Values{"error": {code}, "error_description": {description}, "state": {req.state}})
+	return err
+}
+
+func (req *authorizeRequest) consent(r *http.Request, session *LoginSession) *OAuthConsent {
+	params := map[string]string{}
+	for _, name := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+		if value := r.Form.Get(name); value != "" {
+			params[name] = value
+		}
+	}
+	return &OAuthConsent{ClientName: req.client.Name, Scopes: strings.Fields(req.scope), CSRFToken: session.CSRFToken, Params: params}
+}
+
+func (s *authStore) issueAuthorizationCode(b Backender, req *authorizeRequest, session *LoginSession) (*OAuthAuthorization, error) {
+	code, codeHash, err := generateStringAndHash()
+	if err != nil {
+		return nil, newLoggedError("Problem generating authorization code", err)
+	}
+	err = b.CreateAuthorizationCode(&authorizationCode{codeHash, req.client.ClientID, session.UserID, session.Email, req.redirectURI,
+		req.scope, req.nonce, req.codeChallenge, time.Now().UTC().Add(authorizationCodeExpireDuration)})
+	if err != nil {
+		return nil, newLoggedError("Unable to save authorization code", err)
+	}
+	return &OAuthAuthorization{RedirectURL: withQuery(req.redirectURI, url.Values{"code": {code}, "state": {req.state}})}, nil
+}
+
+// OAuthToken handles the token endpoint for the authorization_code and refresh_token grants
+func (s *authStore) OAuthToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, newOAuthError("invalid_request", "Unable to parse request", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.oauthToken(b, r)
+}
+
+func (s *authStore) oauthToken(b Backender, r *http.Request) (*TokenResponse, error) {
+	if s.keys == nil {
+		return nil, newAuthError("OAuth is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	client, err := authenticateClient(b, r)
+	if err != nil {
+		return nil, err
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		return s.exchangeAuthorizationCode(b, client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		token, user, err := s.useRefreshToken(b, r.PostForm.Get("refresh_token"), client.ClientID)
+		if err != nil {
+			return nil, newOAuthError("invalid_grant", err.Error(), err)
+		}
+		return s.issueOAuthTokens(b, user, client.ClientID, token.Scope, "", token.FamilyID)
+	}
+	return nil, newOAuthError("unsupported_grant_type", "Only the authorization_code and refresh_token grants are supported", nil)
+}
+
+// authenticateClient checks the client secret from basic auth or the form. Public clients have no secret
+// and rely on PKCE instead
+func authenticateClient(b Backender, r *http.Request) (*oauthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, err := b.GetOAuthClient(clientID)
+	if err != nil {
+		return nil, newOAuthError("invalid_client", "Unknown client", err)
+	}
+	if client.isPublic() {
+		if secret != "" {
+			return nil, newOAuthError("invalid_client", "Public clients must not send a secret", nil)
+		}
+		return client, nil
+	}
+	if err := encodedHashEquals(secret, client.SecretHash); err != nil {
+		return nil, newOAuthError("invalid_client", "Invalid client credentials", err)
+	}
+	return client, nil
+}
+
+func (s *authStore) exchangeAuthorizationCode(b Backender, client *oauthClient, code, redirectURI, codeVerifier string) (*TokenResponse, error) {
+	codeHash, err := decodeStringToHash(code)
+	if err != nil {
+		return nil, newOAuthError("invalid_grant", "Invalid authorization code", err)
+	}
+	authCode, err := b.ConsumeAuthorizationCode(codeHash) // single use, even when the rest of the request is invalid
+	if err != nil {
+		return nil, newOAuthError("invalid_grant", "Invalid authorization code", err)
+	}
+	if authCode.ClientID != client.ClientID {
+		return nil, newOAuthError("invalid_grant", "Authorization code was issued to another client", nil)
+	}
+	if redirectURI != authCode.RedirectURI && !(redirectURI == "" && len(client.RedirectURIs) == 1) {
+		return nil, newOAuthError("invalid_grant", "Redirect URI doesn't match the authorization request", nil)
+	}
+	if authCode.ExpireTimeUTC.Before(time.Now().UTC()) {
+		return nil, newOAuthError("invalid_grant", "Authorization code has expired", nil)
+	}
+	if authCode.CodeChallenge != "" && !verifyCodeChallenge(codeVerifier, authCode.CodeChallenge) {
+		return nil, newOAuthError("invalid_grant", "Invalid code_verifier", nil)
+	}
+
+	user, err := b.GetUser(authCode.Email)
+	if err != nil {
+		return nil, newLoggedError("Unable to find user", err)
+	}
+	if user.IsLockedOut() {
+		return nil, newOAuthError("invalid_grant", "The account is locked", nil)
+	}
+	familyID, err := generateRandomString()
+	if err != nil {
+		return nil, newLoggedError("Problem generating refresh token", err)
+	}
+	return s.issueOAuthTokens(b, user, client.ClientID, authCode.Scope, authCode.Nonce, familyID)
+}
+
+// verifyCodeChallenge checks an S256 PKCE code verifier against the challenge from the authorization request
+func verifyCodeChallenge(codeVerifier, codeChallenge string) bool {
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(codeChallenge)) == 1
+}
+
+func (s *authStore) issueOAuthTokens(b Backender, user *User, clientID, scope, nonce, familyID string) (*TokenResponse, error) {
+	tokens, err := s.issueTokens(b, user, clientID, scope, familyID)
+	if err != nil {
+		return nil, err
+	}
+	if hasScope(scope, oauthScopeOpenID) {
+		if tokens.IDToken, err = s.signIDToken(user, clientID, scope, nonce); err != nil {
+			return nil, newLoggedError("Problem signing ID token", err)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *authStore) signIDToken(user *User, clientID, scope, nonce string) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.MapClaims(s.userClaims(user, scope))
+	claims["iss"] = s.conf.TokenIssuer
+	claims["sub"] = user.UserID
+	claims["aud"] = clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(accessTokenExpireDuration).Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return s.keys.Sign(claims)
+}
+
+// OAuthUserInfo returns the claims for the user an OAuth access token was issued for
+func (s *authStore) OAuthUserInfo(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.oauthUserInfo(b, getBearerToken(r))
+}
+
+func (s *authStore) oauthUserInfo(b Backender, accessToken string) (map[string]interface{}, error) {
+	if s.keys == nil {
+		return nil, newAuthError("OAuth is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	claims := &accessTokenClaims{}
+	if err := s.keys.Parse(accessToken, claims); err != nil {
+		return nil, newOAuthError("invalid_token", "Invalid access token", err)
+	}
+	if claims.Issuer != s.conf.TokenIssuer || claims.Audience == "" || claims.Audience == accessTokenAudience || claims.Audience == IdentityTokenAudience {
+		return nil, newOAuthError("invalid_token", "Access token was not issued to an OAuth client", nil)
+	}
+	if !hasScope(claims.Scope, oauthScopeOpenID) {
+		return nil, newOAuthError("insufficient_scope", "The openid scope is required", nil)
+	}
+	user, err := b.GetUser(claims.Email)
+	if err != nil {
+		return nil, newOAuthError("invalid_token", "User not found", err)
+	}
+	info := s.userClaims(user, claims.Scope)
+	info["sub"] = user.UserID
+	return info, nil
+}
+
+// reservedClaims can't be set from User.Info
+var reservedClaims = []string{"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "nonce", "auth_time", "email", "email_verified"}
+
+// userClaims maps the user to OpenID claims. The profile scope releases the User.Info fields users set themselves,
+// so admin and read-only fields and the ones the auth server keeps stay private
+func (s *authStore) userClaims(user *User, scope string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if hasScope(scope, oauthScopeProfile) {
+		for name, value := range s.conf.ProfileSchema.userInfo(user.Info) {
+			if !contains(reservedClaims, name) {
+				claims[name] = value
+			}
+		}
+	}
+	if hasScope(scope, oauthScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.IsEmailVerified
+	}
+	return claims
+}
+
+func hasScope(scope, name string) bool {
+	return contains(strings.Fields(scope), name)
+}
+
+// scopesIncluded returns true if every scope requested is in granted
+func scopesIncluded(requested, granted string) bool {
+	for _, scope := range strings.Fields(requested) {
+		if !hasScope(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// withQuery adds params to the query of rawURL, skipping empty values
+func withQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	for name, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
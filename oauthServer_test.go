@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const testCodeVerifier string = "dBjftJeZ4CVP-mJ92K9Zk6fXaqZC4FgDthhDpDLnW3Zg"
+
+func getOAuthStore(t *testing.T) (*authStore, *backendMemory, *LoginSession) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	b.AddUserFull("test@test.com", "password", map[string]interface{}{"fullName": "Test User", "sub": "spoofed"})
+	b.VerifyEmail("test@test.com")
+	keys, _ := NewKeyManager(b, "", 0, 0)
+	s := &authStore{b: b, mailer: &TextMailer{}, cookieStore: newMockCookieStore(nil, false, false),
+		conf: AuthStoreConfig{OAuthServer: true, TokenIssuer: "https://auth.example.com", OAuthRegistrationToken: "registrationToken"}, keys: keys}
+	session, err := s.login(nil, &http.Request{}, b, "test@test.com", "password", false)
+	if err != nil {
+		t.Fatal("expected login", err)
+	}
+	return s, b, session
+}
+
+func registerTestClient(t *testing.T, s *authStore, b Backender, method string) *OAuthClientRegistration {
+	client, err := s.registerOAuthClient(b, &OAuthClientRegistration{ClientName: "App", RedirectURIs: []string{"https://app.example.com/callback"}, TokenEndpointAuthMethod: method})
+	if err != nil {
+		t.Fatal("expected client", err)
+	}
+	return client
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func newAuthorizeRequest(method string, params url.Values) *http.Request {
+	if method == "GET" {
+		return httptest.NewRequest("GET", "/oauth2/authorize?"+params.Encode(), nil)
+	}
+	r := httptest.NewRequest("POST", "/oauth2/consent", strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func tokenRequest(params url.Values) *http.Request {
+	r := newAuthorizeRequest("POST", params)
+	r.ParseForm()
+	return r
+}
+
+func TestRegisterOAuthClient(t *testing.T) {
+	s, b, _ := getOAuthStore(t)
+	r := httptest.NewRequest("POST", "/oauth2/register", strings.NewReader(`{"client_name": "App", "redirect_uris": ["https://app.example.com/callback"]}`))
+	if _, err := s.RegisterOAuthClient(nil, r); err == nil || err.(*OAuthError).Code != "invalid_token" {
+		t.Fatal("expected registration token to be required", err)
+	}
+
+	r = httptest.NewRequest("POST", "/oauth2/register", strings.NewReader(`{"client_name": "App", "redirect_uris": ["https://app.example.com/callback"]}`))
+	r.Header.Set("Authorization", "Bearer registrationToken")
+	client, err := s.RegisterOAuthClient(nil, r)
+	if err != nil || client.ClientID == "" || client.ClientSecret == "" || client.TokenEndpointAuthMethod != "client_secret_basic" ||
+		len(b.OAuthClients) != 1 || b.OAuthClients[0].SecretHash == client.ClientSecret {
+		t.Fatal("expected confidential client", err, client)
+	}
+
+	public := registerTestClient(t, s, b, "none")
+	if public.ClientSecret != "" || !b.OAuthClients[1].isPublic() {
+		t.Fatal("expected public client", public)
+	}
+
+	for _, uri := range []string{"http://app.example.com/callback", "https://app.example.com/callback#fragment", "/callback", "http://127.0.0.1.example.com/"} {
+		if _, err := s.registerOAuthClient(b, &OAuthClientRegistration{ClientName: "App", RedirectURIs: []string{uri}}); err == nil || err.(*OAuthError).Code != "invalid_redirect_uri" {
+			t.Error("expected invalid redirect uri", uri, err)
+		}
+	}
+	if !isValidRedirectURI("http://localhost:8080/callback") || !isValidRedirectURI("http://127.0.0.1/callback") {
+		t.Error("expected loopback redirect to be allowed")
+	}
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	s, b, session := getOAuthStore(t)
+	client := registerTestClient(t, s, b, "none")
+	params := url.Values{"response_type": {"code"}, "client_id": {client.ClientID}, "redirect_uri": {"https://app.example.com/callback"},
+		"scope": {"openid email profile"}, "state": {"xyz"}, "nonce": {"n-0S6"}, "code_challenge": {codeChallenge(testCodeVerifier)}, "code_challenge_method": {"S256"}}
+
+	result, err := s.oauthAuthorize(nil, newAuthorizeRequest("GET", params), b)
+	if err != nil || result.Consent == nil || result.Consent.ClientName != "App" || result.Consent.CSRFToken != session.CSRFToken || result.Consent.Params["state"] != "xyz" {
+		t.Fatal("expected consent to be required", err, result)
+	}
+
+	consent := url.Values{"decision": {"approve"}, "csrf_token": {"wrong"}}
+	for name, value := range result.Consent.Params {
+		consent.Set(name, value)
+	}
+	if _, err := s.oauthConsent(nil, newAuthorizeRequest("POST", consent), b); err != errInvalidCSRF {
+		t.Fatal("expected csrf check", err)
+	}
+	consent.Set("csrf_token", session.CSRFToken)
+	result, err = s.oauthConsent(nil, newAuthorizeRequest("POST", consent), b)
+	if err != nil || !strings.HasPrefix(result.RedirectURL, "https://app.example.com/callback?") || len(b.OAuthConsents) != 1 {
+		t.Fatal("expected code redirect", err, result)
+	}
+	redirect, _ := url.Parse(result.RedirectURL)
+	if redirect.Query().Get("state") != "xyz" || redirect.Query().Get("code") == "" {
+		t.Fatal("expected code and state", result.RedirectURL)
+	}
+
+	// consent is remembered
+	again, err := s.oauthAuthorize(nil, newAuthorizeRequest("GET", params), b)
+	if err != nil || again.RedirectURL == "" {
+		t.Fatal("expected consent to be remembered", err, again)
+	}
+
+	code := redirect.Query().Get("code")
+	tokenParams := url.Values{"grant_type": {"authorization_code"}, "client_id": {client.ClientID}, "code": {code}, "redirect_uri": {"https://app.example.com/callback"}, "code_verifier": {strings.Repeat("a", 43)}}
+	if _, err := s.oauthToken(b, tokenRequest(tokenParams)); err == nil || err.(*OAuthError).Description != "Invalid code_verifier" {
+		t.Fatal("expected PKCE check", err)
+	}
+	tokenParams.Set("code_verifier", testCodeVerifier)
+	if _, err := s.oauthToken(b, tokenRequest(tokenParams)); err == nil || err.(*OAuthError).Code != "invalid_grant" {
+		t.Fatal("expected code to be single use", err)
+	}
+
+	redirect, _ = url.Parse(again.RedirectURL)
+	tokenParams.Set("code", redirect.Query().Get("code"))
+	tokens, err := s.oauthToken(b, tokenRequest(tokenParams))
+	if err != nil || tokens.AccessToken == "" || tokens.IDToken == "" || tokens.RefreshToken == "" || tokens.Scope != "openid email profile" {
+		t.Fatal("expected tokens", err, tokens)
+	}
+
+	idToken := jwt.MapClaims{}
+	if err := s.keys.Parse(tokens.IDToken, idToken); err != nil || idToken["aud"] != client.ClientID || idToken["sub"] != "1" || idToken["nonce"] != "n-0S6" ||
+		idToken["email"] != "test@test.com" || idToken["fullName"] != "Test User" || idToken["iss"] != "https://auth.example.com" {
+		t.Fatal("expected id token", err, idToken)
+	}
+
+	// client tokens can't be used as a session and don't carry the profile, but can get userinfo
+	if _, err := s.getTokenSession(tokens.AccessToken); err == nil {
+		t.Fatal("expected client token to be rejected as a session")
+	}
+	accessToken := &accessTokenClaims{}
+	if err := s.keys.Parse(tokens.AccessToken, accessToken); err != nil || accessToken.Info != nil || accessToken.Email != "test@test.com" || accessToken.Subject != "1" {
+		t.Fatal("expected client token without info", err, accessToken)
+	}
+	info, err := s.oauthUserInfo(b, tokens.AccessToken)
+	if err != nil || info["sub"] != "1" || info["email"] != "test@test.com" || info["email_verified"] != true || info["fullName"] != "Test User" {
+		t.Fatal("expected user info", err, info)
+	}
+	user, _ := b.GetUser("test@test.com")
+	openIDOnly, _ := s.signAccessToken(user, client.ClientID, "openid")
+	if info, err := s.oauthUserInfo(b, openIDOnly); err != nil || info["sub"] != "1" || info["fullName"] != nil || info["email"] != nil {
+		t.Fatal("expected only the subject without the profile and email scopes", err, info)
+	}
+
+	refreshed, err := s.oauthToken(b, tokenRequest(url.Values{"grant_type": {"refresh_token"}, "client_id": {client.ClientID}, "refresh_token": {tokens.RefreshToken}}))
+	if err != nil || refreshed.AccessToken == "" || refreshed.IDToken == "" || refreshed.Scope != "openid email profile" {
+		t.Fatal("expected refresh", err, refreshed)
+	}
+	if _, err := s.refreshToken(b, refreshed.RefreshToken); err == nil {
+		t.Fatal("expected client refresh token to be rejected by token login")
+	}
+}
+
+func TestOAuthProfileClaims(t *testing.T) {
+	s, _, _ := getOAuthStore(t)
+	user := &User{UserID: "1", Email: "test@test.com", Info: map[string]interface{}{"fullName": "Test User", "plan": "pro", "fileQuota": 10,
+		InfoChannel: "web", InfoAvatarURL: "/uploads/a.png", "roles": []string{"admin"}, "email": "spoofed@test.com"}}
+	claims := s.userClaims(user, "openid profile")
+	if len(claims) != 3 || claims["fullName"] != "Test User" || claims["plan"] != "pro" || claims["fileQuota"] != 10 {
+		t.Error("expected every field but the system ones without a schema", claims)
+	}
+
+	s.conf.ProfileSchema, _ = ParseProfileSchema([]byte(`{"fields": [{"name": "fullName"}, {"name": "email"}, {"name": "plan", "access": "admin"}, {"name": "fileQuota", "type": "number", "access": "readOnly"}]}`))
+	claims = s.userClaims(user, "openid profile")
+	if len(claims) != 1 || claims["fullName"] != "Test User" {
+		t.Error("expected only the fields users set", claims)
+	}
+	if claims = s.userClaims(user, "openid email"); len(claims) != 2 || claims["email"] != "test@test.com" {
+		t.Error("expected email without profile", claims)
+	}
+}
+
+func TestOAuthAuthorizeErrors(t *testing.T) {
+	s, b, _ := getOAuthStore(t)
+	public := registerTestClient(t, s, b, "none")
+	params := url.Values{"response_type": {"code"}, "client_id": {public.ClientID}, "state": {"xyz"}, "code_challenge": {codeChallenge(testCodeVerifier)}, "code_challenge_method": {"S256"}}
+
+	bogus := url.Values{"response_type": {"code"}, "client_id": {"bogus"}}
+	if _, err := s.oauthAuthorize(nil, newAuthorizeRequest("GET", bogus), b); err == nil || err.(*OAuthError).RedirectURL != "" {
+		t.Fatal("expected unknown client to not be redirected", err)
+	}
+	wrongRedirect := url.Values{"response_type": {"code"}, "client_id": {public.ClientID}, "redirect_uri": {"https://evil.example.com/"}}
+	if _, err := s.oauthAuthorize(nil, newAuthorizeRequest("GET", wrongRedirect), b); err == nil || err.(*OAuthError).RedirectURL != "" {
+		t.Fatal("expected unregistered redirect to not be redirected", err)
+	}
+
+	tests := []struct {
+		name, value, code string
+	}{
+		{"response_type", "token", "unsupported_response_type"},
+		{"code_challenge", "", "invalid_request"},
+		{"code_challenge_method", "plain", "invalid_request"},
+		{"scope", "openid admin", "invalid_scope"},
+		{"prompt", "none", "consent_required"},
+	}
+	for _, test := range tests {
+		p := url.Values{}
+		for name, value := range params {
+			p[name] = value
+		}
+		p.Set(test.name, test.value)
+		_, err := s.oauthAuthorize(nil, newAuthorizeRequest("GET", p), b)
+		oauthErr, ok := err.(*OAuthError)
+		if !ok || oauthErr.Code != test.code || !strings.HasPrefix(oauthErr.RedirectURL, "https://app.example.com/callback?") || !strings.Contains(oauthErr.RedirectURL, "state=xyz") {
+			t.Error("expected redirected error", test, err)
+		}
+	}
+
+	deny := url.Values{"decision": {"deny"}}
+	for name, value := range params {
+		deny[name] = value
+	}
+	session, _ := s.getCookieSession(nil, &http.Request{}, b)
+	deny.Set("csrf_token", session.CSRFToken)
+	if _, err := s.oauthConsent(nil, newAuthorizeRequest("POST", deny), b); err == nil || err.(*OAuthError).Code != "access_denied" {
+		t.Error("expected access denied", err)
+	}
+
+	// not logged in
+	s.cookieStore = newMockCookieStore(nil, false, false)
+	if result, err := s.oauthAuthorize(nil, newAuthorizeRequest("GET", params), b); err != nil || !result.LoginRequired {
+		t.Error("expected login to be required", err, result)
+	}
+}
+
+func TestOAuthTokenClientAuthentication(t *testing.T) {
+	s, b, _ := getOAuthStore(t)
+	confidential := registerTestClient(t, s, b, "")
+	r := tokenRequest(url.Values{"grant_type": {"authorization_code"}, "code": {"bogus"}})
+	r.SetBasicAuth(confidential.ClientID, "wrong")
+	if _, err := s.oauthToken(b, r); err == nil || err.(*OAuthError).Code != "invalid_client" {
+		t.Fatal("expected invalid client", err)
+	}
+	r.SetBasicAuth(confidential.ClientID, confidential.ClientSecret)
+	if _, err := s.oauthToken(b, r); err == nil || err.(*OAuthError).Code != "invalid_grant" {
+		t.Fatal("expected client to authenticate", err)
+	}
+	r = tokenRequest(url.Values{"grant_type": {"password"}, "client_id": {confidential.ClientID}, "client_secret": {confidential.ClientSecret}})
+	if _, err := s.oauthToken(b, r); err == nil || err.(*OAuthError).Code != "unsupported_grant_type" {
+		t.Fatal("expected unsupported grant", err)
+	}
+}
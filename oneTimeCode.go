@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const oneTimeCodeExpireDuration time.Duration = 15 * time.Minute
+const oneTimeCodeMaxAttempts int = 5
+const oneTimeCodeAttemptBudget int = 10
+const oneTimeCodeAttemptBudgetDuration time.Duration = time.Hour
+const defaultOneTimeCodeLength int = 6
+const emailSessionPurposeOneTimeCode string = "oneTimeCode"
+
+var oneTimeCodeRegex = regexp.MustCompile(`^[0-9]{6,8}$`)
+
+func isOneTimeCode(code string) bool {
+	return oneTimeCodeRegex.MatchString(code)
+}
+
+// oneTimeCodeLength returns the configured code length, limited to 6-8 digits
+func (s *authStore) oneTimeCodeLength() int {
+	length := s.conf.OneTimeCodeLength
+	if length < defaultOneTimeCodeLength {
+		return defaultOneTimeCodeLength
+	}
+	if length > 8 {
+		return 8
+	}
+	return length
+}
+
+// oneTimeCodeHash is the email session key for a one-time code. Codes are short, so they are
+// bound to the email address and looked up by it rather than by the code itself
+func oneTimeCodeHash(email string) string {
+	return encodeToString(hash([]byte(emailSessionPurposeOneTimeCode + ":" + strings.ToLower(email))))
+}
+
+func generateOneTimeCode(length int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", length, n), nil
+}
+
+// addOneTimeCodeSession replaces any outstanding code for this email with a new one
+func (s *authStore) addOneTimeCodeSession(b Backender, userID, email string, info map[string]interface{}) (string, error) {
+	code, err := generateOneTimeCode(s.oneTimeCodeLength())
+	if err != nil {
+		return "", newLoggedError("Problem generating email confirmation code", err)
+	}
+	csrfToken, err := generateRandomString()
+	if err != nil {
+		return "", newLoggedError("Problem generating csrf token", err)
+	}
+
+	codeInfo := copyInfo(info)
+	codeInfo["codeHash"] = encodeToString(hash([]byte(code)))
+	session := &emailSession{userID, email, codeInfo, oneTimeCodeHash(email), csrfToken, emailSessionPurposeOneTimeCode, time.Now().UTC().Add(oneTimeCodeExpireDuration)}
+	if err := s.saveOneTimeCodeSession(b, session); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (s *authStore) saveOneTimeCodeSession(b Backender, session *emailSession) error {
+	b.DeleteEmailSession(session.EmailVerifyHash)
+	err := b.CreateEmailSessionWithExpire(session.UserID, session.Email, session.Info, session.EmailVerifyHash, session.CSRFToken, session.Purpose, session.ExpireTimeUTC)
+	if err != nil {
+		return newLoggedError("Problem saving email confirmation code", err)
+	}
+	return nil
+}
+
+// exchangeOneTimeCode checks the code sent to email and, if it matches, swaps it for a regular
+// email verification code so the rest of the verification flow is unchanged
+func (s *authStore) exchangeOneTimeCode(b Backender, email, code string) (string, error) {
+	if !isValidEmail(email) {
+		return "", newAuthError("Invalid email", nil)
+	}
+	session, err := b.GetEmailSession(oneTimeCodeHash(email))
+	if err != nil || session.Purpose != emailSessionPurposeOneTimeCode {
+		return "", newLoggedError("Invalid or expired verification code", err).withCode(ErrCodeInvalidCode)
+	}
+	if err := s.useOneTimeCode(b, session, code); err != nil {
+		return "", err
+	}
+	info := copyInfo(session.Info)
+	delete(info, "codeHash")
+	return s.addEmailSessionWithExpire(b, session.UserID, session.Email, info, "", time.Time{})
+}
+
+// useOneTimeCode deletes the session if the code matches the one it was created with. Guesses are counted in the
+// backend, up to oneTimeCodeMaxAttempts for each code and oneTimeCodeAttemptBudget an hour for the email or user the
+// session is for, so codes can't be guessed by sending guesses together or by asking for new codes
+func (s *authStore) useOneTimeCode(b Backender, session *emailSession, code string) error {
+	codeHash := GetInfoString(session.Info, "codeHash")
+	attempts, err := b.IncrementCodeAttempts(session.EmailVerifyHash+":"+codeHash, session.ExpireTimeUTC)
+	if err != nil {
+		return newLoggedError("Problem checking verification code", err)
+	}
+	budget, err := b.IncrementCodeAttempts(session.EmailVerifyHash, time.Now().UTC().Add(oneTimeCodeAttemptBudgetDuration))
+	if err != nil {
+		return newLoggedError("Problem checking verification code", err)
+	}
+
+	decoded, err := base64.URLEncoding.DecodeString(codeHash)
+	if attempts > oneTimeCodeMaxAttempts || budget > oneTimeCodeAttemptBudget || err != nil || !hashEquals([]byte(code), decoded) {
+		if attempts >= oneTimeCodeMaxAttempts || budget >= oneTimeCodeAttemptBudget {
+			b.DeleteEmailSession(session.EmailVerifyHash)
+			return newAuthError("Too many invalid attempts. Please request a new code", nil).withCode(ErrCodeTooManyAttempts)
+		}
+		return newAuthError("Invalid verification code", nil).withCode(ErrCodeInvalidCode)
+	}
+
+	if err := b.DeleteEmailSession(session.EmailVerifyHash); err != nil { // codes are single use
+		return newLoggedError("Problem using verification code", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGenerateOneTimeCode(t *testing.T) {
+	for length := 6; length <= 8; length++ {
+		code, err := generateOneTimeCode(length)
+		if err != nil || len(code) != length || !isOneTimeCode(code) {
+			t.Error("expected numeric code", length, code, err)
+		}
+	}
+	if isOneTimeCode("nfwRDzfxxJj2_HY-_mLz6jWyWU7bF0zUlIUUVkQgbZ0") || isOneTimeCode("12345") {
+		t.Error("expected only 6-8 digit codes to match")
+	}
+
+	s := &authStore{conf: AuthStoreConfig{OneTimeCodeLength: 12}}
+	if s.oneTimeCodeLength() != 8 {
+		t.Error("expected length to be limited to 8")
+	}
+}
+
+func TestRegisterAndVerifyOneTimeCode(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	m := &TextMailer{}
+	c := newMockCookieStore(nil, false, false)
+	s := &authStore{b: b, mailer: m, cookieStore: c, conf: AuthStoreConfig{OneTimeCodeLength: 8}}
+
+	err := s.register(&http.Request{}, b, EmailSendParams{Email: "test@test.com", Info: map[string]interface{}{"key": "value"}, UseOneTimeCode: true}, "")
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	if err != nil || len(code) != 8 || !isOneTimeCode(code) {
+		t.Fatal("expected numeric code to be emailed", err, code)
+	}
+
+	// code is bound to the email address
+	if _, _, err := s.verifyEmail(nil, &http.Request{}, b, EmailSendParams{Email: "other@test.com", VerificationCode: code}); err == nil || err.Error() != "Invalid or expired verification code" {
+		t.Fatal("expected code to be bound to email", err)
+	}
+
+	wrongCode := "00000000"
+	if code == wrongCode {
+		wrongCode = "11111111"
+	}
+	if _, _, err := s.verifyEmail(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com", VerificationCode: wrongCode}); err == nil || err.Error() != "Invalid verification code" {
+		t.Fatal("expected invalid code", err)
+	}
+
+	csrfToken, user, err := s.verifyEmail(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com", VerificationCode: code})
+	if err != nil || csrfToken == "" || user.Email != "test@test.com" || user.Info["key"] != "value" || user.Info["codeHash"] != nil {
+		t.Fatal("expected verification to succeed", err, user)
+	}
+	if cookie, ok := c.cookies[emailCookieName].(*emailCookie); !ok || isOneTimeCode(cookie.EmailVerificationCode) {
+		t.Fatal("expected email cookie to hold a full verification code", c.cookies[emailCookieName])
+	}
+
+	// single use
+	if _, _, err := s.verifyEmail(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com", VerificationCode: code}); err == nil {
+		t.Fatal("expected code to be single use")
+	}
+}
+
+func TestOneTimeCodeMaxAttempts(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	s := &authStore{b: b, mailer: &TextMailer{}, cookieStore: newMockCookieStore(nil, false, false)}
+	code, _ := s.addOneTimeCodeSession(b, "1", "test@test.com", nil)
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+	for i := 1; i < oneTimeCodeMaxAttempts; i++ {
+		if _, err := s.exchangeOneTimeCode(b, "test@test.com", wrongCode); err == nil || err.Error() != "Invalid verification code" {
+			t.Fatal("expected invalid code", i, err)
+		}
+	}
+	if _, err := s.exchangeOneTimeCode(b, "test@test.com", wrongCode); err == nil || err.Error() != "Too many invalid attempts. Please request a new code" {
+		t.Fatal("expected too many attempts", err)
+	}
+	if _, err := s.exchangeOneTimeCode(b, "test@test.com", code); err == nil {
+		t.Fatal("expected code to be discarded after too many attempts")
+	}
+}
+
+func TestOneTimeCodeAttemptBudget(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	s := &authStore{b: b, mailer: &TextMailer{}, cookieStore: newMockCookieStore(nil, false, false)}
+	var err error
+	for i := 0; i < oneTimeCodeAttemptBudget; i++ {
+		if i%(oneTimeCodeMaxAttempts-1) == 0 { // ask for a new code before each one is discarded
+			s.addOneTimeCodeSession(b, "1", "test@test.com", nil)
+		}
+		_, err = s.exchangeOneTimeCode(b, "test@test.com", "00000000")
+	}
+	if err == nil || ErrorCode(err) != ErrCodeTooManyAttempts {
+		t.Fatal("expected new codes to share the attempts", err)
+	}
+	code, _ := s.addOneTimeCodeSession(b, "1", "test@test.com", nil)
+	if _, err := s.exchangeOneTimeCode(b, "test@test.com", code); err == nil || ErrorCode(err) != ErrCodeTooManyAttempts {
+		t.Fatal("expected the right code to be refused once the attempts are used", err)
+	}
+	if code, _ := s.addOneTimeCodeSession(b, "2", "other@test.com", nil); !isOneTimeCode(code) {
+		t.Fatal("expected code")
+	} else if _, err := s.exchangeOneTimeCode(b, "other@test.com", code); err != nil {
+		t.Error("expected other emails to have their own attempts", err)
+	}
+}
+
+func TestVerifyPasswordResetOneTimeCode(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	m := &TextMailer{}
+	s := &authStore{b: b, mailer: m, cookieStore: newMockCookieStore(nil, false, false)}
+	b.AddUserFull("test@test.com", "password", map[string]interface{}{})
+
+	if err := s.requestPasswordReset(&http.Request{}, b, EmailSendParams{Email: "test@test.com", UseOneTimeCode: true}); err != nil {
+		t.Fatal("expected reset code to be sent", err)
+	}
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	csrfToken, user, err := s.verifyPasswordReset(nil, &http.Request{}, b, EmailSendParams{Email: "test@test.com", VerificationCode: code})
+	if err != nil || csrfToken == "" || user.Email != "test@test.com" {
+		t.Fatal("expected password reset to be verified", err, user)
+	}
+}
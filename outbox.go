@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultOutboxWorkers int = 2
+const defaultOutboxMaxAttempts int = 8
+const defaultOutboxRetryDelay time.Duration = 30 * time.Second
+const defaultOutboxMaxRetryDelay time.Duration = time.Hour
+const defaultOutboxPollInterval time.Duration = 5 * time.Second
+
+// defaultOutboxMaxAge is the lifetime of the shortest lived codes sent by email. Older emails would only carry
+// expired codes and links
+const defaultOutboxMaxAge time.Duration = 15 * time.Minute
+
+// outboxLeaseDuration is how long a claimed email is hidden from other workers. It must be longer than a delivery
+const outboxLeaseDuration time.Duration = 5 * time.Minute
+
+// outboxStoreDuration is how long a backend with expiring records keeps queued emails and dead letters
+const outboxStoreDuration time.Duration = 30 * 24 * time.Hour
+
+// Outbox is a Mailer which renders emails straight away but delivers them in the background, so a slow or
+// failing mail server doesn't fail registration or password resets. Emails are persisted in the session backend
+// until they are delivered. Failed deliveries are retried with exponential backoff. Emails which fail MaxAttempts
+// times, or which are still undelivered after MaxAge, become dead letters. Dead letters only keep the recipient and
+// subject, so codes and links aren't stored once they can't be sent, and are kept until they are discarded
+type Outbox struct {
+	Emailer       *Emailer
+	Workers       int
+	MaxAttempts   int
+	MaxAge        time.Duration
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	PollInterval  time.Duration
+
+	b        Backender
+	wake     chan struct{}
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// OutboxEmail describes a queued email without its content
+type OutboxEmail struct {
+	ID                 string    `json:"id"`
+	To                 string    `json:"to"`
+	Subject            string    `json:"subject"`
+	Attempts           int       `json:"attempts"`
+	LastError          string    `json:"lastError,omitempty"`
+	IsDead             bool      `json:"isDead"`
+	NextAttemptTimeUTC time.Time `json:"nextAttemptTimeUTC"`
+	CreatedTimeUTC     time.Time `json:"createdTimeUTC"`
+}
+
+// OutboxStatus counts the emails waiting for delivery and lists the dead letters
+type OutboxStatus struct {
+	Pending     int            `json:"pending"`
+	Retrying    int            `json:"retrying"`
+	Dead        int            `json:"dead"`
+	DeadLetters []*OutboxEmail `json:"deadLetters"`
+}
+
+// NewOutbox creates an Outbox which delivers with emailer and stores emails in b. Call Start to deliver them
+func NewOutbox(emailer *Emailer, b Backender) *Outbox {
+	return &Outbox{
+		Emailer:       emailer,
+		Workers:       defaultOutboxWorkers,
+		MaxAttempts:   defaultOutboxMaxAttempts,
+		MaxAge:        defaultOutboxMaxAge,
+		RetryDelay:    defaultOutboxRetryDelay,
+		MaxRetryDelay: defaultOutboxMaxRetryDelay,
+		PollInterval:  defaultOutboxPollInterval,
+		b:             b,
+		wake:          make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+	}
+}
+
+// SendMessage renders the email and queues it. Template errors are returned, delivery errors are retried
+func (o *Outbox) SendMessage(to, templateName, emailSubject string, data interface{}) error {
+	m, err := o.Emailer.render(to, templateName, emailSubject, data)
+	if err != nil {
+		return err
+	}
+	id, err := generateRandomString()
+	if err != nil {
+		return err
+	}
+	b := o.b.Clone()
+	defer b.Close()
+	now := time.Now().UTC()
+	if err := b.QueueEmail(&queuedEmail{ID: id, Message: m, NextAttemptTimeUTC: now, CreatedTimeUTC: now}); err != nil {
+		return newLoggedError("Unable to queue email", err)
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start delivers queued emails with Workers goroutines until Shutdown is called
+func (o *Outbox) Start() {
+	for i := 0; i < o.Workers; i++ {
+		o.wg.Add(1)
+		go o.work()
+	}
+}
+
+// Shutdown stops claiming emails and waits for deliveries in progress to finish, or for ctx to be done. Emails
+// which haven't been delivered stay queued for the next start
+func (o *Outbox) Shutdown(ctx context.Context) error {
+	o.stopOnce.Do(func() { close(o.quit) })
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status counts the queued emails and lists the dead letters, oldest first
+func (o *Outbox) Status() (*OutboxStatus, error) {
+	b := o.b.Clone()
+	defer b.Close()
+	emails, err := b.GetQueuedEmails()
+	if err != nil {
+		return nil, newLoggedError("Unable to get queued emails", err)
+	}
+	status := &OutboxStatus{DeadLetters: []*OutboxEmail{}}
+	for _, email := range emails {
+		switch {
+		case email.IsDead:
+			status.Dead++
+			status.DeadLetters = append(status.DeadLetters, email.summary())
+		case email.Attempts > 0:
+			status.Retrying++
+			fallthrough
+		default:
+			status.Pending++
+		}
+	}
+	return status, nil
+}
+
+// Discard deletes a dead letter
+func (o *Outbox) Discard(id string) error {
+	b := o.b.Clone()
+	defer b.Close()
+	if _, err := o.getDeadLetter(b, id); err != nil {
+		return err
+	}
+	if err := b.DeleteQueuedEmail(id); err != nil {
+		return newLoggedError("Unable to discard email", err)
+	}
+	return nil
+}
+
+func (o *Outbox) getDeadLetter(b Backender, id string) (*queuedEmail, error) {
+	emails, err := b.GetQueuedEmails()
+	if err != nil {
+		return nil, newLoggedError("Unable to get queued emails", err)
+	}
+	for _, email := range emails {
+		if email.ID == id && email.IsDead {
+			return email, nil
+		}
+	}
+	return nil, newAuthError("Dead letter not found", errQueuedEmailNotFound)
+}
+
+func (o *Outbox) work() {
+	defer o.wg.Done()
+	for {
+		select {
+		case <-o.quit:
+			return
+		default:
+		}
+		if o.deliverNext() {
+			continue
+		}
+		select {
+		case <-o.quit:
+			return
+		case <-o.wake:
+		case <-time.After(o.PollInterval):
+		}
+	}
+}
+
+// deliverNext sends the email due the longest. It returns false when there was none, so the worker can wait
+func (o *Outbox) deliverNext() bool {
+	b := o.b.Clone()
+	defer b.Close()
+	now := time.Now().UTC()
+	email, err := b.ClaimEmail(now, now.Add(outboxLeaseDuration))
+	if err == errQueuedEmailNotFound {
+		return false
+	} else if err != nil {
+		log.Println("Unable to claim queued email:", err)
+		return false
+	}
+
+	if now.Sub(email.CreatedTimeUTC) > o.MaxAge {
+		email.LastError = "Expired before it could be delivered"
+		o.giveUp(email)
+	} else if err = o.Emailer.send(email.Message); err == nil {
+		if err := b.DeleteQueuedEmail(email.ID); err != nil {
+			log.Println("Unable to delete delivered email", email.ID, err)
+		}
+		return true
+	} else {
+		email.Attempts++
+		email.LastError = err.Error()
+		if email.Attempts >= o.MaxAttempts {
+			o.giveUp(email)
+		} else {
+			email.NextAttemptTimeUTC = time.Now().UTC().Add(o.retryDelay(email.Attempts))
+		}
+	}
+	if err := b.UpdateQueuedEmail(email); err != nil {
+		log.Println("Unable to update queued email", email.ID, err)
+	}
+	return true
+}
+
+// retryDelay doubles RetryDelay for each failed attempt, up to MaxRetryDelay
+func (o *Outbox) retryDelay(attempts int) time.Duration {
+	delay := o.RetryDelay
+	for i := 1; i < attempts && delay < o.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxRetryDelay {
+		return o.MaxRetryDelay
+	}
+	return delay
+}
+
+// giveUp makes the email a dead letter and drops its body, which may hold codes and links
+func (o *Outbox) giveUp(email *queuedEmail) {
+	email.IsDead = true
+	email.Message = &Message{To: email.Message.To, Subject: email.Message.Subject}
+	log.Println("Giving up on email", email.ID, "to", email.Message.To, "after", email.Attempts, "attempts:", email.LastError)
+}
+
+func (e *queuedEmail) summary() *OutboxEmail {
+	summary := &OutboxEmail{ID: e.ID, Attempts: e.Attempts, LastError: e.LastError, IsDead: e.IsDead,
+		NextAttemptTimeUTC: e.NextAttemptTimeUTC, CreatedTimeUTC: e.CreatedTimeUTC}
+	if e.Message != nil {
+		summary.To = e.Message.To
+		summary.Subject = e.Message.Subject
+	}
+	return summary
+}
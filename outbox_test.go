@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxDelivers(t *testing.T) {
+	sender := &flakySender{}
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	o := newTestOutbox(sender, b)
+	if err := o.SendMessage("to@test.com", "missing", "Subject", nil); err == nil || len(b.Outbox) != 0 {
+		t.Error("expected template error before queueing", err)
+	}
+	if err := o.SendMessage("to@test.com", "verifyEmail.html", "Subject", EmailSendParams{Email: "to@test.com"}); err != nil || len(b.Outbox) != 1 {
+		t.Fatal("expected queued email", err)
+	}
+	if sender.count() != 0 {
+		t.Error("expected delivery to wait for a worker")
+	}
+
+	o.Start()
+	waitFor(t, func() bool { return sender.count() == 1 })
+	if err := o.Shutdown(context.Background()); err != nil {
+		t.Error("expected shutdown", err)
+	}
+	emails, _ := b.GetQueuedEmails()
+	if len(emails) != 0 || sender.last().HTMLBody != "email:to@test.com" || sender.last().Subject != "Subject" {
+		t.Error("expected delivered email to be removed", emails, sender.last())
+	}
+	if err := o.Shutdown(context.Background()); err != nil {
+		t.Error("expected second shutdown to be a no-op", err)
+	}
+}
+
+func TestOutboxRetriesAndDeadLetters(t *testing.T) {
+	sender := &flakySender{failures: 100}
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	o := newTestOutbox(sender, b)
+	o.MaxAttempts = 3
+	o.SendMessage("to@test.com", "verifyEmail.html", "Subject", EmailSendParams{Email: "to@test.com"})
+
+	for i := 1; i <= 3; i++ {
+		b.Outbox[0].NextAttemptTimeUTC = time.Now().UTC() // skip the backoff
+		if !o.deliverNext() || b.Outbox[0].Attempts != i || b.Outbox[0].LastError != "unavailable" {
+			t.Fatal("expected failed attempt", i, b.Outbox[0])
+		}
+	}
+	if !b.Outbox[0].IsDead || o.deliverNext() {
+		t.Error("expected dead letter which isn't claimed again", b.Outbox[0])
+	}
+
+	status, err := o.Status()
+	if err != nil || status.Dead != 1 || status.Pending != 0 || len(status.DeadLetters) != 1 || status.DeadLetters[0].To != "to@test.com" || status.DeadLetters[0].Attempts != 3 {
+		t.Error("expected dead letter status", status, err)
+	}
+
+	if b.Outbox[0].Message.To != "to@test.com" || b.Outbox[0].Message.HTMLBody != "" || b.Outbox[0].Message.TextBody != "" {
+		t.Error("expected dead letter to drop its body", b.Outbox[0].Message)
+	}
+	if err := o.Discard("unknown"); ErrorCode(err) != ErrCodeNotFound {
+		t.Error("expected not found", err)
+	}
+}
+
+func TestOutboxExpires(t *testing.T) {
+	sender := &flakySender{}
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	o := newTestOutbox(sender, b)
+	o.SendMessage("to@test.com", "verifyEmail.html", "Subject", EmailSendParams{Email: "to@test.com"})
+	if err := o.Discard(b.Outbox[0].ID); ErrorCode(err) != ErrCodeNotFound {
+		t.Error("expected only dead letters to be discarded", err)
+	}
+
+	b.Outbox[0].CreatedTimeUTC = time.Now().UTC().Add(-o.MaxAge - time.Second)
+	if !o.deliverNext() || sender.count() != 0 || !b.Outbox[0].IsDead || b.Outbox[0].Message.HTMLBody != "" {
+		t.Error("expected expired email to become a dead letter without being sent", sender.count(), b.Outbox[0])
+	}
+	if b.Outbox[0].Attempts != 0 || b.Outbox[0].LastError != "Expired before it could be delivered" {
+		t.Error("expected expired error", b.Outbox[0])
+	}
+}
+
+func TestOutboxRetryDelay(t *testing.T) {
+	o := NewOutbox(nil, nil)
+	o.RetryDelay = time.Second
+	o.MaxRetryDelay = 10 * time.Second
+	tests := []struct {
+		Attempts int
+		Delay    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if delay := o.retryDelay(test.Attempts); delay != test.Delay {
+			t.Errorf("expected %v after %d attempts, got %v", test.Delay, test.Attempts, delay)
+		}
+	}
+}
+
+func TestOutboxDiscard(t *testing.T) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	o := newTestOutbox(&flakySender{}, b)
+	b.QueueEmail(&queuedEmail{ID: "dead", Message: &Message{To: "to@test.com"}, IsDead: true})
+	b.QueueEmail(&queuedEmail{ID: "pending", Message: &Message{To: "to@test.com"}, Attempts: 1})
+	status, err := o.Status()
+	if err != nil || status.Pending != 1 || status.Retrying != 1 || status.Dead != 1 {
+		t.Error("expected status", status, err)
+	}
+	if err := o.Discard("dead"); err != nil || len(b.Outbox) != 1 || b.Outbox[0].ID != "pending" {
+		t.Error("expected dead letter to be discarded", err, b.Outbox)
+	}
+}
+
+func TestOutboxShutdownTimeout(t *testing.T) {
+	o := NewOutbox(nil, nil)
+	o.wg.Add(1) // a delivery which doesn't finish
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := o.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("expected deadline", err)
+	}
+}
+
+/***************************************************************************************/
+
+func newTestOutbox(sender sender, b Backender) *Outbox {
+	emailer := &Emailer{Sender: sender, TemplateCache: template.Must(template.New("verifyEmail.html").Parse(verifyEmailTmpl))}
+	o := NewOutbox(emailer, b)
+	o.PollInterval = time.Millisecond
+	return o
+}
+
+func waitFor(t *testing.T, done func() bool) {
+	for i := 0; i < 1000; i++ {
+		if done() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+type flakySender struct {
+	sync.Mutex
+	failures int
+	sent     []*Message
+}
+
+func (s *flakySender) Send(to, subject, body string) error {
+	return s.SendMultipart(&Message{To: to, Subject: subject, HTMLBody: body})
+}
+
+func (s *flakySender) SendMultipart(m *Message) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sent = append(s.sent, m)
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (s *flakySender) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sent)
+}
+
+func (s *flakySender) last() *Message {
+	s.Lock()
+	defer s.Unlock()
+	return s.sent[len(s.sent)-1]
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const emailSessionPurposeVerifyPhone string = "verifyPhone"
+
+// phone verification codes are rate limited for each user since every one is a paid text message
+const phoneCodeResendInterval time.Duration = time.Minute
+const phoneCodeMaxSends int = 5
+const phoneCodeMaxSendsDuration time.Duration = time.Hour
+
+// phoneNumberRegex matches E.164 numbers, e.g. +14155550123
+var phoneNumberRegex = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// phoneNumberSeparators are left out of phone numbers, so they can be entered as they are usually written
+var phoneNumberSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// normalizePhoneNumber returns the number in E.164 format, or "" when it isn't valid
+func normalizePhoneNumber(phoneNumber string) string {
+	phoneNumber = phoneNumberSeparators.Replace(phoneNumber)
+	if strings.HasPrefix(phoneNumber, "00") {
+		phoneNumber = "+" + phoneNumber[2:]
+	}
+	if !phoneNumberRegex.MatchString(phoneNumber) {
+		return ""
+	}
+	return phoneNumber
+}
+
+// phoneCodeHash is the email session key for a phone verification code. Each user has one outstanding code
+func phoneCodeHash(userID string) string {
+	return encodeToString(hash([]byte(emailSessionPurposeVerifyPhone + ":" + userID)))
+}
+
+// RequestPhoneVerification sends a code by SMS to the phone number of the logged in user. The number is only saved
+// once VerifyPhone is called with the code. Users can ask for a code once a minute and five times an hour.
+// params.TemplateSuccess names the template, e.g. verifyPhone.sms
+func (s *authStore) RequestPhoneVerification(w http.ResponseWriter, r *http.Request, phoneNumber string, params EmailSendParams) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.requestPhoneVerification(w, r, b, phoneNumber, params)
+}
+
+func (s *authStore) requestPhoneVerification(w http.ResponseWriter, r *http.Request, b Backender, phoneNumber string, params EmailSendParams) error {
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return err
+	}
+	sms, ok := s.conf.Channels[ChannelSMS]
+	if !ok {
+		return newAuthError("SMS is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	phoneNumber = normalizePhoneNumber(phoneNumber)
+	if phoneNumber == "" {
+		return newAuthError("Invalid phone number. Please include the country code, e.g. +14155550123", nil)
+	}
+	if err := s.checkPhoneCodeSends(b, session.UserID); err != nil {
+		return err
+	}
+
+	code, err := generateOneTimeCode(s.oneTimeCodeLength())
+	if err != nil {
+		return newLoggedError("Problem generating phone verification code", err)
+	}
+	csrfToken, err := generateRandomString()
+	if err != nil {
+		return newLoggedError("Problem generating csrf token", err)
+	}
+	info := map[string]interface{}{"phoneNumber": phoneNumber, "codeHash": encodeToString(hash([]byte(code)))}
+	codeSession := &emailSession{session.UserID, session.Email, info, phoneCodeHash(session.UserID), csrfToken, emailSessionPurposeVerifyPhone, time.Now().UTC().Add(oneTimeCodeExpireDuration)}
+	if err := s.saveOneTimeCodeSession(b, codeSession); err != nil {
+		return err
+	}
+
+	params.VerificationCode = code
+	params.Email = session.Email
+	params.Info = copyInfo(session.Info)
+	params.Locale = userLocale(session.Info, params.Locale)
+	if err := sms.Notify(&Recipient{Email: session.Email, PhoneNumber: phoneNumber}, params.TemplateSuccess, params.SubjectSuccess, params); err != nil {
+		return newLoggedError("Unable to send phone verification code", err)
+	}
+	return nil
+}
+
+// checkPhoneCodeSends counts a phone verification code sent to the user, returning an error when they have asked
+// for too many
+func (s *authStore) checkPhoneCodeSends(b Backender, userID string) error {
+	now := time.Now().UTC()
+	recent, err := b.IncrementCodeAttempts(phoneCodeHash(userID)+":recent", now.Add(phoneCodeResendInterval))
+	if err != nil {
+		return newLoggedError("Unable to send phone verification code", err)
+	}
+	if recent > 1 {
+		return newAuthError("Please wait a minute before asking for another code", nil).withCode(ErrCodeTooManyAttempts)
+	}
+	sends, err := b.IncrementCodeAttempts(phoneCodeHash(userID)+":sends", now.Add(phoneCodeMaxSendsDuration))
+	if err != nil {
+		return newLoggedError("Unable to send phone verification code", err)
+	}
+	if sends > phoneCodeMaxSends {
+		return newAuthError("Too many codes requested. Please try again later", nil).withCode(ErrCodeTooManyAttempts)
+	}
+	return nil
+}
+
+// VerifyPhone saves the phone number of the logged in user, marked verified, when the code is the one sent to it
+func (s *authStore) VerifyPhone(w http.ResponseWriter, r *http.Request, code string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.verifyPhone(w, r, b, code)
+}
+
+func (s *authStore) verifyPhone(w http.ResponseWriter, r *http.Request, b Backender, code string) error {
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return err
+	}
+	codeSession, err := b.GetEmailSession(phoneCodeHash(session.UserID))
+	if err != nil || codeSession.Purpose != emailSessionPurposeVerifyPhone {
+		return newLoggedError("Invalid or expired verification code", err).withCode(ErrCodeInvalidCode)
+	}
+	if err := s.useOneTimeCode(b, codeSession, code); err != nil {
+		return err
+	}
+	if err := b.VerifyPhoneNumber(session.UserID, GetInfoString(codeSession.Info, "phoneNumber")); err != nil {
+		return newLoggedError("Unable to verify phone number", err)
+	}
+	return nil
+}
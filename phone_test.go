@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	texttemplate "text/template"
+)
+
+func getSMSStore() (*authStore, *backendMemory, *SMSStub, string) {
+	s, b := getTokenStore()
+	stub := &SMSStub{}
+	templates := texttemplate.Must(texttemplate.New("").Parse(`{{define "verifyPhone.sms"}}Your code is {{.VerificationCode}}{{end}}` +
+		`{{define "passwordReset.sms"}}Reset at {{.BaseURL}}/reset?code={{.VerificationCode}}{{end}}`))
+	s.conf.Channels = map[string]Channel{ChannelSMS: &SMSChannel{Provider: stub, TemplateCache: templates}}
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	return s, b, stub, tokens.AccessToken
+}
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := map[string]string{"+1 (415) 555-0123": "+14155550123", "0044 20 7946 0958": "+442079460958", "+33.6.12.34.56.78": "+33612345678",
+		"4155550123": "", "+0123456789": "", "+1415": "", "+1415555012345678": "", "+1 415 CALL NOW": ""}
+	for number, expected := range tests {
+		if actual := normalizePhoneNumber(number); actual != expected {
+			t.Error("expected", expected, "for", number, "got", actual)
+		}
+	}
+}
+
+func TestVerifyPhone(t *testing.T) {
+	s, b, stub, accessToken := getSMSStore()
+	r := bearerRequest(accessToken)
+	if err := s.requestPhoneVerification(nil, r, b, "+1 415 555", EmailSendParams{TemplateSuccess: "verifyPhone.sms"}); err == nil {
+		t.Error("expected invalid number error")
+	}
+	if err := s.requestPhoneVerification(nil, r, b, "+1 (415) 555-0123", EmailSendParams{TemplateSuccess: "verifyPhone.sms"}); err != nil {
+		t.Fatal("expected code to be sent", err)
+	}
+	sms := stub.Latest("+14155550123")
+	if sms == nil || !strings.HasPrefix(sms.Body, "Your code is ") {
+		t.Fatal("expected SMS with code", sms)
+	}
+	if u, _ := b.GetUserByID("1"); u.PhoneNumber != "" || u.IsPhoneVerified {
+		t.Fatal("expected number to be saved only once verified", u)
+	}
+
+	if err := s.verifyPhone(nil, r, b, "000000"); err == nil || ErrorCode(err) != ErrCodeInvalidCode {
+		t.Error("expected wrong code to fail", err)
+	}
+	if err := s.verifyPhone(nil, r, b, strings.TrimPrefix(sms.Body, "Your code is ")); err != nil {
+		t.Fatal("expected phone to be verified", err)
+	}
+	if u, _ := b.GetUserByID("1"); u.PhoneNumber != "+14155550123" || !u.IsPhoneVerified {
+		t.Error("expected verified number", u)
+	}
+	if err := s.verifyPhone(nil, r, b, strings.TrimPrefix(sms.Body, "Your code is ")); err == nil {
+		t.Error("expected code to be single use")
+	}
+
+	// asking for another number keeps the verified one until its code is entered
+	if err := s.requestPhoneVerification(nil, r, b, "+14155550199", EmailSendParams{TemplateSuccess: "verifyPhone.sms"}); err == nil || ErrorCode(err) != ErrCodeTooManyAttempts {
+		t.Fatal("expected codes to be sent once a minute", err)
+	}
+	waitResendInterval(b)
+	if err := s.requestPhoneVerification(nil, r, b, "+14155550199", EmailSendParams{TemplateSuccess: "verifyPhone.sms"}); err != nil {
+		t.Fatal("expected code to be sent", err)
+	}
+	if u, _ := b.GetUserByID("1"); u.PhoneNumber != "+14155550123" || !u.IsPhoneVerified {
+		t.Error("expected verified number to be kept", u)
+	}
+	if err := s.verifyPhone(nil, r, b, strings.TrimPrefix(stub.Latest("+14155550199").Body, "Your code is ")); err != nil {
+		t.Fatal("expected new number to be verified", err)
+	}
+	if u, _ := b.GetUserByID("1"); u.PhoneNumber != "+14155550199" || !u.IsPhoneVerified {
+		t.Error("expected new number", u)
+	}
+
+	for i := 2; i < phoneCodeMaxSends; i++ {
+		waitResendInterval(b)
+		if err := s.requestPhoneVerification(nil, r, b, "+14155550123", EmailSendParams{TemplateSuccess: "verifyPhone.sms"}); err != nil {
+			t.Fatal("expected code to be sent", i, err)
+		}
+	}
+	waitResendInterval(b)
+	if err := s.requestPhoneVerification(nil, r, b, "+14155550123", EmailSendParams{TemplateSuccess: "verifyPhone.sms"}); err == nil || ErrorCode(err) != ErrCodeTooManyAttempts {
+		t.Error("expected codes to be limited each hour", err)
+	}
+
+	s.conf.Channels = nil
+	if err := s.requestPhoneVerification(nil, r, b, "+14155550123", EmailSendParams{}); err == nil || ErrorCode(err) != ErrCodeNotEnabled {
+		t.Error("expected SMS not enabled", err)
+	}
+}
+
+// waitResendInterval lets the next phone verification code be sent
+func waitResendInterval(b *backendMemory) {
+	for _, attempts := range b.CodeAttempts {
+		if strings.HasSuffix(attempts.Key, ":recent") {
+			attempts.ExpireTimeUTC = pastTime
+		}
+	}
+}
+
+func TestSetChannel(t *testing.T) {
+	s, b, stub, accessToken := getSMSStore()
+	r := bearerRequest(accessToken)
+	if err := s.setChannel(nil, r, b, "pigeon"); err == nil {
+		t.Error("expected unknown channel error")
+	}
+	if err := s.setChannel(nil, r, b, ChannelSMS); err == nil {
+		t.Error("expected unverified phone error")
+	}
+	b.VerifyPhoneNumber("1", "+14155550123")
+	if err := s.setChannel(nil, r, b, ChannelSMS); err != nil {
+		t.Fatal("expected channel to be saved", err)
+	}
+
+	// password resets go by SMS, messages without an SMS template by email
+	mailer := s.mailer.(*TextMailer)
+	if err := s.requestPasswordReset(r, b, EmailSendParams{Email: "test@test.com", BaseURL: "https://example.com", TemplateSuccess: "passwordReset.html", UseOneTimeCode: true}); err != nil {
+		t.Fatal(err)
+	}
+	if sms := stub.Latest("+14155550123"); sms == nil || !strings.HasPrefix(sms.Body, "Reset at https://example.com/reset?code=") || mailer.MessageTo != "" {
+		t.Fatal("expected password reset by SMS", sms, mailer.MessageTo)
+	}
+	s.conf.PasswordChangedTemplate = "passwordChanged.html"
+	s.sendPasswordChanged(r, b, "1", "test@test.com", nil)
+	if mailer.MessageTo != "test@test.com" || len(stub.Messages("")) != 1 {
+		t.Error("expected email without SMS template", mailer.MessageTo)
+	}
+
+	if err := s.setChannel(nil, r, b, ChannelEmail); err != nil {
+		t.Fatal(err)
+	}
+	s.requestPasswordReset(r, b, EmailSendParams{Email: "test@test.com", TemplateSuccess: "passwordReset.html", UseOneTimeCode: true})
+	if len(stub.Messages("")) != 1 {
+		t.Error("expected email once the user chose it")
+	}
+}
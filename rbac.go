@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RoleAdmin is built in and grants every permission, including PermissionAdmin
+const RoleAdmin string = "admin"
+
+// PermissionAdmin is required to manage roles and assign them to users
+const PermissionAdmin string = "auth:admin"
+
+// permissionAll can be granted to a role to give it every permission
+const permissionAll string = "*"
+
+var roleNameRegex = regexp.MustCompile(`^[A-Za-z0-9:._/-]{1,64}$`)
+
+type userRolesRequest struct {
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+// Authorize returns an error unless the session's user has at least one of roles and every one of permissions.
+// Sessions from API keys with scopes only get the permissions of the user's roles which are also in their scopes,
+// and only count roles whose permissions are all in their scopes
+func (s *authStore) Authorize(session *LoginSession, roles, permissions []string) error {
+	if len(roles) == 0 && len(permissions) == 0 {
+		return nil
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.authorize(b, session, roles, permissions)
+}
+
+func (s *authStore) authorize(b Backender, session *LoginSession, roles, permissions []string) error {
+	if session == nil || session.UserID == "" {
+		return newAuthError("Not authorized", nil).withCode(ErrCodeForbidden)
+	}
+	userRoles, err := b.GetUserRoles(session.UserID)
+	if err != nil {
+		return newLoggedError("Unable to get user roles", err)
+	}
+	if len(roles) > 0 {
+		if !containsAny(userRoles, roles) {
+			return newAuthError("Not authorized. Requires role: "+strings.Join(roles, " or "), nil).withCode(ErrCodeForbidden)
+		}
+		if len(session.Scopes) > 0 {
+			scoped, err := s.scopedRoles(b, userRoles, session.Scopes)
+			if err != nil {
+				return err
+			}
+			if !containsAny(scoped, roles) {
+				return newAuthError("Not authorized. API key scopes don't cover role: "+strings.Join(roles, " or "), nil).withCode(ErrCodeForbidden)
+			}
+		}
+	}
+	if len(permissions) == 0 {
+		return nil
+	}
+
+	granted, err := s.grantedPermissions(b, userRoles)
+	if err != nil {
+		return err
+	}
+	if len(session.Scopes) > 0 {
+		granted = scopedPermissions(granted, session.Scopes)
+	}
+	for _, permission := range permissions {
+		if !granted[permission] && !granted[permissionAll] {
+			if len(session.Scopes) > 0 && !contains(session.Scopes, permission) {
+				return newAuthError("Not authorized. API key scopes don't include: "+permission, nil).withCode(ErrCodeForbidden)
+			}
+			return newAuthError("Not authorized. Requires permission: "+permission, nil).withCode(ErrCodeForbidden)
+		}
+	}
+	return nil
+}
+
+// scopedPermissions returns the granted permissions which are also in scopes
+func scopedPermissions(granted map[string]bool, scopes []string) map[string]bool {
+	scoped := make(map[string]bool)
+	for _, scope := range scopes {
+		if granted[scope] || granted[permissionAll] {
+			scoped[scope] = true
+		}
+	}
+	return scoped
+}
+
+// scopedRoles returns the roles of userRoles whose permissions are all in scopes. The admin role needs
+// PermissionAdmin in scopes
+func (s *authStore) scopedRoles(b Backender, userRoles, scopes []string) ([]string, error) {
+	roles, err := b.GetRoles()
+	if err != nil {
+		return nil, newLoggedError("Unable to get roles", err)
+	}
+	var scoped []string
+	for _, name := range userRoles {
+		if name == RoleAdmin {
+			if contains(scopes, PermissionAdmin) {
+				scoped = append(scoped, name)
+			}
+			continue
+		}
+		for _, role := range roles {
+			if role.Name == name && containsAll(scopes, role.Permissions) {
+				scoped = append(scoped, name)
+			}
+		}
+	}
+	return scoped, nil
+}
+
+// GetSessionRoles returns the roles of the session's user so they can be passed on to upstream servers
+func (s *authStore) GetSessionRoles(session *LoginSession) ([]string, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	roles, err := b.GetUserRoles(session.UserID)
+	if err != nil {
+		return nil, newLoggedError("Unable to get user roles", err)
+	}
+	return roles, nil
+}
+
+// grantedPermissions returns the permissions from all of userRoles
+func (s *authStore) grantedPermissions(b Backender, userRoles []string) (map[string]bool, error) {
+	if contains(userRoles, RoleAdmin) {
+		return map[string]bool{permissionAll: true}, nil
+	}
+	roles, err := b.GetRoles()
+	if err != nil {
+		return nil, newLoggedError("Unable to get roles", err)
+	}
+	granted := make(map[string]bool)
+	for _, role := range roles {
+		if contains(userRoles, role.Name) {
+			for _, permission := range role.Permissions {
+				granted[permission] = true
+			}
+		}
+	}
+	return granted, nil
+}
+
+// requireAdmin returns the session of a logged in user with PermissionAdmin
+func (s *authStore) requireAdmin(w http.ResponseWriter, r *http.Request, b Backender) (*LoginSession, error) {
+	session, err := s.getSession(w, r, b)
+	if err != nil {
+		return nil, err
+	}
+	return session, s.authorize(b, session, nil, []string{PermissionAdmin})
+}
+
+func (s *authStore) GetRoles(w http.ResponseWriter, r *http.Request) ([]*Role, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.getRoles(w, r, b)
+}
+
+func (s *authStore) getRoles(w http.ResponseWriter, r *http.Request, b Backender) ([]*Role, error) {
+	if _, err := s.requireAdmin(w, r, b); err != nil {
+		return nil, err
+	}
+	roles, err := b.GetRoles()
+	if err != nil {
+		return nil, newLoggedError("Unable to get roles", err)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return append([]*Role{{Name: RoleAdmin, Permissions: []string{permissionAll}}}, roles...), nil
+}
+
+func (s *authStore) SaveRole(w http.ResponseWriter, r *http.Request) (*Role, error) {
+	role := &Role{}
+	if err := getJSON(r, role); err != nil {
+		return nil, newAuthError("Unable to get role", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.saveRole(w, r, b, role)
+}
+
+func (s *authStore) saveRole(w http.ResponseWriter, r *http.Request, b Backender, role *Role) (*Role, error) {
+	if _, err := s.requireAdmin(w, r, b); err != nil {
+		return nil, err
+	}
+	if !roleNameRegex.MatchString(role.Name) {
+		return nil, newAuthError("Invalid role name", nil)
+	}
+	if role.Name == RoleAdmin {
+		return nil, newAuthError("The admin role can't be changed", nil).withCode(ErrCodeForbidden)
+	}
+	for _, permission := range role.Permissions {
+		if permission != permissionAll && !roleNameRegex.MatchString(permission) {
+			return nil, newAuthError("Invalid permission: "+permission, nil)
+		}
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	if err := b.SaveRole(role); err != nil {
+		return nil, newLoggedError("Unable to save role", err)
+	}
+	return role, nil
+}
+
+func (s *authStore) DeleteRole(w http.ResponseWriter, r *http.Request, name string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.deleteRole(w, r, b, name)
+}
+
+// deleteRole removes the role's permissions. Users who were assigned the role keep the name, which grants nothing
+func (s *authStore) deleteRole(w http.ResponseWriter, r *http.Request, b Backender, name string) error {
+	if _, err := s.requireAdmin(w, r, b); err != nil {
+		return err
+	}
+	if name == RoleAdmin {
+		return newAuthError("The admin role can't be deleted", nil).withCode(ErrCodeForbidden)
+	}
+	if err := b.DeleteRole(name); err != nil {
+		return newLoggedError("Unable to delete role", err)
+	}
+	return nil
+}
+
+func (s *authStore) GetUserRoles(w http.ResponseWriter, r *http.Request, email string) ([]string, error) {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.getUserRoles(w, r, b, email)
+}
+
+func (s *authStore) getUserRoles(w http.ResponseWriter, r *http.Request, b Backender, email string) ([]string, error) {
+	if _, err := s.requireAdmin(w, r, b); err != nil {
+		return nil, err
+	}
+	user, err := b.GetUser(email)
+	if err != nil {
+		return nil, newLoggedError("User not found", err)
+	}
+	roles, err := b.GetUserRoles(user.UserID)
+	if err != nil {
+		return nil, newLoggedError("Unable to get user roles", err)
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	return roles, nil
+}
+
+func (s *authStore) SetUserRoles(w http.ResponseWriter, r *http.Request) error {
+	request := &userRolesRequest{}
+	if err := getJSON(r, request); err != nil {
+		return newAuthError("Unable to get user roles", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.setUserRoles(w, r, b, request.Email, request.Roles)
+}
+
+func (s *authStore) setUserRoles(w http.ResponseWriter, r *http.Request, b Backender, email string, roles []string) error {
+	if _, err := s.requireAdmin(w, r, b); err != nil {
+		return err
+	}
+	user, err := b.GetUser(email)
+	if err != nil {
+		return newLoggedError("User not found", err)
+	}
+	defined, err := b.GetRoles()
+	if err != nil {
+		return newLoggedError("Unable to get roles", err)
+	}
+	for _, role := range roles {
+		if role != RoleAdmin && !hasRole(defined, role) {
+			return newAuthError("Unknown role: "+role, nil)
+		}
+	}
+	if err := b.UpdateUserRoles(user.UserID, roles); err != nil {
+		return newLoggedError("Unable to update user roles", err)
+	}
+	return nil
+}
+
+func hasRole(roles []*Role, name string) bool {
+	for _, role := range roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values, find []string) bool {
+	for _, value := range find {
+		if contains(values, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(values, find []string) bool {
+	for _, value := range find {
+		if !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"testing"
+)
+
+func getRBACStore(t *testing.T) (*authStore, *backendMemory, string) {
+	s, b := getTokenStore()
+	b.AddUserFull("admin@test.com", "password", nil)
+	b.VerifyEmail("admin@test.com")
+	b.Users[1].Roles = []string{RoleAdmin}
+	tokens, err := s.loginToken(b, "admin@test.com", "password")
+	if err != nil {
+		t.Fatal("expected admin login", err)
+	}
+	return s, b, tokens.AccessToken
+}
+
+func TestAuthorize(t *testing.T) {
+	s, b, _ := getRBACStore(t)
+	b.Roles = []*Role{{Name: "editor", Permissions: []string{"posts:write", "posts:read"}}, {Name: "viewer", Permissions: []string{"posts:read"}}}
+	b.Users[0].Roles = []string{"editor"}
+	session := &LoginSession{UserID: "1"}
+
+	if err := s.Authorize(session, nil, nil); err != nil {
+		t.Error("expected no policy to allow", err)
+	}
+	if err := s.Authorize(session, []string{"viewer", "editor"}, nil); err != nil {
+		t.Error("expected any matching role to allow", err)
+	}
+	if err := s.Authorize(session, []string{"viewer"}, nil); err == nil || err.Error() != "Not authorized. Requires role: viewer" {
+		t.Error("expected missing role to be denied", err)
+	}
+	if err := s.Authorize(session, nil, []string{"posts:read", "posts:write"}); err != nil {
+		t.Error("expected permissions from role", err)
+	}
+	if err := s.Authorize(session, nil, []string{"posts:read", "posts:delete"}); err == nil || err.Error() != "Not authorized. Requires permission: posts:delete" {
+		t.Error("expected every permission to be required", err)
+	}
+	if err := s.Authorize(&LoginSession{UserID: "2"}, nil, []string{"anything"}); err != nil {
+		t.Error("expected admin to have every permission", err)
+	}
+	if err := s.Authorize(&LoginSession{UserID: "1", Scopes: []string{"posts:read"}}, nil, []string{"posts:write"}); err == nil {
+		t.Error("expected API key scopes to limit permissions")
+	}
+	if err := s.Authorize(&LoginSession{UserID: "1", Scopes: []string{"posts:read", "posts:write"}}, []string{"editor"}, []string{"posts:write"}); err != nil {
+		t.Error("expected API key scopes covering the role to allow", err)
+	}
+	if err := s.Authorize(&LoginSession{UserID: "1", Scopes: []string{"posts:read"}}, []string{"editor"}, nil); err == nil {
+		t.Error("expected API key scopes to limit roles")
+	}
+	if err := s.Authorize(&LoginSession{}, []string{"editor"}, nil); err == nil {
+		t.Error("expected session without user to be denied")
+	}
+}
+
+func TestAuthorizeScopedAPIKey(t *testing.T) {
+	s, b, adminToken := getRBACStore(t)
+	b.Roles = []*Role{{Name: "editor", Permissions: []string{"posts:write"}}}
+	key := createTestAPIKey(t, s, b, adminToken, "posts:read")
+	session, err := s.GetSession(nil, bearerRequest(key.Key))
+	if err != nil {
+		t.Fatal("expected API key session", err)
+	}
+	if err := s.Authorize(session, nil, []string{"posts:read"}); err != nil {
+		t.Error("expected scoped permission of the admin to be allowed", err)
+	}
+	if err := s.Authorize(session, nil, []string{PermissionAdmin}); err == nil || ErrorCode(err) != ErrCodeForbidden {
+		t.Error("expected admin permission outside the key's scopes to be denied", err)
+	}
+	if err := s.Authorize(session, []string{RoleAdmin}, nil); err == nil || ErrorCode(err) != ErrCodeForbidden {
+		t.Error("expected admin role to be denied without the admin scope", err)
+	}
+
+	key = createTestAPIKey(t, s, b, adminToken, PermissionAdmin)
+	if session, _ = s.GetSession(nil, bearerRequest(key.Key)); s.Authorize(session, []string{RoleAdmin}, []string{PermissionAdmin}) != nil {
+		t.Error("expected key with the admin scope to act as admin")
+	}
+}
+
+func TestRoleAdministration(t *testing.T) {
+	s, b, adminToken := getRBACStore(t)
+	userTokens, _ := s.loginToken(b, "test@test.com", "password")
+	if _, err := s.getRoles(nil, bearerRequest(userTokens.AccessToken), b); err == nil {
+		t.Fatal("expected non-admin to be denied")
+	}
+
+	r := bearerRequest(adminToken)
+	if _, err := s.saveRole(nil, r, b, &Role{Name: "editor", Permissions: []string{"posts:write"}}); err != nil {
+		t.Fatal("expected role to be saved", err)
+	}
+	for _, role := range []*Role{{Name: "bad name"}, {Name: RoleAdmin}, {Name: "x", Permissions: []string{"bad permission"}}} {
+		if _, err := s.saveRole(nil, r, b, role); err == nil {
+			t.Error("expected invalid role to fail", role)
+		}
+	}
+	roles, err := s.getRoles(nil, r, b)
+	if err != nil || len(roles) != 2 || roles[0].Name != RoleAdmin || roles[1].Name != "editor" {
+		t.Fatal("expected built in and saved roles", err, roles)
+	}
+
+	if err := s.setUserRoles(nil, r, b, "test@test.com", []string{"unknown"}); err == nil || err.Error() != "Unknown role: unknown" {
+		t.Error("expected unknown role to be rejected", err)
+	}
+	if err := s.setUserRoles(nil, r, b, "test@test.com", []string{"editor"}); err != nil {
+		t.Fatal("expected role to be assigned", err)
+	}
+	if userRoles, err := s.getUserRoles(nil, r, b, "test@test.com"); err != nil || len(userRoles) != 1 || userRoles[0] != "editor" {
+		t.Error("expected assigned roles", err, userRoles)
+	}
+	if err := s.Authorize(&LoginSession{UserID: "1"}, nil, []string{"posts:write"}); err != nil {
+		t.Error("expected assigned role to grant its permissions", err)
+	}
+	if sessionRoles, err := s.GetSessionRoles(&LoginSession{UserID: "1"}); err != nil || len(sessionRoles) != 1 || sessionRoles[0] != "editor" {
+		t.Error("expected session roles", err, sessionRoles)
+	}
+
+	if err := s.deleteRole(nil, r, b, RoleAdmin); err == nil {
+		t.Error("expected admin role not to be deleted")
+	}
+	if err := s.deleteRole(nil, r, b, "editor"); err != nil || len(b.Roles) != 0 {
+		t.Error("expected role to be deleted", err)
+	}
+	if err := s.Authorize(&LoginSession{UserID: "1"}, nil, []string{"posts:write"}); err == nil {
+		t.Error("expected deleted role to grant nothing")
+	}
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RegistrationOpen lets anyone register. It is the default mode
+const RegistrationOpen string = "open"
+
+// RegistrationDomainAllowlist only lets emails at RegistrationPolicy.AllowedDomains register, or invited ones
+const RegistrationDomainAllowlist string = "domainAllowlist"
+
+// RegistrationInviteOnly only lets emails with an invitation from CreateInvitation register
+const RegistrationInviteOnly string = "inviteOnly"
+
+// RegistrationClosed doesn't let anyone register, even with an invitation
+const RegistrationClosed string = "closed"
+
+const emailSessionPurposeInvitation string = "invitation"
+const defaultInvitationDuration time.Duration = 7 * 24 * time.Hour
+const mxLookupTimeout time.Duration = 5 * time.Second
+
+// infoInvitedRoles holds the roles of an invitation in the verification session until the user is created
+const infoInvitedRoles string = "invitedRoles"
+
+var registrationModes = []string{"", RegistrationOpen, RegistrationDomainAllowlist, RegistrationInviteOnly, RegistrationClosed}
+
+// MXResolver looks up the mail servers of a domain. net.DefaultResolver is one
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// RegistrationPolicy decides who may register with Register or by logging in with OAuthLogin for the first time
+type RegistrationPolicy struct {
+	// Mode is RegistrationOpen (default), RegistrationDomainAllowlist, RegistrationInviteOnly or RegistrationClosed
+	Mode string
+	// AllowedDomains are the email domains which may register in RegistrationDomainAllowlist mode, including
+	// their subdomains
+	AllowedDomains []string
+	// DisposableDomains are throwaway email domains, and their subdomains, which may not register without an
+	// invitation. ReadDomainList reads them from a file
+	DisposableDomains []string
+	// MXResolver rejects email domains without mail servers when it's set
+	MXResolver MXResolver
+	// InvitationDuration is how long invitations can be used, 7 days when 0
+	InvitationDuration time.Duration
+}
+
+// ReadDomainList reads a file with a domain on each line. Blank lines and lines starting with # are skipped
+func ReadDomainList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	return domains, nil
+}
+
+func (p *RegistrationPolicy) mode() string {
+	if p == nil || p.Mode == "" {
+		return RegistrationOpen
+	}
+	return p.Mode
+}
+
+// checkRegistration returns an error unless the policy lets email register. It returns the invitation when the
+// email registers with one, which lets it in whatever the mode except RegistrationClosed
+func (s *authStore) checkRegistration(b Backender, email, inviteCode string) (*emailSession, error) {
+	policy := s.conf.Registration
+	if policy.mode() == RegistrationClosed {
+		return nil, newAuthError("Registration is closed", nil).withCode(ErrCodeForbidden)
+	}
+	if inviteCode != "" {
+		invitation, err := s.getEmailSessionWithPurpose(b, inviteCode, emailSessionPurposeInvitation)
+		if err != nil {
+			return nil, newLoggedError("Invalid or expired invitation", err).withCode(ErrCodeInvalidCode)
+		}
+		if !strings.EqualFold(invitation.Email, email) {
+			return nil, newAuthError("The invitation is for another email", nil).withCode(ErrCodeInvalidCode)
+		}
+		return invitation, nil
+	}
+
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	switch policy.mode() {
+	case RegistrationInviteOnly:
+		return nil, newAuthError("Registration requires an invitation", nil).withCode(ErrCodeForbidden)
+	case RegistrationDomainAllowlist:
+		if !matchesDomain(domain, policy.AllowedDomains) {
+			return nil, newAuthError("Registration isn't open to "+domain+" emails", nil).withCode(ErrCodeForbidden)
+		}
+	}
+	if policy == nil {
+		return nil, nil
+	}
+	if matchesDomain(domain, policy.DisposableDomains) {
+		return nil, newAuthError("Disposable email addresses can't be used to register", nil)
+	}
+	if policy.MXResolver != nil && !hasMailServer(policy.MXResolver, domain) {
+		return nil, newAuthError(domain+" doesn't receive email", nil)
+	}
+	return nil, nil
+}
+
+// hasMailServer returns false when the domain doesn't exist or has no mail servers. Lookup failures such as
+// timeouts are let through so a DNS outage doesn't stop registrations
+func hasMailServer(resolver MXResolver, domain string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), mxLookupTimeout)
+	defer cancel()
+	records, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return false
+		}
+		log.Println("Unable to look up mail servers of", domain, err)
+		return true
+	}
+	for _, record := range records {
+		if record.Host != "." { // a null MX record says the domain accepts no mail
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDomain returns true if domain or one of its parents is in domains
+func matchesDomain(domain string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// useInvitation deletes the invitation so it can't be used again, and gives its roles to the user. The roles are
+// kept in info until markAsVerified creates users who registered without a password
+func useInvitation(b Backender, invitation *emailSession, userID string, info map[string]interface{}) error {
+	if err := b.DeleteEmailSession(invitation.EmailVerifyHash); err != nil {
+		return newLoggedError("Unable to use invitation", err)
+	}
+	roles := infoStrings(invitation.Info["roles"])
+	if len(roles) == 0 {
+		return nil
+	}
+	if userID == "" {
+		info[infoInvitedRoles] = roles
+		return nil
+	}
+	if err := b.UpdateUserRoles(userID, roles); err != nil {
+		return newLoggedError("Unable to give invited user roles", err)
+	}
+	return nil
+}
+
+// infoStrings returns a string list from info, which the Mongo backend reads back as []interface{}
+func infoStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// CreateInvitation lets admins invite params.Email to register, with the roles it will be given. The invitation
+// code is sent as params.VerificationCode and must be passed to Register as EmailSendParams.InviteCode
+func (s *authStore) CreateInvitation(w http.ResponseWriter, r *http.Request, params EmailSendParams, roles []string) error {
+	b := s.b.Clone()
+	defer b.Close()
+	return s.createInvitation(w, r, b, params, roles)
+}
+
+func (s *authStore) createInvitation(w http.ResponseWriter, r *http.Request, b Backender, params EmailSendParams, roles []string) error {
+	session, err := s.requireAdmin(w, r, b)
+	if err != nil {
+		return err
+	}
+	if s.conf.Registration.mode() == RegistrationClosed {
+		return newAuthError("Registration is closed", nil).withCode(ErrCodeForbidden)
+	}
+	if !isValidEmail(params.Email) {
+		return newAuthError("Invalid email", nil)
+	}
+	if user, _ := b.GetUser(params.Email); user != nil && user.IsEmailVerified {
+		return newAuthError("User already registered", nil).withCode(ErrCodeUserExists)
+	}
+	if len(roles) > 0 {
+		defined, err := b.GetRoles()
+		if err != nil {
+			return newLoggedError("Unable to get roles", err)
+		}
+		for _, role := range roles {
+			if role != RoleAdmin && !hasRole(defined, role) {
+				return newAuthError("Unknown role: "+role, nil)
+			}
+		}
+	}
+
+	duration := defaultInvitationDuration
+	if s.conf.Registration != nil && s.conf.Registration.InvitationDuration > 0 {
+		duration = s.conf.Registration.InvitationDuration
+	}
+	code, err := s.addEmailSessionWithExpire(b, "", params.Email, map[string]interface{}{"roles": roles}, emailSessionPurposeInvitation, time.Now().UTC().Add(duration))
+	if err != nil {
+		return newLoggedError("Unable to create invitation", err)
+	}
+
+	params.VerificationCode = code[:len(code)-1] // drop the "=" at the end of the code since it makes it look like a querystring
+	if params.BaseURL == "" {
+		params.BaseURL = s.baseURL(r)
+	}
+	params.Info = copyInfo(params.Info)
+	params.Info["invitedBy"] = session.Email
+	if err := s.mailer.SendMessage(params.Email, params.TemplateSuccess, params.SubjectSuccess, params); err != nil {
+		return newLoggedError("Unable to send invitation", err)
+	}
+	return nil
+}
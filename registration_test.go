@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type mockMXResolver map[string][]*net.MX
+
+func (m mockMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if name == "timeout.example.com" {
+		return nil, errors.New("i/o timeout")
+	}
+	records, ok := m[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestCheckRegistration(t *testing.T) {
+	s, b := getTokenStore()
+	if _, err := s.checkRegistration(b, "new@anything.com", ""); err != nil {
+		t.Error("expected anyone to register without a policy", err)
+	}
+
+	s.conf.Registration = &RegistrationPolicy{Mode: RegistrationDomainAllowlist, AllowedDomains: []string{"example.com"}, DisposableDomains: []string{"mailinator.com"},
+		MXResolver: mockMXResolver{"example.com": {{Host: "mx.example.com."}}, "eu.example.com": {{Host: "."}}, "mailinator.com": {{Host: "mx.mailinator.com."}}}}
+	tests := map[string]string{
+		"jane@example.com":         "",
+		"jane@EXAMPLE.com":         "",
+		"jane@other.com":           "Registration isn't open to other.com emails",
+		"jane@notexample.com":      "Registration isn't open to notexample.com emails",
+		"jane@eu.example.com":      "eu.example.com doesn't receive email",
+		"jane@missing.example.com": "missing.example.com doesn't receive email",
+		"jane@timeout.example.com": "",
+	}
+	for email, message := range tests {
+		if _, err := s.checkRegistration(b, email, ""); (message == "" && err != nil) || (message != "" && (err == nil || err.Error() != message)) {
+			t.Error("expected", message, "for", email, err)
+		}
+	}
+
+	s.conf.Registration.Mode = RegistrationOpen
+	if _, err := s.checkRegistration(b, "jane@spam.mailinator.com", ""); err == nil || err.Error() != "Disposable email addresses can't be used to register" {
+		t.Error("expected disposable domain to be blocked", err)
+	}
+	s.conf.Registration.Mode = RegistrationInviteOnly
+	if _, err := s.checkRegistration(b, "jane@example.com", ""); err == nil || ErrorCode(err) != ErrCodeForbidden {
+		t.Error("expected invitation to be required", err)
+	}
+	if _, err := s.checkRegistration(b, "jane@example.com", "bogus"); err == nil || ErrorCode(err) != ErrCodeInvalidCode {
+		t.Error("expected invalid invitation", err)
+	}
+	s.conf.Registration.Mode = RegistrationClosed
+	if err := s.register(&http.Request{}, b, EmailSendParams{Email: "jane@example.com"}, "password"); err == nil || err.Error() != "Registration is closed" {
+		t.Error("expected closed registration", err)
+	}
+	if _, err := s.oauthLogin(nil, &http.Request{}, b, "jane@example.com", nil); err == nil || err.Error() != "Registration is closed" {
+		t.Error("expected new OAuth users to be refused", err)
+	}
+}
+
+func TestInvitation(t *testing.T) {
+	s, b, adminToken := getRBACStore(t)
+	m := s.mailer.(*TextMailer)
+	b.Roles = []*Role{{Name: "editor", Permissions: []string{"posts:write"}}}
+	s.conf.Registration = &RegistrationPolicy{Mode: RegistrationInviteOnly}
+	params := EmailSendParams{Email: "jane@example.com", BaseURL: "https://example.com", TemplateSuccess: "invite.html"}
+
+	if err := s.createInvitation(nil, bearerRequest(adminToken), b, params, []string{"owner"}); err == nil || err.Error() != "Unknown role: owner" {
+		t.Error("expected unknown role error", err)
+	}
+	if err := s.createInvitation(nil, bearerRequest(adminToken), b, EmailSendParams{Email: "test@test.com"}, nil); err == nil || ErrorCode(err) != ErrCodeUserExists {
+		t.Error("expected registered user error", err)
+	}
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	if err := s.createInvitation(nil, bearerRequest(tokens.AccessToken), b, params, nil); err == nil || ErrorCode(err) != ErrCodeForbidden {
+		t.Error("expected non-admin to be denied", err)
+	}
+
+	if err := s.createInvitation(nil, bearerRequest(adminToken), b, params, []string{"editor"}); err != nil {
+		t.Fatal("expected invitation", err)
+	}
+	sent := m.MessageData.(EmailSendParams)
+	if m.MessageTo != "jane@example.com" || sent.VerificationCode == "" || sent.Info["invitedBy"] != "admin@test.com" {
+		t.Fatal("expected invitation email", m.MessageTo, sent)
+	}
+	code := sent.VerificationCode
+	if err := s.register(&http.Request{}, b, EmailSendParams{Email: "john@example.com", InviteCode: code}, "password"); err == nil || ErrorCode(err) != ErrCodeInvalidCode {
+		t.Error("expected invitation for another email to fail", err)
+	}
+	if err := s.register(&http.Request{}, b, EmailSendParams{Email: "jane@example.com", InviteCode: code, UseOneTimeCode: true}, "password"); err != nil {
+		t.Fatal("expected invited user to register", err)
+	}
+	if u, _ := b.GetUser("jane@example.com"); u == nil {
+		t.Fatal("expected user")
+	} else if roles, _ := b.GetUserRoles(u.UserID); len(roles) != 1 || roles[0] != "editor" {
+		t.Error("expected invited roles", roles)
+	}
+	if err := s.register(&http.Request{}, b, EmailSendParams{Email: "jane@example.com", InviteCode: code, UseOneTimeCode: true}, "password"); err == nil {
+		t.Error("expected invitation to be single use")
+	}
+}
+
+func TestInvitationWithoutPassword(t *testing.T) {
+	s, b, adminToken := getRBACStore(t)
+	m := s.mailer.(*TextMailer)
+	s.cookieStore = newMockCookieStore(nil, false, false)
+	s.conf.Registration = &RegistrationPolicy{Mode: RegistrationInviteOnly}
+	if err := s.createInvitation(nil, bearerRequest(adminToken), b, EmailSendParams{Email: "jane@example.com"}, []string{RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	code := m.MessageData.(EmailSendParams).VerificationCode
+	if err := s.register(&http.Request{}, b, EmailSendParams{Email: "jane@example.com", InviteCode: code}, ""); err != nil {
+		t.Fatal("expected invited user to register", err)
+	}
+	verifyCode := m.MessageData.(EmailSendParams).VerificationCode
+	if _, user, err := s.verifyEmail(nil, &http.Request{Header: http.Header{}}, b, EmailSendParams{VerificationCode: verifyCode}); err != nil {
+		t.Fatal("expected email to be verified", err)
+	} else if roles, _ := b.GetUserRoles(user.UserID); len(roles) != 1 || roles[0] != RoleAdmin {
+		t.Error("expected roles once the user is created", roles)
+	} else if _, ok := user.Info[infoInvitedRoles]; ok {
+		t.Error("expected roles to be removed from info", user.Info)
+	}
+}
+
+func TestRegisterWithForgedRoles(t *testing.T) {
+	s, b := getTokenStore()
+	m := s.mailer.(*TextMailer)
+	s.cookieStore = newMockCookieStore(nil, false, false)
+	info := map[string]interface{}{"fullName": "Mallory", infoInvitedRoles: []string{RoleAdmin}, "roles": []string{RoleAdmin}}
+	if err := s.register(&http.Request{}, b, EmailSendParams{Email: "mallory@example.com", Info: info, DestinationURL: "/app"}, ""); err != nil {
+		t.Fatal("expected user to register", err)
+	}
+	verifyCode := m.MessageData.(EmailSendParams).VerificationCode
+	_, user, err := s.verifyEmail(nil, &http.Request{Header: http.Header{}}, b, EmailSendParams{VerificationCode: verifyCode})
+	if err != nil {
+		t.Fatal("expected email to be verified", err)
+	}
+	if roles, _ := b.GetUserRoles(user.UserID); len(roles) != 0 {
+		t.Error("expected forged roles to be ignored", roles)
+	}
+	if user.Info["fullName"] != "Mallory" || user.Info["destinationURL"] != "/app" || user.Info["roles"] != nil {
+		t.Error("expected only client info and the destination", user.Info)
+	}
+}
+
+func TestReadDomainList(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "domains")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "disposable.txt")
+	ioutil.WriteFile(file, []byte("# throwaway\nMailinator.com\n\n  guerrillamail.com  \n"), 0644)
+	domains, err := ReadDomainList(file)
+	if err != nil || len(domains) != 2 || domains[0] != "mailinator.com" || domains[1] != "guerrillamail.com" {
+		t.Error("expected domains", domains, err)
+	}
+	if _, err := ReadDomainList(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("expected missing file error")
+	}
+}
@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// FieldTypeString is the default type of profile fields
+const FieldTypeString string = "string"
+
+// FieldTypeNumber fields hold a float64. Form values are parsed
+const FieldTypeNumber string = "number"
+
+// FieldTypeBoolean fields hold a bool. Form values such as "true" and "1" are parsed
+const FieldTypeBoolean string = "boolean"
+
+// FieldAccessUser fields are set by users in their profile and by admins. It is the default access
+const FieldAccessUser string = "user"
+
+// FieldAccessAdmin fields are only set by admins, e.g. a plan or quota
+const FieldAccessAdmin string = "admin"
+
+// FieldAccessReadOnly fields are only set by the application through AuthStorer.UpdateInfo
+const FieldAccessReadOnly string = "readOnly"
+
+const defaultFieldMaxLength int = 1024
+
+// accessRanks orders who may edit fields. Each editor may set fields of its own rank and below
+var accessRanks = map[string]int{FieldAccessUser: 1, FieldAccessAdmin: 2, FieldAccessReadOnly: 3}
+
+var fieldTypes = []string{FieldTypeString, FieldTypeNumber, FieldTypeBoolean}
+var infoKeyRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// systemInfoKeys are set by the auth server itself and upstream servers may trust them, so they are never taken
+// from profile forms or the admin API
+var systemInfoKeys = []string{"destinationURL", "roles", infoInvitedRoles, InfoChannel, InfoAvatarURL, InfoAvatarThumbnailURL}
+
+// ProfileSchema declares the user info fields which may be set and who may set them. Fields it doesn't declare
+// are rejected. It is parsed from JSON such as
+//
+//	{"fields": [{"name": "fullName", "required": true, "maxLength": 100},
+//	            {"name": "plan", "access": "admin", "pattern": "free|pro"},
+//	            {"name": "fileQuota", "type": "number", "access": "readOnly"}]}
+type ProfileSchema struct {
+	Fields []*ProfileField `json:"fields"`
+}
+
+// ProfileField is a user info field of a ProfileSchema
+type ProfileField struct {
+	Name string `json:"name"`
+	// Type is FieldTypeString (default), FieldTypeNumber or FieldTypeBoolean
+	Type string `json:"type"`
+	// Required fields must be given a value when the profile is created, and can't be cleared
+	Required bool `json:"required"`
+	// Access is FieldAccessUser (default), FieldAccessAdmin or FieldAccessReadOnly
+	Access string `json:"access"`
+	// MaxLength limits strings to a number of characters, 1024 when 0
+	MaxLength int `json:"maxLength"`
+	// Pattern is a regular expression strings must match entirely
+	Pattern string `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+type userInfoRequest struct {
+	Email string                 `json:"email"`
+	Info  map[string]interface{} `json:"info"`
+}
+
+// ParseProfileSchema reads and checks a JSON schema
+func ParseProfileSchema(data []byte) (*ProfileSchema, error) {
+	schema := &ProfileSchema{}
+	if err := json.Unmarshal(data, schema); err != nil {
+		return nil, errors.Wrap(err, "Invalid profile schema")
+	}
+	return schema, schema.check()
+}
+
+// check fills in the field defaults and compiles the patterns. NewAuthStoreWithConfig calls it for schemas
+// declared in Go
+func (p *ProfileSchema) check() error {
+	names := make(map[string]bool)
+	for _, field := range p.Fields {
+		if !infoKeyRegex.MatchString(field.Name) || contains(systemInfoKeys, field.Name) {
+			return errors.Errorf("Invalid profile field name: %q", field.Name)
+		}
+		if names[field.Name] {
+			return errors.Errorf("Profile field %s is declared twice", field.Name)
+		}
+		names[field.Name] = true
+		if field.Type == "" {
+			field.Type = FieldTypeString
+		}
+		if !contains(fieldTypes, field.Type) {
+			return errors.Errorf("Unknown type of profile field %s: %s", field.Name, field.Type)
+		}
+		if field.Access == "" {
+			field.Access = FieldAccessUser
+		}
+		if _, ok := accessRanks[field.Access]; !ok {
+			return errors.Errorf("Unknown access of profile field %s: %s", field.Name, field.Access)
+		}
+		if field.MaxLength == 0 {
+			field.MaxLength = defaultFieldMaxLength
+		}
+		if field.Pattern != "" {
+			pattern, err := regexp.Compile(`^(?:` + field.Pattern + `)$`)
+			if err != nil {
+				return errors.Wrapf(err, "Invalid pattern of profile field %s", field.Name)
+			}
+			field.pattern = pattern
+		}
+	}
+	return nil
+}
+
+func (p *ProfileSchema) field(name string) *ProfileField {
+	if p == nil {
+		return nil
+	}
+	for _, field := range p.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// userInfo returns the fields of info which users set themselves. Without a schema that is every field except the
+// system ones
+func (p *ProfileSchema) userInfo(info map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for key, value := range info {
+		if field := p.field(key); field != nil && field.Access == FieldAccessUser || p == nil && !contains(systemInfoKeys, key) {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// validate checks the info an editor with the given access wants to set and returns it with the values converted
+// to the field types, since forms only send strings. Without a schema any field may be set except the system ones.
+// A nil value clears a field which isn't required
+func (p *ProfileSchema) validate(info map[string]interface{}, access string) (map[string]interface{}, error) {
+	valid := make(map[string]interface{}, len(info))
+	for key, value := range info {
+		if access == FieldAccessReadOnly {
+			if field := p.field(key); field != nil && value != nil {
+				converted, err := field.convert(value)
+				if err != nil {
+					return nil, err
+				}
+				value = converted
+			}
+			valid[key] = value // the application may set any field
+			continue
+		}
+		if contains(systemInfoKeys, key) {
+			return nil, newAuthError("The "+key+" field can't be changed", nil).withCode(ErrCodeForbidden)
+		}
+		if !infoKeyRegex.MatchString(key) {
+			return nil, newAuthError("Invalid field name: "+key, nil)
+		}
+		if p == nil {
+			valid[key] = value
+			continue
+		}
+		field := p.field(key)
+		if field == nil {
+			return nil, newAuthError("Unknown field: "+key, nil)
+		}
+		if accessRanks[field.Access] > accessRanks[access] {
+			return nil, newAuthError("The "+key+" field can't be changed", nil).withCode(ErrCodeForbidden)
+		}
+		if value == nil || value == "" {
+			if field.Required {
+				return nil, newAuthError("The "+key+" field is required", nil)
+			}
+			valid[key] = nil
+			continue
+		}
+		converted, err := field.convert(value)
+		if err != nil {
+			return nil, err
+		}
+		valid[key] = converted
+	}
+	return valid, nil
+}
+
+// checkRequired returns an error unless info has a value for every required field users set
+func (p *ProfileSchema) checkRequired(info map[string]interface{}) error {
+	if p == nil {
+		return nil
+	}
+	for _, field := range p.Fields {
+		if value, ok := info[field.Name]; field.Required && field.Access == FieldAccessUser && (!ok || value == nil || value == "") {
+			return newAuthError("The "+field.Name+" field is required", nil)
+		}
+	}
+	return nil
+}
+
+func (f *ProfileField) convert(value interface{}) (interface{}, error) {
+	invalid := newAuthError("The "+f.Name+" field must be a "+f.Type, nil)
+	switch f.Type {
+	case FieldTypeNumber:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case string:
+			number, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, invalid
+			}
+			return number, nil
+		}
+		return nil, invalid
+	case FieldTypeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, invalid
+			}
+			return b, nil
+		}
+		return nil, invalid
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return nil, invalid
+	}
+	if utf8.RuneCountInString(s) > f.MaxLength {
+		return nil, newAuthError("The "+f.Name+" field must be at most "+strconv.Itoa(f.MaxLength)+" characters", nil)
+	}
+	if f.pattern != nil && !f.pattern.MatchString(s) {
+		return nil, newAuthError("The "+f.Name+" field is invalid", nil)
+	}
+	return s, nil
+}
+
+// SetUserInfo lets admins set user and admin fields of the user with the email in the JSON request
+func (s *authStore) SetUserInfo(w http.ResponseWriter, r *http.Request) error {
+	request := &userInfoRequest{}
+	if err := getJSON(r, request); err != nil {
+		return newAuthError("Unable to get user info", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.setUserInfo(w, r, b, request.Email, request.Info)
+}
+
+func (s *authStore) setUserInfo(w http.ResponseWriter, r *http.Request, b Backender, email string, info map[string]interface{}) error {
+	if _, err := s.requireAdmin(w, r, b); err != nil {
+		return err
+	}
+	info, err := s.conf.ProfileSchema.validate(info, FieldAccessAdmin)
+	if err != nil {
+		return err
+	}
+	user, err := b.GetUser(email)
+	if err != nil {
+		return newLoggedError("User not found", err)
+	}
+	if err := b.UpdateInfo(user.UserID, info); err != nil {
+		return newLoggedError("Unable to update user info", err)
+	}
+	return nil
+}
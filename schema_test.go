@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+const testProfileSchema string = `{"fields": [
+	{"name": "fullName", "required": true, "maxLength": 10},
+	{"name": "age", "type": "number"},
+	{"name": "newsletter", "type": "boolean"},
+	{"name": "plan", "access": "admin", "pattern": "free|pro"},
+	{"name": "fileQuota", "type": "number", "access": "readOnly"}]}`
+
+func TestParseProfileSchema(t *testing.T) {
+	schema, err := ParseProfileSchema([]byte(testProfileSchema))
+	if err != nil || len(schema.Fields) != 5 {
+		t.Fatal("expected schema", err)
+	}
+	if f := schema.field("fullName"); f.Type != FieldTypeString || f.Access != FieldAccessUser || f.MaxLength != 10 {
+		t.Error("expected defaults", f)
+	}
+	if f := schema.field("age"); f.MaxLength != defaultFieldMaxLength {
+		t.Error("expected default max length", f)
+	}
+
+	invalid := map[string]string{
+		`{"fields": [{"name": "roles"}]}`:                   "Invalid profile field name",
+		`{"fields": [{"name": "full.name"}]}`:               "Invalid profile field name",
+		`{"fields": [{"name": "a"}, {"name": "a"}]}`:        "declared twice",
+		`{"fields": [{"name": "a", "type": "date"}]}`:       "Unknown type",
+		`{"fields": [{"name": "a", "access": "everyone"}]}`: "Unknown access",
+		`{"fields": [{"name": "a", "pattern": "("}]}`:       "Invalid pattern",
+		`{"fields": "fullName"}`:                            "Invalid profile schema",
+	}
+	for data, message := range invalid {
+		if _, err := ParseProfileSchema([]byte(data)); err == nil || !strings.Contains(err.Error(), message) {
+			t.Error("expected", message, "for", data, err)
+		}
+	}
+}
+
+func TestProfileSchemaValidate(t *testing.T) {
+	schema, _ := ParseProfileSchema([]byte(testProfileSchema))
+	info, err := schema.validate(map[string]interface{}{"fullName": "Jane", "age": "42", "newsletter": "true"}, FieldAccessUser)
+	if err != nil || info["fullName"] != "Jane" || info["age"] != 42.0 || info["newsletter"] != true {
+		t.Error("expected converted form values", info, err)
+	}
+
+	tests := []struct {
+		info    map[string]interface{}
+		access  string
+		message string
+	}{
+		{map[string]interface{}{"nickname": "J"}, FieldAccessUser, "Unknown field: nickname"},
+		{map[string]interface{}{"plan": "pro"}, FieldAccessUser, "The plan field can't be changed"},
+		{map[string]interface{}{"fileQuota": 10.0}, FieldAccessAdmin, "The fileQuota field can't be changed"},
+		{map[string]interface{}{"roles": "admin"}, FieldAccessAdmin, "The roles field can't be changed"},
+		{map[string]interface{}{"fullName": "Jane Doe-Smith"}, FieldAccessUser, "The fullName field must be at most 10 characters"},
+		{map[string]interface{}{"fullName": ""}, FieldAccessAdmin, "The fullName field is required"},
+		{map[string]interface{}{"fullName": 42.0}, FieldAccessUser, "The fullName field must be a string"},
+		{map[string]interface{}{"age": "old"}, FieldAccessUser, "The age field must be a number"},
+		{map[string]interface{}{"newsletter": "maybe"}, FieldAccessUser, "The newsletter field must be a boolean"},
+		{map[string]interface{}{"plan": "enterprise"}, FieldAccessAdmin, "The plan field is invalid"},
+		{map[string]interface{}{"plan": "pro2"}, FieldAccessAdmin, "The plan field is invalid"},
+	}
+	for _, test := range tests {
+		if _, err := schema.validate(test.info, test.access); err == nil || err.Error() != test.message {
+			t.Error("expected", test.message, "got", err)
+		}
+	}
+
+	if info, err := schema.validate(map[string]interface{}{"plan": "pro", "age": nil}, FieldAccessAdmin); err != nil || info["plan"] != "pro" || info["age"] != nil {
+		t.Error("expected admin to set admin fields and clear optional ones", info, err)
+	}
+	if info, err := schema.validate(map[string]interface{}{"fileQuota": "5", InfoChannel: ChannelSMS}, FieldAccessReadOnly); err != nil || info["fileQuota"] != 5.0 ||
+		info[InfoChannel] != ChannelSMS {
+		t.Error("expected application to set any field", info, err)
+	}
+
+	if err := schema.checkRequired(map[string]interface{}{"age": 42.0}); err == nil || err.Error() != "The fullName field is required" {
+		t.Error("expected required field error", err)
+	}
+	if err := schema.checkRequired(map[string]interface{}{"fullName": "Jane"}); err != nil {
+		t.Error("expected required fields to be set", err)
+	}
+
+	var none *ProfileSchema
+	if info, err := none.validate(map[string]interface{}{"anything": "goes"}, FieldAccessUser); err != nil || info["anything"] != "goes" {
+		t.Error("expected any field without a schema", info, err)
+	}
+	if _, err := none.validate(map[string]interface{}{"destinationURL": "https://evil.example.com"}, FieldAccessUser); err == nil {
+		t.Error("expected system field to be rejected without a schema")
+	}
+	if _, err := none.validate(map[string]interface{}{"$where": "1"}, FieldAccessAdmin); err == nil {
+		t.Error("expected invalid field name to be rejected")
+	}
+}
+
+func TestGetProfileSystemFields(t *testing.T) {
+	r := uploadRequest(map[string]string{"fullName": "Jane", "roles": "admin", "destinationURL": "https://evil.example.com"}, nil)
+	profile, _ := getProfile(r)
+	if len(profile.Info) != 1 || profile.Info["fullName"] != "Jane" {
+		t.Error("expected system fields to be skipped", profile.Info)
+	}
+}
+
+func TestSetUserInfo(t *testing.T) {
+	s, b, adminToken := getRBACStore(t)
+	s.conf.ProfileSchema, _ = ParseProfileSchema([]byte(testProfileSchema))
+	if err := s.setUserInfo(nil, bearerRequest(adminToken), b, "test@test.com", map[string]interface{}{"plan": "pro", "fullName": "Jane"}); err != nil {
+		t.Fatal("expected admin to set info", err)
+	}
+	if u, _ := b.GetUserByID("1"); u.Info["plan"] != "pro" || u.Info["fullName"] != "Jane" {
+		t.Error("expected info to be saved", u.Info)
+	}
+	if err := s.setUserInfo(nil, bearerRequest(adminToken), b, "test@test.com", map[string]interface{}{"fileQuota": 100.0}); err == nil || ErrorCode(err) != ErrCodeForbidden {
+		t.Error("expected read-only field to be rejected", err)
+	}
+	if err := s.setUserInfo(nil, bearerRequest(adminToken), b, "missing@test.com", map[string]interface{}{"plan": "pro"}); err == nil {
+		t.Error("expected unknown user error")
+	}
+
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	if err := s.setUserInfo(nil, bearerRequest(tokens.AccessToken), b, "test@test.com", map[string]interface{}{"plan": "pro"}); err == nil || ErrorCode(err) != ErrCodeForbidden {
+		t.Error("expected non-admin to be denied", err)
+	}
+}
+
+func TestUpdateInfoSchema(t *testing.T) {
+	s, b := getTokenStore()
+	s.conf.ProfileSchema, _ = ParseProfileSchema([]byte(testProfileSchema))
+	if err := s.UpdateInfo("1", map[string]interface{}{"fileQuota": "100"}); err != nil {
+		t.Fatal("expected application to set read-only field", err)
+	}
+	if u, _ := b.GetUserByID("1"); u.Info["fileQuota"] != 100.0 {
+		t.Error("expected converted value", u.Info)
+	}
+	if err := s.UpdateInfo("1", map[string]interface{}{"age": "old"}); err == nil {
+		t.Error("expected invalid value error")
+	}
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// twilioAPIURL is where TwilioSMSProvider sends messages when APIURL isn't set
+const twilioAPIURL string = "https://api.twilio.com/2010-04-01"
+
+// smsProviderTimeout limits how long sending a text message can hold up a request
+const smsProviderTimeout time.Duration = 10 * time.Second
+
+// SMSProvider sends text messages through an SMS gateway. Numbers are in E.164 format, e.g. +14155550123
+type SMSProvider interface {
+	SendSMS(to, body string) error
+}
+
+// SMSChannel sends text messages made from plain text templates named for the email ones with an .sms extension,
+// such as passwordReset.sms for passwordReset.html, or passwordReset.fr.sms in French. Messages without an .sms
+// template are sent by email
+type SMSChannel struct {
+	Provider      SMSProvider
+	TemplateCache *texttemplate.Template
+}
+
+// TwilioSMSProvider sends text messages with the Twilio Messages API
+type TwilioSMSProvider struct {
+	AccountSID string
+	AuthToken  string
+	// From is the Twilio phone number or messaging service SID the messages are sent from
+	From string
+	// APIURL replaces the Twilio API, e.g. for a test server. Optional
+	APIURL string
+	// Client sends the requests. One with a 10 second timeout is used when nil
+	Client *http.Client
+}
+
+// SMSStub keeps the text messages it is given in memory instead of sending them, so tests and local development
+// can read the codes. It keeps the last 100 messages and is safe for concurrent use
+type SMSStub struct {
+	mu       sync.Mutex
+	messages []*SMS
+}
+
+// SMS is a text message received by an SMSStub
+type SMS struct {
+	To          string    `json:"to"`
+	Body        string    `json:"body"`
+	SentTimeUTC time.Time `json:"sentTimeUTC"`
+}
+
+// Notify renders the .sms template for the message and sends it to the recipient's phone number
+func (c *SMSChannel) Notify(to *Recipient, templateName, subject string, data interface{}) error {
+	if to.PhoneNumber == "" || c.TemplateCache == nil {
+		return ErrChannelUnavailable
+	}
+	base := strings.TrimSuffix(templateName, filepath.Ext(templateName))
+	name := localizedTemplate(dataLocale(data), base, ".sms", base+".sms", func(name string) bool { return c.TemplateCache.Lookup(name) != nil })
+	if c.TemplateCache.Lookup(name) == nil {
+		return ErrChannelUnavailable
+	}
+	var buf bytes.Buffer
+	if err := c.TemplateCache.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	return c.Provider.SendSMS(to.PhoneNumber, strings.TrimSpace(buf.String()))
+}
+
+// SendSMS posts the message to the Twilio API
+func (p *TwilioSMSProvider) SendSMS(to, body string) error {
+	apiURL := p.APIURL
+	if apiURL == "" {
+		apiURL = twilioAPIURL
+	}
+	form := url.Values{"To": {to}, "From": {p.From}, "Body": {body}}
+	req, err := http.NewRequest("POST", apiURL+"/Accounts/"+url.PathEscape(p.AccountSID)+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.AccountSID, p.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: smsProviderTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("Unable to send SMS. Twilio responded %s: %s", resp.Status, message)
+	}
+	return nil
+}
+
+// SendSMS keeps the message
+func (s *SMSStub) SendSMS(to, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, &SMS{To: to, Body: body, SentTimeUTC: time.Now().UTC()})
+	if len(s.messages) > defaultInboxSize {
+		s.messages = s.messages[len(s.messages)-defaultInboxSize:]
+	}
+	return nil
+}
+
+// Messages returns the messages sent to the number, or all of them when to is empty, newest first
+func (s *SMSStub) Messages(to string) []*SMS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []*SMS
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if to == "" || s.messages[i].To == to {
+			messages = append(messages, s.messages[i])
+		}
+	}
+	return messages
+}
+
+// Latest returns the newest message sent to the number, or nil when there is none
+func (s *SMSStub) Latest(to string) *SMS {
+	if messages := s.Messages(to); len(messages) > 0 {
+		return messages[0]
+	}
+	return nil
+}
+
+// Clear deletes every message
+func (s *SMSStub) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
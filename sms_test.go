@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	texttemplate "text/template"
+)
+
+func TestSMSChannel(t *testing.T) {
+	stub := &SMSStub{}
+	templates := texttemplate.Must(texttemplate.New("").Parse(`{{define "magicLink.sms"}} Log in: {{.VerificationCode}} {{end}}` +
+		`{{define "magicLink.fr.sms"}}Connexion : {{.VerificationCode}}{{end}}{{define "broken.sms"}}{{.Missing}}{{end}}`))
+	c := &SMSChannel{Provider: stub, TemplateCache: templates}
+	to := &Recipient{Email: "test@test.com", PhoneNumber: "+14155550123"}
+
+	if err := c.Notify(to, "magicLink.html", "Log in", EmailSendParams{VerificationCode: "123"}); err != nil || stub.Latest("+14155550123").Body != "Log in: 123" {
+		t.Error("expected trimmed SMS", err, stub.Messages(""))
+	}
+	if err := c.Notify(to, "magicLink.html", "Log in", EmailSendParams{VerificationCode: "123", Locale: "fr-CA"}); err != nil || stub.Latest("").Body != "Connexion : 123" {
+		t.Error("expected localized SMS", err)
+	}
+	if err := c.Notify(to, "welcome.html", "Welcome", EmailSendParams{}); err != ErrChannelUnavailable {
+		t.Error("expected no template to be unavailable", err)
+	}
+	if err := c.Notify(&Recipient{Email: "test@test.com"}, "magicLink.html", "Log in", EmailSendParams{}); err != ErrChannelUnavailable {
+		t.Error("expected no number to be unavailable", err)
+	}
+	if err := c.Notify(to, "broken.html", "Broken", EmailSendParams{}); err == nil || err == ErrChannelUnavailable {
+		t.Error("expected template error", err)
+	}
+	if len(stub.Messages("")) != 2 || len(stub.Messages("+14155550199")) != 0 {
+		t.Error("expected messages by number", stub.Messages(""))
+	}
+	stub.Clear()
+	if stub.Latest("") != nil {
+		t.Error("expected cleared messages")
+	}
+}
+
+func TestTwilioSMSProvider(t *testing.T) {
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		request = r
+		if r.FormValue("To") == "+10000000000" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "invalid number"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	p := &TwilioSMSProvider{AccountSID: "AC123", AuthToken: "token", From: "+14155550100", APIURL: server.URL}
+	if err := p.SendSMS("+14155550123", "Your code is 123456"); err != nil {
+		t.Fatal("expected SMS to be sent", err)
+	}
+	user, password, _ := request.BasicAuth()
+	if request.URL.Path != "/Accounts/AC123/Messages.json" || user != "AC123" || password != "token" ||
+		request.FormValue("From") != "+14155550100" || request.FormValue("Body") != "Your code is 123456" {
+		t.Error("unexpected request", request.URL, request.Form)
+	}
+	if err := p.SendSMS("+10000000000", "Hi"); err == nil || err.Error() != `Unable to send SMS. Twilio responded 400 Bad Request: {"message": "invalid number"}` {
+		t.Error("expected provider error", err)
+	}
+}
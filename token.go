@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const accessTokenExpireDuration time.Duration = 15 * time.Minute
+const refreshTokenExpireDuration time.Duration = rememberMeExpireDuration
+
+// accessTokenAudience is the audience of access tokens issued to the user rather than to an OAuth client. They are
+// the only tokens GetSession accepts
+const accessTokenAudience string = "access"
+
+// IdentityTokenAudience is the audience of tokens which pass the user's identity on to other servers, such as the
+// signed X-User header. They are never accepted as access tokens
+const IdentityTokenAudience string = "identity"
+
+// TokenResponse holds the tokens issued to clients which can't use cookies
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// accessTokenClaims are the claims of an access token. Tokens issued to OAuth clients have the
+// client ID as their audience instead of accessTokenAudience and can't be used in place of a session
+type accessTokenClaims struct {
+	Email string                 `json:"email"`
+	Info  map[string]interface{} `json:"info,omitempty"`
+	Scope string                 `json:"scope,omitempty"`
+	jwt.StandardClaims
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (s *authStore) LoginToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error) {
+	credentials, err := getCredentials(r)
+	if err != nil {
+		return nil, newAuthError("Unable to get credentials", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	if credentials.Code != "" {
+		return s.loginTokenWithCode(b, credentials.Email, credentials.Code)
+	}
+	return s.loginToken(b, credentials.Email, credentials.Password)
+}
+
+func (s *authStore) loginToken(b Backender, email, password string) (*TokenResponse, error) {
+	if s.keys == nil {
+		return nil, newAuthError("Token login is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	user, err := s.authenticate(b, email, password)
+	if err != nil {
+		return nil, err
+	}
+	if s.conf.LoginCodeTemplate != "" {
+		return nil, s.sendLoginCode(b, user, false)
+	}
+	familyID, err := generateRandomString()
+	if err != nil {
+		return nil, newLoggedError("Problem generating refresh token", err)
+	}
+	return s.issueTokens(b, user, "", "", familyID)
+}
+
+// loginTokenWithCode finishes a token login which needed a code
+func (s *authStore) loginTokenWithCode(b Backender, email, code string) (*TokenResponse, error) {
+	if s.keys == nil {
+		return nil, newAuthError("Token login is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	user, _, err := s.useLoginCode(b, email, code)
+	if err != nil {
+		return nil, err
+	}
+	familyID, err := generateRandomString()
+	if err != nil {
+		return nil, newLoggedError("Problem generating refresh token", err)
+	}
+	return s.issueTokens(b, user, "", "", familyID)
+}
+
+func (s *authStore) RefreshToken(w http.ResponseWriter, r *http.Request) (*TokenResponse, error) {
+	req := &refreshTokenRequest{}
+	if err := getJSON(r, req); err != nil {
+		return nil, newAuthError("Unable to get refresh token", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.refreshToken(b, req.RefreshToken)
+}
+
+// refreshToken exchanges a refresh token for a new access and refresh token
+func (s *authStore) refreshToken(b Backender, refreshToken string) (*TokenResponse, error) {
+	if s.keys == nil {
+		return nil, newAuthError("Token login is not enabled", nil).withCode(ErrCodeNotEnabled)
+	}
+	token, user, err := s.useRefreshToken(b, refreshToken, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.issueTokens(b, user, "", "", token.FamilyID)
+}
+
+// useRefreshToken rotates a refresh token issued to clientID and returns its user. Each refresh token
+// can only be used once, so presenting a rotated token means it was stolen and the family is revoked
+func (s *authStore) useRefreshToken(b Backender, refreshToken, clientID string) (*refreshTokenSession, *User, error) {
+	token, err := s.getRefreshToken(b, refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if token.ClientID != clientID {
+		return nil, nil, newLoggedError("Invalid refresh token", nil).withCode(ErrCodeUnauthenticated)
+	}
+	if token.IsRotated {
+		if err := b.DeleteRefreshTokenFamily(token.FamilyID); err != nil {
+			return nil, nil, newLoggedError("Unable to revoke refresh tokens", err)
+		}
+		return nil, nil, newLoggedError("Refresh token reuse detected", nil).withCode(ErrCodeUnauthenticated)
+	}
+	if err := b.RotateRefreshToken(token.Selector); err != nil {
+		return nil, nil, newLoggedError("Unable to rotate refresh token", err)
+	}
+
+	user, err := b.GetUser(token.Email)
+	if err != nil {
+		return nil, nil, newLoggedError("Unable to find user", err)
+	}
+	if user.IsLockedOut() {
+		return nil, nil, newAuthError("Your account is locked. Please reset your password.", nil).withCode(ErrCodeAccountLocked)
+	}
+	return token, user, nil
+}
+
+func (s *authStore) RevokeToken(w http.ResponseWriter, r *http.Request) error {
+	req := &refreshTokenRequest{}
+	if err := getJSON(r, req); err != nil {
+		return newAuthError("Unable to get refresh token", err)
+	}
+	b := s.b.Clone()
+	defer b.Close()
+	return s.revokeToken(b, req.RefreshToken)
+}
+
+func (s *authStore) revokeToken(b Backender, refreshToken string) error {
+	token, err := s.getRefreshToken(b, refreshToken)
+	if err != nil {
+		return err
+	}
+	if err := b.DeleteRefreshTokenFamily(token.FamilyID); err != nil {
+		return newLoggedError("Unable to revoke refresh tokens", err)
+	}
+	return nil
+}
+
+func (s *authStore) getRefreshToken(b Backender, refreshToken string) (*refreshTokenSession, error) {
+	parts := strings.Split(refreshToken, ".")
+	if len(parts) != 2 {
+		return nil, newAuthError("Invalid refresh token", nil).withCode(ErrCodeUnauthenticated)
+	}
+	token, err := b.GetRefreshToken(parts[0])
+	if err != nil {
+		return nil, newLoggedError("Invalid refresh token", err).withCode(ErrCodeUnauthenticated)
+	}
+	if err := encodedHashEquals(parts[1], token.TokenHash); err != nil {
+		return nil, newLoggedError("Invalid refresh token", err).withCode(ErrCodeUnauthenticated)
+	}
+	if token.ExpireTimeUTC.Before(time.Now().UTC()) {
+		return nil, newAuthError("Refresh token has expired", nil).withCode(ErrCodeSessionExpired)
+	}
+	return token, nil
+}
+
+// issueTokens creates an access and refresh token for user. clientID and scope are empty for tokens
+// issued directly to the user rather than to an OAuth client
+func (s *authStore) issueTokens(b Backender, user *User, clientID, scope, familyID string) (*TokenResponse, error) {
+	accessToken, err := s.signAccessToken(user, clientID, scope)
+	if err != nil {
+		return nil, newLoggedError("Problem signing access token", err)
+	}
+
+	selector, token, tokenHash, err := generateSelectorTokenAndHash()
+	if err != nil {
+		return nil, newLoggedError("Problem generating refresh token", err)
+	}
+	_, err = b.CreateRefreshToken(user.UserID, user.Email, clientID, scope, familyID, selector, tokenHash, time.Now().UTC().Add(refreshTokenExpireDuration))
+	if err != nil {
+		return nil, newLoggedError("Unable to save refresh token", err)
+	}
+
+	return &TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenExpireDuration.Seconds()),
+		RefreshToken: selector + "." + token,
+		Scope:        scope,
+	}, nil
+}
+
+// signAccessToken puts the user's info in tokens issued to the user. Tokens issued to OAuth clients only have the
+// subject, email and scope, and clients get the claims their scope allows from userinfo
+func (s *authStore) signAccessToken(user *User, clientID, scope string) (string, error) {
+	now := time.Now().UTC()
+	audience, info := clientID, map[string]interface{}(nil)
+	if clientID == "" {
+		audience, info = accessTokenAudience, user.Info
+	}
+	return s.keys.Sign(accessTokenClaims{
+		Email: user.Email,
+		Info:  info,
+		Scope: scope,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  audience,
+			Subject:   user.UserID,
+			Issuer:    s.conf.TokenIssuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenExpireDuration).Unix(),
+		},
+	})
+}
+
+// getTokenSession validates a bearer access token and returns the session it represents
+func (s *authStore) getTokenSession(accessToken string) (*LoginSession, error) {
+	claims := &accessTokenClaims{}
+	if err := s.keys.Parse(accessToken, claims); err != nil {
+		return nil, newAuthError("Invalid access token", err).withCode(ErrCodeUnauthenticated)
+	}
+	if claims.Issuer != s.conf.TokenIssuer {
+		return nil, newAuthError("Invalid access token issuer", nil).withCode(ErrCodeUnauthenticated)
+	}
+	if claims.Audience != accessTokenAudience {
+		return nil, newAuthError("Token isn't an access token for this server", nil).withCode(ErrCodeUnauthenticated)
+	}
+	return &LoginSession{UserID: claims.Subject, Email: claims.Email, Info: claims.Info, ExpireTimeUTC: time.Unix(claims.ExpiresAt, 0).UTC()}, nil
+}
+
+// getBearerToken returns the token from an "Authorization: Bearer {token}" header
+func getBearerToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func getTokenStore() (*authStore, *backendMemory) {
+	b := NewBackendMemory(&hashStore{}).(*backendMemory)
+	b.AddUserFull("test@test.com", "password", map[string]interface{}{"key": "value"})
+	b.VerifyEmail("test@test.com")
+	keys, _ := NewKeyManager(b, "", 0, 0)
+	s := &authStore{b: b, mailer: &TextMailer{}, cookieStore: newMockCookieStore(nil, false, false), conf: AuthStoreConfig{TokenMode: true, TokenIssuer: "https://auth.example.com"}, keys: keys}
+	return s, b
+}
+
+func bearerRequest(accessToken string) *http.Request {
+	return &http.Request{Header: http.Header{"Authorization": {"Bearer " + accessToken}}}
+}
+
+func TestLoginToken(t *testing.T) {
+	s, b := getTokenStore()
+	if _, err := s.loginToken(b, "test@test.com", "wrongPassword"); err == nil || err.Error() != "Invalid username or password" {
+		t.Fatal("expected login failure", err)
+	}
+
+	tokens, err := s.loginToken(b, "test@test.com", "password")
+	if err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.TokenType != "Bearer" || tokens.ExpiresIn != 900 || len(b.RefreshTokens) != 1 {
+		t.Fatal("expected tokens", err, tokens)
+	}
+	if b.RefreshTokens[0].TokenHash == tokens.RefreshToken {
+		t.Fatal("expected refresh token to be stored hashed")
+	}
+
+	session, err := s.GetSession(nil, bearerRequest(tokens.AccessToken))
+	if err != nil || session.Email != "test@test.com" || session.UserID != "1" || session.Info["key"] != "value" {
+		t.Fatal("expected bearer token to be accepted", err, session)
+	}
+
+	if _, err := s.GetSession(nil, bearerRequest(tokens.AccessToken+"bogus")); err == nil || err.Error() != "Invalid access token" {
+		t.Fatal("expected invalid token", err)
+	}
+
+	other := &authStore{conf: AuthStoreConfig{TokenIssuer: "https://other.example.com"}, keys: s.keys}
+	if _, err := other.getTokenSession(tokens.AccessToken); err == nil || err.Error() != "Invalid access token issuer" {
+		t.Fatal("expected issuer check", err)
+	}
+
+	identity, _ := s.keys.Sign(accessTokenClaims{Email: "test@test.com", StandardClaims: jwt.StandardClaims{Audience: IdentityTokenAudience, Subject: "1", Issuer: "https://auth.example.com"}})
+	if _, err := s.getTokenSession(identity); err == nil || err.Error() != "Token isn't an access token for this server" {
+		t.Fatal("expected identity token to be refused", err)
+	}
+
+	disabled := &authStore{b: b}
+	if _, err := disabled.loginToken(b, "test@test.com", "password"); err == nil {
+		t.Fatal("expected token mode to be required")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	s, b := getTokenStore()
+	first, _ := s.loginToken(b, "test@test.com", "password")
+	second, err := s.refreshToken(b, first.RefreshToken)
+	if err != nil || second.RefreshToken == first.RefreshToken || len(b.RefreshTokens) != 2 || !b.RefreshTokens[0].IsRotated {
+		t.Fatal("expected refresh token to rotate", err, second)
+	}
+	third, err := s.refreshToken(b, second.RefreshToken)
+	if err != nil {
+		t.Fatal("expected new refresh token to be usable", err)
+	}
+
+	// reuse of a rotated token revokes the whole family
+	if _, err := s.refreshToken(b, first.RefreshToken); err == nil || err.Error() != "Refresh token reuse detected" {
+		t.Fatal("expected reuse to be detected", err)
+	}
+	if len(b.RefreshTokens) != 0 {
+		t.Fatal("expected family to be revoked", b.RefreshTokens)
+	}
+	if _, err := s.refreshToken(b, third.RefreshToken); err == nil || err.Error() != "Invalid refresh token" {
+		t.Fatal("expected latest token to be revoked too", err)
+	}
+}
+
+func TestRefreshTokenErrors(t *testing.T) {
+	s, b := getTokenStore()
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	if _, err := s.refreshToken(b, "bogus"); err == nil || err.Error() != "Invalid refresh token" {
+		t.Fatal("expected invalid token", err)
+	}
+	selector := b.RefreshTokens[0].Selector
+	if _, err := s.refreshToken(b, selector+".dG9rZW4="); err == nil || err.Error() != "Invalid refresh token" {
+		t.Fatal("expected token hash mismatch", err)
+	}
+	b.RefreshTokens[0].ExpireTimeUTC = pastTime
+	if _, err := s.refreshToken(b, tokens.RefreshToken); err == nil || err.Error() != "Refresh token has expired" {
+		t.Fatal("expected expired token", err)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	s, b := getTokenStore()
+	s.loginToken(b, "test@test.com", "password")
+	tokens, _ := s.loginToken(b, "test@test.com", "password")
+	if err := s.revokeToken(b, tokens.RefreshToken); err != nil || len(b.RefreshTokens) != 1 {
+		t.Fatal("expected only this login's tokens to be revoked", err, b.RefreshTokens)
+	}
+}
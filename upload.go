@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	_ "image/gif" // decodes GIF uploads
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InfoAvatarURL is the user info key holding the URL of the profile picture the user uploaded
+const InfoAvatarURL string = "avatarURL"
+
+// InfoAvatarThumbnailURL is the user info key holding the URL of a 150 pixel square version of the profile picture
+const InfoAvatarThumbnailURL string = "avatarThumbnailURL"
+
+const defaultMaxUploadBytes int64 = 5 << 20 // 5 MB
+const maxProfileFormBytes int64 = 1 << 20   // allowance for the other profile fields
+const maxUploadPixels int = 16 << 20        // about 4096 x 4096, so small files can't decompress into huge images
+const avatarThumbnailSize int = 150
+const uploadNameBytes int = 16
+
+// uploadTypes are the image types accepted as profile pictures, with the type they are saved as
+var uploadTypes = map[string]string{"image/jpeg": "image/jpeg", "image/png": "image/png", "image/gif": "image/png"}
+
+// uploadExtensions are the extensions of the saved types
+var uploadExtensions = map[string]string{"image/jpeg": ".jpg", "image/png": ".png"}
+
+// FileStorer saves uploaded files and returns the URL each one is served from. Names are generated by the caller
+// and only contain letters, digits, "-" and "."
+type FileStorer interface {
+	Save(name, contentType string, data []byte) (string, error)
+	Delete(name string) error
+}
+
+// LocalFileStore saves files in Dir, which a web server serves at BaseURL
+type LocalFileStore struct {
+	Dir     string
+	BaseURL string
+}
+
+// S3FileStore saves files in a bucket of Amazon S3 or a compatible service such as MinIO, using path-style URLs
+// and AWS Signature Version 4
+type S3FileStore struct {
+	// Endpoint is the URL of the service, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// BaseURL is where the bucket is served publicly, e.g. from a CDN. Endpoint/Bucket when empty
+	BaseURL string
+	// Client sends the requests. One with a 30 second timeout is used when nil
+	Client *http.Client
+}
+
+// Save writes the file to a temporary name first, so it is never served partly written
+func (s *LocalFileStore) Save(name, contentType string, data []byte) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(s.Dir, ".upload")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.Dir, filepath.Base(name))); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + name, nil
+}
+
+// Delete removes the file. Files which don't exist are ignored
+func (s *LocalFileStore) Delete(name string) error {
+	if err := os.Remove(filepath.Join(s.Dir, filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Save puts the object in the bucket
+func (s *S3FileStore) Save(name, contentType string, data []byte) (string, error) {
+	if err := s.do("PUT", name, contentType, data); err != nil {
+		return "", err
+	}
+	baseURL := s.BaseURL
+	if baseURL == "" {
+		baseURL = strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + name, nil
+}
+
+// Delete removes the object from the bucket
+func (s *S3FileStore) Delete(name string) error {
+	return s.do("DELETE", name, "", nil)
+}
+
+func (s *S3FileStore) do(method, name, contentType string, data []byte) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(s.Endpoint, "/")+"/"+s.Bucket+"/"+name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	payloadHash := sha256.Sum256(data)
+	signAWSv4(req, s.AccessKeyID, s.SecretAccessKey, s.Region, "s3", hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("Unable to %s %s. Storage responded %s: %s", method, name, resp.Status, message)
+	}
+	return nil
+}
+
+// signAWSv4 adds the Authorization header of AWS Signature Version 4, signing the host and every header of req
+func signAWSv4(req *http.Request, accessKeyID, secretAccessKey, region, service, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.Query().Encode() + "\n" +
+		canonicalHeaders.String() + "\n" + signedHeaders + "\n" + payloadHash
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := now.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{now.Format("20060102"), region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+",SignedHeaders="+signedHeaders+
+		",Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// maxUploadBytes returns the configured limit, or 5 MB
+func (s *authStore) maxUploadBytes() int64 {
+	if s.conf.MaxUploadBytes > 0 {
+		return s.conf.MaxUploadBytes
+	}
+	return defaultMaxUploadBytes
+}
+
+// saveAvatar stores the profile picture in the "file" form field, if there is one, and a square thumbnail of it,
+// and sets their URLs in info. It returns the names of the saved files, so the caller can delete them if the user
+// isn't updated. The picture must be a JPEG, PNG or GIF image. It is re-encoded, which drops metadata such as the
+// location photos were taken at
+func (s *authStore) saveAvatar(r *http.Request, info map[string]interface{}) ([]string, error) {
+	if s.conf.FileStore == nil {
+		return nil, nil
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil // no picture uploaded
+	}
+	defer file.Close()
+	if header.Size > s.maxUploadBytes() {
+		return nil, newAuthError("Profile pictures must be smaller than "+byteSize(s.maxUploadBytes()), nil)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, s.maxUploadBytes()+1))
+	if err != nil {
+		return nil, newAuthError("Unable to read profile picture", err)
+	}
+	if int64(len(data)) > s.maxUploadBytes() {
+		return nil, newAuthError("Profile pictures must be smaller than "+byteSize(s.maxUploadBytes()), nil)
+	}
+
+	contentType, ok := uploadTypes[http.DetectContentType(data)] // the client's content type and file name aren't trusted
+	if !ok {
+		return nil, newAuthError("Profile pictures must be JPEG, PNG or GIF images", nil)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, newAuthError("Unable to read profile picture", err)
+	}
+	if config.Width*config.Height > maxUploadPixels {
+		return nil, newAuthError("Profile pictures must be at most 16 megapixels", nil)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, newAuthError("Unable to read profile picture", err)
+	}
+
+	id, err := generateRandomBytes(uploadNameBytes)
+	if err != nil {
+		return nil, newLoggedError("Unable to create profile picture name", err)
+	}
+	name := hex.EncodeToString(id) + uploadExtensions[contentType]
+	thumbnailName := hex.EncodeToString(id) + "-thumb" + uploadExtensions[contentType]
+	picture, err := encodeImage(img, contentType)
+	if err != nil {
+		return nil, newLoggedError("Unable to encode profile picture", err)
+	}
+	thumbnail, err := encodeImage(squareThumbnail(img, avatarThumbnailSize), contentType)
+	if err != nil {
+		return nil, newLoggedError("Unable to encode profile picture thumbnail", err)
+	}
+	pictureURL, err := s.conf.FileStore.Save(name, contentType, picture)
+	if err != nil {
+		return nil, newLoggedError("Unable to save profile picture", err)
+	}
+	thumbnailURL, err := s.conf.FileStore.Save(thumbnailName, contentType, thumbnail)
+	if err != nil {
+		s.deleteFiles([]string{name})
+		return nil, newLoggedError("Unable to save profile picture thumbnail", err)
+	}
+	info[InfoAvatarURL] = pictureURL
+	info[InfoAvatarThumbnailURL] = thumbnailURL
+	return []string{name, thumbnailName}, nil
+}
+
+// avatarFiles returns the names of the profile picture and thumbnail files in info
+func avatarFiles(info map[string]interface{}) []string {
+	var names []string
+	for _, key := range []string{InfoAvatarURL, InfoAvatarThumbnailURL} {
+		if url, ok := info[key].(string); ok && url != "" {
+			names = append(names, path.Base(url))
+		}
+	}
+	return names
+}
+
+// deleteFiles removes files which nothing refers to any more. Failures are only logged, as the files can't be reached
+func (s *authStore) deleteFiles(names []string) {
+	for _, name := range names {
+		if err := s.conf.FileStore.Delete(name); err != nil {
+			log.Println("Unable to delete file", name, err)
+		}
+	}
+}
+
+// encodeImage encodes JPEGs as JPEG and the other types as PNG. GIFs are saved as PNG too, as resizing them creates
+// more colors than a GIF palette holds
+func encodeImage(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// squareThumbnail crops the middle square of img and scales it to size x size by averaging the pixels each
+// thumbnail pixel covers. Images smaller than size aren't enlarged
+func squareThumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(bounds.Min).Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+	if side < size {
+		size = side
+	}
+
+	thumbnail := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := crop.Min.Y+y*side/size, crop.Min.Y+(y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0, x1 := crop.Min.X+x*side/size, crop.Min.X+(x+1)*side/size
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			thumbnail.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return thumbnail
+}
+
+func byteSize(n int64) string {
+	if n >= 1<<20 && n%(1<<20) == 0 {
+		return strconv.FormatInt(n>>20, 10) + " MB"
+	}
+	if n >= 1<<10 && n%(1<<10) == 0 {
+		return strconv.FormatInt(n>>10, 10) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}